@@ -1,8 +1,8 @@
 #!/bin/sh
 
 # Install the lint-tool, and the shadow-tool
-go get -u golang.org/x/lint/golint
-go get -u golang.org/x/tools/go/analysis/passes/shadow/cmd/shadow
+go install golang.org/x/lint/golint@latest
+go install golang.org/x/tools/go/analysis/passes/shadow/cmd/shadow@v0.13.0
 
 # At this point failures cause aborts
 set -e
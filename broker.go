@@ -0,0 +1,257 @@
+//
+// A minimal MQTT broker, which the selftest sub-command embeds so that
+// it can exercise the whole pipeline without a real queue.
+//
+// It supports just enough of MQTT 3.1.1 for our own use: subscriptions
+// with wildcards, retained messages, and wills.  Messages are always
+// delivered with a QoS of zero, and sessions are never persisted.
+//
+// This is not suitable for use as a real queue!
+//
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// broker holds the state of our embedded broker.
+type broker struct {
+	// listener accepts connections from our clients.
+	listener net.Listener
+
+	// conns holds the connected clients.
+	conns map[*brokerConn]bool
+
+	// retained holds the retained messages, by topic.
+	retained map[string]*packets.PublishPacket
+
+	// mutex protects our maps.
+	mutex sync.Mutex
+}
+
+// brokerConn is a single connection to our broker.
+type brokerConn struct {
+	// conn is the network connection.
+	conn net.Conn
+
+	// subs holds the topic-filters this client has subscribed to.
+	subs map[string]bool
+
+	// will is the message to publish if the client vanishes.
+	will *packets.PublishPacket
+
+	// mutex serializes writes to the connection.
+	mutex sync.Mutex
+}
+
+// newBroker launches a broker upon the given address, which may use
+// port zero to pick a free port, see Addr.
+func newBroker(addr string) (*broker, error) {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &broker{
+		listener: l,
+		conns:    make(map[*brokerConn]bool),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the address of our broker, as a client would use it.
+func (b *broker) Addr() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// Close stops our broker, disconnecting all of its clients.
+func (b *broker) Close() {
+
+	b.listener.Close()
+
+	b.mutex.Lock()
+	for c := range b.conns {
+		c.conn.Close()
+	}
+	b.mutex.Unlock()
+}
+
+// accept handles each connection made to us.
+func (b *broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(&brokerConn{conn: conn, subs: make(map[string]bool)})
+	}
+}
+
+// topicMatches returns true if the topic matches the given filter, which
+// may contain the wildcards "+" and "#".
+func topicMatches(filter string, topic string) bool {
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// send writes a packet to the client.
+func (c *brokerConn) send(p packets.ControlPacket) {
+	c.mutex.Lock()
+	p.Write(c.conn)
+	c.mutex.Unlock()
+}
+
+// deliver sends a message to the client.
+func (c *brokerConn) deliver(topic string, payload []byte, retain bool) {
+	out := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	out.TopicName = topic
+	out.Payload = payload
+	out.Retain = retain
+	c.send(out)
+}
+
+// publish delivers a message to every client subscribed to its topic,
+// retaining it if we should.
+func (b *broker) publish(p *packets.PublishPacket) {
+
+	b.mutex.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p
+		}
+	}
+
+	var targets []*brokerConn
+	for c := range b.conns {
+		for filter := range c.subs {
+			if topicMatches(filter, p.TopicName) {
+				targets = append(targets, c)
+				break
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, c := range targets {
+		c.deliver(p.TopicName, p.Payload, false)
+	}
+}
+
+// serve handles the packets sent to us by a client, until it disconnects.
+func (b *broker) serve(c *brokerConn) {
+
+	graceful := false
+	defer func() {
+		b.mutex.Lock()
+		delete(b.conns, c)
+		b.mutex.Unlock()
+
+		c.conn.Close()
+		if !graceful && c.will != nil {
+			b.publish(c.will)
+		}
+	}()
+
+	for {
+		cp, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return
+		}
+
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			if p.WillFlag {
+				c.will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				c.will.TopicName = p.WillTopic
+				c.will.Payload = p.WillMessage
+				c.will.Retain = p.WillRetain
+			}
+			b.mutex.Lock()
+			b.conns[c] = true
+			b.mutex.Unlock()
+			c.send(packets.NewControlPacket(packets.Connack))
+
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+
+			var retained []*packets.PublishPacket
+			b.mutex.Lock()
+			for _, filter := range p.Topics {
+				c.subs[filter] = true
+				ack.ReturnCodes = append(ack.ReturnCodes, 0)
+				for topic, msg := range b.retained {
+					if topicMatches(filter, topic) {
+						retained = append(retained, msg)
+					}
+				}
+			}
+			b.mutex.Unlock()
+
+			c.send(ack)
+			for _, msg := range retained {
+				c.deliver(msg.TopicName, msg.Payload, true)
+			}
+
+		case *packets.UnsubscribePacket:
+			b.mutex.Lock()
+			for _, filter := range p.Topics {
+				delete(c.subs, filter)
+			}
+			b.mutex.Unlock()
+
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			c.send(ack)
+
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.send(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				c.send(rec)
+			}
+			b.publish(p)
+
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			c.send(comp)
+
+		case *packets.PingreqPacket:
+			c.send(packets.NewControlPacket(packets.Pingresp))
+
+		case *packets.DisconnectPacket:
+			graceful = true
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+//
+// Manage the accounts of a running server.
+//
+// We make requests to the administrative API of the server, see
+// pkg/server/accounts_api.go, which must have been launched with
+// -accounts-db:
+//
+//   tunneller accounts list                  - List the accounts.
+//   tunneller accounts add foo               - Create the account "foo".
+//   tunneller accounts delete foo            - Delete the account "foo".
+//   tunneller accounts tokens foo            - List the tokens of "foo".
+//   tunneller accounts issue foo             - Issue a token for "foo".
+//   tunneller accounts revoke 0123abcd       - Revoke a token.
+//   tunneller accounts names                 - List the reserved names.
+//   tunneller accounts reserve bar foo       - Reserve "bar" for "foo".
+//   tunneller accounts release bar           - Release the name "bar".
+//   tunneller accounts usage [foo]           - Report the traffic of "foo".
+//   tunneller accounts limits [foo]          - List the limits of tokens.
+//   tunneller accounts limit 0123abcd        - Limit a token.
+//   tunneller accounts unlimit 0123abcd      - Remove a token's limits.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+//
+// accountsCmd is the structure for this sub-command.
+//
+type accountsCmd struct {
+	// The address of the server's administrative API.
+	admin string
+
+	// How long to wait for the server to reply.
+	timeout time.Duration
+
+	// The email address of a new account.
+	email string
+
+	// The label of a new token.
+	label string
+
+	// The number of days of traffic to report.
+	days int
+
+	// The limits to place upon a token.
+	tunnels  int
+	requests int64
+	bytes    int64
+}
+
+// accountAction describes the request which carries out an action.
+type accountAction struct {
+	// method and path are those of the request.
+	method string
+	path   string
+
+	// params names the parameters our arguments are sent as, and
+	// required is the number of them which must be given.
+	params   []string
+	required int
+}
+
+// accountActions maps each of our actions to the request which carries
+// it out.
+var accountActions = map[string]accountAction{
+	"list":    {http.MethodGet, "/accounts", []string{"account"}, 0},
+	"add":     {http.MethodPost, "/accounts", []string{"account"}, 1},
+	"delete":  {http.MethodDelete, "/accounts", []string{"account"}, 1},
+	"tokens":  {http.MethodGet, "/tokens", []string{"account"}, 0},
+	"issue":   {http.MethodPost, "/tokens", []string{"account"}, 1},
+	"revoke":  {http.MethodDelete, "/tokens", []string{"id"}, 1},
+	"names":   {http.MethodGet, "/names", nil, 0},
+	"reserve": {http.MethodPost, "/names", []string{"name", "account"}, 2},
+	"release": {http.MethodDelete, "/names", []string{"name"}, 1},
+	"usage":   {http.MethodGet, "/accounts/usage", []string{"account"}, 0},
+	"limits":  {http.MethodGet, "/limits", []string{"account"}, 0},
+	"limit":   {http.MethodPost, "/limits", []string{"id"}, 1},
+	"unlimit": {http.MethodDelete, "/limits", []string{"id"}, 1},
+}
+
+// Name returns the name of this sub-command.
+func (p *accountsCmd) Name() string { return "accounts" }
+
+// Synopsis returns the brief description of this sub-command
+func (p *accountsCmd) Synopsis() string { return "Manage the accounts of a server." }
+
+// Usage returns details of this sub-command.
+func (p *accountsCmd) Usage() string {
+	return `accounts [options] action [arguments]:
+  Manage the accounts, tokens, and reserved names, of a server launched
+  with -accounts-db, via its administrative API.  The actions are:
+
+    list [account]            List the accounts.
+    add account               Create an account, with the given -email.
+    delete account            Delete an account, with its tokens and names.
+    tokens [account]          List the tokens.
+    issue account             Issue a token, with the given -label.
+    revoke id                 Revoke a token.
+    names                     List the reserved names.
+    reserve name account      Reserve a name for an account.
+    release name              Release a reserved name.
+    usage [account]           Report the traffic of the last -days days.
+    limits [account]          List the limits of tokens, and their use today.
+    limit id                  Limit a token to the given -tunnels, and
+                              -requests and -bytes per day.
+    unlimit id                Remove the limits of a token.
+
+  Tokens are only shown when they're issued, and are given to clients
+  via -token.
+`
+}
+
+// SetFlags configures the flags this sub-command accepts.
+func (p *accountsCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.admin, "admin", "127.0.0.1:8081", "The address of the server's administrative API.")
+	f.DurationVar(&p.timeout, "timeout", 5*time.Second, "How long to wait for the server to reply.")
+	f.StringVar(&p.email, "email", "", "The email address of the account to add.")
+	f.StringVar(&p.label, "label", "", "The label of the token to issue.")
+	f.IntVar(&p.days, "days", 31, "The number of days of traffic to report.")
+	f.IntVar(&p.tunnels, "tunnels", 0, "The number of tunnels a token may serve, zero for unlimited.")
+	f.Int64Var(&p.requests, "requests", 0, "The number of requests a token may receive per day, zero for unlimited.")
+	f.Int64Var(&p.bytes, "bytes", 0, "The number of bytes a token may transfer per day, zero for unlimited.")
+}
+
+// Execute is the entry-point to this sub-command.
+func (p *accountsCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	args := f.Args()
+	if len(args) < 1 {
+		fmt.Printf("Usage: %s", p.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	action, ok := accountActions[args[0]]
+	if !ok {
+		fmt.Printf("Unknown action %s\n", args[0])
+		return subcommands.ExitUsageError
+	}
+	args = args[1:]
+	if len(args) < action.required || len(args) > len(action.params) {
+		fmt.Printf("Usage: %s", p.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	q := url.Values{}
+	for i, arg := range args {
+		q.Set(action.params[i], arg)
+	}
+	switch action.path {
+	case "/accounts":
+		if p.email != "" && action.method == http.MethodPost {
+			q.Set("email", p.email)
+		}
+	case "/tokens":
+		if p.label != "" && action.method == http.MethodPost {
+			q.Set("label", p.label)
+		}
+	case "/accounts/usage":
+		q.Set("days", strconv.Itoa(p.days))
+	case "/limits":
+		if action.method == http.MethodPost {
+			q.Set("tunnels", strconv.Itoa(p.tunnels))
+			q.Set("requests", strconv.FormatInt(p.requests, 10))
+			q.Set("bytes", strconv.FormatInt(p.bytes, 10))
+		}
+	}
+
+	addr := p.admin
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	addr = strings.TrimSuffix(addr, "/") + action.path
+	if len(q) > 0 {
+		addr += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequest(action.method, addr, nil)
+	if err != nil {
+		fmt.Printf("Error creating the request: %s\n", err.Error())
+		return 1
+	}
+
+	c := &http.Client{Timeout: p.timeout}
+	res, err := c.Do(req)
+	if err != nil {
+		fmt.Printf("Error querying the server: %s\n", err.Error())
+		return 1
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fmt.Printf("Error reading the server's reply: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("%s", body)
+	if len(body) > 0 && !strings.HasSuffix(string(body), "\n") {
+		fmt.Printf("\n")
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+//
+// Administer a running server.
+//
+// We make requests to the administrative API of the server, allowing
+// operators to kick, ban, and pause, tunnels without needing curl:
+//
+//   tunneller admin kick foo         - Disconnect the client(s) serving "foo".
+//   tunneller admin ban foo          - Ban "foo", and disconnect its client(s).
+//   tunneller admin unban foo        - Lift the ban upon "foo".
+//   tunneller admin bans             - List the banned tunnels.
+//   tunneller admin maintenance foo  - Put "foo" into maintenance mode.
+//   tunneller admin resume foo       - Take "foo" out of maintenance mode.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+//
+// adminCmd is the structure for this sub-command.
+//
+type adminCmd struct {
+	// The address of the server's administrative API.
+	admin string
+
+	// How long to wait for the server to reply.
+	timeout time.Duration
+
+	// The message to show visitors to a tunnel in maintenance mode.
+	message string
+}
+
+// adminActions maps each of our actions to the method, and path, of
+// the request which carries it out.
+var adminActions = map[string][2]string{
+	"kick":        {http.MethodPost, "/kick"},
+	"ban":         {http.MethodPost, "/bans"},
+	"unban":       {http.MethodDelete, "/bans"},
+	"bans":        {http.MethodGet, "/bans"},
+	"maintenance": {http.MethodPost, "/maintenance"},
+	"resume":      {http.MethodDelete, "/maintenance"},
+}
+
+// Name returns the name of this sub-command.
+func (p *adminCmd) Name() string { return "admin" }
+
+// Synopsis returns the brief description of this sub-command
+func (p *adminCmd) Synopsis() string { return "Kick, ban, or pause, tunnels upon a server." }
+
+// Usage returns details of this sub-command.
+func (p *adminCmd) Usage() string {
+	return `admin [options] kick|ban|unban|maintenance|resume <name>, or admin [options] bans:
+  Kick, ban, or pause, tunnels via the administrative API of a server.
+
+  Kicking a tunnel disconnects the client(s) serving it, banning it
+  also prevents the name from being used until the ban is lifted, or
+  the server restarts.
+
+  Putting a tunnel into maintenance mode answers its visitors with a
+  503 page, showing the -message given, until it is resumed.
+`
+}
+
+// SetFlags configures the flags this sub-command accepts.
+func (p *adminCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.admin, "admin", "127.0.0.1:8081", "The address of the server's administrative API.")
+	f.DurationVar(&p.timeout, "timeout", 5*time.Second, "How long to wait for the server to reply.")
+	f.StringVar(&p.message, "message", "", "The message to show visitors to a tunnel in maintenance mode.")
+}
+
+// Execute is the entry-point to this sub-command.
+func (p *adminCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	args := f.Args()
+	if len(args) < 1 {
+		fmt.Printf("Usage: %s", p.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	action, ok := adminActions[args[0]]
+	if !ok {
+		fmt.Printf("Unknown action %s\n", args[0])
+		return subcommands.ExitUsageError
+	}
+
+	name := ""
+	if args[0] != "bans" {
+		if len(args) != 2 {
+			fmt.Printf("The %s action requires the name of a tunnel\n", args[0])
+			return subcommands.ExitUsageError
+		}
+		name = args[1]
+	}
+
+	addr := p.admin
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	addr = strings.TrimSuffix(addr, "/") + action[1]
+	if name != "" {
+		addr += "?tunnel=" + url.QueryEscape(name)
+	}
+	if p.message != "" && args[0] == "maintenance" {
+		addr += "&message=" + url.QueryEscape(p.message)
+	}
+
+	req, err := http.NewRequest(action[0], addr, nil)
+	if err != nil {
+		fmt.Printf("Error creating the request: %s\n", err.Error())
+		return 1
+	}
+
+	c := &http.Client{Timeout: p.timeout}
+	res, err := c.Do(req)
+	if err != nil {
+		fmt.Printf("Error querying the server: %s\n", err.Error())
+		return 1
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fmt.Printf("Error reading the server's reply: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("%s", body)
+	if len(body) > 0 && !strings.HasSuffix(string(body), "\n") {
+		fmt.Printf("\n")
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -1,40 +1,35 @@
 //
 // Client for our self-hosted ngrok alternative.
 //
-// The way that this operates is pretty simple:
+// The work of relaying requests is carried out by pkg/client, this
+// sub-command parses our flags, and presents a simple text-based GUI
+// showing a few statistics about the requests we've made, and the
+// resulting response-code(s).
 //
-//  1.  Generate an ID for ourselves.
-//  2.  Connect to the named Mosquitto Queue
-//  3.  Subscribe to /clients/$id
-//  4.  When a request to fetch an URL is posted to the topic; get it.
-//  5.  Post the reply back to the same topic.
-//
-// There is a simple text-based GUI present, which relies upon keeping
-// a few statistics about the requests we've made, and the resulting
-// response-code(s).
+// Given -tui=false we print a line describing each request instead,
+// which suits running beneath a process-supervisor, or within a
+// container, where there is no terminal.
 //
 
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	ui "github.com/gizak/termui/v3"
 	"github.com/gizak/termui/v3/widgets"
 	"github.com/google/subcommands"
-	uuid "github.com/satori/go.uuid"
+	"github.com/skx/tunneller/pkg/client"
 )
 
 //
@@ -43,33 +38,35 @@ import (
 type clientCmd struct {
 
 	//
-	// The name we'll access this resource via.
+	// The settings of our client, which our flags populate.
 	//
-	name string
+	opts client.Options
 
 	//
-	// The tunnel end-point.
+	// The configuration file to load.
+	//
+	config string
+
 	//
-	// This is the host to which remote visitors will make their
-	// HTTP-requests, and it is also the host which is running an
-	// open (!) mosquitto-server.
+	// The plugins to load our hooks from.
 	//
-	tunnel string
+	plugins []string
 
 	//
-	// The service to expose, expressed as 1.2.3.4:NN
+	// The local directories to serve.
 	//
-	expose string
+	serveDirs []string
 
 	//
-	// A map of the HTTP-status-codes we've returned and their count.
+	// Should we present our full-screen GUI, rather than printing a
+	// line for each request?
 	//
-	stats map[string]int
+	tui bool
 
 	//
-	// The recent requests we've seen.
+	// Our daemon mode, see daemon.go.
 	//
-	requests []Request
+	daemon daemon
 }
 
 // Name returns the name of this sub-command.
@@ -80,151 +77,149 @@ func (p *clientCmd) Synopsis() string { return "Launch our client." }
 
 // Usage returns details of this sub-command.
 func (p *clientCmd) Usage() string {
-	return `client :
+	return `client [options] [start|stop|restart|status]:
   Launch the client, exposing a local service to the internet
+
+  Settings may also be loaded from a YAML file, via -config, or from the
+  environment, where TUNNELLER_EXPOSE sets -expose for example.
+
+  Given -daemon, or the start action, we run in the background, writing
+  our PID to -pid-file and our messages to -log-file.  The stop, restart,
+  and status actions act upon the process named by -pid-file.
 `
 }
 
 // SetFlags configures the flags this sub-command accepts.
 func (p *clientCmd) SetFlags(f *flag.FlagSet) {
 
-	f.StringVar(&p.expose, "expose", "", "The host/port to expose to the internet.")
-	f.StringVar(&p.tunnel, "tunnel", "tunnel.steve.fi", "The address of the publicly visible tunnel-host")
-	f.StringVar(&p.name, "name", "", "The name for this connection")
+	f.StringVar(&p.config, "config", "", "Load settings from the given YAML file.")
+	f.Var((*stringList)(&p.opts.Expose), "expose", "The host/port, https://host:port, tcp://host:port, udp://host:port, grpc://host:port, socks5://, unix:///path/to/socket, or docker://container[:port], to expose to the internet, optionally prefixed with \"name=\".  May be repeated.")
+	f.Var((*stringList)(&p.serveDirs), "serve-dir", "Serve the files within the given directory, optionally prefixed with \"name=\", rather than a local service.  May be repeated.")
+	f.StringVar(&p.opts.SNI, "sni", "", "The server-name to send to a local service using TLS.")
+	f.BoolVar(&p.opts.Insecure, "insecure", false, "Don't verify the certificate of a local service using TLS.")
+	f.BoolVar(&p.opts.RewriteHost, "rewrite-host", false, "Rewrite the Host: header of requests, and the Location: header of responses, to match the local service.")
+	f.BoolVar(&p.opts.RewriteBody, "rewrite-body", false, "Rewrite references to the local service within HTML responses too.")
+	f.BoolVar(&p.opts.TunnelHeaders, "tunnel-headers", true, "Tell local services the tunnel, request ID, and visitor of each request, via X-Tunnel-* headers.")
+	f.StringVar(&p.opts.Tunnel, "tunnel", "tunnel.steve.fi", "The address of the publicly visible tunnel-host")
+	f.StringVar(&p.opts.PathPrefix, "path-prefix", "", "Report the addresses of our tunnels by path, given the -path-prefix of the server, such as \"/t/\".")
+	f.Var((*stringList)(&p.opts.Brokers), "broker", "The address of the MQ-server, such as ssl://tunnel.example.com:8883 (default tcp://$tunnel:1883).  May be repeated, to fail over between the members of a cluster.")
+	f.StringVar(&p.opts.BrokerCA, "broker-ca", "", "Only trust the MQ-server if its certificate is signed by the CA in the given PEM file.")
+	f.StringVar(&p.opts.BrokerCert, "broker-cert", "", "Present the certificate in the given PEM file to the MQ-server.")
+	f.StringVar(&p.opts.BrokerKey, "broker-key", "", "The private key for the certificate given via -broker-cert.")
+	f.StringVar(&p.opts.Name, "name", "", "The name for this connection")
+	f.StringVar(&p.opts.Auth, "auth", "", "Require visitors to login with the given user:password.")
+	f.Var((*stringList)(&p.opts.Allow), "allow", "Only allow visitors from the given IP/CIDR range.  May be repeated.")
+	f.Var((*stringList)(&p.opts.Deny), "deny", "Deny visitors from the given IP/CIDR range.  May be repeated.")
+	f.BoolVar(&p.opts.Compress, "compress", false, "Compress the requests and responses sent over the queue.")
+	f.IntVar(&p.opts.PoolSize, "pool-size", 8, "The number of idle connections to keep open to each local service.")
+	f.DurationVar(&p.opts.PoolIdle, "pool-idle", 90*time.Second, "How long to keep idle connections to each local service open.")
+	f.BoolVar(&p.opts.Sticky, "sticky", false, "Send each visitor to the same client, if several serve our tunnels.")
+	f.StringVar(&p.opts.Token, "token", "", "The API token, \"account:secret\", with which to register, if the server requires one.")
+	f.BoolVar(&p.opts.Reregister, "reregister", false, "Re-register our tunnels, rather than exiting, if the server expires them as idle.")
+	f.BoolVar(&p.opts.Encrypt, "encrypt", false, "Encrypt the requests and responses sent over the queue.")
+	f.StringVar(&p.opts.Secret, "secret", "", "The secret, shared with the server, used to sign the requests and responses sent over the queue.")
+	f.IntVar(&p.opts.QoS, "qos", 0, "The MQTT QoS level (0, 1, or 2) to use for requests and replies.")
+	f.IntVar(&p.opts.ChunkSize, "chunk-size", 0, "Split replies larger than this many bytes into several messages, for brokers which limit their size, zero to disable.")
+	f.BoolVar(&p.opts.Retain, "retain", true, "Publish our presence as a retained message.")
+	f.BoolVar(&p.opts.Persistent, "persistent-session", false, "Ask the queue to persist our session, and subscriptions, whilst we're reconnecting.")
+	f.BoolVar(&p.tui, "tui", true, "Present a full-screen view of our tunnels and requests, rather than printing a line for each request.")
+	p.daemon.SetFlags(f, p.Name())
+	f.StringVar(&p.opts.Identity, "identity", defaultIdentity(), "The file holding our identity, so that we reclaim the same names when restarted, or \"\" to use a new identity each time.")
+	f.BoolVar(&p.opts.FreshIdentity, "new-identity", false, "Replace our identity with a new one, rather than reusing it.")
+	f.Var((*stringList)(&p.plugins), "plugin", "Load hooks from the given Go plugin.  May be repeated.")
+	f.BoolVar(&p.opts.Maintenance, "maintenance", false, "Start in maintenance mode, in which the server answers visitors with a 503 page.  Press m to switch it on, or off.")
+	f.StringVar(&p.opts.MaintenanceMessage, "maintenance-message", "", "The message to show visitors whilst we're in maintenance mode.")
+	f.StringVar(&p.opts.Metrics, "metrics", "", "The address to present metrics upon, e.g. 127.0.0.1:9090.")
+	f.DurationVar(&p.opts.Heartbeat, "heartbeat", 30*time.Second, "The interval at which we tell the server we're alive, zero to disable.")
+	f.DurationVar(&p.opts.ReconnectMax, "reconnect-max", 60*time.Second, "The maximum delay between attempts to reconnect to the MQ-host.")
 }
 
-// onMessage is called when a message is received upon the MQ-topic we're
-// watching.
 //
-// We have to perform the HTTP-fetch which is contained within the message,
-// and submit the result back to that same topic.
-func (p *clientCmd) onMessage(client MQTT.Client, msg MQTT.Message) {
-
-	//
-	// Get the text of the request.
-	//
-	fetch := msg.Payload()
-
-	//
-	// If this is one of our replies ignore it.
-	//
-	// Because we receive requests and post the replies upon the
-	// same topic we make sure that our replies are prefixed with
-	// `X-`, this means we can avoid processing the requests that
-	// we sent ourselves.
-	//
-	if strings.HasPrefix(string(fetch), "X-") {
-		return
-	}
+// defaultIdentity returns the file which holds our identity by default,
+// within the user's configuration directory.
+//
+func defaultIdentity() string {
 
-	//
-	// OK if it isn't one of our requests it should be a JSON-object
-	//
-	var req Request
-	err := json.Unmarshal([]byte(fetch), &req)
+	dir, err := os.UserConfigDir()
 	if err != nil {
-
-		//
-		// TODO: This needs better handling.
-		//
-		fmt.Printf("Failed to unmarshal ..: %s\n", err.Error())
-		return
+		return ""
 	}
+	return filepath.Join(dir, "tunneller", "identity.json")
+}
 
-	//
-	// This is the result we'll publish back onto the topic in the case
-	// that we cannot successfully communicate with the local service
-	// we're trying to expose.
-	//
-	//   503 -> Service Unavailable
-	//
-	result := `HTTP/1.0 503 OK
-Content-type: text/html; charset=UTF-8
-Connection: close
-
-<!DOCTYPE html>
-<html>
-<body>
-<p>The remote server was unreachable.</p>
-</body>
-</html>`
-
-	//
-	// Make the connection to our proxied host.
-	//
-	d := net.Dialer{}
-	con, err := d.Dial("tcp", p.expose)
-
-	//
-	// OK we have a default result saved, which shows an error-page.
-	//
-	// If we didn't actually get an error then make the actual request,
-	// and update with the response we receive.
-	//
-	if err == nil {
-
-		//
-		// Make the request
-		//
-		con.Write([]byte(req.Request))
-
-		//
-		// Read the reply.
-		//
-		var reply bytes.Buffer
-		io.Copy(&reply, con)
+//
+// remoteAccess describes how each of our tunnels may be accessed.
+//
+func (p *clientCmd) remoteAccess(c *client.Client) string {
 
-		//
-		// Store the result in our string.
-		//
-		result = string(reply.Bytes())
+	text := ""
+	for _, t := range c.Tunnels() {
+		address := t.Address
+		if address == "" {
+			address = p.opts.Tunnel + ":(awaiting port)"
+		}
+		text += "\n  " + address + "\n"
+		text += "    Will proxy content from " + t.Expose
+		if c.Maintenance(t.Name) {
+			text += " (in maintenance)"
+		}
+		text += "\n"
 	}
+	return text
+}
 
-	//
-	// Now we have either received a real reply from the service
-	// we're exposing, or we've got the fake one we created above.
-	//
-	// Either way record the request/response, and the HTTP-status
-	// code we received.
-	//
+//
+// totals describes the totals of the requests we've handled.
+//
+func (p *clientCmd) totals(c *client.Client) string {
 
-	//
-	// The response will have "HTTP/1.x CODE OK..\n"
-	//
-	tmp := strings.Split(result, " ")
-	if len(tmp) > 1 {
-		code := tmp[1]
-		p.stats[code]++
-	}
+	t := c.Totals()
+	text := fmt.Sprintf("\n  Requests: %d, of which %d failed", t.Requests, t.Errors)
+	text += fmt.Sprintf("\n  Received: %s, Sent: %s", client.FormatBytes(t.BytesIn), client.FormatBytes(t.BytesOut))
+	text += fmt.Sprintf("\n  Average latency: %s\n", t.Latency.Round(time.Millisecond))
+	return text
+}
 
-	//
-	// Save the response.
-	//
-	req.Response = result
+//
+// console runs our client without the GUI, printing a line for each
+// request, until we're interrupted or our tunnels expire.
+//
+func (p *clientCmd) console(c *client.Client, expired *bool) subcommands.ExitStatus {
 
-	//
-	// Add this request to our list of "recent requests".
-	//
-	p.requests = append(p.requests, req)
+	fmt.Printf("Remote access:\n%s\n", p.remoteAccess(c))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
 
 	//
-	// And truncate the list, so that we don't consume all our RAM
-	// keeping everything.
+	// Report changes to our status, and to the addresses of our
+	// tunnels, which the server may allocate ports for later.
 	//
-	if len(p.requests) > 5 {
+	status, access := "", p.remoteAccess(c)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
 
-		// Work out how many to trim.
-		trim := len(p.requests) - 5
-
-		// Do the necessary truncation.
-		p.requests = p.requests[trim:]
+	for {
+		select {
+		case <-sigs:
+			fmt.Printf("%s\n", p.totals(c))
+			return 0
+
+		case <-c.Expired():
+			*expired = true
+			return 1
+
+		case <-ticker.C:
+			if now := c.Status(); now != status {
+				status = now
+				fmt.Printf("Status: %s\n", status)
+			}
+			if now := p.remoteAccess(c); now != access {
+				access = now
+				fmt.Printf("Remote access:\n%s\n", access)
+			}
+		}
 	}
-
-	//
-	// Send the reply back to the MQ topic.
-	//
-	token := client.Publish("clients/"+p.name, 0, false, "X-"+result)
-	token.Wait()
 }
 
 //
@@ -232,7 +227,7 @@ Connection: close
 //
 // 1. Connect to the tunnel-host.
 // 2. Subscribe to MQ and await the reception of URLs to fetch.
-//    (When one is received it will be handled via onMessage.)
+//    (When one is received it will be handled by our client.)
 // 3. Present our (read-only) GUI.
 //
 func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -243,61 +238,92 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	start := time.Now()
 
 	//
-	// Ensure that we have setup variables
+	// Load our configuration file, and environmental overrides.
 	//
-	if p.expose == "" {
-		fmt.Printf("You must specify the local host:port to expose.\n")
-		return 1
-	}
-	if p.tunnel == "" {
-		fmt.Printf("You must specify the tunnel end-point.\n")
+	if err := loadConfig(f); err != nil {
+		fmt.Printf("Error loading configuration: %s\n", err.Error())
 		return 1
 	}
 
 	//
-	// This is optional, but useful.
+	// Carry out our action, or launch ourselves in the background,
+	// where we've no terminal to present our GUI upon.
 	//
-	if p.name == "" {
-		uid := uuid.NewV4()
-		p.name = uid.String()
+	if exit, status := p.daemon.Run(f.Args()); exit {
+		return status
+	}
+	defer p.daemon.Close()
+	if os.Getenv(daemonEnv) != "" {
+		p.tui = false
 	}
 
 	//
-	// Setup a map of our HTTP-status code statistics.
+	// Load our hooks.
 	//
-	p.stats = make(map[string]int)
+	hooks, err := loadPlugins(p.plugins)
+	if err != nil {
+		fmt.Printf("Error loading our plugins: %s\n", err.Error())
+		return 1
+	}
+	p.opts.Hooks = hooks
 
 	//
-	// Setup the server-address.
+	// Each directory we serve is exposed via the "dir://" scheme.
 	//
-	opts := MQTT.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s:1883", p.tunnel))
+	for _, ent := range p.serveDirs {
+		name := ""
+		if i := strings.Index(ent, "="); i > 0 {
+			name, ent = ent[:i+1], ent[i+1:]
+		}
+		path, err := filepath.Abs(ent)
+		if err != nil {
+			fmt.Printf("Error serving %s: %s\n", ent, err.Error())
+			return 1
+		}
+		p.opts.Expose = append(p.opts.Expose, name+"dir://"+path)
+	}
 
 	//
-	// Set our name.
+	// Without our GUI we print a line for each request.
 	//
-	opts.SetClientID(p.name)
+	if !p.tui {
+		p.opts.OnRequest = func(e client.Entry) {
+			fmt.Println(e.String())
+		}
+	}
 
 	//
-	// Once we're connected we will subscribe to the named topic.
+	// Create our client, which validates our settings.
 	//
-	opts.OnConnect = func(c MQTT.Client) {
-
-		topic := "clients/" + p.name
-
-		if token := c.Subscribe(topic, 0, p.onMessage); token.Wait() && token.Error() != nil {
-			fmt.Printf("Failed to subscribe to the MQ-topic:%s\n", token.Error())
-			os.Exit(1)
-		}
+	c, err := client.New(p.opts)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return 1
 	}
 
 	//
 	// Actually establish the MQ connection.
 	//
-	client := MQTT.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Printf("Failed to connect to the MQ-host %s\n", token.Error())
+	if err := c.Connect(); err != nil {
+		fmt.Printf("Failed to connect to the MQ-host %s\n", err.Error())
 		return 1
 	}
+	defer c.Close()
+
+	//
+	// If the server expires our tunnels we exit, explaining why once
+	// our GUI has gone.
+	//
+	expired := false
+	defer func() {
+		if expired {
+			fmt.Printf("Exiting, as our tunnel(s) %s\n", c.Status())
+		}
+	}()
+
+	if !p.tui {
+		return p.console(c, &expired)
+	}
 
 	//
 	// Setup our GUI
@@ -317,7 +343,7 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	//
 	p11 := widgets.NewParagraph()
 	p11.Title = "Keyboard Control"
-	p11.Text = "\n  Press q to quit\n  Press h or l to switch tabs, or use the arrow-keys\n\n"
+	p11.Text = "\n  Press q to quit\n  Press h or l to switch tabs, or use the arrow-keys\n  Press m to switch maintenance mode on, or off\n"
 	p11.SetRect(0, 3, termWidth, 9)
 	p11.BorderStyle.Fg = ui.ColorYellow
 
@@ -326,20 +352,30 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	//
 	p12 := widgets.NewParagraph()
 	p12.Title = "Remote Access"
-	p12.Text += "\n  http://" + p.name + "." + p.tunnel + "\n\n"
-	p12.Text += "  Will proxy content from " + p.expose
-	p12.SetRect(0, 10, termWidth, 17)
+	p12.Text = p.remoteAccess(c)
+	p12Bottom := 10 + 3 + 2*len(c.Tunnels())
+	p12.SetRect(0, 10, termWidth, p12Bottom)
 	p12.BorderStyle.Fg = ui.ColorYellow
 
 	//
 	// Page 1 - widget 3 - uptime
 	//
 	p13 := widgets.NewParagraph()
-	p13.Title = "Uptime"
+	p13.Title = "Uptime & Status"
 	p13.Text += "\n  00:00:00"
-	p13.SetRect(0, 18, termWidth, 23)
+	p13.Text += "\n\n  Status: " + c.Status()
+	p13.SetRect(0, p12Bottom+1, termWidth, p12Bottom+7)
 	p13.BorderStyle.Fg = ui.ColorYellow
 
+	//
+	// Page 1 - widget 4 - totals
+	//
+	p14 := widgets.NewParagraph()
+	p14.Title = "Totals"
+	p14.Text = p.totals(c)
+	p14.SetRect(0, p12Bottom+8, termWidth, p12Bottom+14)
+	p14.BorderStyle.Fg = ui.ColorYellow
+
 	//
 	// Page 2 - widget 1 - response-codes
 	//
@@ -352,11 +388,11 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	//
 	p22 := widgets.NewTable()
 	p22.Rows = [][]string{
-		[]string{"IP Address", "Status", "Request"},
+		[]string{"Tunnel", "IP Address", "Status", "Request"},
 	}
 	p22.TextStyle = ui.NewStyle(ui.ColorWhite)
 	p22.SetRect(0, (termHeight/2)+1, termWidth, termHeight-3)
-	p22.ColumnWidths = []int{20, 8, termWidth - 28}
+	p22.ColumnWidths = []int{20, 20, 8, termWidth - 48}
 
 	//
 	// Show our "uptime"
@@ -396,7 +432,18 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 		}
 
 		p13.Text = "\n  " + p13.Text
+		p13.Text += "\n\n  Status: " + c.Status()
 		ui.Render(p13)
+
+		//
+		// The server might have allocated ports to our TCP
+		// tunnels since we last looked.
+		//
+		p12.Text = p.remoteAccess(c)
+		ui.Render(p12)
+
+		p14.Text = p.totals(c)
+		ui.Render(p14)
 	}
 
 	//
@@ -413,8 +460,10 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 		// We want to sort the keys, so that HTTP-status codes
 		// are shown in a logical order.
 		//
+		stats := c.Stats()
+
 		var tmp []string
-		for k := range p.stats {
+		for k := range stats {
 			tmp = append(tmp, k)
 		}
 		sort.Strings(tmp)
@@ -423,9 +472,9 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 		// Update.
 		//
 		for _, code := range tmp {
-			if p.stats[code] > 0 {
+			if stats[code] > 0 {
 				statsLabel = append(statsLabel, code)
-				statsData = append(statsData, float64(p.stats[code]))
+				statsData = append(statsData, float64(stats[code]))
 			}
 		}
 
@@ -440,8 +489,8 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 		// Now update the table.
 		//
 		var rows [][]string
-		rows = append(rows, []string{"IP Address", "Status", "Request"})
-		for _, ent := range p.requests {
+		rows = append(rows, []string{"Tunnel", "IP Address", "Status", "Request"})
+		for _, ent := range c.Requests() {
 
 			//
 			// The response is "HTTP XXX BLAH\n.."
@@ -473,7 +522,7 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 				request = reqRows[0]
 			}
 
-			rows = append(rows, []string{ent.Source, tmp, request})
+			rows = append(rows, []string{ent.Tunnel, ent.Source, tmp, request})
 		}
 		p22.Rows = rows
 		ui.Render(p22)
@@ -495,7 +544,7 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 			//
 			// First tab-pane.
 			//
-			ui.Render(p11, p12, p13)
+			ui.Render(p11, p12, p13, p14)
 		case 1:
 			//
 			// Second tab-pane.
@@ -507,7 +556,7 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	//
 	// Default to the first tab.
 	//
-	ui.Render(tabpane, p11, p12, p13)
+	ui.Render(tabpane, p11, p12, p13, p14)
 
 	//
 	// Ensure we can poll for events.
@@ -530,6 +579,11 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 			case "q", "<C-c>":
 				return 0
 
+			case "m":
+				c.SetMaintenance("", !c.Maintenance(""), p.opts.MaintenanceMessage)
+				p12.Text = p.remoteAccess(c)
+				renderTab()
+
 			case "h", "<Left>", "<tab>":
 				tabpane.FocusLeft()
 				ui.Clear()
@@ -558,6 +612,10 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 				renderTab()
 			}
 
+		case <-c.Expired():
+			expired = true
+			return 1
+
 		case <-ticker:
 
 			//
@@ -578,9 +636,4 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 
 		}
 	}
-
-	//
-	// Not reached.
-	//
-	return 0
 }
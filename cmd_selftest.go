@@ -0,0 +1,259 @@
+//
+// Test the whole pipeline, end to end.
+//
+// We launch a stub HTTP-server, a server, and a client which exposes
+// the stub, all within this process, and then make requests through
+// the server to ensure they reach the stub, reporting how long each
+// step took.
+//
+// By default we use an embedded broker, see broker.go, but a real one
+// may be given via -broker to validate a deployment.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/subcommands"
+	uuid "github.com/satori/go.uuid"
+	"github.com/skx/tunneller/pkg/client"
+	"github.com/skx/tunneller/pkg/server"
+)
+
+//
+// selftestCmd is the structure for this sub-command.
+//
+type selftestCmd struct {
+	// The address of the broker to use, if not our embedded one.
+	broker string
+
+	// How long to wait for each step to complete.
+	timeout time.Duration
+
+	// The number of requests to make once the tunnel is up.
+	count int
+}
+
+// Name returns the name of this sub-command.
+func (p *selftestCmd) Name() string { return "selftest" }
+
+// Synopsis returns the brief description of this sub-command
+func (p *selftestCmd) Synopsis() string { return "Test a tunnel, end to end." }
+
+// Usage returns details of this sub-command.
+func (p *selftestCmd) Usage() string {
+	return `selftest [options]:
+  Launch a server, and a client exposing a stub HTTP-server, within
+  this process, and ensure that requests made to the server reach it.
+
+  An embedded broker is used unless -broker is given.
+`
+}
+
+// SetFlags configures the flags this sub-command accepts.
+func (p *selftestCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.broker, "broker", "", "The broker to use, such as tcp://localhost:1883, rather than an embedded one.")
+	f.DurationVar(&p.timeout, "timeout", 10*time.Second, "How long to wait for each step to complete.")
+	f.IntVar(&p.count, "count", 10, "The number of requests to make through the tunnel.")
+}
+
+// report shows the outcome of a single step, returning true if it
+// was successful.
+func report(step string, start time.Time, err error) bool {
+
+	if err != nil {
+		fmt.Printf("%-10s FAIL  %s\n", step, err.Error())
+		return false
+	}
+	fmt.Printf("%-10s ok    %s\n", step, time.Since(start).Round(time.Microsecond))
+	return true
+}
+
+// freePort returns a port upon localhost which is free, at least for
+// the moment.
+func freePort() (int, error) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// fetch makes a request through the tunnel, and ensures that it
+// received the response from our stub.
+func fetch(url string, host string, token string) error {
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %d", res.StatusCode)
+	}
+	if string(body) != token {
+		return fmt.Errorf("received the wrong response")
+	}
+	return nil
+}
+
+// Execute is the entry-point to this sub-command.
+func (p *selftestCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	//
+	// Each run uses a random name for its tunnel, and expects a
+	// random response, so that we cannot be confused by anything
+	// else using the same broker.
+	//
+	name := "selftest-" + uuid.NewV4().String()[:8]
+	token := uuid.NewV4().String()
+
+	//
+	// The broker.
+	//
+	start := time.Now()
+	addr := p.broker
+	if addr == "" {
+		b, err := newBroker("127.0.0.1:0")
+		if !report("broker", start, err) {
+			return 1
+		}
+		defer b.Close()
+		addr = b.Addr()
+	} else {
+		report("broker", start, nil)
+	}
+
+	//
+	// The stub service we'll expose.
+	//
+	start = time.Now()
+	stub, err := net.Listen("tcp", "127.0.0.1:0")
+	if !report("stub", start, err) {
+		return 1
+	}
+	defer stub.Close()
+	go http.Serve(stub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, token)
+	}))
+
+	//
+	// The server.
+	//
+	start = time.Now()
+	port, err := freePort()
+	var s *server.Server
+	if err == nil {
+		s, err = server.New(server.Options{
+			Broker:   addr,
+			BindHost: "127.0.0.1",
+			BindPort: port,
+			Timeout:  p.timeout,
+		})
+	}
+	if !report("server", start, err) {
+		return 1
+	}
+	failed := make(chan error, 1)
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			failed <- err
+		}
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+
+	//
+	// The client.
+	//
+	start = time.Now()
+	c, err := client.New(client.Options{
+		Tunnel: "127.0.0.1",
+		Broker: addr,
+		Expose: []string{name + "=" + stub.Addr().String()},
+		Retain: true,
+	})
+	if err == nil {
+		err = c.Connect()
+	}
+	if !report("client", start, err) {
+		return 1
+	}
+	defer c.Close()
+
+	//
+	// Wait for the server to learn of the client, which is complete
+	// once our first request succeeds.
+	//
+	url := "http://127.0.0.1:" + strconv.Itoa(port) + "/"
+	host := name + ".selftest"
+
+	start = time.Now()
+	for {
+		err = fetch(url, host, token)
+		if err == nil || time.Since(start) > p.timeout {
+			break
+		}
+
+		//
+		// Give up immediately if the server failed to launch.
+		//
+		select {
+		case err = <-failed:
+		case <-time.After(50 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	if !report("connect", start, err) {
+		return 1
+	}
+
+	//
+	// Now make our requests, timing each of them.
+	//
+	var total, slowest time.Duration
+	for i := 0; i < p.count; i++ {
+		start = time.Now()
+		if err := fetch(url, host, token); err != nil {
+			report("request", start, err)
+			return 1
+		}
+		took := time.Since(start)
+		total += took
+		if took > slowest {
+			slowest = took
+		}
+	}
+	if p.count > 0 {
+		fmt.Printf("%-10s ok    %d requests, average %s, slowest %s\n", "requests", p.count,
+			(total / time.Duration(p.count)).Round(time.Microsecond), slowest.Round(time.Microsecond))
+	}
+
+	fmt.Printf("PASS\n")
+	return 0
+}
@@ -0,0 +1,230 @@
+//
+// Show the status of a running server.
+//
+// We query the administrative API of the server, see pkg/server/tunnels.go,
+// and show the tunnels which are connected, and their activity, either
+// as a table or as JSON.
+//
+// Given -stats we show the traffic of each tunnel over the last few
+// minutes instead, see pkg/server/stats.go, busiest first.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/skx/tunneller/pkg/server"
+)
+
+//
+// statusCmd is the structure for this sub-command.
+//
+type statusCmd struct {
+	// The address of the server's administrative API.
+	admin string
+
+	// Should we output JSON?
+	json bool
+
+	// How long to wait for the server to reply.
+	timeout time.Duration
+
+	// Should we show the recent traffic of each tunnel, over which
+	// window, and sorted by what?
+	stats  bool
+	window string
+	sort   string
+}
+
+// Name returns the name of this sub-command.
+func (p *statusCmd) Name() string { return "status" }
+
+// Synopsis returns the brief description of this sub-command
+func (p *statusCmd) Synopsis() string { return "Show the tunnels connected to a server." }
+
+// Usage returns details of this sub-command.
+func (p *statusCmd) Usage() string {
+	return `status [options]:
+  Show the tunnels connected to a server, via its administrative API,
+  along with the time they were last active, and the number of requests
+  they've received.
+
+  With -stats show the requests, errors, latency, and bytes transferred
+  by each tunnel over the last 1m, 5m, or 15m, as given by -window.
+`
+}
+
+// SetFlags configures the flags this sub-command accepts.
+func (p *statusCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.admin, "admin", "127.0.0.1:8081", "The address of the server's administrative API.")
+	f.BoolVar(&p.json, "json", false, "Output JSON, rather than a table.")
+	f.DurationVar(&p.timeout, "timeout", 5*time.Second, "How long to wait for the server to reply.")
+	f.BoolVar(&p.stats, "stats", false, "Show the recent traffic of each tunnel, rather than those connected.")
+	f.StringVar(&p.window, "window", "5m", "The window to show the traffic over, with -stats: 1m, 5m, or 15m.")
+	f.StringVar(&p.sort, "sort", "requests", "Sort the tunnels, with -stats, by requests, errors, latency, or bytes.")
+}
+
+// get fetches the given path from the server's administrative API, and
+// decodes the JSON it returns.
+func (p *statusCmd) get(path string, v interface{}) error {
+
+	url := p.admin
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+
+	c := &http.Client{Timeout: p.timeout}
+	res, err := c.Get(strings.TrimSuffix(url, "/") + path)
+	if err != nil {
+		return fmt.Errorf("querying the server: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("querying the server: %s", res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("parsing the server's reply: %s", err.Error())
+	}
+	return nil
+}
+
+// printJSON outputs the given value as JSON.
+func printJSON(v interface{}) subcommands.ExitStatus {
+
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding JSON: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("%s\n", out)
+	return 0
+}
+
+// showStats shows the recent traffic of each tunnel.
+func (p *statusCmd) showStats() subcommands.ExitStatus {
+
+	var stats map[string]map[string]server.Stats
+	if err := p.get("/stats", &stats); err != nil {
+		fmt.Printf("Error %s\n", err.Error())
+		return 1
+	}
+
+	if p.json {
+		return printJSON(stats)
+	}
+
+	var key func(s server.Stats) float64
+	switch p.sort {
+	case "requests":
+		key = func(s server.Stats) float64 { return float64(s.Requests) }
+	case "errors":
+		key = func(s server.Stats) float64 { return float64(s.Errors) }
+	case "latency":
+		key = func(s server.Stats) float64 { return s.P95 }
+	case "bytes":
+		key = func(s server.Stats) float64 { return float64(s.BytesIn + s.BytesOut) }
+	default:
+		fmt.Printf("Unknown -sort %s, use requests, errors, latency, or bytes.\n", p.sort)
+		return 1
+	}
+
+	var names []string
+	for name, windows := range stats {
+		if _, ok := windows[p.window]; !ok {
+			fmt.Printf("Unknown -window %s, use 1m, 5m, or 15m.\n", p.window)
+			return 1
+		}
+		if windows[p.window].Requests > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Printf("No tunnels have received requests within the last %s.\n", p.window)
+		return 0
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := key(stats[names[i]][p.window]), key(stats[names[j]][p.window])
+		if a != b {
+			return a > b
+		}
+		return names[i] < names[j]
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tREQUESTS\tERRORS\tP50\tP95\tBYTES IN\tBYTES OUT\n")
+	for _, name := range names {
+		s := stats[name][p.window]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1fms\t%.1fms\t%d\t%d\n",
+			name, s.Requests, s.Errors, s.P50, s.P95, s.BytesIn, s.BytesOut)
+	}
+	w.Flush()
+	return 0
+}
+
+// ago describes the time which has passed since the given time, which
+// may be zero to mean that it never happened.
+func ago(t time.Time) string {
+
+	if t.IsZero() {
+		return "never"
+	}
+
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return strconv.Itoa(int(d.Seconds())) + "s ago"
+	case d < time.Hour:
+		return strconv.Itoa(int(d.Minutes())) + "m ago"
+	case d < 24*time.Hour:
+		return strconv.Itoa(int(d.Hours())) + "h ago"
+	default:
+		return strconv.Itoa(int(d.Hours()/24)) + "d ago"
+	}
+}
+
+// Execute is the entry-point to this sub-command.
+func (p *statusCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if p.stats {
+		return p.showStats()
+	}
+
+	var tunnels []server.TunnelStatus
+	if err := p.get("/tunnels", &tunnels); err != nil {
+		fmt.Printf("Error %s\n", err.Error())
+		return 1
+	}
+
+	if p.json {
+		return printJSON(tunnels)
+	}
+
+	if len(tunnels) == 0 {
+		fmt.Printf("No tunnels are connected.\n")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tKIND\tCLIENTS\tCONNECTED\tLAST SEEN\tLAST ACTIVE\tREQUESTS\tBYTES IN\tBYTES OUT\n")
+	for _, t := range tunnels {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			t.Name, t.Kind, len(t.Clients), ago(t.Connected), ago(t.LastSeen), ago(t.LastActive),
+			t.Requests, t.BytesIn, t.BytesOut)
+	}
+	w.Flush()
+	return 0
+}
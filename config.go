@@ -0,0 +1,133 @@
+//
+// Both the client and the server may be configured via a YAML file,
+// specified with -config, and via environment variables.
+//
+// Rather than having a separate set of configuration keys the file
+// simply contains the names of our command-line flags:
+//
+//   port: 8080
+//   rate: 10
+//   secret:
+//     - foo=bar
+//     - baz=steve
+//
+// Similarly the environmental variable TUNNELLER_MAX_BODY sets the value
+// of the -max-body flag.
+//
+// Flags given upon the command-line take precedence over environmental
+// variables, which take precedence over the configuration file.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envName returns the name of the environmental variable which may be
+// used to set the given flag.
+func envName(name string) string {
+	return "TUNNELLER_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// loadConfig updates the values of the flags in the given set, which
+// were not specified upon the command-line, from the environment and
+// the configuration file named by the -config flag.
+func loadConfig(f *flag.FlagSet) error {
+
+	//
+	// Find the flags which were set explicitly, and which we must
+	// therefore leave alone.
+	//
+	set := make(map[string]bool)
+	f.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	//
+	// Apply the environment.
+	//
+	var err error
+	f.VisitAll(func(fl *flag.Flag) {
+
+		val, ok := os.LookupEnv(envName(fl.Name))
+		if !ok || set[fl.Name] || err != nil {
+			return
+		}
+		set[fl.Name] = true
+
+		//
+		// Flags which may be repeated accept a comma-separated list.
+		//
+		values := []string{val}
+		if _, list := fl.Value.(*stringList); list {
+			values = strings.Split(val, ",")
+		}
+		for _, v := range values {
+			if e := fl.Value.Set(v); e != nil {
+				err = fmt.Errorf("invalid value for %s: %s", envName(fl.Name), e)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	//
+	// The name of the configuration file may have been set by the
+	// environment, so we only look for it now.
+	//
+	path := ""
+	if fl := f.Lookup("config"); fl != nil {
+		path = fl.Value.String()
+	}
+	if path == "" {
+		return nil
+	}
+
+	//
+	// Now apply the configuration file.
+	//
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var cfg map[string]interface{}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	for name, value := range cfg {
+
+		fl := f.Lookup(name)
+		if fl == nil {
+			return fmt.Errorf("unknown setting in %s: %s", path, name)
+		}
+		if set[name] {
+			continue
+		}
+
+		//
+		// Lists are used for flags which may be repeated.
+		//
+		values := []interface{}{value}
+		if list, ok := value.([]interface{}); ok {
+			values = list
+		}
+		for _, v := range values {
+			if err := fl.Value.Set(fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("invalid value for %s in %s: %s", name, path, err)
+			}
+		}
+	}
+
+	return nil
+}
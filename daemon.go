@@ -0,0 +1,308 @@
+//
+// Running in the background.
+//
+// Machines without a service manager may run the server, or the client,
+// via -daemon, which relaunches us in the background, detached from our
+// terminal.  The process we launch writes its PID to -pid-file, and its
+// messages to -log-file, which is renamed to -log-file.1 once it exceeds
+// -log-max-size, with the older files shifted up to -log-keep.
+//
+// Both sub-commands also accept an action, following their flags:
+//
+//   start   - Launch in the background, as -daemon.
+//   stop    - Stop the process named by -pid-file, awaiting its exit.
+//   restart - Stop the process named by -pid-file, then launch anew.
+//   status  - Report whether the process named by -pid-file is running.
+//
+// The stop, restart, and status actions need only be given the same
+// -pid-file, or -config, as the process they act upon.
+//
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/skx/tunneller/pkg/logfile"
+)
+
+const (
+	// daemonEnv marks the process we launch in the background, and
+	// doesn't match any flag, see loadConfig.
+	daemonEnv = "TUNNELLER_DAEMONIZED"
+
+	// daemonStartup is how long we wait to see whether the process we
+	// launched fails to start.
+	daemonStartup = time.Second
+
+	// daemonStopTimeout is how long we wait for a process we've asked
+	// to stop to exit, allowing for the server to drain its requests.
+	daemonStopTimeout = 2 * time.Minute
+)
+
+// daemon holds the settings of our daemon mode, which are shared by the
+// serve and client sub-commands.
+type daemon struct {
+	// enabled is true if we should run in the background.
+	enabled bool
+
+	// pidFile is the file we record our PID within.
+	pidFile string
+
+	// logFile is the file we write our messages to.
+	logFile string
+
+	// logMaxSize is the size our log may grow to before it is rotated,
+	// and logKeep the number of rotated files we keep.
+	logMaxSize int64
+	logKeep    int
+
+	// out is our log, and done is closed once everything written to
+	// it has been copied, when we're running in the background.
+	out  *os.File
+	done chan struct{}
+}
+
+// SetFlags configures the flags of our daemon mode, naming our files
+// after the given sub-command.
+func (d *daemon) SetFlags(f *flag.FlagSet, name string) {
+	f.BoolVar(&d.enabled, "daemon", false, "Run in the background, writing our PID to -pid-file and our messages to -log-file.")
+	f.StringVar(&d.pidFile, "pid-file", "tunneller-"+name+".pid", "The file holding our PID, with -daemon, which the stop, restart, and status actions read.")
+	f.StringVar(&d.logFile, "log-file", "tunneller-"+name+".log", "The file to write our messages to, with -daemon.")
+	f.Int64Var(&d.logMaxSize, "log-max-size", 10*1024*1024, "Rotate -log-file once it exceeds this many bytes, zero to disable.")
+	f.IntVar(&d.logKeep, "log-keep", 5, "The number of rotated log files to keep.")
+}
+
+// Run carries out the action given via our arguments, if any, and
+// launches us in the background if we should.
+//
+// It returns true, along with our exit-status, if the sub-command should
+// exit rather than continuing to run.
+func (d *daemon) Run(args []string) (bool, subcommands.ExitStatus) {
+
+	action := ""
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	//
+	// We're the process launched in the background.
+	//
+	if os.Getenv(daemonEnv) != "" && (action == "" || action == "start" || action == "restart") {
+		if err := d.setup(); err != nil {
+			fmt.Printf("Error running in the background: %s\n", err.Error())
+			return true, 1
+		}
+		return false, 0
+	}
+
+	var err error
+	switch action {
+	case "":
+		if !d.enabled {
+			return false, 0
+		}
+		err = d.start()
+	case "start":
+		err = d.start()
+	case "stop":
+		err = d.stop()
+		if err == errNotRunning {
+			fmt.Printf("Not running\n")
+			return true, 1
+		}
+	case "restart":
+		err = d.stop()
+		if err == errNotRunning {
+			err = nil
+		}
+		if err == nil {
+			err = d.start()
+		}
+	case "status":
+		pid, running := d.running()
+		if !running {
+			fmt.Printf("Not running\n")
+			return true, 1
+		}
+		fmt.Printf("Running as PID %d\n", pid)
+	default:
+		err = fmt.Errorf("unknown action %q, expected start, stop, restart, or status", action)
+	}
+
+	if err != nil {
+		fmt.Printf("Error %s\n", err.Error())
+		return true, 1
+	}
+	return true, 0
+}
+
+// errNotRunning is returned when asked to stop a process which isn't
+// running.
+var errNotRunning = errors.New("not running")
+
+// running returns the PID recorded within our PID file, and whether that
+// process is still running.
+func (d *daemon) running() (int, bool) {
+
+	data, err := ioutil.ReadFile(d.pidFile)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, processAlive(pid)
+}
+
+// start launches us in the background, with the arguments we were
+// launched with, less our action.
+func (d *daemon) start() error {
+
+	if pid, running := d.running(); running {
+		return fmt.Errorf("already running as PID %d", pid)
+	}
+
+	args := os.Args[1:]
+	if n := len(args); n > 0 && (args[n-1] == "start" || args[n-1] == "restart") {
+		args = args[:n-1]
+	}
+
+	//
+	// The process we launch writes anything it prints before it has
+	// opened its log, such as errors in its configuration, to the
+	// end of our log.
+	//
+	out, err := os.OpenFile(d.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening our log: %s", err.Error())
+	}
+	defer out.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := detach(cmd); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("launching in the background: %s", err.Error())
+	}
+
+	//
+	// Report the process failing at once, rather than leaving the
+	// user to discover it.
+	//
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case <-exited:
+		return fmt.Errorf("failed to start, see %s", d.logFile)
+	case <-time.After(daemonStartup):
+	}
+
+	fmt.Printf("Started as PID %d, logging to %s\n", cmd.Process.Pid, d.logFile)
+	return nil
+}
+
+// stop asks the process named by our PID file to exit, and awaits it.
+func (d *daemon) stop() error {
+
+	pid, running := d.running()
+	if !running {
+		return errNotRunning
+	}
+	if err := terminate(pid); err != nil {
+		return fmt.Errorf("stopping PID %d: %s", pid, err.Error())
+	}
+
+	deadline := time.Now().Add(daemonStopTimeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("PID %d didn't exit within %s", pid, daemonStopTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	os.Remove(d.pidFile)
+
+	fmt.Printf("Stopped PID %d\n", pid)
+	return nil
+}
+
+// setup records our PID, and sends our messages to our log, when we're
+// the process launched in the background.
+func (d *daemon) setup() error {
+
+	out, err := logfile.Open(d.logFile, 0644, d.logMaxSize, 0, d.logKeep)
+	if err != nil {
+		return fmt.Errorf("opening our log: %s", err.Error())
+	}
+
+	//
+	// Everything writes to stdout, or stderr, so we replace both with
+	// a pipe, and copy whatever is written to it into our log.
+	//
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	d.out = w
+	d.done = make(chan struct{})
+	go func() {
+		//
+		// Should we fail to write to our log we discard whatever
+		// follows, rather than blocking those writing to the pipe.
+		//
+		io.Copy(out, r)
+		io.Copy(ioutil.Discard, r)
+		out.Close()
+		close(d.done)
+	}()
+	os.Stdout = w
+	os.Stderr = w
+
+	//
+	// The standard logger doesn't notice os.Stderr being replaced.
+	//
+	log.SetOutput(w)
+
+	pid := strconv.Itoa(os.Getpid())
+	if err := ioutil.WriteFile(d.pidFile, []byte(pid+"\n"), 0644); err != nil {
+		return fmt.Errorf("writing our PID file: %s", err.Error())
+	}
+	return nil
+}
+
+// Close flushes our log, and removes our PID file, when we're the
+// process launched in the background and are about to exit.
+func (d *daemon) Close() {
+
+	if d.out == nil {
+		return
+	}
+	d.out.Close()
+	<-d.done
+
+	if pid, _ := d.running(); pid == os.Getpid() {
+		os.Remove(d.pidFile)
+	}
+}
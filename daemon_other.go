@@ -0,0 +1,28 @@
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// errNoDaemon reports that we can't run in the background upon this
+// platform.
+var errNoDaemon = errors.New("-daemon is not supported upon this platform")
+
+// detach reports that we can't run in the background upon this platform.
+func detach(cmd *exec.Cmd) error {
+	return errNoDaemon
+}
+
+// processAlive reports that no process is running, as we can't have
+// launched one.
+func processAlive(pid int) bool {
+	return false
+}
+
+// terminate reports that we can't stop processes upon this platform.
+func terminate(pid int) error {
+	return errNoDaemon
+}
@@ -0,0 +1,10 @@
+//
+// Include the PostgreSQL driver, for -accounts-db, which is written in
+// pure Go and so is present in every build.
+//
+
+package main
+
+import (
+	_ "github.com/lib/pq"
+)
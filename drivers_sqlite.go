@@ -0,0 +1,13 @@
+// +build sqlite
+
+//
+// Include the SQLite driver, for -accounts-db, when built with
+// "-tags sqlite".  This requires cgo, so isn't present in the binaries
+// we release, which are built without it.
+//
+
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
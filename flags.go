@@ -0,0 +1,20 @@
+package main
+
+import "strings"
+
+// stringList is a flag which may be specified multiple times, with
+// each value being appended to the list.
+//
+// For example "-expose foo=localhost:3000 -expose bar=localhost:8080".
+type stringList []string
+
+// String returns a string-representation of the flag's value.
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set appends a new value to the list.
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
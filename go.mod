@@ -1,14 +1,25 @@
 module github.com/skx/tunneller
 
-go 1.12
+go 1.21
 
 require (
 	github.com/blevesearch/bleve v0.7.0
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/gizak/termui/v3 v3.0.0
 	github.com/google/subcommands v1.0.1
-	github.com/kr/pretty v0.1.0 // indirect
+	github.com/lib/pq v1.12.3
+	github.com/mattn/go-sqlite3 v1.14.52
 	github.com/satori/go.uuid v1.2.0
-	golang.org/x/net v0.0.0-20190424024845-afe8014c977f // indirect
+	golang.org/x/net v0.0.0-20190424024845-afe8014c977f
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/cjbassi/drawille-go v0.0.0-20190126131713-27dc511fe6fd // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/mattn/go-runewidth v0.0.2 // indirect
+	github.com/mitchellh/go-wordwrap v0.0.0-20150314170334-ad45545899c7 // indirect
+	github.com/nsf/termbox-go v0.0.0-20190121233118-02980233997d // indirect
+	golang.org/x/text v0.3.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 )
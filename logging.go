@@ -0,0 +1,89 @@
+//
+// Where the server writes its messages.
+//
+// By default the server writes its messages to stdout, but via
+// -log-output they may be sent to syslog, locally or to a remote host,
+// or directly to journald:
+//
+//   stdout                     - The default.
+//   syslog                     - The local syslog daemon.
+//   syslog://host:514          - A remote syslog daemon, via UDP.
+//   syslog+tcp://host:514      - A remote syslog daemon, via TCP.
+//   journald                   - The systemd journal.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// logTag is the name we log under.
+const logTag = "tunneller"
+
+// journalSocket is the socket journald receives messages upon.
+const journalSocket = "/run/systemd/journal/socket"
+
+// openLog returns the writer for the given -log-output setting.
+func openLog(output string) (io.Writer, error) {
+
+	switch {
+	case output == "" || output == "stdout":
+		return os.Stdout, nil
+	case output == "syslog":
+		return dialSyslog("", "")
+	case strings.HasPrefix(output, "syslog://"):
+		return dialSyslog("udp", strings.TrimPrefix(output, "syslog://"))
+	case strings.HasPrefix(output, "syslog+udp://"):
+		return dialSyslog("udp", strings.TrimPrefix(output, "syslog+udp://"))
+	case strings.HasPrefix(output, "syslog+tcp://"):
+		return dialSyslog("tcp", strings.TrimPrefix(output, "syslog+tcp://"))
+	case output == "journald":
+		return newJournal()
+	}
+	return nil, fmt.Errorf("unknown log output %q", output)
+}
+
+// journal writes each message it receives to journald, via its native
+// protocol.
+type journal struct {
+	conn net.Conn
+}
+
+// newJournal connects to journald.
+func newJournal() (*journal, error) {
+
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{conn: conn}, nil
+}
+
+// Write sends a single message to journald.
+//
+// Messages which span several lines must be sent with an explicit
+// length, rather than terminated by a newline.
+func (j *journal) Write(p []byte) (int, error) {
+
+	msg := bytes.TrimRight(p, "\n")
+
+	var buf bytes.Buffer
+	buf.WriteString("SYSLOG_IDENTIFIER=" + logTag + "\n")
+	buf.WriteString("PRIORITY=6\n")
+	buf.WriteString("MESSAGE\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(len(msg)))
+	buf.Write(msg)
+	buf.WriteString("\n")
+
+	if _, err := j.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,13 @@
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslog reports that syslog isn't available upon this platform.
+func dialSyslog(network string, addr string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported upon this platform")
+}
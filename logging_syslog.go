@@ -0,0 +1,14 @@
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to the syslog daemon at the given address, or the
+// local one if the network and address are empty.
+func dialSyslog(network string, addr string) (io.Writer, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, logTag)
+}
@@ -20,8 +20,12 @@ func main() {
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
+	subcommands.Register(&accountsCmd{}, "")
+	subcommands.Register(&adminCmd{}, "")
 	subcommands.Register(&clientCmd{}, "")
+	subcommands.Register(&selftestCmd{}, "")
 	subcommands.Register(&serveCmd{}, "")
+	subcommands.Register(&statusCmd{}, "")
 	subcommands.Register(&versionCmd{}, "")
 
 	flag.Parse()
@@ -0,0 +1,1410 @@
+// Package client implements the client of our tunnels, which receives
+// requests from the server via the queue and relays them to the local
+// service(s) it exposes.
+//
+// It is used by the "client" sub-command, but may be embedded within
+// any Go program:
+//
+//   c, err := client.New(client.Options{
+//       Tunnel: "tunnel.example.com",
+//       Expose: []string{"web=localhost:3000"},
+//       Retain: true,
+//   })
+//   if err != nil {
+//       ...
+//   }
+//   err = c.Connect()
+//
+package client
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/satori/go.uuid"
+	"github.com/skx/tunneller/pkg/hook"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+//
+// Options holds the settings of a Client.
+//
+// The zero value of each field disables the corresponding feature,
+// unless otherwise noted.
+//
+type Options struct {
+
+	//
+	// The tunnel end-point.
+	//
+	// This is the host to which remote visitors will make their
+	// HTTP-requests, and it is also the host which is running an
+	// open (!) mosquitto-server.
+	//
+	Tunnel string
+
+	//
+	// The prefix of the paths by which the server addresses tunnels,
+	// as given to its -path-prefix, if we should report their
+	// addresses by path rather than by hostname.
+	//
+	PathPrefix string
+
+	//
+	// The address of the MQ-server, which defaults to port 1883
+	// upon the tunnel end-point.  Brokers may list several MQ-servers
+	// instead, such as the members of a cluster, which we try in
+	// order, failing over to the next if we lose our connection.
+	//
+	Broker  string
+	Brokers []string
+
+	//
+	// The CA which signed the MQ-server's certificate, and the
+	// certificate and key we present to it, when connecting via TLS.
+	//
+	BrokerCA   string
+	BrokerCert string
+	BrokerKey  string
+
+	//
+	// The name we'll access this resource via, if the name isn't
+	// specified as part of the Expose entry.
+	//
+	Name string
+
+	//
+	// The service(s) to expose, expressed as 1.2.3.4:NN, optionally
+	// prefixed with a name as "name=1.2.3.4:NN".  A local directory
+	// may be served as "dir:///path/to/directory".
+	//
+	Expose []string
+
+	//
+	// The server-name to send to TLS-enabled services.
+	//
+	SNI string
+
+	//
+	// Skip verification of the certificates of TLS-enabled services?
+	//
+	Insecure bool
+
+	//
+	// Rewrite the Host: header of requests, and the Location: header
+	// of responses?
+	//
+	RewriteHost bool
+
+	//
+	// Rewrite the bodies of HTML responses?
+	//
+	RewriteBody bool
+
+	//
+	// Should we tell local services which tunnel, and visitor, each
+	// request came from, via headers?  See metadata.go.
+	//
+	TunnelHeaders bool
+
+	//
+	// Credentials, as "user:password", which visitors must present
+	// before the server will forward their requests to us.
+	//
+	Auth string
+
+	//
+	// The networks from which visitors may, or may not, access our
+	// tunnels.
+	//
+	Allow []string
+	Deny  []string
+
+	//
+	// Should requests and responses be compressed in transit?
+	//
+	Compress bool
+
+	//
+	// Should visitors be pinned to this client?
+	//
+	Sticky bool
+
+	//
+	// The number of idle connections we keep to each local service,
+	// and for how long.  Zero disables the pool.
+	//
+	PoolSize int
+	PoolIdle time.Duration
+
+	//
+	// The QoS level we use for requests, replies, and presence.
+	//
+	QoS int
+
+	//
+	// The size of the largest message we'll publish, as we split
+	// larger replies into parts, see pkg/protocol/chunks.go.
+	//
+	ChunkSize int
+
+	//
+	// Should our presence be retained by the queue?
+	//
+	// This should be set unless the queue doesn't support retained
+	// messages, as otherwise servers only learn of us when we connect.
+	//
+	Retain bool
+
+	//
+	// Should the queue persist our session whilst we're disconnected?
+	//
+	Persistent bool
+
+	//
+	// Should our tunnels start in maintenance mode, and the message to
+	// show visitors whilst they're in it, see maintenance.go.
+	//
+	Maintenance        bool
+	MaintenanceMessage string
+
+	//
+	// The token, "account:secret", with which we register, if the
+	// server has an account system.
+	//
+	Token string
+
+	//
+	// Should we re-register our tunnels, rather than disconnecting,
+	// if the server expires them as idle?
+	//
+	Reregister bool
+
+	//
+	// Should requests and responses be encrypted in transit?
+	//
+	Encrypt bool
+
+	//
+	// The secret, shared with the server, used to sign messages.
+	//
+	Secret string
+
+	//
+	// The maximum delay between attempts to reconnect to the
+	// MQ-host, after our connection has been lost, which defaults
+	// to one minute.
+	//
+	ReconnectMax time.Duration
+
+	//
+	// The interval at which we republish our registration, so that
+	// the server knows we're alive, with zero disabling it.
+	//
+	Heartbeat time.Duration
+
+	//
+	// The address upon which we present our metrics, if any.
+	//
+	Metrics string
+
+	//
+	// Hooks which may inspect, modify, or answer our requests, and
+	// inspect or modify our responses.
+	//
+	Hooks []hook.Hook
+
+	//
+	// A function to call with a description of each request we've
+	// handled, see console.go.
+	//
+	OnRequest func(Entry)
+
+	//
+	// The file holding our identity, which lets us reclaim the same
+	// names when we restart, and whether to replace it with a new
+	// identity, see identity.go.
+	//
+	Identity      string
+	FreshIdentity bool
+}
+
+//
+// Client is the structure which holds our state.
+//
+type Client struct {
+
+	//
+	// Our settings.
+	//
+	opts Options
+
+	//
+	// The ID we use for our MQ-connection, see ID.
+	//
+	id string
+
+	//
+	// Our MQ-connection.
+	//
+	mq MQTT.Client
+
+	//
+	// The IDs of the requests we've handled recently.
+	//
+	handled *dedup
+
+	//
+	// The requests whose parts we're receiving.
+	//
+	chunks *protocol.Chunks
+
+	//
+	// The private-key we use to encrypt requests and responses.
+	//
+	key *ecdh.PrivateKey
+
+	//
+	// The verifier of the credentials we require visitors to present,
+	// which we send to the server in their place.
+	//
+	auth string
+
+	//
+	// Our identity, if we keep one.
+	//
+	identity *identity
+
+	//
+	// The TCP connections we're relaying.
+	//
+	streams *protocol.Streams
+
+	//
+	// The tunnels we're serving, built from our options.
+	//
+	tunnels []*tunnel
+
+	//
+	// A map of the HTTP-status-codes we've returned and their count.
+	//
+	stats map[string]int
+
+	//
+	// The recent requests we've seen.
+	//
+	requests []protocol.Request
+
+	//
+	// Lock for our statistics, and recent requests.
+	//
+	statsMutex sync.Mutex
+
+	//
+	// A human-readable description of our connection-state.
+	//
+	status string
+
+	//
+	// Our registration, as last published, which we republish as our
+	// heartbeat.
+	//
+	registration protocol.Registration
+	presence     []byte
+
+	//
+	// The tunnels in maintenance mode, mapped to the message to show
+	// visitors, see maintenance.go.
+	//
+	maintenance map[string]string
+
+	//
+	// Lock for our status, and registration.
+	//
+	statusMutex sync.Mutex
+
+	//
+	// Closed when we're closed, to stop our heartbeat.
+	//
+	done chan struct{}
+
+	//
+	// Closed if the server expires our tunnels, see onExpire.
+	//
+	expired     chan struct{}
+	expiredOnce sync.Once
+
+	//
+	// Our metrics, see metrics.go.
+	//
+	metrics *metrics
+
+	//
+	// The TLS configuration we use to connect to the MQ-server, if any.
+	//
+	tls *tls.Config
+}
+
+//
+// Tunnel describes one of the tunnels a client is serving.
+//
+type Tunnel struct {
+
+	//
+	// The name of the tunnel.
+	//
+	Name string
+
+	//
+	// The local service it exposes.
+	//
+	Expose string
+
+	//
+	// The address visitors may reach it via.
+	//
+	// This is empty for TCP, and UDP, tunnels until the server has
+	// allocated a port to them.
+	//
+	Address string
+}
+
+//
+// New creates a new client with the given settings.
+//
+// The client does nothing until Connect is invoked.
+//
+func New(opts Options) (*Client, error) {
+
+	//
+	// Ensure that we have setup variables
+	//
+	if len(opts.Expose) == 0 {
+		return nil, errors.New("you must specify the local host:port to expose")
+	}
+	if opts.Tunnel == "" {
+		return nil, errors.New("you must specify the tunnel end-point")
+	}
+	if opts.QoS < 0 || opts.QoS > 2 {
+		return nil, errors.New("the QoS level must be 0, 1, or 2")
+	}
+	if opts.ChunkSize != 0 && opts.ChunkSize < protocol.MinChunkSize {
+		return nil, fmt.Errorf("the chunk size must be at least %d bytes", protocol.MinChunkSize)
+	}
+	if opts.Auth != "" && !strings.Contains(opts.Auth, ":") {
+		return nil, errors.New("the credentials must be specified as user:password")
+	}
+
+	//
+	// Load our identity, which may give the token we registered with
+	// last time.
+	//
+	var id *identity
+	if opts.Identity != "" {
+		var err error
+		id, err = loadIdentity(opts.Identity, opts.FreshIdentity)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Token == "" {
+			opts.Token = id.Token
+		}
+	}
+	if opts.Token != "" {
+		if _, _, err := protocol.SplitToken(opts.Token); err != nil {
+			return nil, err
+		}
+	}
+	for _, network := range append(opts.Allow, opts.Deny...) {
+		if _, err := protocol.ParseCIDR(network); err != nil {
+			return nil, fmt.Errorf("invalid network %s: %s", network, err.Error())
+		}
+	}
+
+	if opts.Broker == "" && len(opts.Brokers) == 0 {
+		opts.Broker = fmt.Sprintf("tcp://%s:1883", opts.Tunnel)
+	}
+	if opts.ReconnectMax <= 0 {
+		opts.ReconnectMax = 60 * time.Second
+	}
+
+	c := &Client{
+		opts:        opts,
+		stats:       make(map[string]int),
+		streams:     protocol.NewStreams(),
+		handled:     newDedup(5 * time.Minute),
+		chunks:      protocol.NewChunks(),
+		done:        make(chan struct{}),
+		expired:     make(chan struct{}),
+		metrics:     newMetrics(),
+		maintenance: make(map[string]string),
+		identity:    id,
+	}
+
+	//
+	// Load our certificates, if we're connecting via TLS.
+	//
+	var err error
+	c.tls, err = protocol.BrokerTLS(opts.BrokerCA, opts.BrokerCert, opts.BrokerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load our TLS settings: %s", err.Error())
+	}
+
+	//
+	// Work out the name and local service of each tunnel.
+	//
+	if err := c.parseTunnels(); err != nil {
+		return nil, err
+	}
+
+	//
+	// Derive the verifier of our credentials once, as doing so is
+	// deliberately slow.
+	//
+	if opts.Auth != "" {
+		creds := strings.SplitN(opts.Auth, ":", 2)
+		c.auth, err = protocol.AuthVerifier(creds[0], creds[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//
+	// We may start in maintenance mode.
+	//
+	if opts.Maintenance {
+		c.SetMaintenance("", true, opts.MaintenanceMessage)
+	}
+
+	//
+	// Generate our key-pair, if we're to use encryption.
+	//
+	// We reuse the key of our identity, if it has one.
+	//
+	if opts.Encrypt && id != nil && id.Key != nil {
+		c.key, err = ecdh.X25519().NewPrivateKey(id.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load our key: %s", err.Error())
+		}
+	} else if opts.Encrypt {
+		c.key, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate our key: %s", err.Error())
+		}
+	}
+
+	//
+	// Save our identity, for the next time we're launched.
+	//
+	if id != nil {
+		id.Token = opts.Token
+		if c.key != nil {
+			id.Key = c.key.Bytes()
+		}
+		if err := id.save(opts.Identity); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// setStatus updates our connection-status.
+func (c *Client) setStatus(format string, args ...interface{}) {
+	c.statusMutex.Lock()
+	c.status = fmt.Sprintf(format, args...)
+	c.statusMutex.Unlock()
+}
+
+// Status returns a human-readable description of our connection-state.
+func (c *Client) Status() string {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	return c.status
+}
+
+// parseTunnels builds our list of tunnels from our Expose option.
+//
+// Each value is either "host:port", in which case the name is taken
+// from our Name option (or generated), or "name=host:port".
+func (c *Client) parseTunnels() error {
+
+	seen := make(map[string]bool)
+	unnamed := false
+
+	for _, ent := range c.opts.Expose {
+
+		t := &tunnel{
+			expose:      ent,
+			sni:         c.opts.SNI,
+			insecure:    c.opts.Insecure,
+			rewriteHost: c.opts.RewriteHost || c.opts.RewriteBody,
+			rewriteBody: c.opts.RewriteBody,
+		}
+
+		//
+		// Split off the name, if one is present.
+		//
+		if i := strings.Index(ent, "="); i > 0 && !strings.ContainsAny(ent[:i], ":/") {
+			t.name = ent[:i]
+			t.expose = ent[i+1:]
+		} else {
+			if unnamed {
+				return fmt.Errorf("only one service to expose may omit the name")
+			}
+			unnamed = true
+			t.name = c.opts.Name
+		}
+
+		//
+		// The name is optional, but useful, and we reuse the name
+		// we generated last time, if we keep our identity.
+		//
+		if t.name == "" && c.identity != nil {
+			t.name = c.identity.Names[t.expose]
+		}
+		if t.name == "" {
+			uid := uuid.NewV4()
+			t.name = uid.String()
+			if c.identity != nil {
+				c.identity.Names[t.expose] = t.name
+			}
+		}
+
+		if err := protocol.CheckName(t.name); err != nil {
+			return err
+		}
+		if t.expose == "" {
+			return fmt.Errorf("no local service given for the tunnel %s", t.name)
+		}
+		if seen[t.name] {
+			return fmt.Errorf("the name %s is used by more than one tunnel", t.name)
+		}
+		seen[t.name] = true
+
+		if t.isDir() {
+			if err := t.checkDir(); err != nil {
+				return fmt.Errorf("unable to serve the tunnel %s: %s", t.name, err.Error())
+			}
+		}
+		if t.isDocker() {
+			if _, err := t.dockerAddress(); err != nil {
+				return fmt.Errorf("unable to serve the tunnel %s: %s", t.name, err.Error())
+			}
+		}
+
+		t.setupTransport(c.opts.PoolSize, c.opts.PoolIdle)
+		c.tunnels = append(c.tunnels, t)
+	}
+
+	//
+	// Now we know the name of our first tunnel we can choose our ID.
+	//
+	uid := uuid.NewV4()
+	c.id = c.tunnels[0].name + "." + uid.String()[:8]
+
+	return nil
+}
+
+// ID returns the ID we use for our MQ-connection.
+//
+// This is the name of our first tunnel, followed by a random suffix,
+// as several clients may serve the same tunnels.  It also gives the
+// topic upon which we publish our presence, and is unambiguous as
+// the names of tunnels never contain a period.
+func (c *Client) ID() string {
+	return c.id
+}
+
+// onConnect is called every time we connect to the MQ-host, both
+// initially and after any reconnection.
+//
+// We subscribe to the topic of each tunnel, and announce our presence.
+func (c *Client) onConnect(client MQTT.Client) {
+
+	reg := protocol.Registration{Client: c.ID(), Connected: time.Now(), Heartbeat: c.opts.Heartbeat}
+
+	//
+	// If we require visitors to authenticate then tell the server.
+	//
+	reg.Auth = c.auth
+	reg.Allow = c.opts.Allow
+	reg.Deny = c.opts.Deny
+
+	//
+	// Ask the server to compress the requests it sends us.
+	//
+	if c.opts.Compress {
+		reg.Compress = "gzip"
+	}
+
+	//
+	// Ask the server to keep sending each visitor to us.
+	//
+	reg.Sticky = c.opts.Sticky
+
+	//
+	// Tell the server we'll acknowledge its requests.
+	//
+	reg.Acks = true
+
+	//
+	// Tell the server we'll reassemble the requests it splits.
+	//
+	reg.Chunks = true
+
+	//
+	// Ask the server to encrypt the requests it sends us.
+	//
+	if c.key != nil {
+		reg.PublicKey = c.key.PublicKey().Bytes()
+	}
+
+	//
+	// The server may ask us to disconnect, see onKick.
+	//
+	kick := "clients/" + protocol.TopicLevel(c.ID()) + "/kick"
+	if token := client.Subscribe(kick, byte(c.opts.QoS), c.onKick); token.Wait() && token.Error() != nil {
+		c.setStatus("failed to subscribe to %s: %s", kick, token.Error())
+		client.Disconnect(250)
+		go c.reconnect(client)
+		return
+	}
+
+	//
+	// The server may expire our tunnels if they're idle, see onExpire.
+	//
+	expire := "clients/" + protocol.TopicLevel(c.ID()) + "/expire"
+	if token := client.Subscribe(expire, byte(c.opts.QoS), c.onExpire); token.Wait() && token.Error() != nil {
+		c.setStatus("failed to subscribe to %s: %s", expire, token.Error())
+		client.Disconnect(250)
+		go c.reconnect(client)
+		return
+	}
+
+	for _, t := range c.tunnels {
+
+		//
+		// Take a copy for the closures.
+		//
+		t := t
+
+		//
+		// The topics we subscribe to depend upon whether we're
+		// relaying HTTP-requests, raw TCP connections, or UDP
+		// datagrams.
+		//
+		subs := make(map[string]MQTT.MessageHandler)
+		if t.isTCP() {
+			subs["clients/"+protocol.TopicLevel(t.name)+"/"+protocol.TopicLevel(c.ID())+"/stream/down"] = func(client MQTT.Client, msg MQTT.Message) {
+				c.onStream(t, client, msg)
+			}
+			subs["clients/"+protocol.TopicLevel(t.name)+"/tcp"] = func(client MQTT.Client, msg MQTT.Message) {
+				c.onPort(t, client, msg)
+			}
+			reg.TCP = append(reg.TCP, t.name)
+		} else if t.isUDP() {
+			subs["clients/"+protocol.TopicLevel(t.name)+"/"+protocol.TopicLevel(c.ID())+"/datagram/down"] = func(client MQTT.Client, msg MQTT.Message) {
+				c.onDatagram(t, client, msg)
+			}
+			subs["clients/"+protocol.TopicLevel(t.name)+"/udp"] = func(client MQTT.Client, msg MQTT.Message) {
+				c.onPort(t, client, msg)
+			}
+			reg.UDP = append(reg.UDP, t.name)
+		} else {
+			subs["clients/"+protocol.TopicLevel(t.name)+"/"+protocol.TopicLevel(c.ID())] = func(client MQTT.Client, msg MQTT.Message) {
+				c.onMessage(t, client, msg)
+			}
+		}
+
+		//
+		// We use a clean session, so our subscriptions must be
+		// renewed every time we connect.
+		//
+		// If that fails we drop the connection and try again, rather
+		// than sitting connected but deaf.
+		//
+		for topic, handler := range subs {
+			if token := client.Subscribe(topic, byte(c.opts.QoS), handler); token.Wait() && token.Error() != nil {
+				c.setStatus("failed to subscribe to %s: %s", topic, token.Error())
+				client.Disconnect(250)
+				go c.reconnect(client)
+				return
+			}
+		}
+
+		reg.Names = append(reg.Names, t.name)
+	}
+
+	//
+	// Announce our presence.
+	//
+	c.announce(client, reg)
+
+	c.setStatus("connected")
+}
+
+// onConnectionLost is called when our connection to the MQ-host is lost.
+func (c *Client) onConnectionLost(client MQTT.Client, err error) {
+	c.setStatus("connection lost: %s", err)
+	go c.reconnect(client)
+}
+
+// onKick is called when the server asks us to disconnect, because its
+// operator has kicked, or banned, one of our tunnels.
+//
+// We don't attempt to reconnect.
+func (c *Client) onKick(client MQTT.Client, msg MQTT.Message) {
+
+	reason := msg.Payload()
+	if c.opts.Secret != "" {
+		var err error
+		reason, err = protocol.Verify(c.opts.Secret, "kick", msg.Topic(), reason)
+		if err != nil {
+			fmt.Printf("Ignoring kick ..: %s\n", err.Error())
+			return
+		}
+	}
+
+	c.setStatus("disconnected: %s", reason)
+	go client.Disconnect(250)
+}
+
+// onExpire is called when the server expires our tunnels, as they've not
+// received any requests for longer than its operator permits.
+//
+// We either re-register them, if we should, or disconnect as if we'd been
+// kicked, and let those awaiting Expired know.
+func (c *Client) onExpire(client MQTT.Client, msg MQTT.Message) {
+
+	reason := msg.Payload()
+	if c.opts.Secret != "" {
+		var err error
+		reason, err = protocol.Verify(c.opts.Secret, "expire", msg.Topic(), reason)
+		if err != nil {
+			fmt.Printf("Ignoring expiry ..: %s\n", err.Error())
+			return
+		}
+	}
+
+	if c.opts.Reregister {
+		c.statusMutex.Lock()
+		reg := c.registration
+		c.statusMutex.Unlock()
+
+		reg.Connected = time.Now()
+		go c.announce(client, reg)
+		c.setStatus("re-registered: %s", reason)
+		return
+	}
+
+	c.setStatus("expired: %s", reason)
+	c.expiredOnce.Do(func() { close(c.expired) })
+	go client.Disconnect(250)
+}
+
+// Expired returns a channel which is closed if the server expires our
+// tunnels, and we're not re-registering them.
+func (c *Client) Expired() <-chan struct{} {
+	return c.expired
+}
+
+// heartbeat republishes our registration at the interval given by our
+// options, whilst we're connected, until we're closed.
+func (c *Client) heartbeat() {
+
+	ticker := time.NewTicker(c.opts.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.statusMutex.Lock()
+		out := c.presence
+		reg := c.registration
+		c.statusMutex.Unlock()
+
+		//
+		// Our proof must be recent, so we make a new one each time,
+		// and our signature covers the topic, so we can't reuse the
+		// one our presence carries.
+		//
+		topic := "clients/" + protocol.TopicLevel(c.ID()) + "/heartbeat"
+		if out != nil && (c.opts.Token != "" || c.opts.Secret != "") {
+			out, _ = c.marshalRegistration(reg, "heartbeat", topic)
+		}
+
+		if out != nil && c.mq.IsConnected() {
+			c.mq.Publish(topic, 0, false, out)
+		}
+	}
+}
+
+// reconnect attempts to re-establish our connection to the MQ-host,
+// backing off exponentially between failed attempts.
+//
+// Once we're connected again onConnect will restore our subscription.
+func (c *Client) reconnect(client MQTT.Client) {
+
+	delay := time.Second
+	attempt := 1
+
+	for {
+		c.setStatus("reconnecting (attempt %d)", attempt)
+
+		token := client.Connect()
+		if token.Wait() && token.Error() == nil {
+			c.metrics.reconnected()
+			return
+		}
+
+		c.setStatus("reconnection failed, retrying in %s: %s", delay, token.Error())
+		time.Sleep(delay)
+
+		//
+		// Double the delay, up to our limit.
+		//
+		delay *= 2
+		if delay > c.opts.ReconnectMax {
+			delay = c.opts.ReconnectMax
+		}
+		attempt++
+	}
+}
+
+// onMessage is called when a message is received upon the MQ-topic we're
+// watching for the given tunnel.
+//
+// We have to perform the HTTP-fetch which is contained within the message,
+// and submit the result back to that same topic.
+func (c *Client) onMessage(t *tunnel, client MQTT.Client, msg MQTT.Message) {
+
+	//
+	// Get the text of the request.
+	//
+	fetch := msg.Payload()
+
+	//
+	// The server may have split the request into several parts, in
+	// which case we wait until we've received them all.
+	//
+	if protocol.IsChunk(fetch) {
+		var err error
+		fetch, err = c.chunks.Add(c.opts.Secret, msg.Topic(), fetch)
+		if err != nil {
+			fmt.Printf("Ignoring request ..: %s\n", err.Error())
+			return
+		}
+		if fetch == nil {
+			return
+		}
+	}
+
+	//
+	// If this is one of our replies ignore it.
+	//
+	// Because we receive requests and post the replies upon the
+	// same topic we make sure that our replies are prefixed with
+	// `X-`, this means we can avoid processing the requests that
+	// we sent ourselves.
+	//
+	if strings.HasPrefix(string(fetch), "X-") {
+		return
+	}
+
+	//
+	// If we share a secret with the server then the request must be
+	// signed with it, otherwise somebody else might be trying to
+	// probe our network.
+	//
+	if c.opts.Secret != "" {
+		var err error
+		fetch, err = protocol.Verify(c.opts.Secret, "request", msg.Topic(), fetch)
+		if err != nil {
+			fmt.Printf("Ignoring request ..: %s\n", err.Error())
+			return
+		}
+	}
+
+	//
+	// If we're using encryption then the request must be encrypted,
+	// and we'll use the same key to encrypt our reply.
+	//
+	// We never process plain-text requests in that case.
+	//
+	var key []byte
+	if c.key != nil {
+		var err error
+		fetch, key, err = protocol.UnsealRequest(c.key, fetch)
+		if err != nil {
+			fmt.Printf("Failed to decrypt ..: %s\n", err.Error())
+			return
+		}
+	}
+
+	//
+	// The server may have compressed the request.
+	//
+	fetch, err := protocol.Decompress(fetch)
+	if err != nil {
+		fmt.Printf("Failed to decompress ..: %s\n", err.Error())
+		return
+	}
+
+	//
+	// OK if it isn't one of our requests it should be a JSON-object
+	//
+	var req protocol.Request
+	err = json.Unmarshal([]byte(fetch), &req)
+	if err != nil {
+
+		//
+		// TODO: This needs better handling.
+		//
+		fmt.Printf("Failed to unmarshal ..: %s\n", err.Error())
+		return
+	}
+
+	//
+	// Let the server know we've received the request, so it needn't
+	// send it again.  We acknowledge duplicates too, as the server
+	// may have resent the request because our acknowledgement was
+	// lost.
+	//
+	if req.Ack && req.Reply != "" {
+		c.acknowledge(client, req)
+	}
+
+	//
+	// If the queue delivered this request more than once we only
+	// handle it the first time.
+	//
+	if req.ID != "" && c.handled.Seen(req.ID) {
+		return
+	}
+
+	//
+	// The queue delivers our messages one at a time, so we handle the
+	// request in the background, rather than delaying the requests
+	// which follow, and our acknowledgement of them, whilst the local
+	// service responds.
+	//
+	go c.handle(t, client, msg.Topic(), req, key)
+}
+
+// handle sends the given request, received upon the given topic, to the
+// local service the tunnel exposes, and publishes its response.
+//
+// If the request was encrypted the key it was encrypted with is given,
+// and our reply is encrypted with it too.
+func (c *Client) handle(t *tunnel, client MQTT.Client, received string, req protocol.Request, key []byte) {
+
+	var err error
+
+	//
+	// This is the result we'll publish back onto the topic in the case
+	// that we cannot successfully communicate with the local service
+	// we're trying to expose.
+	//
+	//   503 -> Service Unavailable
+	//
+	result := `HTTP/1.0 503 OK
+Content-type: text/html; charset=UTF-8
+Connection: close
+
+<!DOCTYPE html>
+<html>
+<body>
+<p>The remote server was unreachable.</p>
+</body>
+</html>`
+
+	//
+	// The request we'll send to the local service.
+	//
+	request := req.Request
+
+	//
+	// Update the Host: header, if we should.
+	//
+	// We remember the public origin the visitor used so that we can
+	// point any redirects back there.
+	//
+	public := ""
+	if t.rewriteHost {
+		request, public, err = rewriteRequest(request, t.host())
+		if err != nil {
+			fmt.Printf("Failed to rewrite request: %s\n", err.Error())
+		}
+	}
+
+	//
+	// Tell the local service where the request came from, if we should.
+	//
+	if c.opts.TunnelHeaders {
+		request, err = addMetadata(request, t.name, req)
+		if err != nil {
+			fmt.Printf("Failed to add tunnel headers: %s\n", err.Error())
+		}
+	}
+
+	//
+	// Our hooks may modify the request, or answer it themselves.
+	//
+	answer := ""
+	request, answer, err = c.hookRequest(t, request)
+
+	//
+	// Make the request to our proxied host, via HTTP/2 if it is a
+	// gRPC service.
+	//
+	var res string
+	start := time.Now()
+	switch {
+	case err != nil:
+	case answer != "":
+		res = answer
+	case t.isGRPC():
+		res, err = t.roundTripGRPC(request)
+	default:
+		res, err = t.roundTrip(request)
+	}
+	latency := time.Since(start)
+	c.metrics.record(t.name, len(request), len(res), latency, err != nil)
+
+	//
+	// OK we have a default result saved, which shows an error-page.
+	//
+	// If we didn't actually get an error then update it with the
+	// response we received.
+	//
+	if err != nil {
+		fmt.Printf("Failed to make request: %s\n", err.Error())
+	} else {
+
+		//
+		// Store the result in our string.
+		//
+		result = res
+
+		//
+		// Point any redirects back to the public origin.
+		//
+		if public != "" {
+			result, err = rewriteResponse(result, t.host(), public, t.rewriteBody)
+			if err != nil {
+				fmt.Printf("Failed to rewrite response: %s\n", err.Error())
+			}
+		}
+
+		//
+		// Let our hooks see the response of the local service.
+		//
+		if answer == "" {
+			result, err = c.hookResponse(t, request, result)
+			if err != nil {
+				fmt.Printf("Failed to run our hooks: %s\n", err.Error())
+			}
+		}
+	}
+
+	//
+	// Now we have either received a real reply from the service
+	// we're exposing, or we've got the fake one we created above.
+	//
+	// Either way record the request/response, and the HTTP-status
+	// code we received.
+	//
+
+	//
+	// The response will have "HTTP/1.x CODE OK..\n"
+	//
+	c.statsMutex.Lock()
+
+	tmp := strings.Split(result, " ")
+	if len(tmp) > 1 {
+		code := tmp[1]
+		c.stats[code]++
+	}
+
+	//
+	// Save the response, and the tunnel it was made via.
+	//
+	req.Response = result
+	req.Tunnel = t.name
+
+	//
+	// Add this request to our list of "recent requests".
+	//
+	c.requests = append(c.requests, req)
+
+	//
+	// And truncate the list, so that we don't consume all our RAM
+	// keeping everything.
+	//
+	if len(c.requests) > 5 {
+
+		// Work out how many to trim.
+		trim := len(c.requests) - 5
+
+		// Do the necessary truncation.
+		c.requests = c.requests[trim:]
+	}
+
+	c.statsMutex.Unlock()
+
+	if c.opts.OnRequest != nil {
+		c.opts.OnRequest(newEntry(t.name, req.Source, req.Request, result, start, latency))
+	}
+
+	//
+	// Send the reply back to the MQ topic, compressing it if we should.
+	//
+	// The server tells us which topic it awaits our reply upon.
+	//
+	topic := req.Reply
+	if topic == "" {
+		topic = received
+	}
+	reply := []byte(result)
+	if c.opts.Compress {
+		tmp, err := protocol.Compress(reply)
+		if err == nil {
+			reply = tmp
+		}
+	}
+
+	//
+	// Encrypt the reply, if the request was encrypted.
+	//
+	if key != nil {
+		reply, err = protocol.Seal(key, reply)
+		if err != nil {
+			fmt.Printf("Failed to encrypt ..: %s\n", err.Error())
+			return
+		}
+	}
+	//
+	// Sign the reply, if we should.
+	//
+	if c.opts.Secret != "" {
+		reply = protocol.Sign(c.opts.Secret, "reply", topic, reply)
+	}
+
+	//
+	// Split the reply into parts, if it is too large for the queue.
+	//
+	parts, err := protocol.Split(c.opts.Secret, topic, append([]byte("X-"), reply...), c.opts.ChunkSize)
+	if err != nil {
+		fmt.Printf("Failed to split our reply ..: %s\n", err.Error())
+		return
+	}
+	for _, part := range parts {
+		token := client.Publish(topic, byte(c.opts.QoS), false, part)
+		if token.Wait() && token.Error() != nil {
+			fmt.Printf("Failed to publish our reply of %d bytes ..: %s\n", len(reply), token.Error())
+			return
+		}
+	}
+}
+
+// acknowledge publishes our acknowledgement of the given request.
+func (c *Client) acknowledge(client MQTT.Client, req protocol.Request) {
+
+	ack := []byte(req.ID)
+	if c.opts.Secret != "" {
+		ack = protocol.Sign(c.opts.Secret, "ack", req.Reply, ack)
+	}
+
+	//
+	// We don't wait for the queue to accept our acknowledgement, as
+	// we're invoked by the queue, and the server resends the request
+	// should it be lost.
+	//
+	client.Publish(req.Reply, byte(c.opts.QoS), false, append([]byte("A-"), ack...))
+}
+
+//
+// Connect establishes our connection to the MQ-host.
+//
+// Once connected we'll handle requests in the background, reconnecting
+// as required, until Close is invoked.
+//
+func (c *Client) Connect() error {
+
+	//
+	// Setup the server-addresses.
+	//
+	// We connect to the first which accepts us, and when we reconnect
+	// we try them all again, in the same order, so we fail over to
+	// the others if the one we were using has gone.
+	//
+	opts := MQTT.NewClientOptions()
+	brokers := c.opts.Brokers
+	if len(brokers) == 0 {
+		brokers = []string{c.opts.Broker}
+	}
+	for _, broker := range brokers {
+		opts.AddBroker(broker)
+	}
+
+	//
+	// Set our name.
+	//
+	opts.SetClientID(c.ID())
+
+	//
+	// Once we're connected we will subscribe to the named topic.
+	//
+	opts.SetOnConnectHandler(c.onConnect)
+
+	//
+	// If we lose our connection we'll handle reconnecting ourselves,
+	// rather than relying upon the library to do so.
+	//
+	opts.SetAutoReconnect(false)
+	opts.SetConnectionLostHandler(c.onConnectionLost)
+
+	//
+	// If we vanish without saying goodbye the MQ-host will clear our
+	// presence on our behalf.
+	//
+	opts.SetWill("clients/"+protocol.TopicLevel(c.ID())+"/presence", "", byte(c.opts.QoS), c.opts.Retain)
+
+	//
+	// Ask the MQ-host to keep our subscriptions, and queue any
+	// requests, whilst we reconnect.
+	//
+	opts.SetCleanSession(!c.opts.Persistent)
+
+	//
+	// Present our certificate, and verify the MQ-server's, if we
+	// should.
+	//
+	if c.tls != nil {
+		opts.SetTLSConfig(c.tls)
+	}
+
+	//
+	// Actually establish the MQ connection.
+	//
+	c.mq = MQTT.NewClient(opts)
+	if token := c.mq.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	//
+	// Present our metrics, if we should.
+	//
+	if c.opts.Metrics != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/metrics", c.metricsHandler)
+			err := http.ListenAndServe(c.opts.Metrics, mux)
+			if err != nil {
+				fmt.Printf("Error presenting our metrics: %s\n", err.Error())
+			}
+		}()
+	}
+
+	//
+	// Let the server know we're still alive.
+	//
+	if c.opts.Heartbeat > 0 {
+		go c.heartbeat()
+	}
+	return nil
+}
+
+//
+// Close disconnects from the MQ-host.
+//
+func (c *Client) Close() {
+	close(c.done)
+	if c.mq != nil {
+		//
+		// The queue only publishes our will if we vanish, so
+		// withdraw our presence ourselves, that the server forgets
+		// us at once.
+		//
+		if c.mq.IsConnected() {
+			token := c.mq.Publish("clients/"+protocol.TopicLevel(c.ID())+"/presence", byte(c.opts.QoS), c.opts.Retain, "")
+			token.WaitTimeout(time.Second)
+		}
+		c.mq.Disconnect(250)
+	}
+}
+
+//
+// Tunnels describes the tunnels we're serving.
+//
+func (c *Client) Tunnels() []Tunnel {
+
+	var out []Tunnel
+	for _, t := range c.tunnels {
+		ent := Tunnel{Name: t.name, Expose: t.expose}
+		if t.isTCP() || t.isUDP() {
+			if port := t.getPort(); port != "" {
+				ent.Address = c.opts.Tunnel + ":" + port
+			}
+		} else {
+			ent.Address = c.address(t.name)
+		}
+		out = append(out, ent)
+	}
+	return out
+}
+
+//
+// address returns the public address of the named HTTP tunnel, which is
+// routed by its hostname, or beneath our path prefix if we have one.
+//
+func (c *Client) address(name string) string {
+
+	if c.opts.PathPrefix != "" {
+		prefix := "/" + strings.Trim(c.opts.PathPrefix, "/") + "/"
+		return "http://" + c.opts.Tunnel + prefix + name + "/"
+	}
+	return "http://" + name + "." + c.opts.Tunnel
+}
+
+//
+// Stats returns the number of responses we've sent, by their
+// HTTP-status-code.
+//
+func (c *Client) Stats() map[string]int {
+
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	out := make(map[string]int)
+	for code, count := range c.stats {
+		out[code] = count
+	}
+	return out
+}
+
+//
+// Requests returns the most recent requests we've handled, along with
+// our responses.
+//
+func (c *Client) Requests() []protocol.Request {
+
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	return append([]protocol.Request(nil), c.requests...)
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTunnels(t *testing.T) {
+
+	tunnels := []*tunnel{
+		{name: "web", expose: "localhost:3000"},
+		{name: "ssh", expose: "tcp://localhost:22", port: "9000"},
+		{name: "dns", expose: "udp://localhost:53"},
+	}
+
+	tests := []struct {
+		name     string
+		prefix   string
+		expected []string
+	}{
+		{"host", "", []string{"http://web.tunnel.example.com", "tunnel.example.com:9000", ""}},
+		{"path", "/t/", []string{"http://tunnel.example.com/t/web/", "tunnel.example.com:9000", ""}},
+		{"unslashed path", "t", []string{"http://tunnel.example.com/t/web/", "tunnel.example.com:9000", ""}},
+		{"nested path", "/a/b", []string{"http://tunnel.example.com/a/b/web/", "tunnel.example.com:9000", ""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			c := &Client{opts: Options{Tunnel: "tunnel.example.com", PathPrefix: test.prefix}, tunnels: tunnels}
+
+			var got []string
+			for _, ent := range c.Tunnels() {
+				got = append(got, ent.Address)
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+//
+// Descriptions of the requests we've handled, for our console.
+//
+// Those running the client like to see what their tunnels are doing, so
+// each request we handle may be reported via Options.OnRequest, which
+// the client sub-command uses to print a line for each, such as:
+//
+//   15:04:05 steve  203.0.113.7  GET /login  200  12ms  512B
+//
+// Totals returns the totals of our requests, for its full-screen view.
+//
+
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry describes a single request we've handled.
+type Entry struct {
+	// Time is when we received the request.
+	Time time.Time
+
+	// Tunnel is the name of the tunnel it was received upon.
+	Tunnel string
+
+	// Source is the address of the visitor who made it.
+	Source string
+
+	// Method and Path are those of the request.
+	Method string
+	Path   string
+
+	// Status is the HTTP-status of our response.
+	Status int
+
+	// Latency is how long the local service took to respond.
+	Latency time.Duration
+
+	// BytesIn and BytesOut are the size of the request, and of our
+	// response.
+	BytesIn  int
+	BytesOut int
+}
+
+// Totals holds the totals of the requests we've handled.
+type Totals struct {
+	// Requests is the number of requests we've handled, and Errors
+	// the number we failed to send to the local service.
+	Requests int64
+	Errors   int64
+
+	// BytesIn and BytesOut are the total size of the requests we've
+	// received, and the responses we've sent.
+	BytesIn  int64
+	BytesOut int64
+
+	// Latency is the average time the local service took to respond.
+	Latency time.Duration
+}
+
+// newEntry describes the given request, and our response to it.
+func newEntry(tunnel string, source string, request string, response string, start time.Time, latency time.Duration) Entry {
+
+	e := Entry{
+		Time:     start,
+		Tunnel:   tunnel,
+		Source:   source,
+		Latency:  latency,
+		BytesIn:  len(request),
+		BytesOut: len(response),
+	}
+
+	//
+	// The request begins "GET /path HTTP/1.1", and the response
+	// "HTTP/1.1 200 OK".
+	//
+	line := request
+	if i := strings.Index(line, "\n"); i >= 0 {
+		line = line[:i]
+	}
+	if f := strings.Fields(line); len(f) >= 2 {
+		e.Method, e.Path = f[0], f[1]
+	}
+
+	line = response
+	if i := strings.Index(line, "\n"); i >= 0 {
+		line = line[:i]
+	}
+	if f := strings.Fields(line); len(f) >= 2 {
+		e.Status, _ = strconv.Atoi(f[1])
+	}
+	return e
+}
+
+// String returns the line describing the request, which our console
+// prints.
+func (e Entry) String() string {
+	return fmt.Sprintf("%s %s  %s  %s %s  %d  %s  %s",
+		e.Time.Format("15:04:05"), e.Tunnel, e.Source, e.Method, e.Path,
+		e.Status, e.Latency.Round(time.Millisecond), FormatBytes(int64(e.BytesOut)))
+}
+
+// FormatBytes returns the given number of bytes in a human-readable form,
+// such as "1.5KB".
+func FormatBytes(n int64) string {
+
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for i := n / unit; i >= unit; i /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Totals returns the totals of the requests we've handled.
+func (c *Client) Totals() Totals {
+
+	m := c.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var out Totals
+	var latency float64
+	for _, t := range m.tunnels {
+		out.Requests += t.requests
+		out.Errors += t.errors
+		out.BytesIn += t.bytesIn
+		out.BytesOut += t.bytesOut
+		latency += t.latency
+	}
+	if out.Requests > 0 {
+		out.Latency = time.Duration(latency / float64(out.Requests) * float64(time.Second))
+	}
+	return out
+}
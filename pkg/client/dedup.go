@@ -0,0 +1,57 @@
+//
+// Detection of duplicate messages.
+//
+// When the queue is used with a QoS of one a message may be delivered
+// more than once, so we remember the IDs of the requests we've handled
+// recently to avoid handling them again.
+//
+
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// dedup remembers the IDs it has seen, for a limited time.
+type dedup struct {
+	// ttl is how long we remember each ID.
+	ttl time.Duration
+
+	// seen maps each ID to the time it was first seen.
+	seen map[string]time.Time
+
+	// mutex protects our map.
+	mutex sync.Mutex
+}
+
+// newDedup creates a new dedup, which remembers IDs for the given
+// duration.
+func newDedup(ttl time.Duration) *dedup {
+	return &dedup{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// Seen records the given ID, and returns true if it had already been
+// seen within our time-limit.
+func (d *dedup) Seen(id string) bool {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+
+	//
+	// Expire old entries, to bound our memory usage.
+	//
+	for k, t := range d.seen {
+		if now.Sub(t) > d.ttl {
+			delete(d.seen, k)
+		}
+	}
+
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+	d.seen[id] = now
+	return false
+}
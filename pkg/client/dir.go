@@ -0,0 +1,104 @@
+//
+// Serving a local directory.
+//
+// Rather than exposing a local web server the client may serve the files
+// within a directory itself, via "-expose dir:///path/to/public", or the
+// shorthand "-serve-dir ./public".
+//
+// Directories are served via their "index.html", if they have one, or
+// as a listing otherwise, and ranges and conditional requests work just
+// as they do with http.FileServer.  Files and directories whose names
+// begin with a period, such as ".git", are never served.
+//
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//
+// isDir returns true if this tunnel serves a local directory, which is
+// specified as "dir:///path/to/directory".
+//
+func (t *tunnel) isDir() bool {
+	return strings.HasPrefix(t.expose, "dir://")
+}
+
+//
+// checkDir ensures that the directory this tunnel serves exists.
+//
+func (t *tunnel) checkDir() error {
+
+	path := strings.TrimPrefix(t.expose, "dir://")
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+//
+// dirTransport returns the transport which serves requests from the
+// directory this tunnel exposes.
+//
+func (t *tunnel) dirTransport() *http.Transport {
+
+	fs := hiddenFS{http.Dir(strings.TrimPrefix(t.expose, "dir://"))}
+
+	tr := &http.Transport{}
+	tr.RegisterProtocol("dir", http.NewFileTransport(fs))
+	return tr
+}
+
+//
+// hiddenFS is a http.FileSystem which hides the files, and directories,
+// whose names begin with a period.
+//
+type hiddenFS struct {
+	fs http.FileSystem
+}
+
+// Open opens the named file, unless it, or any of its parents, is hidden.
+func (h hiddenFS) Open(name string) (http.File, error) {
+
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+
+	f, err := h.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return hiddenFile{f}, nil
+}
+
+//
+// hiddenFile is a http.File whose directory listings omit hidden files.
+//
+type hiddenFile struct {
+	http.File
+}
+
+// Readdir returns the entries of this directory, without those which
+// are hidden.
+func (h hiddenFile) Readdir(count int) ([]os.FileInfo, error) {
+
+	entries, err := h.File.Readdir(count)
+
+	out := entries[:0]
+	for _, ent := range entries {
+		if !strings.HasPrefix(ent.Name(), ".") {
+			out = append(out, ent)
+		}
+	}
+	return out, err
+}
@@ -0,0 +1,194 @@
+//
+// Exposing a Docker container.
+//
+// Services running within containers are often reachable only via the
+// address Docker gave the container, which changes each time it starts,
+// unless their ports are published.  So the client may expose a container
+// by name, or ID, via "-expose docker://web", or "-expose docker://web:8080"
+// to choose its port.
+//
+// We ask the Docker daemon for the container's address each time we
+// connect to it, via DOCKER_HOST or /var/run/docker.sock, so restarting
+// the container doesn't break the tunnel.  If no port is given we use the
+// one the container's image exposes, if it exposes exactly one.
+//
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dockerSocket is where the Docker daemon listens, unless DOCKER_HOST
+// says otherwise.
+const dockerSocket = "unix:///var/run/docker.sock"
+
+// dockerContainer holds the details of a container we need, as returned
+// by the Docker API.
+type dockerContainer struct {
+	State struct {
+		Running bool
+	}
+	Config struct {
+		ExposedPorts map[string]struct{}
+	}
+	HostConfig struct {
+		NetworkMode string
+	}
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+//
+// isDocker returns true if this tunnel exposes a Docker container, which
+// is specified as "docker://name", or "docker://name:port".
+//
+func (t *tunnel) isDocker() bool {
+	return strings.HasPrefix(t.expose, "docker://")
+}
+
+//
+// dockerClient returns a HTTP client which speaks to the Docker daemon,
+// along with the URL of its API.
+//
+func dockerClient() (*http.Client, string, error) {
+
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = dockerSocket
+	}
+	if os.Getenv("DOCKER_TLS_VERIFY") != "" {
+		return nil, "", errors.New("connecting to the Docker daemon via TLS is not supported")
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid DOCKER_HOST %q", host)
+	}
+
+	network, addr := "", ""
+	switch u.Scheme {
+	case "unix":
+		network, addr = "unix", u.Path
+	case "tcp":
+		network, addr = "tcp", u.Host
+	default:
+		return nil, "", fmt.Errorf("unsupported DOCKER_HOST %q", host)
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	return client, "http://docker", nil
+}
+
+//
+// dockerAddress asks the Docker daemon for the address of the container
+// this tunnel exposes, returning it as "1.2.3.4:NN".
+//
+func (t *tunnel) dockerAddress() (string, error) {
+
+	name := strings.TrimPrefix(t.expose, "docker://")
+	port := ""
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, port = name[:i], name[i+1:]
+		if _, err := strconv.Atoi(port); err != nil {
+			return "", fmt.Errorf("invalid port %q for the container %s", port, name)
+		}
+	}
+	if name == "" {
+		return "", errors.New("no container given")
+	}
+
+	client, api, err := dockerClient()
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Get(api + "/containers/" + url.PathEscape(name) + "/json")
+	if err != nil {
+		return "", fmt.Errorf("failed to reach the Docker daemon: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("no such container %s", name)
+	default:
+		return "", fmt.Errorf("failed to inspect the container %s: %s", name, res.Status)
+	}
+
+	var c dockerContainer
+	if err := json.NewDecoder(res.Body).Decode(&c); err != nil {
+		return "", fmt.Errorf("failed to inspect the container %s: %s", name, err.Error())
+	}
+	if !c.State.Running {
+		return "", fmt.Errorf("the container %s isn't running", name)
+	}
+
+	//
+	// Use the port the image exposes, if we weren't given one and
+	// there's no doubt as to which.
+	//
+	if port == "" {
+		var ports []string
+		for p := range c.Config.ExposedPorts {
+			if strings.HasSuffix(p, "/tcp") {
+				ports = append(ports, strings.TrimSuffix(p, "/tcp"))
+			}
+		}
+		sort.Slice(ports, func(i, j int) bool {
+			a, _ := strconv.Atoi(ports[i])
+			b, _ := strconv.Atoi(ports[j])
+			return a < b
+		})
+		switch len(ports) {
+		case 0:
+			return "", fmt.Errorf("the container %s exposes no ports, give one via docker://%s:port", name, name)
+		case 1:
+			port = ports[0]
+		default:
+			return "", fmt.Errorf("the container %s exposes the ports %s, choose one via docker://%s:port", name, strings.Join(ports, ", "), name)
+		}
+	}
+
+	//
+	// Containers sharing our network are reached via the loopback
+	// address, and others via the address of the first network they
+	// belong to.
+	//
+	if c.HostConfig.NetworkMode == "host" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	var networks []string
+	for n := range c.NetworkSettings.Networks {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+	for _, n := range networks {
+		if ip := c.NetworkSettings.Networks[n].IPAddress; ip != "" {
+			return net.JoinHostPort(ip, port), nil
+		}
+	}
+	return "", fmt.Errorf("the container %s has no address we can reach", name)
+}
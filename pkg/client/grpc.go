@@ -0,0 +1,68 @@
+//
+// gRPC tunnels.
+//
+// gRPC services only speak HTTP/2, and report the status of each call
+// via trailers, so we cannot simply write the plain-text request we
+// receive to them.
+//
+// Instead tunnels exposed via "-expose grpc://localhost:50051" parse
+// the request, make it via HTTP/2 (without TLS), and return the
+// response to the server in chunked-form, which carries the trailers.
+//
+// Only calls which the visitor completes before awaiting the response
+// are supported, i.e. unary and server-streaming calls.
+//
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// roundTripGRPC makes the given plain-text request to the local gRPC
+// service, and returns the plain-text response.
+func (t *tunnel) roundTripGRPC(request string) (string, error) {
+
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+	if err != nil {
+		return "", err
+	}
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host()
+
+	res, err := t.grpc.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	//
+	// The trailers are only available once the body has been read.
+	//
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	out := &http.Response{
+		StatusCode:       res.StatusCode,
+		ProtoMajor:       1,
+		ProtoMinor:       1,
+		Header:           res.Header,
+		Body:             ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength:    -1,
+		TransferEncoding: []string{"chunked"},
+		Trailer:          res.Trailer,
+	}
+
+	var buf bytes.Buffer
+	if err := out.Write(&buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
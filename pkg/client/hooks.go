@@ -0,0 +1,74 @@
+//
+// Our hooks, see pkg/hook, may inspect, modify, or answer the requests
+// we receive, and inspect or modify the responses of the local service.
+//
+// We exchange requests and responses as plain-text, so we parse them
+// before invoking the hooks, and convert them back afterwards.  That's
+// only done if there are hooks to invoke.
+//
+
+package client
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// hookRequest passes the given plain-text request to our hooks, and
+// returns the request to send, or the response to send in its place.
+func (c *Client) hookRequest(t *tunnel, request string) (string, string, error) {
+
+	if len(c.opts.Hooks) == 0 {
+		return request, "", nil
+	}
+
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+	if err != nil {
+		return request, "", err
+	}
+
+	for _, h := range c.opts.Hooks {
+		res, err := h.Request(t.name, r)
+		if err != nil {
+			return request, "", err
+		}
+		if res != nil {
+			defer res.Body.Close()
+			out, err := httputil.DumpResponse(res, true)
+			return request, string(out), err
+		}
+	}
+
+	out, err := httputil.DumpRequest(r, true)
+	return string(out), "", err
+}
+
+// hookResponse passes the given plain-text response, to the given
+// request, to our hooks, and returns the response to send.
+func (c *Client) hookResponse(t *tunnel, request string, response string) (string, error) {
+
+	if len(c.opts.Hooks) == 0 {
+		return response, nil
+	}
+
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+	if err != nil {
+		return response, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(response)), r)
+	if err != nil {
+		return response, err
+	}
+	defer res.Body.Close()
+
+	for _, h := range c.opts.Hooks {
+		if err := h.Response(t.name, r, res); err != nil {
+			return response, err
+		}
+	}
+
+	out, err := httputil.DumpResponse(res, true)
+	return string(out), err
+}
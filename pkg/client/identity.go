@@ -0,0 +1,91 @@
+//
+// Our identity.
+//
+// Tunnels which aren't given a name are given a random one, so each time
+// the client restarts the tunnel is reached via a new address.  To avoid
+// that the client may keep its identity within a file, given via the
+// Identity option, which holds:
+//
+//   * The names we generated, by the local service they expose.
+//   * The token we register with, if the server has accounts.
+//   * The private-key we use to encrypt requests and responses.
+//
+// The file is written when we first run, and reused thereafter, so that
+// restarting the client reclaims the same public addresses, unless the
+// FreshIdentity option asks us to start afresh.
+//
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// identity is the content of our identity file.
+type identity struct {
+	// Names maps each local service we expose to the name we
+	// generated for its tunnel.
+	Names map[string]string `json:"names,omitempty"`
+
+	// Token is the token we register with.
+	Token string `json:"token,omitempty"`
+
+	// Key is our private-key.
+	Key []byte `json:"key,omitempty"`
+}
+
+// loadIdentity loads our identity from the given file, returning an
+// empty identity if it doesn't yet exist, or if fresh is true.
+func loadIdentity(path string, fresh bool) (*identity, error) {
+
+	id := &identity{Names: make(map[string]string)}
+	if fresh {
+		return id, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return id, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read our identity: %s", err.Error())
+	}
+	if err := json.Unmarshal(data, id); err != nil {
+		return nil, fmt.Errorf("failed to parse our identity %s: %s", path, err.Error())
+	}
+	if id.Names == nil {
+		id.Names = make(map[string]string)
+	}
+	return id, nil
+}
+
+// save writes our identity to the given file, which only we may read as
+// it holds our token and private-key.
+func (id *identity) save(path string) error {
+
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to save our identity: %s", err.Error())
+	}
+
+	//
+	// Write a temporary file, and rename it, so that we never leave
+	// a partial identity behind.
+	//
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to save our identity: %s", err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save our identity: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+//
+// Maintenance mode.
+//
+// Whilst restarting, or deploying, the local service a client may put
+// its tunnels into maintenance mode, in which case the server answers
+// visitors itself, with a "503 Service Unavailable" page, rather than
+// relaying requests which would fail.  If several clients serve the same
+// tunnel the server sends visitors to those which aren't in maintenance.
+//
+// The client may start in maintenance mode, via -maintenance, and be
+// switched in and out of it via SetMaintenance, or by pressing "m" in
+// its GUI.
+//
+
+package client
+
+import (
+	"encoding/json"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// SetMaintenance puts the named tunnel, or every tunnel if the name is
+// empty, into maintenance mode, showing visitors the given message, or
+// takes it out of maintenance mode.
+func (c *Client) SetMaintenance(name string, on bool, message string) {
+
+	c.statusMutex.Lock()
+	for _, t := range c.tunnels {
+		if name != "" && t.name != name {
+			continue
+		}
+		if on {
+			c.maintenance[t.name] = message
+		} else {
+			delete(c.maintenance, t.name)
+		}
+	}
+	reg := c.registration
+	c.statusMutex.Unlock()
+
+	//
+	// Tell the server, if we've already announced ourselves.
+	//
+	if reg.Client != "" && c.mq.IsConnected() {
+		c.announce(c.mq, reg)
+	}
+}
+
+// Maintenance returns true if the named tunnel, or any tunnel if the
+// name is empty, is in maintenance mode.
+func (c *Client) Maintenance(name string) bool {
+
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	if name == "" {
+		return len(c.maintenance) > 0
+	}
+	_, ok := c.maintenance[name]
+	return ok
+}
+
+// announce publishes our registration, with our current maintenance
+// mode, and records it for our heartbeat.
+func (c *Client) announce(client MQTT.Client, reg protocol.Registration) {
+
+	c.statusMutex.Lock()
+	reg.Maintenance = make(map[string]string)
+	for name, msg := range c.maintenance {
+		reg.Maintenance[name] = msg
+	}
+	c.registration = reg
+	c.statusMutex.Unlock()
+
+	topic := "clients/" + protocol.TopicLevel(c.ID()) + "/presence"
+	out, err := c.marshalRegistration(reg, "presence", topic)
+	if err != nil {
+		return
+	}
+	token := client.Publish(topic, byte(c.opts.QoS), c.opts.Retain, out)
+	token.Wait()
+
+	c.statusMutex.Lock()
+	c.presence = out
+	c.statusMutex.Unlock()
+}
+
+// marshalRegistration encodes the given registration for publication
+// upon the given topic, with a new proof that we hold our token, if we
+// have one, and signed if we share a secret with the server.
+//
+// The kind should be either "presence" or "heartbeat".
+func (c *Client) marshalRegistration(reg protocol.Registration, kind string, topic string) ([]byte, error) {
+
+	if c.opts.Token != "" {
+		account, secret, _ := protocol.SplitToken(c.opts.Token)
+		reg.Account = account
+		reg.Signed = time.Now()
+		reg.Proof = protocol.TokenProof(protocol.TokenHash(secret), reg)
+	}
+
+	out, err := json.Marshal(reg)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Secret != "" {
+		out = protocol.Sign(c.opts.Secret, kind, topic, out)
+	}
+	return out, nil
+}
@@ -0,0 +1,60 @@
+//
+// Tunnel metadata headers.
+//
+// So that local services may log, and correlate, the requests they
+// receive via our tunnels we add the following headers to each request
+// before we send it to them:
+//
+//   X-Tunnel-Name         The name of the tunnel it arrived upon.
+//   X-Tunnel-Request-Id   The ID the server gave the request, which
+//                         also appears in the server's logs.
+//   X-Tunnel-Client-Ip    The address of the visitor who made it.
+//
+// Any such headers the visitor sent are removed first, so that they
+// cannot be forged.  The visitor's address is that of their connection
+// to the server, unless the server was told to trust the proxy which
+// made it, via -trusted-proxy, in which case it is taken from the
+// proxy's X-Forwarded-For header.  These headers may be disabled via
+// -tunnel-headers=false.
+//
+
+package client
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// addMetadata adds our metadata headers to the given request, which was
+// received via the given tunnel.
+func addMetadata(raw string, name string, req protocol.Request) (string, error) {
+
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		return raw, err
+	}
+
+	for key := range r.Header {
+		if strings.HasPrefix(key, "X-Tunnel-") {
+			r.Header.Del(key)
+		}
+	}
+
+	r.Header.Set("X-Tunnel-Name", name)
+	if req.ID != "" {
+		r.Header.Set("X-Tunnel-Request-Id", req.ID)
+	}
+	if req.Source != "" {
+		r.Header.Set("X-Tunnel-Client-Ip", req.Source)
+	}
+
+	out, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		return raw, err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,135 @@
+//
+// The client may present metrics, in the text-format which Prometheus
+// understands, so that those exposing services can monitor their side
+// of the tunnel independently of the server.
+//
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tunnelMetrics holds the metrics of a single tunnel.
+type tunnelMetrics struct {
+	// requests is the number of requests we've received.
+	requests int64
+
+	// errors is the number of those we failed to send to the local
+	// service.
+	errors int64
+
+	// bytesIn and bytesOut are the total size of the requests we've
+	// received, and the responses we've sent.
+	bytesIn  int64
+	bytesOut int64
+
+	// latency is the total time, in seconds, the local service took
+	// to respond.
+	latency float64
+}
+
+// metrics holds the metrics of each of our tunnels.
+type metrics struct {
+	// tunnels maps the name of each tunnel to its metrics.
+	tunnels map[string]*tunnelMetrics
+
+	// reconnects is the number of times we've reconnected to the
+	// MQ-host.
+	reconnects int64
+
+	// mutex protects our fields.
+	mutex sync.Mutex
+}
+
+// newMetrics creates a new, empty, set of metrics.
+func newMetrics() *metrics {
+	return &metrics{tunnels: make(map[string]*tunnelMetrics)}
+}
+
+// record adds a request made via the named tunnel to our metrics.
+func (m *metrics) record(name string, in int, out int, latency time.Duration, failed bool) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.tunnels[name]
+	if !ok {
+		t = &tunnelMetrics{}
+		m.tunnels[name] = t
+	}
+	t.requests++
+	if failed {
+		t.errors++
+	}
+	t.bytesIn += int64(in)
+	t.bytesOut += int64(out)
+	t.latency += latency.Seconds()
+}
+
+// reconnected records that we've reconnected to the MQ-host.
+func (m *metrics) reconnected() {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.reconnects++
+}
+
+// metricsHandler reports our metrics.
+func (c *Client) metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	m := c.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	//
+	// Sort the names, for consistent output.
+	//
+	var names []string
+	for name := range m.tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP tunneller_client_requests_total Requests received by each tunnel.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_client_requests_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "tunneller_client_requests_total{tunnel=%q} %d\n", name, m.tunnels[name].requests)
+	}
+
+	fmt.Fprintf(w, "# HELP tunneller_client_errors_total Requests which couldn't be sent to the local service.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_client_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "tunneller_client_errors_total{tunnel=%q} %d\n", name, m.tunnels[name].errors)
+	}
+
+	fmt.Fprintf(w, "# HELP tunneller_client_latency_seconds Time taken by the local service to respond.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_client_latency_seconds summary\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "tunneller_client_latency_seconds_sum{tunnel=%q} %f\n", name, m.tunnels[name].latency)
+		fmt.Fprintf(w, "tunneller_client_latency_seconds_count{tunnel=%q} %d\n", name, m.tunnels[name].requests)
+	}
+
+	fmt.Fprintf(w, "# HELP tunneller_client_bytes_in_total Bytes received by each tunnel.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_client_bytes_in_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "tunneller_client_bytes_in_total{tunnel=%q} %d\n", name, m.tunnels[name].bytesIn)
+	}
+
+	fmt.Fprintf(w, "# HELP tunneller_client_bytes_out_total Bytes sent by each tunnel.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_client_bytes_out_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "tunneller_client_bytes_out_total{tunnel=%q} %d\n", name, m.tunnels[name].bytesOut)
+	}
+
+	fmt.Fprintf(w, "# HELP tunneller_client_reconnects_total Reconnections to the MQ-host.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_client_reconnects_total counter\n")
+	fmt.Fprintf(w, "tunneller_client_reconnects_total %d\n", m.reconnects)
+}
@@ -0,0 +1,108 @@
+//
+// Rewriting of requests and responses within the client.
+//
+// Local applications often believe they're running upon localhost:3000,
+// and will issue redirects to that address.  To keep visitors upon the
+// public tunnel we can rewrite:
+//
+//  1.  The Host: header of the request we send to the local service.
+//
+//  2.  The Location: and Content-Location: headers of the response, and
+//      optionally the body of HTML responses, replacing references to the
+//      local service with the public hostname.
+//
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// rewriteRequest changes the Host: header of the given request to the
+// specified local host.
+//
+// The updated request is returned, along with the public origin which
+// the visitor used, such as "http://foo.tunnel.steve.fi".
+func rewriteRequest(raw string, host string) (string, string, error) {
+
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		return raw, "", err
+	}
+
+	//
+	// If the server told us how the visitor connected we'll use
+	// that, otherwise assume plain HTTP.
+	//
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+	}
+	public := scheme + "://" + r.Host
+
+	r.Host = host
+
+	out, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		return raw, "", err
+	}
+	return string(out), public, nil
+}
+
+// rewriteResponse replaces references to the given local host, within
+// the Location: and Content-Location: headers of the response, with the
+// public origin.
+//
+// If body is true then the body of HTML responses is updated too.
+func rewriteResponse(raw string, host string, public string, body bool) (string, error) {
+
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), nil)
+	if err != nil {
+		return raw, err
+	}
+
+	//
+	// The prefixes we'll replace.
+	//
+	r := strings.NewReplacer("http://"+host, public, "https://"+host, public)
+
+	for _, hdr := range []string{"Location", "Content-Location"} {
+		if val := res.Header.Get(hdr); val != "" {
+			res.Header.Set(hdr, r.Replace(val))
+		}
+	}
+
+	//
+	// We can only rewrite bodies we understand, which means HTML
+	// which hasn't been compressed.
+	//
+	if body &&
+		strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") &&
+		res.Header.Get("Content-Encoding") == "" {
+
+		content, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return raw, err
+		}
+
+		content = []byte(r.Replace(string(content)))
+
+		res.Body = ioutil.NopCloser(bytes.NewReader(content))
+		res.ContentLength = int64(len(content))
+		res.TransferEncoding = nil
+		res.Header.Set("Content-Length", strconv.Itoa(len(content)))
+	}
+
+	out, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		return raw, err
+	}
+	return string(out), nil
+}
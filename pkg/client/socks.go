@@ -0,0 +1,175 @@
+//
+// SOCKS5 tunnels.
+//
+// A client may expose the network it is running upon, rather than a
+// single service, via "-expose socks5://".
+//
+// The server treats these exactly like our TCP tunnels, allocating a
+// public port; the client answers the SOCKS5 handshake upon each
+// connection made to it, and dials whichever destination is named.
+//
+
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded         = 0
+	socksHostUnreachable   = 4
+	socksCommandNotSupport = 7
+	socksAddrNotSupported  = 8
+)
+
+// dialSOCKS returns a connection which speaks SOCKS5 to the remote
+// visitor; the far end of it is served by a goroutine which performs
+// the handshake and relays the data to the requested destination.
+func dialSOCKS() (net.Conn, error) {
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		serveSOCKS(remote)
+	}()
+	return local, nil
+}
+
+// serveSOCKS answers a SOCKS5 handshake upon the given connection, and
+// if it is successful relays data between it and the destination.
+func serveSOCKS(conn net.Conn) {
+
+	dest, err := socksHandshake(conn)
+	if err != nil {
+		fmt.Printf("SOCKS5 handshake failed: %s\n", err.Error())
+		return
+	}
+
+	out, err := net.DialTimeout("tcp", dest, 10*time.Second)
+	if err != nil {
+		socksReply(conn, socksHostUnreachable)
+		return
+	}
+	defer out.Close()
+
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(out, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, out)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// socksHandshake negotiates the (lack of) authentication, reads the
+// CONNECT request, and returns the destination as "host:port".
+func socksHandshake(conn net.Conn) (string, error) {
+
+	//
+	// The greeting: version, and the authentication methods offered.
+	//
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	ok := false
+	for _, m := range methods {
+		if m == socksNoAuth {
+			ok = true
+		}
+	}
+	if !ok {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	//
+	// The request: version, command, reserved, address-type.
+	//
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		socksReply(conn, socksCommandNotSupport)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if req[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+
+	case socksDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+
+	default:
+		socksReply(conn, socksAddrNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply sends the reply to a CONNECT request.  We don't reveal the
+// address we bound, which clients ignore anyway.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,96 @@
+//
+// Raw TCP tunnels.
+//
+// The server allocates a public port to each of our TCP tunnels, and
+// announces it upon "clients/$name/tcp".  The connections made to that
+// port are relayed to us, or to another client serving the tunnel, as a
+// series of Stream messages upon "clients/$name/$id/stream/down", and we
+// make a connection of our own to the service we expose for each.
+//
+
+package client
+
+import (
+	"fmt"
+	"net"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// onStream is invoked when the server sends a protocol.Stream message for one of
+// our TCP tunnels.
+func (c *Client) onStream(t *tunnel, client MQTT.Client, msg MQTT.Message) {
+
+	s, err := protocol.DecodeStream(c.opts.Secret, "stream-down", msg)
+	if err != nil {
+		fmt.Printf("Ignoring stream message ..: %s\n", err.Error())
+		return
+	}
+
+	topic := "clients/" + protocol.TopicLevel(t.name) + "/" + protocol.TopicLevel(c.ID()) + "/stream/up"
+	send := func(key []byte, s protocol.Stream) {
+		if key != nil && s.Data != nil {
+			var err error
+			s.Data, err = protocol.Seal(key, s.Data)
+			if err != nil {
+				return
+			}
+		}
+		out, err := protocol.EncodeStream(c.opts.Secret, "stream-up", topic, s)
+		if err == nil {
+			token := client.Publish(topic, byte(c.opts.QoS), false, out)
+			token.Wait()
+		}
+	}
+
+	switch s.Kind {
+	case "open":
+		//
+		// If we're using encryption then the connection must be
+		// encrypted too, with the key the server opened it with.
+		//
+		var key []byte
+		if c.key != nil {
+			key, err = protocol.SessionKey(c.key, s.Key)
+			if err != nil {
+				fmt.Printf("Failed to decrypt ..: %s\n", err.Error())
+			}
+		} else if s.Key != nil {
+			err = fmt.Errorf("the server encrypted a connection we didn't ask it to")
+		}
+
+		var conn net.Conn
+		if err == nil {
+			conn, err = t.dial()
+		}
+		if err != nil {
+			go send(nil, protocol.Stream{ID: s.ID, Kind: "close"})
+			return
+		}
+		c.streams.Add(s.ID, conn, key)
+		go c.streams.Pump(s.ID, conn, func(s protocol.Stream) {
+			send(key, s)
+		})
+
+	case "data":
+		data := s.Data
+		if key := c.streams.Key(s.ID); key != nil {
+			data, err = protocol.Unseal(key, data)
+			if err != nil {
+				fmt.Printf("Failed to decrypt ..: %s\n", err.Error())
+				return
+			}
+		}
+		c.streams.Write(s.ID, data)
+
+	case "close":
+		c.streams.Remove(s.ID)
+	}
+}
+
+// onPort is invoked when the server announces the port it has allocated
+// to one of our TCP, or UDP, tunnels.
+func (c *Client) onPort(t *tunnel, client MQTT.Client, msg MQTT.Message) {
+	t.setPort(string(msg.Payload()))
+}
@@ -0,0 +1,99 @@
+//
+// Connections to the local services.
+//
+// Rather than dialing the local service for each request we make them
+// via a http.Transport, which keeps a pool of idle connections alive
+// for reuse.  This avoids the latency of connecting, and of the TLS
+// handshake, for each request.
+//
+// The size of the pool, and how long idle connections are kept, may be
+// set via -pool-size and -pool-idle.
+//
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// setupTransport creates the transport which this tunnel uses to make
+// requests, pooling up to size idle connections for the given time.
+//
+// A size of zero disables the pooling of connections.
+func (t *tunnel) setupTransport(size int, idle time.Duration) {
+
+	//
+	// gRPC services speak HTTP/2, over which requests are multiplexed
+	// upon a single connection.
+	//
+	if t.isGRPC() {
+		t.grpc = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return t.dial()
+			},
+		}
+		return
+	}
+
+	//
+	// Local directories are served by a transport of their own.
+	//
+	if t.isDir() {
+		t.transport = t.dirTransport()
+		return
+	}
+
+	//
+	// We dial the local service ourselves, so that we can reach it
+	// via a unix-domain socket, or TLS, and the transport can treat
+	// each connection as plain HTTP.
+	//
+	t.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return t.dial()
+		},
+		MaxIdleConns:        size,
+		MaxIdleConnsPerHost: size,
+		IdleConnTimeout:     idle,
+		DisableKeepAlives:   size == 0,
+		DisableCompression:  true,
+	}
+}
+
+// roundTrip makes the given plain-text request to the local service,
+// and returns the plain-text response.
+func (t *tunnel) roundTrip(request string) (string, error) {
+
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+	if err != nil {
+		return "", err
+	}
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host()
+	if t.isDir() {
+		req.URL.Scheme = "dir"
+	}
+
+	res, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	out, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
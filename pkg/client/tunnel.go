@@ -0,0 +1,204 @@
+//
+// A client may expose several services, each of which is reached via a
+// tunnel of its own.
+//
+
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+//
+// tunnel holds the details of a single service we're exposing.
+//
+type tunnel struct {
+
+	//
+	// The name we'll access this resource via.
+	//
+	name string
+
+	//
+	// The service to expose, expressed as 1.2.3.4:NN, as the path
+	// to a Unix domain socket "unix:///path/to/socket", as a
+	// TLS-enabled service "https://1.2.3.4:NN", as a directory to
+	// serve "dir:///path/to/directory", or as a Docker container
+	// "docker://name:NN".
+	//
+	expose string
+
+	//
+	// The server-name to send, via SNI, when the service is
+	// using TLS.  If empty the host from `expose` is used.
+	//
+	sni string
+
+	//
+	// Should we skip verifying the certificate of a service using TLS?
+	//
+	insecure bool
+
+	//
+	// Should we rewrite the Host: header of requests, and the
+	// Location: header of responses?
+	//
+	rewriteHost bool
+
+	//
+	// Should we rewrite the bodies of HTML responses too?
+	//
+	rewriteBody bool
+
+	//
+	// The public port the server allocated to us, if we're relaying
+	// a raw TCP, or UDP, service.
+	//
+	port string
+
+	//
+	// Lock for our port.
+	//
+	portMutex sync.Mutex
+
+	//
+	// The transport we make requests via, which keeps a pool of
+	// connections to the local service.
+	//
+	transport *http.Transport
+
+	//
+	// The transport we make requests to gRPC services via.
+	//
+	grpc *http2.Transport
+}
+
+//
+// isTCP returns true if this tunnel relays a raw TCP service, which is
+// specified as "tcp://1.2.3.4:NN".
+//
+// SOCKS5 tunnels are relayed in the same way.
+//
+func (t *tunnel) isTCP() bool {
+	return strings.HasPrefix(t.expose, "tcp://") || t.isSOCKS()
+}
+
+//
+// isSOCKS returns true if this tunnel exposes our network via SOCKS5,
+// which is specified as "socks5://".
+//
+func (t *tunnel) isSOCKS() bool {
+	return strings.HasPrefix(t.expose, "socks5://")
+}
+
+//
+// isUDP returns true if this tunnel relays a UDP service, which is
+// specified as "udp://1.2.3.4:NN".
+//
+func (t *tunnel) isUDP() bool {
+	return strings.HasPrefix(t.expose, "udp://")
+}
+
+//
+// isGRPC returns true if this tunnel exposes a gRPC service, which is
+// specified as "grpc://1.2.3.4:NN".
+//
+func (t *tunnel) isGRPC() bool {
+	return strings.HasPrefix(t.expose, "grpc://")
+}
+
+//
+// setPort records the public port the server allocated to us.
+//
+func (t *tunnel) setPort(port string) {
+	t.portMutex.Lock()
+	t.port = port
+	t.portMutex.Unlock()
+}
+
+//
+// getPort returns the public port the server allocated to us.
+//
+func (t *tunnel) getPort() string {
+	t.portMutex.Lock()
+	defer t.portMutex.Unlock()
+	return t.port
+}
+
+//
+// host returns the name of the local service, as it expects to see
+// it in the Host: header of the requests it receives.
+//
+func (t *tunnel) host() string {
+
+	switch {
+	case strings.HasPrefix(t.expose, "unix://"), t.isDir(), t.isDocker():
+		return "localhost"
+	case strings.HasPrefix(t.expose, "https://"):
+		if t.sni != "" {
+			return t.sni
+		}
+		return strings.TrimPrefix(t.expose, "https://")
+	case t.isGRPC():
+		return strings.TrimPrefix(t.expose, "grpc://")
+	default:
+		return strings.TrimPrefix(t.expose, "http://")
+	}
+}
+
+//
+// dial opens a connection to the local service this tunnel exposes.
+//
+func (t *tunnel) dial() (net.Conn, error) {
+
+	d := net.Dialer{}
+
+	switch {
+	case strings.HasPrefix(t.expose, "unix://"):
+		return d.Dial("unix", strings.TrimPrefix(t.expose, "unix://"))
+
+	case strings.HasPrefix(t.expose, "https://"):
+		addr := strings.TrimPrefix(t.expose, "https://")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "443")
+		}
+
+		name := t.sni
+		if name == "" {
+			name, _, _ = net.SplitHostPort(addr)
+		}
+
+		return tls.DialWithDialer(&d, "tcp", addr, &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: t.insecure,
+		})
+
+	case strings.HasPrefix(t.expose, "tcp://"):
+		return d.Dial("tcp", strings.TrimPrefix(t.expose, "tcp://"))
+
+	case strings.HasPrefix(t.expose, "udp://"):
+		return d.Dial("udp", strings.TrimPrefix(t.expose, "udp://"))
+
+	case t.isSOCKS():
+		return dialSOCKS()
+
+	case t.isGRPC():
+		return d.Dial("tcp", strings.TrimPrefix(t.expose, "grpc://"))
+
+	case t.isDocker():
+		addr, err := t.dockerAddress()
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial("tcp", addr)
+
+	default:
+		return d.Dial("tcp", strings.TrimPrefix(t.expose, "http://"))
+	}
+}
@@ -0,0 +1,109 @@
+//
+// UDP tunnels.
+//
+// The server allocates a public port to each of our UDP tunnels, and
+// relays the datagrams sent to it upon "clients/$name/$id/datagram/down".
+//
+// We send each to our service from a socket dedicated to the visitor
+// who sent it, and relay any replies upon "clients/$name/$id/datagram/up"
+// until the socket has been idle for a while.
+//
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// udpIdle is the length of time after which we forget about a visitor
+// who has sent us nothing.
+const udpIdle = 2 * time.Minute
+
+// onDatagram is invoked when the server relays a datagram for one of
+// our UDP tunnels.
+func (c *Client) onDatagram(t *tunnel, client MQTT.Client, msg MQTT.Message) {
+
+	s, err := protocol.DecodeStream(c.opts.Secret, "datagram-down", msg)
+	if err != nil {
+		fmt.Printf("Ignoring datagram ..: %s\n", err.Error())
+		return
+	}
+
+	//
+	// If we're using encryption then the datagram must be encrypted,
+	// with the key the server generated for the visitor.
+	//
+	var key []byte
+	data := s.Data
+	if c.key != nil {
+		key, err = protocol.SessionKey(c.key, s.Key)
+		if err == nil {
+			data, err = protocol.Unseal(key, data)
+		}
+		if err != nil {
+			fmt.Printf("Failed to decrypt ..: %s\n", err.Error())
+			return
+		}
+	} else if s.Key != nil {
+		fmt.Printf("Ignoring datagram ..: the server encrypted a datagram we didn't ask it to\n")
+		return
+	}
+
+	//
+	// Each visitor gets their own socket, so that we can tell which
+	// of them the replies are for.
+	//
+	id := t.name + "/" + s.ID
+	conn := c.streams.Get(id)
+	if conn == nil {
+		conn, err = t.dial()
+		if err != nil {
+			return
+		}
+		c.streams.Add(id, conn, key)
+		go c.relayDatagrams(t, client, id, s.ID, conn)
+	} else if key != nil && !bytes.Equal(key, c.streams.Key(id)) {
+		c.streams.SetKey(id, key)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(udpIdle))
+	c.streams.Write(id, data)
+}
+
+// relayDatagrams sends the replies our service makes to a visitor back
+// to the server, until the visitor has been idle for too long.
+func (c *Client) relayDatagrams(t *tunnel, client MQTT.Client, id string, visitor string, conn net.Conn) {
+
+	topic := "clients/" + protocol.TopicLevel(t.name) + "/" + protocol.TopicLevel(c.ID()) + "/datagram/up"
+	buf := make([]byte, 65535)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+
+		data := buf[:n]
+		if key := c.streams.Key(id); key != nil {
+			data, err = protocol.Seal(key, data)
+			if err != nil {
+				continue
+			}
+		}
+
+		out, err := protocol.EncodeStream(c.opts.Secret, "datagram-up", topic, protocol.Stream{ID: visitor, Kind: "data", Data: data})
+		if err != nil {
+			continue
+		}
+		token := client.Publish(topic, byte(c.opts.QoS), false, out)
+		token.Wait()
+	}
+
+	c.streams.Remove(id)
+}
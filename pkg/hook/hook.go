@@ -0,0 +1,90 @@
+// Package hook allows requests and responses to be inspected, modified,
+// or answered, as they pass through the server or the client.
+//
+// Programs which embed the server, or the client, may set the Hooks
+// field of their options directly.  The tunneller binary loads them from
+// Go plugins, given via -plugin, which must export a variable named
+// "Hook":
+//
+//   package main
+//
+//   var Hook hook.Hook = hook.Funcs{
+//       OnRequest: func(tunnel string, r *http.Request) (*http.Response, error) {
+//           if strings.HasPrefix(r.URL.Path, "/admin") {
+//               return hook.Respond(r, http.StatusForbidden, "Forbidden\n"), nil
+//           }
+//           return nil, nil
+//       },
+//   }
+//
+// Such a plugin is built with "go build -buildmode=plugin".
+package hook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Hook is invoked with each request, and each response.
+//
+// Hooks run in the server before a request is sent to the client, and
+// in the client before it is sent to the local service.  Both handle
+// several requests at once, so hooks may be invoked concurrently.
+type Hook interface {
+	// Request is invoked with each request received by the named
+	// tunnel, which it may modify.
+	//
+	// If it returns a response then that is sent to the visitor,
+	// rather than passing the request on.
+	Request(tunnel string, r *http.Request) (*http.Response, error)
+
+	// Response is invoked with each response to a request received
+	// by the named tunnel, which it may modify.
+	Response(tunnel string, r *http.Request, res *http.Response) error
+}
+
+// Funcs implements Hook via a pair of functions, either of which may
+// be nil.
+type Funcs struct {
+	OnRequest  func(tunnel string, r *http.Request) (*http.Response, error)
+	OnResponse func(tunnel string, r *http.Request, res *http.Response) error
+}
+
+// Request invokes OnRequest, if set.
+func (f Funcs) Request(tunnel string, r *http.Request) (*http.Response, error) {
+	if f.OnRequest == nil {
+		return nil, nil
+	}
+	return f.OnRequest(tunnel, r)
+}
+
+// Response invokes OnResponse, if set.
+func (f Funcs) Response(tunnel string, r *http.Request, res *http.Response) error {
+	if f.OnResponse == nil {
+		return nil
+	}
+	return f.OnResponse(tunnel, r, res)
+}
+
+// Respond returns a plain-text response to the given request, with the
+// given status-code and body, for hooks which answer requests.
+func Respond(r *http.Request, status int, body string) *http.Response {
+
+	header := make(http.Header)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
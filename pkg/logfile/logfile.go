@@ -0,0 +1,138 @@
+// Package logfile writes logs which are rotated as they grow large, or
+// old.
+//
+// The daemon's log, see -log-file, and the server's audit log, see
+// -audit-log, are rotated by renaming "foo.log" to "foo.log.1", and any
+// existing "foo.log.1" to "foo.log.2", and so on, removing the oldest
+// once we have as many as we should keep.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// File is a log file, which is rotated as required.
+type File struct {
+	// path is the name of the file we write to, and perm the
+	// permissions we create it with.
+	path string
+	perm os.FileMode
+
+	// maxSize and maxAge are the size, and age, after which we rotate
+	// the log, with zero meaning there is no limit.
+	maxSize int64
+	maxAge  time.Duration
+
+	// keep is the number of rotated logs to keep.
+	keep int
+
+	// file is the log we're currently writing.
+	file *os.File
+
+	// size is the size of that file, and opened the time at which we
+	// opened it.
+	size   int64
+	opened time.Time
+
+	// mutex serializes our writes.
+	mutex sync.Mutex
+}
+
+// Open opens the given log for appending, creating it with the given
+// permissions if need be.
+func Open(path string, perm os.FileMode, maxSize int64, maxAge time.Duration, keep int) (*File, error) {
+
+	f := &File{
+		path:    path,
+		perm:    perm,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		keep:    keep,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens our log, for appending.
+//
+// The caller must hold the mutex, if we're in use.
+func (f *File) open() error {
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.perm)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// rotate renames our log, and those rotated previously, and opens a
+// fresh one.
+//
+// The caller must hold the mutex.
+func (f *File) rotate() error {
+
+	f.file.Close()
+
+	name := func(n int) string {
+		return fmt.Sprintf("%s.%d", f.path, n)
+	}
+
+	os.Remove(name(f.keep))
+	for n := f.keep - 1; n >= 1; n-- {
+		os.Rename(name(n), name(n+1))
+	}
+	if f.keep > 0 {
+		os.Rename(f.path, name(1))
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+// Write appends the given data to our log, rotating it first if it has
+// grown too large, or too old.
+//
+// The data is never split between two files, so each call should be
+// given whole lines.
+func (f *File) Write(p []byte) (int, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.size > 0 {
+		tooBig := f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize
+		tooOld := f.maxAge > 0 && time.Since(f.opened) > f.maxAge
+		if tooBig || tooOld {
+			if err := f.rotate(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes our log.
+func (f *File) Close() error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.file.Close()
+}
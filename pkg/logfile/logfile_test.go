@@ -0,0 +1,68 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotate(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.log")
+
+	f, err := Open(path, 0640, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{path, "four\nfive\n"},
+		{path + ".1", "three\n"},
+		{path + ".2", "one\ntwo\n"},
+	}
+
+	for _, test := range tests {
+		data, err := os.ReadFile(test.name)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(data) != test.expected {
+			t.Fatalf("%s: expected %q, got %q", test.name, test.expected, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only two rotated logs to be kept")
+	}
+}
+
+func TestRotateAge(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.log")
+
+	f, err := Open(path, 0640, 0, time.Hour, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("old\n"))
+	f.opened = time.Now().Add(-2 * time.Hour)
+	f.Write([]byte("new\n"))
+
+	data, _ := os.ReadFile(path)
+	rotated, _ := os.ReadFile(path + ".1")
+	if string(data) != "new\n" || string(rotated) != "old\n" {
+		t.Fatalf("unexpected logs %q and %q", data, rotated)
+	}
+}
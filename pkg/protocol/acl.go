@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseCIDR parses the given network, which may also be a single
+// IP address.
+func ParseCIDR(network string) (*net.IPNet, error) {
+
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %s", network)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(network)
+	return n, err
+}
+
+// inNetworks returns true if the IP is within any of the given networks.
+//
+// Networks which cannot be parsed are ignored.
+func inNetworks(ip net.IP, networks []string) bool {
+
+	for _, network := range networks {
+		n, err := ParseCIDR(network)
+		if err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permitted returns true if a visitor from the given IP address may
+// access the tunnel(s) of this registration.
+//
+// Visitors within the Deny list are always rejected, and if there is an
+// Allow list then visitors must be within it.
+func (r *Registration) Permitted(ip net.IP) bool {
+
+	if ip == nil {
+		return len(r.Allow) == 0 && len(r.Deny) == 0
+	}
+	if inNetworks(ip, r.Deny) {
+		return false
+	}
+	if len(r.Allow) > 0 {
+		return inNetworks(ip, r.Allow)
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+//
+// A client may require visitors to present HTTP Basic credentials, which
+// the server checks before forwarding their requests.
+//
+// The client's registration is retained by the queue, and readable by
+// anybody who may subscribe to it, so it doesn't hold the credentials.
+// Instead it holds a verifier: the output of PBKDF2-HMAC-SHA256, applied
+// to "username:password" with a salt the client generates randomly, and
+// enough iterations to make guessing the password expensive:
+//
+//   pbkdf2-sha256$100000$<salt>$<key>
+//
+// The salt and key are encoded as unpadded base64.
+//
+
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// authScheme identifies our verifiers.
+	authScheme = "pbkdf2-sha256"
+
+	// authIterations is the number of iterations of PBKDF2 we use, and
+	// the only number we accept, so that verifiers can neither be made
+	// cheap to guess, nor expensive for the server to check.
+	authIterations = 100000
+
+	// authSaltSize is the length of the salts we generate.
+	authSaltSize = 16
+)
+
+// AuthVerifier returns the value of Registration.Auth for the given
+// username and password, with a new, random, salt.
+func AuthVerifier(user string, pass string) (string, error) {
+
+	salt := make([]byte, authSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2([]byte(user+":"+pass), salt, authIterations, sha256.Size)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", authScheme, authIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// CheckAuth returns true if the given username and password match the
+// given verifier, which was returned by AuthVerifier.
+func CheckAuth(verifier string, user string, pass string) bool {
+
+	fields := strings.Split(verifier, "$")
+	if len(fields) != 4 || fields[0] != authScheme {
+		return false
+	}
+	iter, err := strconv.Atoi(fields[1])
+	if err != nil || iter != authIterations {
+		return false
+	}
+
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(fields[2])
+	if err != nil || len(salt) == 0 {
+		return false
+	}
+	key, err := enc.DecodeString(fields[3])
+	if err != nil || len(key) != sha256.Size {
+		return false
+	}
+
+	got := pbkdf2([]byte(user+":"+pass), salt, iter, len(key))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
+
+// pbkdf2 derives a key of the given length from the password and salt,
+// as described in RFC 8018, using HMAC-SHA256.
+func pbkdf2(password []byte, salt []byte, iter int, length int) []byte {
+
+	prf := hmac.New(sha256.New, password)
+
+	var out []byte
+	var block [4]byte
+	for n := uint32(1); len(out) < length; n++ {
+
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(block[:], n)
+		prf.Write(block[:])
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:length]
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+
+	//
+	// The test vectors of RFC 7914, and RFC 7677.
+	//
+	tests := []struct {
+		password string
+		salt     string
+		iter     int
+		length   int
+		key      string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, test := range tests {
+		got := hex.EncodeToString(pbkdf2([]byte(test.password), []byte(test.salt), test.iter, test.length))
+		if got != test.key {
+			t.Fatalf("PBKDF2(%q, %q, %d): expected %s, got %s", test.password, test.salt, test.iter, test.key, got)
+		}
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+
+	verifier, err := AuthVerifier("alice", "secret:with:colons")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(verifier, "secret") {
+		t.Fatalf("the verifier contains the password: %s", verifier)
+	}
+
+	//
+	// The salt differs each time.
+	//
+	again, err := AuthVerifier("alice", "secret:with:colons")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if again == verifier {
+		t.Fatalf("expected a different salt each time")
+	}
+
+	fields := strings.Split(verifier, "$")
+
+	tests := []struct {
+		name     string
+		verifier string
+		user     string
+		pass     string
+		ok       bool
+	}{
+		{"match", verifier, "alice", "secret:with:colons", true},
+		{"other salt", again, "alice", "secret:with:colons", true},
+		{"wrong password", verifier, "alice", "secret", false},
+		{"wrong user", verifier, "bob", "secret:with:colons", false},
+		{"empty", "", "alice", "secret:with:colons", false},
+		{"unsalted hash", "9f3d5b7c2a1e", "alice", "secret:with:colons", false},
+		{"other scheme", "bcrypt$" + strings.Join(fields[1:], "$"), "alice", "secret:with:colons", false},
+		{"too few iterations", fields[0] + "$1$" + fields[2] + "$" + fields[3], "alice", "secret:with:colons", false},
+		{"fewer iterations", fields[0] + "$10000$" + fields[2] + "$" + fields[3], "alice", "secret:with:colons", false},
+		{"more iterations", fields[0] + "$100001$" + fields[2] + "$" + fields[3], "alice", "secret:with:colons", false},
+		{"too many iterations", fields[0] + "$999999999$" + fields[2] + "$" + fields[3], "alice", "secret:with:colons", false},
+		{"bad salt", fields[0] + "$" + fields[1] + "$!!$" + fields[3], "alice", "secret:with:colons", false},
+		{"short key", fields[0] + "$" + fields[1] + "$" + fields[2] + "$" + fields[3][:20], "alice", "secret:with:colons", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CheckAuth(test.verifier, test.user, test.pass); got != test.ok {
+				t.Fatalf("expected %t, got %t", test.ok, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+//
+// Brokers commonly limit the size of the messages they'll relay, such as
+// to 256KB, which large uploads and downloads exceed.  So the server may
+// split its requests, and the client its replies, into several parts, via
+// their -chunk-size flags, and the other side reassembles them.
+//
+// Each part begins with a header giving the ID of the message it is part
+// of, its position, and the number of parts:
+//
+//   C-0123456789abcdef:1:3:...data...
+//
+// Messages are split once they're complete, having been signed and
+// encrypted, and the message is verified again once reassembled.  Given a
+// secret each part is signed too, so that nobody else can add parts to a
+// message, and those which aren't are discarded before we hold on to
+// them.  We also limit the number of messages, and bytes, we'll hold for
+// each topic, so a sender can't exhaust our memory with parts of messages
+// it never completes.
+//
+// The server only splits the requests it sends to clients which say they
+// can reassemble them, via Registration.Chunks.
+//
+
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// chunkPrefix begins each part of a message.
+	chunkPrefix = "C-"
+
+	// MinChunkSize is the smallest size we'll split messages into, as
+	// the header of each part must fit comfortably within it.
+	MinChunkSize = 1024
+
+	// maxChunks is the largest number of parts a message may have.
+	maxChunks = 16384
+
+	// chunkTimeout is how long we wait for the remaining parts of a
+	// message, once we've received its first.
+	chunkTimeout = time.Minute
+
+	// chunkMaxPending is the number of incomplete messages we'll hold
+	// for each topic.
+	chunkMaxPending = 32
+
+	// chunkMaxBytes is the number of bytes of incomplete messages we'll
+	// hold for each topic.
+	chunkMaxBytes = 256 * 1024 * 1024
+)
+
+// IsChunk returns true if the given data is part of a larger message.
+func IsChunk(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(chunkPrefix))
+}
+
+// Split returns the parts of the given message, each of which is no
+// larger than the given size, or the message itself if it is no larger,
+// or the size is zero.
+//
+// If we have a secret each part is signed with it, for the topic it will
+// be published upon.
+func Split(secret string, topic string, data []byte, size int) ([][]byte, error) {
+
+	if size <= 0 || len(data) <= size {
+		return [][]byte{data}, nil
+	}
+	if size < MinChunkSize {
+		return nil, fmt.Errorf("the chunk size must be at least %d bytes", MinChunkSize)
+	}
+
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(raw)
+
+	//
+	// Allow for the longest header we might need.
+	//
+	room := size - len(fmt.Sprintf("%s%s:%d:%d:", chunkPrefix, id, maxChunks, maxChunks))
+	if secret != "" {
+		room -= sha256.Size
+	}
+	total := (len(data) + room - 1) / room
+	if total > maxChunks {
+		return nil, fmt.Errorf("the message of %d bytes needs more than %d parts", len(data), maxChunks)
+	}
+
+	var out [][]byte
+	for i := 0; i < total; i++ {
+		end := (i + 1) * room
+		if end > len(data) {
+			end = len(data)
+		}
+		part := []byte(fmt.Sprintf("%s%s:%d:%d:", chunkPrefix, id, i+1, total))
+		part = append(part, data[i*room:end]...)
+		if secret != "" {
+			part = Sign(secret, "chunk", topic, part)
+		}
+		out = append(out, part)
+	}
+	return out, nil
+}
+
+// partial is a message whose parts we're still receiving.
+type partial struct {
+	// topic is the topic its parts are sent upon.
+	topic string
+
+	// parts holds the data of each part, by its position.
+	parts [][]byte
+
+	// have is the number of parts we've received, and size their
+	// total length.
+	have int
+	size int
+
+	// started is when we received the first.
+	started time.Time
+}
+
+// Chunks reassembles the messages we receive in parts.
+//
+// This is used by both the client and the server.
+type Chunks struct {
+	// pending holds the messages whose parts we're receiving, by the
+	// topic they were sent upon and their ID.
+	pending map[string]*partial
+
+	// maxPending and maxBytes limit the messages we'll hold for each
+	// topic, see chunkMaxPending and chunkMaxBytes.
+	maxPending int
+	maxBytes   int
+
+	// now returns the current time.
+	now func() time.Time
+
+	// mutex protects our map.
+	mutex sync.Mutex
+}
+
+// NewChunks creates a new, empty, set of messages.
+func NewChunks() *Chunks {
+	return &Chunks{
+		pending:    make(map[string]*partial),
+		maxPending: chunkMaxPending,
+		maxBytes:   chunkMaxBytes,
+		now:        time.Now,
+	}
+}
+
+// Add records the given part of a message received upon the given topic.
+//
+// If we have a secret the part must have been signed with it, by Split.
+//
+// Once every part of the message has been received it is returned, and
+// until then the result is nil.
+func (c *Chunks) Add(secret string, topic string, data []byte) ([]byte, error) {
+
+	if secret != "" {
+		var err error
+		data, err = Verify(secret, "chunk", topic, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !IsChunk(data) {
+		return nil, errors.New("invalid chunk header")
+	}
+
+	//
+	// Parse the header.
+	//
+	fields := bytes.SplitN(data[len(chunkPrefix):], []byte(":"), 4)
+	if len(fields) != 4 {
+		return nil, errors.New("invalid chunk header")
+	}
+	seq, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return nil, errors.New("invalid chunk header")
+	}
+	total, err := strconv.Atoi(string(fields[2]))
+	if err != nil || total < 1 || total > maxChunks || seq < 1 || seq > total {
+		return nil, errors.New("invalid chunk header")
+	}
+	key := topic + " " + string(fields[0])
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	//
+	// Forget the messages whose parts have stopped arriving, and
+	// total those we're holding for this topic.
+	//
+	now := c.now()
+	pending, size := 0, 0
+	for k, p := range c.pending {
+		if now.Sub(p.started) > chunkTimeout {
+			delete(c.pending, k)
+			continue
+		}
+		if p.topic == topic {
+			pending++
+			size += p.size
+		}
+	}
+
+	p, ok := c.pending[key]
+	if !ok {
+		if pending >= c.maxPending {
+			return nil, fmt.Errorf("too many incomplete messages upon %s", topic)
+		}
+		p = &partial{topic: topic, parts: make([][]byte, total), started: now}
+		c.pending[key] = p
+	}
+	if len(p.parts) != total {
+		delete(c.pending, key)
+		return nil, errors.New("inconsistent chunk header")
+	}
+	if p.parts[seq-1] == nil {
+		if size+len(fields[3]) > c.maxBytes {
+			delete(c.pending, key)
+			return nil, fmt.Errorf("too much data of incomplete messages upon %s", topic)
+		}
+		p.parts[seq-1] = fields[3]
+		p.have++
+		p.size += len(fields[3])
+	}
+	if p.have < total {
+		return nil, nil
+	}
+
+	delete(c.pending, key)
+	return bytes.Join(p.parts, nil), nil
+}
@@ -0,0 +1,287 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// message returns a message of the given length, whose bytes differ.
+func message(n int) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(i % 251)
+	}
+	return out
+}
+
+func TestSplit(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		secret string
+		length int
+		size   int
+		parts  int
+		err    string
+	}{
+		{"no size", "", 5000, 0, 1, ""},
+		{"small message", "", 1000, 1024, 1, ""},
+		{"exact fit", "", 1024, 1024, 1, ""},
+		{"split", "", 5000, 1024, 6, ""},
+		{"split signed", "secret", 5000, 1024, 6, ""},
+		{"tiny size", "", 5000, 100, 0, "at least"},
+		{"too many parts", "", maxChunks * 1024, 1024, 0, "more than"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			parts, err := Split(test.secret, "topic", message(test.length), test.size)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(parts) != test.parts {
+				t.Fatalf("expected %d parts, got %d", test.parts, len(parts))
+			}
+			for _, part := range parts {
+				if test.size > 0 && len(part) > test.size {
+					t.Fatalf("part of %d bytes exceeds %d", len(part), test.size)
+				}
+			}
+		})
+	}
+}
+
+func TestChunksAdd(t *testing.T) {
+
+	data := message(10000)
+
+	tests := []struct {
+		name   string
+		secret string
+		order  []int
+		err    string
+	}{
+		{"in order", "", []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, ""},
+		{"reversed", "", []int{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}, ""},
+		{"shuffled", "", []int{3, 0, 9, 1, 8, 2, 7, 4, 6, 5}, ""},
+		{"duplicates", "", []int{0, 0, 1, 2, 2, 3, 4, 5, 6, 7, 8, 1, 9}, ""},
+		{"signed", "secret", []int{4, 0, 9, 1, 8, 2, 7, 3, 6, 5}, ""},
+		{"missing", "", []int{0, 1, 2, 3, 4, 5, 6, 7, 8}, "incomplete"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			parts, err := Split(test.secret, "topic", data, 1100)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(parts) != 10 {
+				t.Fatalf("expected 10 parts, got %d", len(parts))
+			}
+
+			c := NewChunks()
+			var out []byte
+			for i, n := range test.order {
+				got, err := c.Add(test.secret, "topic", parts[n])
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if got != nil {
+					if i != len(test.order)-1 {
+						t.Fatalf("message returned after %d of %d parts", i+1, len(test.order))
+					}
+					out = got
+				}
+			}
+
+			if test.err != "" {
+				if out != nil {
+					t.Fatalf("expected an incomplete message")
+				}
+				return
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("reassembled message differs")
+			}
+			if len(c.pending) != 0 {
+				t.Fatalf("expected nothing pending, got %d", len(c.pending))
+			}
+		})
+	}
+}
+
+func TestChunksInvalid(t *testing.T) {
+
+	signed, err := Split("secret", "topic", message(5000), 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tampered := append([]byte{}, signed[0]...)
+	tampered[len(tampered)-40] ^= 1
+
+	tests := []struct {
+		name   string
+		secret string
+		topic  string
+		part   []byte
+		err    string
+	}{
+		{"no header", "", "topic", []byte("C-abc"), "invalid chunk header"},
+		{"bad position", "", "topic", []byte("C-abc:x:3:data"), "invalid chunk header"},
+		{"zero position", "", "topic", []byte("C-abc:0:3:data"), "invalid chunk header"},
+		{"position beyond total", "", "topic", []byte("C-abc:4:3:data"), "invalid chunk header"},
+		{"too many parts", "", "topic", []byte("C-abc:1:99999:data"), "invalid chunk header"},
+		{"unsigned", "secret", "topic", []byte("C-abc:1:3:" + strings.Repeat("x", 40)), "invalid signature"},
+		{"short", "secret", "topic", []byte("C-abc:1:3:data"), "too short"},
+		{"tampered", "secret", "topic", tampered, "invalid signature"},
+		{"wrong secret", "other", "topic", signed[0], "invalid signature"},
+		{"wrong topic", "secret", "elsewhere", signed[0], "invalid signature"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			c := NewChunks()
+			_, err := c.Add(test.secret, test.topic, test.part)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+			if len(c.pending) != 0 {
+				t.Fatalf("expected nothing pending, got %d", len(c.pending))
+			}
+		})
+	}
+
+	//
+	// A part which disagrees upon the number of parts discards the
+	// message.
+	//
+	c := NewChunks()
+	if _, err := c.Add("", "topic", []byte("C-abc:1:3:data")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := c.Add("", "topic", []byte("C-abc:2:4:data")); err == nil || !strings.Contains(err.Error(), "inconsistent") {
+		t.Fatalf("expected an inconsistent header, got %v", err)
+	}
+	if len(c.pending) != 0 {
+		t.Fatalf("expected nothing pending, got %d", len(c.pending))
+	}
+}
+
+func TestChunksExpiry(t *testing.T) {
+
+	now := time.Now()
+	c := NewChunks()
+	c.now = func() time.Time { return now }
+
+	if _, err := c.Add("", "topic", []byte("C-abc:1:2:data")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	//
+	// Once the remaining part is overdue we forget the message, and
+	// its last part starts it anew.
+	//
+	now = now.Add(chunkTimeout + time.Second)
+	got, err := c.Add("", "topic", []byte("C-abc:2:2:data"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != nil {
+		t.Fatalf("expected the expired message to be forgotten, got %q", got)
+	}
+	if len(c.pending) != 1 {
+		t.Fatalf("expected one message pending, got %d", len(c.pending))
+	}
+
+	//
+	// Within the timeout it completes.
+	//
+	now = now.Add(chunkTimeout - time.Second)
+	got, err = c.Add("", "topic", []byte("C-abc:1:2:more"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != "moredata" {
+		t.Fatalf("unexpected message %q", got)
+	}
+}
+
+func TestChunksLimits(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		parts []string
+		topic []string
+		err   string
+	}{
+		{
+			name:  "pending messages",
+			parts: []string{"C-a:1:2:x", "C-b:1:2:x", "C-c:1:2:x"},
+			topic: []string{"one", "one", "one"},
+			err:   "too many incomplete messages",
+		},
+		{
+			name:  "pending messages of several topics",
+			parts: []string{"C-a:1:2:x", "C-b:1:2:x", "C-c:1:2:x"},
+			topic: []string{"one", "one", "two"},
+		},
+		{
+			name:  "more parts of a pending message",
+			parts: []string{"C-a:1:3:x", "C-b:1:2:x", "C-a:2:3:x"},
+			topic: []string{"one", "one", "one"},
+		},
+		{
+			name:  "bytes",
+			parts: []string{"C-a:1:3:0123456789", "C-a:2:3:0123456789", "C-b:1:2:0"},
+			topic: []string{"one", "one", "one"},
+			err:   "too much data",
+		},
+		{
+			name:  "bytes of several topics",
+			parts: []string{"C-a:1:3:0123456789", "C-a:2:3:0123456789", "C-b:1:2:0"},
+			topic: []string{"one", "one", "two"},
+		},
+		{
+			name:  "duplicates don't count",
+			parts: []string{"C-a:1:3:0123456789", "C-a:1:3:0123456789", "C-a:1:3:0123456789"},
+			topic: []string{"one", "one", "one"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			c := NewChunks()
+			c.maxPending = 2
+			c.maxBytes = 20
+
+			var err error
+			for i, part := range test.parts {
+				_, err = c.Add("", test.topic[i], []byte(part))
+				if err != nil && i != len(test.parts)-1 {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+//
+// Payloads sent over the queue may optionally be compressed, which is
+// negotiated by the client setting Registration.Compress.
+//
+// Compressed payloads are recognized by the gzip header, so we can
+// always handle both compressed and uncompressed messages.
+//
+
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Compress returns the gzip-compressed version of the given data.
+func Compress(data []byte) ([]byte, error) {
+
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isCompressed returns true if the given data is gzip-compressed.
+func isCompressed(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// Decompress returns the given data, decompressing it if necessary.
+func Decompress(data []byte) ([]byte, error) {
+
+	if !isCompressed(data) {
+		return data, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return ioutil.ReadAll(gz)
+}
@@ -0,0 +1,163 @@
+//
+// Payloads sent over the queue may optionally be encrypted, so that the
+// operator of the queue cannot read them.
+//
+// The client generates an X25519 key-pair when it launches, and
+// publishes the public half as part of its registration.  For each
+// request the server generates an ephemeral key-pair, and uses ECDH to
+// derive a key shared with the client.  The request, and the reply, are
+// then encrypted with AES-GCM using that key.
+//
+// Raw TCP connections are encrypted likewise, with a key the server
+// generates as it opens each, and UDP datagrams with a key generated
+// for each visitor.
+//
+// NOTE: This protects against eavesdropping only.  Somebody who can
+// replace the registration of a client can still read its traffic.
+//
+
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// deriveKey returns the AES-key shared between our private key, and
+// the given public key of our peer.
+func deriveKey(priv *ecdh.PrivateKey, peer []byte) ([]byte, error) {
+
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256(secret)
+	return key[:], nil
+}
+
+// newSessionKey generates an ephemeral key-pair, and uses it to derive
+// a key shared with the owner of the given public key.
+//
+// The shared key is returned, along with the public half of the
+// ephemeral key-pair which the peer needs to derive it too.
+func newSessionKey(peer []byte) ([]byte, []byte, error) {
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := deriveKey(priv, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, priv.PublicKey().Bytes(), nil
+}
+
+// NewSessionKey generates a key shared with the owner of the given public
+// key, returning it along with the public key the peer should be sent to
+// derive it too, via SessionKey.
+func NewSessionKey(peer []byte) ([]byte, []byte, error) {
+	return newSessionKey(peer)
+}
+
+// SessionKey derives the key generated by NewSessionKey, from our private
+// key and the public key we were sent.
+func SessionKey(priv *ecdh.PrivateKey, peer []byte) ([]byte, error) {
+	return deriveKey(priv, peer)
+}
+
+// Seal encrypts the data with the given key, returning the nonce
+// followed by the ciphertext.
+func Seal(key []byte, data []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// Unseal decrypts data which was encrypted via Seal.
+func Unseal(key []byte, data []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted message is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// SealRequest encrypts the given request for the client with the given
+// public key, returning the Sealed message to send it, and the key which
+// will be used to encrypt the reply.
+func SealRequest(peer []byte, request []byte) ([]byte, []byte, error) {
+
+	key, pub, err := newSessionKey(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := Seal(key, request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err := json.Marshal(Sealed{Key: pub, Data: data})
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, key, nil
+}
+
+// UnsealRequest decrypts a Sealed message, sent by the server, using
+// our private key.
+//
+// The decrypted request is returned, along with the key which should be
+// used to encrypt the reply.
+func UnsealRequest(priv *ecdh.PrivateKey, msg []byte) ([]byte, []byte, error) {
+
+	var env Sealed
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := deriveKey(priv, env.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err := Unseal(key, env.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, key, nil
+}
@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+)
+
+// newKey generates an X25519 key-pair, or fails the test.
+func newKey(t *testing.T) *ecdh.PrivateKey {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return priv
+}
+
+func TestSeal(t *testing.T) {
+
+	key := bytes.Repeat([]byte{1}, 32)
+	other := bytes.Repeat([]byte{2}, 32)
+
+	sealed, err := Seal(key, []byte("hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	again, err := Seal(key, []byte("hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Fatalf("expected a different nonce each time")
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name string
+		key  []byte
+		data []byte
+		ok   bool
+	}{
+		{"valid", key, sealed, true},
+		{"another nonce", key, again, true},
+		{"wrong key", other, sealed, false},
+		{"tampered", key, tampered, false},
+		{"truncated", key, sealed[:len(sealed)-1], false},
+		{"nonce only", key, sealed[:12], false},
+		{"too short", key, sealed[:5], false},
+		{"invalid key", key[:5], sealed, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := Unseal(test.key, test.data)
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(out) != "hello" {
+				t.Fatalf("unexpected message %q", out)
+			}
+		})
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+
+	priv := newKey(t)
+
+	key, pub, err := NewSessionKey(priv.PublicKey().Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		priv *ecdh.PrivateKey
+		peer []byte
+		same bool
+	}{
+		{"ours", priv, pub, true},
+		{"another key", newKey(t), pub, false},
+		{"another peer", priv, newKey(t).PublicKey().Bytes(), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SessionKey(test.priv, test.peer)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if bytes.Equal(got, key) != test.same {
+				t.Fatalf("expected the keys to match: %t", test.same)
+			}
+		})
+	}
+
+	if _, err := SessionKey(priv, []byte("short")); err == nil {
+		t.Fatalf("expected an invalid public key to be rejected")
+	}
+	if _, _, err := NewSessionKey(nil); err == nil {
+		t.Fatalf("expected a missing public key to be rejected")
+	}
+}
+
+func TestSealRequest(t *testing.T) {
+
+	priv := newKey(t)
+	request := []byte(`{"ID":"1"}`)
+
+	msg, key, err := SealRequest(priv.PublicKey().Bytes(), request)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if bytes.Contains(msg, request) {
+		t.Fatalf("the request was sent in the clear: %s", msg)
+	}
+
+	var env Sealed
+	if err := json.Unmarshal(msg, &env); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	env.Data[len(env.Data)-1] ^= 1
+	tampered, _ := json.Marshal(env)
+
+	tests := []struct {
+		name string
+		priv *ecdh.PrivateKey
+		msg  []byte
+		ok   bool
+	}{
+		{"valid", priv, msg, true},
+		{"another key", newKey(t), msg, false},
+		{"tampered", priv, tampered, false},
+		{"not sealed", priv, request, false},
+		{"not JSON", priv, []byte("hello"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			out, replyKey, err := UnsealRequest(test.priv, test.msg)
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(out, request) {
+				t.Fatalf("unexpected request %q", out)
+			}
+
+			//
+			// The reply is sealed with the key the server kept.
+			//
+			reply, err := Seal(replyKey, []byte("reply"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got, err := Unseal(key, reply)
+			if err != nil || string(got) != "reply" {
+				t.Fatalf("unexpected reply (%q, %v)", got, err)
+			}
+		})
+	}
+}
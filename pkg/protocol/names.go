@@ -0,0 +1,64 @@
+//
+// The names of tunnels.
+//
+// The name of a tunnel is the first label of the hostname visitors use to
+// reach it, and a level of the topics its requests are sent upon, such as
+// "clients/$name/$id".  A name containing "/", "+", or "#" would address
+// other topics, or wildcards, so names are restricted to those which are
+// valid DNS labels: lower-case letters, digits, and hyphens, up to 63
+// characters, neither beginning nor ending with a hyphen.
+//
+// The server refuses requests for invalid names, and registrations which
+// claim them, and the client refuses to serve them.  Names are escaped,
+// via TopicLevel, before they're used within a topic regardless.
+//
+
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxNameLength is the length of the longest name a tunnel may have.
+const MaxNameLength = 63
+
+// validName matches the names tunnels may have.
+var validName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidName returns true if the given name may be used by a tunnel.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// CheckName returns an error describing why the given name may not be used
+// by a tunnel, if it may not.
+func CheckName(name string) error {
+
+	if ValidName(name) {
+		return nil
+	}
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("the name %q is longer than %d characters", name, MaxNameLength)
+	}
+	return fmt.Errorf("the name %q is invalid, names may only contain lower-case letters, digits, and hyphens, which may not begin or end them", name)
+}
+
+// TopicLevel escapes the given string for use as a single level of a
+// topic, so that it cannot address another topic, or a wildcard.
+//
+// Valid names are returned unchanged.
+func TopicLevel(s string) string {
+
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '/', '+', '#', '%', 0:
+			fmt.Fprintf(&out, "%%%02X", c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
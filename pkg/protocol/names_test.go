@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"foo", true},
+		{"a", true},
+		{"0", true},
+		{"foo-bar", true},
+		{"foo--bar", true},
+		{"123", true},
+		{strings.Repeat("a", MaxNameLength), true},
+		{strings.Repeat("a", MaxNameLength+1), false},
+		{"", false},
+		{"-foo", false},
+		{"foo-", false},
+		{"-", false},
+		{"Foo", false},
+		{"foo.bar", false},
+		{"foo_bar", false},
+		{"foo/bar", false},
+		{"+", false},
+		{"#", false},
+		{"foo\n", false},
+		{"föo", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			if got := ValidName(test.name); got != test.ok {
+				t.Fatalf("expected %t, got %t", test.ok, got)
+			}
+
+			err := CheckName(test.name)
+			if (err == nil) != test.ok {
+				t.Fatalf("expected %t, got the error %v", test.ok, err)
+			}
+			if len(test.name) > MaxNameLength && !strings.Contains(err.Error(), "longer than") {
+				t.Fatalf("expected the name to be too long, got %s", err)
+			}
+		})
+	}
+}
+
+func TestTopicLevel(t *testing.T) {
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"foo", "foo"},
+		{"foo-bar", "foo-bar"},
+		{"", ""},
+		{"foo/bar", "foo%2Fbar"},
+		{"+", "%2B"},
+		{"#", "%23"},
+		{"%2F", "%252F"},
+		{"a\x00b", "a%00b"},
+		{"../x", "..%2Fx"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			if got := TopicLevel(test.in); got != test.out {
+				t.Fatalf("expected %q, got %q", test.out, got)
+			}
+		})
+	}
+
+	//
+	// Distinct strings remain distinct.
+	//
+	if TopicLevel("%2F") == TopicLevel("/") {
+		t.Fatalf("expected the escaping to be unambiguous")
+	}
+}
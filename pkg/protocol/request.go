@@ -0,0 +1,203 @@
+// Package protocol holds the messages which the server and its clients
+// exchange over the queue, and the means of compressing, encrypting, and
+// signing them.
+package protocol
+
+import (
+	"time"
+)
+
+// Request is used for the communication between the client and the
+// server.
+//
+// In our earlier releases we communicated from the server to the client
+// via the use of web-sockets.   Now we use a real queue.
+//
+// The server instructs the client of what it wants to fetch by sending an
+// instance of the request-object down the queue.  This structure contains
+// the actual request to send:
+//
+//   GET / HTTP/1.0
+//   Host: blah.tunnel.steve.fi
+//   ...
+//
+// As well as that we also send some extra data, currently that is just
+// the source IP that made the request for tracking purposes.
+//
+type Request struct {
+	// Request holds the literal HTTP-request which was received
+	// by the server and which is to be proxied to the local port.
+	Request string
+
+	// Source contains the IP-address of the client which actually
+	// made the request.
+	Source string
+
+	// Response is the response the client sent.
+	// This is only available in the client, but it is exposed here
+	// because it does no harm.
+	Response string
+
+	// ID uniquely identifies the request, so that the client can
+	// ignore it if it is delivered more than once.
+	ID string
+
+	// Reply is the topic upon which the client should publish its
+	// response.
+	Reply string
+
+	// Tunnel is the name of the tunnel the request was received upon.
+	// Like Response this is only set within the client.
+	Tunnel string
+
+	// Ack, if true, asks the client to acknowledge the request as soon
+	// as it receives it, by publishing "A-$ID" upon the Reply topic, so
+	// that the server may resend those which are lost.
+	Ack bool `json:",omitempty"`
+}
+
+// Registration is published by the client, upon the topic
+// "clients/$id/presence", every time it connects to the queue.
+//
+// A client may serve several tunnels, so the registration lists all
+// of their names.
+//
+// The message is retained by the queue, and the client configures a
+// "last will" which clears it again, so the presence of a registration
+// means that the named client is (probably!) online.
+//
+type Registration struct {
+	// Client holds the ID of the client's MQ-connection.
+	Client string
+
+	// Names holds the names of the tunnels the client is serving.
+	Names []string
+
+	// Connected records the time at which the client (re)connected.
+	Connected time.Time
+
+	// Auth, if non-empty, requires that visitors present HTTP Basic
+	// credentials before their requests are forwarded to the client.
+	//
+	// The credentials are not sent in the clear, instead this field
+	// holds a salted verifier of them, see AuthVerifier.
+	Auth string
+
+	// Allow, if non-empty, holds the networks from which visitors
+	// may access the tunnel(s), in CIDR notation.
+	Allow []string
+
+	// Deny holds the networks from which visitors may not access
+	// the tunnel(s), in CIDR notation.
+	Deny []string
+
+	// Compress, if set to "gzip", asks the server to compress the
+	// requests it sends to the client.
+	Compress string
+
+	// PublicKey, if non-empty, holds the client's X25519 public key,
+	// and asks the server to encrypt the requests it sends.
+	PublicKey []byte
+
+	// TCP holds the names of the tunnels, from Names, which relay raw
+	// TCP connections rather than HTTP-requests.
+	TCP []string
+
+	// UDP holds the names of the tunnels, from Names, which relay UDP
+	// datagrams rather than HTTP-requests.
+	UDP []string
+
+	// Sticky, if true, asks the server to send each visitor to the
+	// same client, when several serve our tunnels.
+	Sticky bool
+
+	// Heartbeat is the interval at which the client republishes its
+	// registration upon "clients/$id/heartbeat", or zero if it doesn't.
+	//
+	// The server forgets clients which miss several heartbeats, even
+	// if the queue hasn't noticed that they've gone.
+	Heartbeat time.Duration
+
+	// Maintenance holds the names of the tunnels, from Names, which are
+	// in maintenance mode, mapped to the message to show visitors, if
+	// any.  The server answers their requests itself, with a 503, if
+	// no other client serving them can.
+	Maintenance map[string]string `json:",omitempty"`
+
+	// Acks is true if the client acknowledges the requests which ask
+	// it to, see Request.Ack.
+	Acks bool `json:",omitempty"`
+
+	// Chunks is true if the client reassembles the requests which the
+	// server splits into several messages, see chunks.go.
+	Chunks bool `json:",omitempty"`
+
+	// Account, if non-empty, names the account the client registered
+	// with, and Proof shows it holds one of the account's tokens, see
+	// token.go.
+	Account string `json:",omitempty"`
+	Proof   string `json:",omitempty"`
+
+	// Signed is the time at which the client made Proof.
+	Signed time.Time
+}
+
+// IsTCP returns true if the named tunnel relays raw TCP connections.
+func (r *Registration) IsTCP(name string) bool {
+	for _, n := range r.TCP {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// InMaintenance returns true, and the message to show visitors, if the
+// named tunnel is in maintenance mode.
+func (r *Registration) InMaintenance(name string) (string, bool) {
+	msg, ok := r.Maintenance[name]
+	return msg, ok
+}
+
+// IsUDP returns true if the named tunnel relays UDP datagrams.
+func (r *Registration) IsUDP(name string) bool {
+	for _, n := range r.UDP {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Stream is used to relay a raw TCP connection over the queue.
+//
+// The server publishes these messages upon "clients/$name/$id/stream/down",
+// and the client replies upon "clients/$name/$id/stream/up".
+//
+// UDP datagrams are relayed similarly.
+type Stream struct {
+	// ID identifies the connection.
+	ID string
+
+	// Kind is one of "open", "data", or "close".
+	Kind string
+
+	// Data holds the bytes read from the connection, for "data".
+	Data []byte `json:",omitempty"`
+
+	// Key is the server's public key, sent with "open" and each
+	// datagram when the client has asked for encryption, from which
+	// the client derives the key used to encrypt Data.
+	Key []byte `json:",omitempty"`
+}
+
+// Sealed is sent by the server, in place of a Request, when the client
+// has asked for encryption.
+type Sealed struct {
+	// Key is the server's ephemeral public key, from which the client
+	// can derive the key used to encrypt Data.
+	Key []byte
+
+	// Data holds the encrypted Request.
+	Data []byte
+}
@@ -0,0 +1,53 @@
+//
+// Messages sent over the queue may be signed with a secret shared
+// between the server and the client, allowing each to be sure that the
+// messages they receive were sent by the other.
+//
+// The signature is an HMAC-SHA256 appended to the message, which covers
+// the topic the message was sent upon, and whether it was a request or a
+// reply, as well as the message itself.
+//
+
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// signature returns the HMAC of the given message.
+func signature(secret string, kind string, topic string, msg []byte) []byte {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(kind + "\n" + topic + "\n"))
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// Sign returns the message with its signature appended.
+//
+// The kind should be one of "request", "reply", or "ack".
+func Sign(secret string, kind string, topic string, msg []byte) []byte {
+
+	out := make([]byte, 0, len(msg)+sha256.Size)
+	out = append(out, msg...)
+	return append(out, signature(secret, kind, topic, msg)...)
+}
+
+// Verify checks the signature of a message which was signed via Sign,
+// returning the message without its signature.
+func Verify(secret string, kind string, topic string, signed []byte) ([]byte, error) {
+
+	if len(signed) < sha256.Size {
+		return nil, fmt.Errorf("message is too short to be signed")
+	}
+
+	msg := signed[:len(signed)-sha256.Size]
+	sig := signed[len(signed)-sha256.Size:]
+
+	if !hmac.Equal(sig, signature(secret, kind, topic, msg)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return msg, nil
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+
+	//
+	// The signature is HMAC-SHA256("secret", "request\ntopic\nhello"),
+	// computed independently.
+	//
+	signed := Sign("secret", "request", "topic", []byte("hello"))
+	if !bytes.HasPrefix(signed, []byte("hello")) {
+		t.Fatalf("expected the message to precede its signature, got %q", signed)
+	}
+	if got := hex.EncodeToString(signed[5:]); got != "7e79c5aa5af250469f99fa22a410527cea6c8e841da5bcc85c3d39f819aef2b9" {
+		t.Fatalf("unexpected signature %s", got)
+	}
+
+	tampered := append([]byte{}, signed...)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name   string
+		secret string
+		kind   string
+		topic  string
+		signed []byte
+		err    string
+	}{
+		{"valid", "secret", "request", "topic", signed, ""},
+		{"empty message", "secret", "reply", "topic", Sign("secret", "reply", "topic", nil), ""},
+		{"wrong secret", "other", "request", "topic", signed, "invalid signature"},
+		{"wrong kind", "secret", "reply", "topic", signed, "invalid signature"},
+		{"wrong topic", "secret", "request", "elsewhere", signed, "invalid signature"},
+		{"tampered", "secret", "request", "topic", tampered, "invalid signature"},
+		{"truncated", "secret", "request", "topic", signed[:len(signed)-1], "invalid signature"},
+		{"unsigned", "secret", "request", "topic", []byte("hello"), "too short"},
+		{"empty", "secret", "request", "topic", nil, "too short"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			msg, err := Verify(test.secret, test.kind, test.topic, test.signed)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(msg, test.signed[:len(test.signed)-32]) {
+				t.Fatalf("unexpected message %q", msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+//
+// Raw TCP connections, and UDP datagrams, are relayed over the queue as
+// a series of Stream messages.
+//
+// The server and the client each keep track of the connections they're
+// relaying, and pump the data they read from them into the queue.
+//
+
+package protocol
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// streamChunk is the maximum amount of data we'll send in one message.
+const streamChunk = 32 * 1024
+
+// streamQueue is the number of messages we'll hold for a connection
+// which is slow to accept them, before giving up upon it.
+const streamQueue = 256
+
+// streamLinger is how long we'll spend writing the data we hold for a
+// connection once it has been removed.
+const streamLinger = 10 * time.Second
+
+// Streams holds the connections being relayed, by their ID.
+//
+// This is used by both the client and the server.
+type Streams struct {
+	// conns maps the ID of each stream to its connection.
+	conns map[string]*stream
+
+	// mutex protects our map.
+	mutex sync.Mutex
+}
+
+// stream is a connection being relayed.
+type stream struct {
+	// conn is the connection.
+	conn net.Conn
+
+	// key, if set, is used to encrypt the data we relay.
+	key []byte
+
+	// queue holds the data waiting to be written to conn.
+	queue chan []byte
+}
+
+// NewStreams creates a new, empty, set of streams.
+func NewStreams() *Streams {
+	return &Streams{conns: make(map[string]*stream)}
+}
+
+// Add records a connection, along with the key used to encrypt the data
+// relayed for it, if any.
+func (s *Streams) Add(id string, conn net.Conn, key []byte) {
+
+	st := &stream{conn: conn, key: key, queue: make(chan []byte, streamQueue)}
+
+	s.mutex.Lock()
+	s.conns[id] = st
+	s.mutex.Unlock()
+
+	//
+	// We write to the connection in the background, so that a slow
+	// visitor doesn't hold up the messages for everybody else.
+	//
+	go func() {
+		for data := range st.queue {
+			if _, err := conn.Write(data); err != nil {
+				conn.Close()
+			}
+		}
+		conn.Close()
+	}()
+}
+
+// Get returns the connection with the given ID.
+func (s *Streams) Get(id string) net.Conn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if st, ok := s.conns[id]; ok {
+		return st.conn
+	}
+	return nil
+}
+
+// Key returns the key of the connection with the given ID.
+func (s *Streams) Key(id string) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if st, ok := s.conns[id]; ok {
+		return st.key
+	}
+	return nil
+}
+
+// SetKey replaces the key of the connection with the given ID.
+func (s *Streams) SetKey(id string, key []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if st, ok := s.conns[id]; ok {
+		st.key = key
+	}
+}
+
+// Write queues data to be written to the connection with the given ID.
+//
+// If the connection falls too far behind it is closed, which leads Pump
+// to send "close".
+func (s *Streams) Write(id string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, ok := s.conns[id]
+	if !ok {
+		return
+	}
+	select {
+	case st.queue <- data:
+	default:
+		st.conn.Close()
+	}
+}
+
+// Remove forgets the connection with the given ID, and closes it once
+// the data queued for it has been written.
+//
+// It returns false if the connection had already been removed.
+func (s *Streams) Remove(id string) bool {
+	s.mutex.Lock()
+	st, ok := s.conns[id]
+	delete(s.conns, id)
+	if ok {
+		close(st.queue)
+	}
+	s.mutex.Unlock()
+
+	if ok {
+		st.conn.SetReadDeadline(time.Now())
+		st.conn.SetWriteDeadline(time.Now().Add(streamLinger))
+	}
+	return ok
+}
+
+// Pump reads from the connection, sending each chunk read via the given
+// function, until the connection is closed.
+//
+// Finally "close" is sent, unless the other side closed it first.
+func (s *Streams) Pump(id string, conn net.Conn, send func(Stream)) {
+
+	buf := make([]byte, streamChunk)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			send(Stream{ID: id, Kind: "data", Data: data})
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if s.Remove(id) {
+		send(Stream{ID: id, Kind: "close"})
+	}
+}
+
+// EncodeStream converts a Stream message to the bytes we'll publish,
+// signing it if we have a secret.
+func EncodeStream(secret string, kind string, topic string, s Stream) ([]byte, error) {
+
+	out, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		out = Sign(secret, kind, topic, out)
+	}
+	return out, nil
+}
+
+// DecodeStream parses a received Stream message, verifying its signature
+// if we have a secret.
+func DecodeStream(secret string, kind string, msg MQTT.Message) (Stream, error) {
+
+	var s Stream
+
+	data := msg.Payload()
+	if secret != "" {
+		var err error
+		data, err = Verify(secret, kind, msg.Topic(), data)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	err := json.Unmarshal(data, &s)
+	return s, err
+}
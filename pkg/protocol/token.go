@@ -0,0 +1,94 @@
+//
+// API tokens.
+//
+// When the server has an account system each user may be issued tokens,
+// of the form "account:secret", with which their clients register.  The
+// server only stores the hash of the secret, and the client never sends
+// the token itself, as presence messages are visible to everyone using
+// the queue.  Instead each registration carries the name of the account,
+// and proof that the client holds one of its tokens: an HMAC, keyed by
+// the hash of the secret, of the whole registration, save the proof.
+//
+// Registrations are retained by the queue, and visible to everyone, so
+// the proof also covers the time at which it was made, which the server
+// requires to be recent.  Clients make a new one for each heartbeat.
+//
+
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProofWindow is how far from the current time a proof may have been
+// made, allowing for the clocks of the client and the server to differ.
+const ProofWindow = 5 * time.Minute
+
+// SplitToken splits the given token into the name of its account, and
+// its secret.
+func SplitToken(token string) (string, string, error) {
+
+	i := strings.Index(token, ":")
+	if i <= 0 || i == len(token)-1 {
+		return "", "", errors.New("tokens must be of the form account:secret")
+	}
+	return token[:i], token[i+1:], nil
+}
+
+// TokenHash returns the hash of the secret of a token, which is what the
+// server stores.
+func TokenHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenProof returns the proof, given the hash of a token's secret, that
+// its holder made the given registration.
+//
+// The proof covers every field but Proof itself, in their canonical JSON
+// encoding, so none of them may be altered.
+func TokenProof(hash string, reg Registration) string {
+
+	reg.Proof = ""
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(hash))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckProof returns true if the proof of the given registration was made
+// with the token whose secret has the given hash.
+func CheckProof(hash string, reg *Registration) bool {
+
+	proof, err := hex.DecodeString(reg.Proof)
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(TokenProof(hash, *reg))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(proof, expected)
+}
+
+// CheckSigned returns an error if the proof of the given registration
+// wasn't made within ProofWindow of the given time.
+func CheckSigned(reg *Registration, now time.Time) error {
+
+	skew := now.Sub(reg.Signed)
+	if skew > ProofWindow || skew < -ProofWindow {
+		return fmt.Errorf("the proof was made at %s, not within %s", reg.Signed.UTC().Format(time.RFC3339), ProofWindow)
+	}
+	return nil
+}
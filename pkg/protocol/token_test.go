@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckProof(t *testing.T) {
+
+	hash := TokenHash("secret")
+	reg := Registration{
+		Client:    "client",
+		Names:     []string{"foo"},
+		PublicKey: []byte("key"),
+		Account:   "alice",
+		Signed:    time.Now(),
+	}
+	reg.Proof = TokenProof(hash, reg)
+
+	tests := []struct {
+		name   string
+		hash   string
+		change func(r *Registration)
+		ok     bool
+	}{
+		{"valid", hash, func(r *Registration) {}, true},
+		{"another token", TokenHash("other"), func(r *Registration) {}, false},
+		{"another name", hash, func(r *Registration) { r.Names = []string{"bar"} }, false},
+		{"another key", hash, func(r *Registration) { r.PublicKey = []byte("mine") }, false},
+		{"another account", hash, func(r *Registration) { r.Account = "bob" }, false},
+		{"another time", hash, func(r *Registration) { r.Signed = r.Signed.Add(time.Second) }, false},
+		{"no proof", hash, func(r *Registration) { r.Proof = "" }, false},
+		{"invalid proof", hash, func(r *Registration) { r.Proof = "xyz" }, false},
+		{"truncated proof", hash, func(r *Registration) { r.Proof = r.Proof[:10] }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := reg
+			test.change(&r)
+			if got := CheckProof(test.hash, &r); got != test.ok {
+				t.Fatalf("expected %t, got %t", test.ok, got)
+			}
+		})
+	}
+}
+
+func TestCheckSigned(t *testing.T) {
+
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		signed time.Time
+		ok     bool
+	}{
+		{"now", now, true},
+		{"recently", now.Add(-ProofWindow + time.Second), true},
+		{"slightly ahead", now.Add(ProofWindow - time.Second), true},
+		{"stale", now.Add(-ProofWindow - time.Second), false},
+		{"in the future", now.Add(ProofWindow + time.Second), false},
+		{"never", time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckSigned(&Registration{Signed: test.signed}, now)
+			if (err == nil) != test.ok {
+				t.Fatalf("expected %t, got the error %v", test.ok, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "not within") {
+				t.Fatalf("unexpected error %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+//
+// Managing accounts via the admin API.
+//
+// Given -accounts-db the admin API presents:
+//
+//   GET    /accounts[?account=foo]               - List the accounts.
+//   POST   /accounts?account=foo[&email=...]     - Create an account.
+//   DELETE /accounts?account=foo                 - Delete an account.
+//
+//   GET    /tokens[?account=foo]                 - List the tokens.
+//   POST   /tokens?account=foo[&label=laptop]    - Issue a token.
+//   DELETE /tokens?id=0123abcd                   - Revoke a token.
+//
+//   GET    /names                                - List the reserved names.
+//   POST   /names?name=bar&account=foo           - Reserve a name.
+//   DELETE /names?name=bar                       - Release a name.
+//
+//   GET    /accounts/usage[?account=foo&days=31] - Report the traffic.
+//
+//   GET    /limits[?account=foo]                 - List the tokens' limits.
+//   POST   /limits?id=0123abcd&requests=1000     - Limit a token.
+//   DELETE /limits?id=0123abcd                   - Remove a token's limits.
+//
+// which "tunneller accounts" uses.  Clients registered with an account,
+// or serving a name reserved for another account, are kicked when it is
+// deleted, or the name is reserved.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// writeJSON writes the given value to the visitor, as indented JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+
+	js, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+	w.Write([]byte("\n"))
+}
+
+// accountError reports the given error to the visitor.
+func accountError(w http.ResponseWriter, err error) {
+
+	status := http.StatusBadRequest
+	if err == errNoAccount || err == errNoToken {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// withAccounts returns the given handler, if the account system is
+// enabled, or one which reports that it isn't.
+func (s *Server) withAccounts(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.accounts == nil {
+			http.Error(w, "The account system is not enabled", http.StatusNotFound)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// kickWhere kicks the clients serving the named tunnel, or every tunnel
+// if the name is empty, for which the given function returns true.
+func (s *Server) kickWhere(name string, reason string, fn func(reg *protocol.Registration) bool) {
+
+	for _, reg := range s.registry.all() {
+		for _, n := range reg.Names {
+			if (name == "" || n == name) && fn(&reg) {
+				s.disconnect(reg.Client, n, "kick", reason)
+				break
+			}
+		}
+	}
+}
+
+// accountsHandler lists, creates, and deletes accounts.
+func (s *Server) accountsHandler(w http.ResponseWriter, r *http.Request) {
+
+	account := r.FormValue("account")
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		if err := s.accounts.add(account, r.FormValue("email")); err != nil {
+			accountError(w, err)
+			return
+		}
+
+	case http.MethodDelete:
+		if err := s.accounts.remove(account); err != nil {
+			accountError(w, err)
+			return
+		}
+		s.kickWhere("", "the account was deleted", func(reg *protocol.Registration) bool {
+			return reg.Account == account
+		})
+		account = ""
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	out, err := s.accounts.list(account)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	if out == nil {
+		out = []Account{}
+	}
+	writeJSON(w, out)
+}
+
+// tokensHandler lists, issues, and revokes tokens.
+func (s *Server) tokensHandler(w http.ResponseWriter, r *http.Request) {
+
+	account := r.FormValue("account")
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		token, err := s.accounts.issue(account, r.FormValue("label"))
+		if err != nil {
+			accountError(w, err)
+			return
+		}
+
+		//
+		// This is the only time the token is available.
+		//
+		writeJSON(w, map[string]string{"Token": token})
+		return
+
+	case http.MethodDelete:
+		if err := s.accounts.revoke(r.FormValue("id")); err != nil {
+			accountError(w, err)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	out, err := s.accounts.tokens(account)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// namesHandler lists, reserves, and releases names.
+func (s *Server) namesHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := r.FormValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		account := r.FormValue("account")
+		if err := s.accounts.reserve(name, account); err != nil {
+			accountError(w, err)
+			return
+		}
+		s.kickWhere(name, fmt.Sprintf("the name %s is reserved", name), func(reg *protocol.Registration) bool {
+			return reg.Account != account
+		})
+
+	case http.MethodDelete:
+		if err := s.accounts.release(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	out, err := s.accounts.names()
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// limitsHandler lists, sets, and clears the limits of tokens, reporting
+// their use of them today.
+func (s *Server) limitsHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := r.FormValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		var l TokenLimits
+		var err error
+		if val := r.FormValue("tunnels"); val != "" {
+			l.Tunnels, err = strconv.Atoi(val)
+		}
+		if val := r.FormValue("requests"); val != "" && err == nil {
+			l.Requests, err = strconv.ParseInt(val, 10, 64)
+		}
+		if val := r.FormValue("bytes"); val != "" && err == nil {
+			l.Bytes, err = strconv.ParseInt(val, 10, 64)
+		}
+		if err != nil {
+			http.Error(w, "Invalid limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.accounts.setLimits(id, l); err != nil {
+			accountError(w, err)
+			return
+		}
+
+	case http.MethodDelete:
+		if err := s.accounts.clearLimits(id); err != nil {
+			accountError(w, err)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tunnels := make(map[string]int)
+	for token, names := range s.tokenTunnels("") {
+		tunnels[token] = len(names)
+	}
+	out, err := s.accounts.quotas(r.FormValue("account"), tunnels)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// accountUsageHandler reports the traffic of each account, by day.
+func (s *Server) accountUsageHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := 31
+	if val := r.FormValue("days"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid number of days", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	out, err := s.accounts.usage(r.FormValue("account"), days)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// errStaleProof is returned by checkRegistration if the proof of the
+// registration wasn't made recently.
+type errStaleProof struct {
+	error
+}
+
+// checkRegistration returns an error if we shouldn't accept the given
+// registration, as it names an account it cannot prove it belongs to,
+// or lacks one when we require it, serves a name reserved for another
+// account, or more tunnels than its token may.  Otherwise we record
+// the token the client registered with.
+func (s *Server) checkRegistration(reg *protocol.Registration) error {
+
+	token := ""
+	if reg.Account != "" {
+		if err := protocol.CheckSigned(reg, time.Now()); err != nil {
+			return errStaleProof{err}
+		}
+
+		var err error
+		token, err = s.accounts.authenticate(reg)
+		if err != nil {
+			return err
+		}
+		if token == "" {
+			return fmt.Errorf("invalid token for the account %s", reg.Account)
+		}
+	} else if s.opts.AccountsRequired {
+		return errors.New("a token is required to register")
+	}
+
+	for _, name := range reg.Names {
+		owner, err := s.accounts.owner(name)
+		if err != nil {
+			return err
+		}
+		if owner != "" && owner != reg.Account {
+			return fmt.Errorf("the name %s is reserved", name)
+		}
+	}
+
+	if token != "" {
+		if err := s.checkTunnels(reg, token); err != nil {
+			return err
+		}
+		s.accounts.bind(reg.Client, token)
+	}
+	return nil
+}
+
+// allowRegistration returns true if we should accept the given
+// registration, otherwise it kicks the client, telling it why.
+func (s *Server) allowRegistration(reg *protocol.Registration) bool {
+
+	err := s.checkRegistration(reg)
+	if err == nil {
+		return true
+	}
+	s.logf("Refusing the registration of client %s: %s\n", reg.Client, err.Error())
+
+	//
+	// A stale registration may have been replayed by somebody else, or
+	// retained by the queue whilst we were away, and the client will
+	// send a fresh one with its next heartbeat, so we don't kick it.
+	//
+	if _, ok := err.(errStaleProof); ok {
+		return false
+	}
+
+	name := ""
+	if len(reg.Names) > 0 {
+		name = reg.Names[0]
+	}
+
+	//
+	// We're invoked by the queue, which must not wait upon itself.
+	//
+	go s.disconnect(reg.Client, name, "kick", err.Error())
+	return false
+}
@@ -0,0 +1,508 @@
+//
+// Obtaining certificates via ACME.
+//
+// Rather than supplying a certificate the operator may ask us to obtain
+// a wildcard certificate, covering every tunnel, from an ACME CA such as
+// Let's Encrypt, via -acme-domain tunnel.example.com.
+//
+// Wildcard certificates may only be issued via the DNS-01 challenge, in
+// which we prove we control the domain by publishing TXT records beneath
+// "_acme-challenge.tunnel.example.com", so a DNS provider is required,
+// see dns.go.
+//
+// The certificate and key are written to the files given via -tls-cert
+// and -tls-key, from which they're loaded as usual, see certs.go.  We
+// obtain a certificate on startup, if those files don't hold a current
+// one, and renew it thirty days before it expires.
+//
+
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// acmeRenewBefore is how long before our certificate expires we renew it.
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// acmeDirectory holds the URLs of an ACME CA's resources.
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeOrder is a request for a certificate.
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+// acmeAuthorization holds the challenges by which we may prove that we
+// control a single name.
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+// acme obtains, and renews, our certificate.
+type acme struct {
+	// s is our server.
+	s *Server
+
+	// dns publishes the records which answer our challenges.
+	dns DNSProvider
+
+	// key is our account key, and kid the URL of our account.
+	key *ecdsa.PrivateKey
+	kid string
+
+	// dir holds the URLs of the CA's resources, and nonce the nonce
+	// to use with our next request.
+	dir   acmeDirectory
+	nonce string
+
+	// client makes our requests.
+	client *http.Client
+}
+
+// newACME creates our ACME client, loading, or creating, our account key.
+func newACME(s *Server) (*acme, error) {
+
+	opts := s.opts
+	if opts.TLSCert == "" || opts.TLSKey == "" {
+		return nil, errors.New("-acme-domain requires -tls-cert and -tls-key, to hold the certificate")
+	}
+
+	dns := opts.DNS
+	if dns == nil {
+		var err error
+		dns, err = newDNSProvider(opts.ACMEDNS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a := &acme{s: s, dns: dns, client: &http.Client{Timeout: 30 * time.Second}}
+
+	pemKey, err := ioutil.ReadFile(opts.ACMEAccountKey)
+	if err == nil {
+		a.key, err = parseECKey(pemKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading our ACME account key: %s", err.Error())
+		}
+		return a, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	a.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeECKey(opts.ACMEAccountKey, a.key); err != nil {
+		return nil, fmt.Errorf("error saving our ACME account key: %s", err.Error())
+	}
+	return a, nil
+}
+
+// parseECKey parses a PEM-encoded EC private key.
+func parseECKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// writeECKey writes the given key to the named file, PEM-encoded.
+func writeECKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// b64 encodes the given data as unpadded, URL-safe, base64.
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// pad32 returns the given P-256 coordinate, or signature half, as the
+// fixed-length big-endian bytes JWS requires.
+func pad32(n *big.Int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// jwk returns our account's public key, as a JSON Web Key, with its
+// members in the order required to compute its thumbprint.
+func (a *acme) jwk() string {
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		b64(pad32(a.key.PublicKey.X)), b64(pad32(a.key.PublicKey.Y)))
+}
+
+// thumbprint returns the thumbprint of our account key.
+func (a *acme) thumbprint() string {
+	sum := sha256.Sum256([]byte(a.jwk()))
+	return b64(sum[:])
+}
+
+// post makes a signed request to the given URL, decoding the JSON
+// response into out, if it is non-nil, and returning the response.
+//
+// A nil payload makes a "POST-as-GET" request.
+func (a *acme) post(url string, payload interface{}, out interface{}) (*http.Response, []byte, error) {
+
+	for attempt := 0; ; attempt++ {
+
+		if a.nonce == "" {
+			res, err := a.client.Head(a.dir.NewNonce)
+			if err != nil {
+				return nil, nil, err
+			}
+			res.Body.Close()
+			a.nonce = res.Header.Get("Replay-Nonce")
+		}
+
+		//
+		// Our account is identified by its key until it has been
+		// created, and by its URL thereafter.
+		//
+		protected := fmt.Sprintf(`{"alg":"ES256","nonce":%q,"url":%q,`, a.nonce, url)
+		if a.kid == "" {
+			protected += `"jwk":` + a.jwk() + `}`
+		} else {
+			protected += fmt.Sprintf(`"kid":%q}`, a.kid)
+		}
+
+		body := ""
+		if payload != nil {
+			data, err := json.Marshal(payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			body = b64(data)
+		}
+
+		signed := b64([]byte(protected)) + "." + body
+		hash := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, a.key, hash[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		sig := append(pad32(r), pad32(s)...)
+
+		msg, _ := json.Marshal(map[string]string{
+			"protected": b64([]byte(protected)),
+			"payload":   body,
+			"signature": b64(sig),
+		})
+
+		res, err := a.client.Post(url, "application/jose+json", bytes.NewReader(msg))
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		a.nonce = res.Header.Get("Replay-Nonce")
+
+		if res.StatusCode >= 400 {
+
+			var problem struct {
+				Type   string `json:"type"`
+				Detail string `json:"detail"`
+			}
+			json.Unmarshal(data, &problem)
+
+			//
+			// Our nonce may have expired, in which case we try
+			// again with the fresh one we've been given.
+			//
+			if strings.HasSuffix(problem.Type, ":badNonce") && attempt < 3 {
+				continue
+			}
+			return nil, nil, fmt.Errorf("%s: %s %s", url, res.Status, problem.Detail)
+		}
+
+		if out != nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, nil, err
+			}
+		}
+		return res, data, nil
+	}
+}
+
+// register fetches the CA's directory, and creates our account, or
+// finds it if it already exists.
+func (a *acme) register() error {
+
+	res, err := a.client.Get(a.s.opts.ACMEDirectory)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", a.s.opts.ACMEDirectory, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&a.dir); err != nil {
+		return err
+	}
+
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if a.s.opts.ACMEEmail != "" {
+		account["contact"] = []string{"mailto:" + a.s.opts.ACMEEmail}
+	}
+
+	a.kid = ""
+	res, _, err = a.post(a.dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	a.kid = res.Header.Get("Location")
+	return nil
+}
+
+// poll fetches the given resource until its status is no longer one of
+// those given, returning the final status.
+func (a *acme) poll(url string, out interface{}, status func() string, pending ...string) error {
+
+	deadline := time.Now().Add(5 * time.Minute)
+	for {
+		if _, _, err := a.post(url, nil, out); err != nil {
+			return err
+		}
+
+		waiting := false
+		for _, p := range pending {
+			if status() == p {
+				waiting = true
+			}
+		}
+		if !waiting {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: still %s", url, status())
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// obtain obtains a certificate for our domain, and its wildcard, and
+// writes it to our certificate and key files.
+func (a *acme) obtain() error {
+
+	domain := a.s.opts.ACMEDomain
+
+	if err := a.register(); err != nil {
+		return err
+	}
+
+	//
+	// Request the certificate.
+	//
+	var order acmeOrder
+	res, _, err := a.post(a.dir.NewOrder, map[string]interface{}{
+		"identifiers": []map[string]string{
+			{"type": "dns", "value": "*." + domain},
+			{"type": "dns", "value": domain},
+		},
+	}, &order)
+	if err != nil {
+		return err
+	}
+	orderURL := res.Header.Get("Location")
+
+	//
+	// Publish the records which answer each challenge, which may
+	// be several for the same name, and then wait for them to reach
+	// every nameserver before asking the CA to check them.
+	//
+	type answer struct {
+		url   string
+		authz string
+		name  string
+		value string
+	}
+	var answers []answer
+
+	defer func() {
+		for _, ans := range answers {
+			if err := a.dns.CleanUp(ans.name, ans.value); err != nil {
+				a.s.logf("Error removing the DNS record %s: %s\n", ans.name, err.Error())
+			}
+		}
+	}()
+
+	for _, url := range order.Authorizations {
+
+		var authz acmeAuthorization
+		if _, _, err := a.post(url, nil, &authz); err != nil {
+			return err
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+
+		found := false
+		for _, ch := range authz.Challenges {
+			if ch.Type != "dns-01" {
+				continue
+			}
+			sum := sha256.Sum256([]byte(ch.Token + "." + a.thumbprint()))
+			ans := answer{
+				url:   ch.URL,
+				authz: url,
+				name:  "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + ".",
+				value: b64(sum[:]),
+			}
+			if err := a.dns.Present(ans.name, ans.value); err != nil {
+				return fmt.Errorf("error publishing the DNS record %s: %s", ans.name, err.Error())
+			}
+			answers = append(answers, ans)
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+		}
+	}
+
+	if len(answers) > 0 {
+		a.s.logf("Waiting %s for our DNS records to propagate\n", a.s.opts.ACMEPropagation)
+		time.Sleep(a.s.opts.ACMEPropagation)
+	}
+
+	for _, ans := range answers {
+		if _, _, err := a.post(ans.url, struct{}{}, nil); err != nil {
+			return err
+		}
+	}
+	for _, ans := range answers {
+		var authz acmeAuthorization
+		if err := a.poll(ans.authz, &authz, func() string { return authz.Status }, "pending", "processing"); err != nil {
+			return err
+		}
+		if authz.Status != "valid" {
+			return fmt.Errorf("the CA could not validate %s: %s", ans.name, authz.Status)
+		}
+	}
+
+	//
+	// Generate our key, and ask the CA to sign it.
+	//
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "*." + domain},
+		DNSNames: []string{"*." + domain, domain},
+	}, crypto.Signer(key))
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := a.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return err
+	}
+	if err := a.poll(orderURL, &order, func() string { return order.Status }, "pending", "ready", "processing"); err != nil {
+		return err
+	}
+	if order.Status != "valid" || order.Certificate == "" {
+		return fmt.Errorf("the CA did not issue our certificate: %s", order.Status)
+	}
+
+	_, chain, err := a.post(order.Certificate, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Write the key first, as the certificate is what we check.
+	//
+	if err := writeECKey(a.s.opts.TLSKey, key); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.s.opts.TLSCert, chain, 0644)
+}
+
+// expires returns the time at which the certificate in our file expires,
+// or the zero time if there isn't a valid certificate for our domain.
+func (a *acme) expires() time.Time {
+
+	data, err := ioutil.ReadFile(a.s.opts.TLSCert)
+	if err != nil {
+		return time.Time{}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || cert.VerifyHostname("*."+a.s.opts.ACMEDomain) != nil {
+		return time.Time{}
+	}
+	return cert.NotAfter
+}
+
+// ensure obtains a certificate, if we don't have one which will remain
+// valid for a while.
+func (a *acme) ensure() error {
+
+	if time.Until(a.expires()) > acmeRenewBefore {
+		return nil
+	}
+
+	a.s.logf("Obtaining a certificate for *.%s\n", a.s.opts.ACMEDomain)
+	if err := a.obtain(); err != nil {
+		return err
+	}
+	a.s.logf("Obtained a certificate for *.%s\n", a.s.opts.ACMEDomain)
+	return nil
+}
+
+// watch renews our certificate when required, checking at the given
+// interval.
+//
+// The new certificate is picked up by certificate.watch.
+func (a *acme) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.ensure(); err != nil {
+			a.s.logf("Error renewing our certificate: %s\n", err.Error())
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDNS is a DNS provider which remembers the records it holds.
+type fakeDNS struct {
+	mu      sync.Mutex
+	records map[string][]string
+	fail    bool
+}
+
+// Present adds the given TXT record.
+func (d *fakeDNS) Present(fqdn string, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fail {
+		return errors.New("refused")
+	}
+	d.records[fqdn] = append(d.records[fqdn], value)
+	return nil
+}
+
+// CleanUp removes the given TXT record.
+func (d *fakeDNS) CleanUp(fqdn string, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, v := range d.records[fqdn] {
+		if v == value {
+			d.records[fqdn] = append(d.records[fqdn][:i], d.records[fqdn][i+1:]...)
+			break
+		}
+	}
+	if len(d.records[fqdn]) == 0 {
+		delete(d.records, fqdn)
+	}
+	return nil
+}
+
+// has returns true if the given TXT record is present.
+func (d *fakeDNS) has(fqdn string, value string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, v := range d.records[fqdn] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeCA is an ACME CA, in the manner of Pebble, which checks the
+// signature, nonce and URL of every request, and validates each dns-01
+// challenge against a fakeDNS before issuing a certificate.
+type fakeCA struct {
+	srv *httptest.Server
+	dns *fakeDNS
+
+	// The behaviour under test: the number of requests to reject
+	// with a badNonce error, the challenge types we offer, whether
+	// our authorizations are valid already, whether we fail to find
+	// the records, and whether we reject the CSR.
+	badNonces  int
+	challenges []string
+	valid      bool
+	unresolved bool
+	rejectCSR  bool
+
+	mu       sync.Mutex
+	nonce    int
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey
+	authz    map[string]string
+	order    string
+	names    []string
+	chain    []byte
+
+	// caKey and caCert sign the certificates we issue.
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+}
+
+// fakeIdentifiers are the identifiers of our authorizations, by the
+// path at which they're found.
+var fakeIdentifiers = map[string]string{
+	"wild": "*.example.com",
+	"bare": "example.com",
+}
+
+// newFakeCA starts a fake CA, which validates challenges against the
+// given DNS provider.
+func newFakeCA(t *testing.T, dns *fakeDNS) *fakeCA {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	ca := &fakeCA{
+		dns:        dns,
+		challenges: []string{"http-01", "dns-01"},
+		nonces:     make(map[string]bool),
+		accounts:   make(map[string]*ecdsa.PublicKey),
+		authz:      make(map[string]string),
+		order:      "pending",
+		caKey:      caKey,
+		caCert:     caCert,
+	}
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+// problem sends an ACME error.
+func (ca *fakeCA) problem(w http.ResponseWriter, status int, kind string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + kind,
+		"detail": detail,
+	})
+}
+
+// verify checks the JWS of the given request, returning its payload, or
+// nil for a POST-as-GET.
+func (ca *fakeCA) verify(r *http.Request) ([]byte, error) {
+
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if r.Header.Get("Content-Type") != "application/jose+json" {
+		return nil, errors.New("unexpected content type")
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, err
+	}
+
+	dec := base64.RawURLEncoding
+	data, err := dec.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+	var protected struct {
+		Alg   string `json:"alg"`
+		Nonce string `json:"nonce"`
+		URL   string `json:"url"`
+		KID   string `json:"kid"`
+		JWK   *struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"jwk"`
+	}
+	if err := json.Unmarshal(data, &protected); err != nil {
+		return nil, err
+	}
+	if protected.Alg != "ES256" {
+		return nil, fmt.Errorf("unexpected algorithm %q", protected.Alg)
+	}
+	if protected.URL != ca.srv.URL+r.URL.Path {
+		return nil, fmt.Errorf("signed for %q", protected.URL)
+	}
+
+	//
+	// New accounts are identified by their key, and thereafter by
+	// their URL.
+	//
+	var key *ecdsa.PublicKey
+	switch {
+	case r.URL.Path == "/account" && protected.JWK != nil && protected.KID == "":
+		x, errX := dec.DecodeString(protected.JWK.X)
+		y, errY := dec.DecodeString(protected.JWK.Y)
+		if errX != nil || errY != nil || protected.JWK.Kty != "EC" || protected.JWK.Crv != "P-256" {
+			return nil, errors.New("invalid jwk")
+		}
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case r.URL.Path != "/account" && protected.JWK == nil:
+		key = ca.accounts[protected.KID]
+		if key == nil {
+			return nil, fmt.Errorf("unknown account %q", protected.KID)
+		}
+	default:
+		return nil, errors.New("expected a jwk, or a kid, but not both")
+	}
+
+	sig, err := dec.DecodeString(jws.Signature)
+	if err != nil || len(sig) != 64 {
+		return nil, errors.New("invalid signature")
+	}
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if !ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, errors.New("invalid signature")
+	}
+
+	if r.URL.Path == "/account" {
+		ca.accounts[ca.srv.URL+"/account/1"] = key
+	}
+
+	//
+	// The nonce is checked last, so that badNonce is only returned
+	// to otherwise acceptable requests.
+	//
+	if !ca.nonces[protected.Nonce] {
+		return nil, errBadNonce
+	}
+	delete(ca.nonces, protected.Nonce)
+	if ca.badNonces > 0 {
+		ca.badNonces--
+		return nil, errBadNonce
+	}
+
+	if jws.Payload == "" {
+		return nil, nil
+	}
+	return dec.DecodeString(jws.Payload)
+}
+
+// errBadNonce is returned by verify if the nonce is unknown, or spent.
+var errBadNonce = errors.New("bad nonce")
+
+// serve handles each request to our CA.
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.nonce++
+	nonce := fmt.Sprintf("nonce-%d", ca.nonce)
+	ca.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(acmeDirectory{
+			NewNonce:   ca.srv.URL + "/nonce",
+			NewAccount: ca.srv.URL + "/account",
+			NewOrder:   ca.srv.URL + "/order",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	if r.Method != "POST" {
+		ca.problem(w, http.StatusMethodNotAllowed, "malformed", "expected POST")
+		return
+	}
+	payload, err := ca.verify(r)
+	if err == errBadNonce {
+		ca.problem(w, http.StatusBadRequest, "badNonce", "bad nonce")
+		return
+	}
+	if err != nil {
+		ca.problem(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/account":
+		w.Header().Set("Location", ca.srv.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+
+	case r.URL.Path == "/order" || r.URL.Path == "/order/1":
+		if r.URL.Path == "/order" {
+			var req struct {
+				Identifiers []map[string]string `json:"identifiers"`
+			}
+			json.Unmarshal(payload, &req)
+			for _, id := range req.Identifiers {
+				ca.names = append(ca.names, id["value"])
+			}
+			for path := range fakeIdentifiers {
+				ca.authz[path] = "pending"
+				if ca.valid {
+					ca.authz[path] = "valid"
+				}
+			}
+			if ca.valid {
+				ca.order = "ready"
+			}
+			w.Header().Set("Location", ca.srv.URL+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+		}
+		ca.sendOrder(w)
+
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		path := strings.TrimPrefix(r.URL.Path, "/authz/")
+		var authz acmeAuthorization
+		authz.Status = ca.authz[path]
+		authz.Identifier.Value = fakeIdentifiers[path]
+		for _, kind := range ca.challenges {
+			authz.Challenges = append(authz.Challenges, struct {
+				Type  string `json:"type"`
+				URL   string `json:"url"`
+				Token string `json:"token"`
+			}{kind, ca.srv.URL + "/chall/" + path + "/" + kind, "token-" + path})
+		}
+		json.NewEncoder(w).Encode(authz)
+
+	case strings.HasPrefix(r.URL.Path, "/chall/"):
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/chall/"), "/")
+		if len(parts) != 2 || parts[1] != "dns-01" || payload == nil {
+			ca.problem(w, http.StatusBadRequest, "malformed", "unexpected challenge")
+			return
+		}
+
+		//
+		// The record holds the digest of the key authorization.
+		//
+		key := ca.accounts[ca.srv.URL+"/account/1"]
+		jwk := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(pad32(key.X)), b64(pad32(key.Y)))
+		thumb := sha256.Sum256([]byte(jwk))
+		sum := sha256.Sum256([]byte("token-" + parts[0] + "." + b64(thumb[:])))
+		name := "_acme-challenge." + strings.TrimPrefix(fakeIdentifiers[parts[0]], "*.") + "."
+
+		ca.authz[parts[0]] = "invalid"
+		if !ca.unresolved && ca.dns.has(name, b64(sum[:])) {
+			ca.authz[parts[0]] = "valid"
+		}
+		if ca.authz["wild"] == "valid" && ca.authz["bare"] == "valid" {
+			ca.order = "ready"
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "processing"})
+
+	case r.URL.Path == "/finalize":
+		if ca.order != "ready" {
+			ca.problem(w, http.StatusForbidden, "orderNotReady", "order is "+ca.order)
+			return
+		}
+		if ca.rejectCSR {
+			ca.problem(w, http.StatusBadRequest, "badCSR", "we don't like it")
+			return
+		}
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			ca.problem(w, http.StatusBadRequest, "badCSR", "invalid CSR")
+			return
+		}
+		got := append([]string{}, csr.DNSNames...)
+		want := append([]string{}, ca.names...)
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			ca.problem(w, http.StatusBadRequest, "badCSR", fmt.Sprintf("CSR names %v, ordered %v", got, want))
+			return
+		}
+
+		cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}, ca.caCert, csr.PublicKey, ca.caKey)
+		if err != nil {
+			ca.problem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+			return
+		}
+		ca.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+		ca.order = "valid"
+		ca.sendOrder(w)
+
+	case r.URL.Path == "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.chain)
+
+	default:
+		ca.problem(w, http.StatusNotFound, "malformed", "not found")
+	}
+}
+
+// sendOrder sends our order.
+func (ca *fakeCA) sendOrder(w http.ResponseWriter) {
+	order := acmeOrder{
+		Status:         ca.order,
+		Authorizations: []string{ca.srv.URL + "/authz/wild", ca.srv.URL + "/authz/bare"},
+		Finalize:       ca.srv.URL + "/finalize",
+	}
+	if ca.order == "valid" {
+		order.Certificate = ca.srv.URL + "/cert"
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+// newTestACME returns our ACME client, using the given CA, writing its
+// files beneath the given directory.
+func newTestACME(t *testing.T, ca *fakeCA, dir string) *acme {
+
+	s := &Server{opts: Options{
+		ACMEDomain:     "example.com",
+		ACMEDirectory:  ca.srv.URL + "/directory",
+		ACMEAccountKey: filepath.Join(dir, "account.pem"),
+		TLSCert:        filepath.Join(dir, "cert.pem"),
+		TLSKey:         filepath.Join(dir, "key.pem"),
+		DNS:            ca.dns,
+		Log:            ioutil.Discard,
+	}}
+	a, err := newACME(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return a
+}
+
+func TestACME(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		setup  func(ca *fakeCA)
+		err    string
+		status string
+	}{
+		{"issued", func(ca *fakeCA) {}, "", "valid"},
+		{"bad nonce retried", func(ca *fakeCA) { ca.badNonces = 2 }, "", "valid"},
+		{"bad nonce persists", func(ca *fakeCA) { ca.badNonces = 100 }, "bad nonce", "pending"},
+		{"already authorized", func(ca *fakeCA) { ca.valid = true }, "", "valid"},
+		{"no dns-01", func(ca *fakeCA) { ca.challenges = []string{"http-01"} }, "no dns-01 challenge", "pending"},
+		{"records refused", func(ca *fakeCA) { ca.dns.fail = true }, "error publishing", "pending"},
+		{"challenge failed", func(ca *fakeCA) { ca.unresolved = true }, "could not validate", "pending"},
+		{"CSR rejected", func(ca *fakeCA) { ca.rejectCSR = true }, "we don't like it", "ready"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			dns := &fakeDNS{records: make(map[string][]string)}
+			ca := newFakeCA(t, dns)
+			test.setup(ca)
+			a := newTestACME(t, ca, t.TempDir())
+
+			err := a.obtain()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if ca.order != test.status {
+				t.Fatalf("expected the order to be %s, got %s", test.status, ca.order)
+			}
+
+			//
+			// We always remove our records.
+			//
+			if len(dns.records) != 0 {
+				t.Fatalf("expected our DNS records to be removed, got %v", dns.records)
+			}
+			if test.err != "" {
+				if !a.expires().IsZero() {
+					t.Fatalf("expected no certificate")
+				}
+				return
+			}
+
+			//
+			// The certificate we wrote covers our names, and its key
+			// is the one we wrote alongside it.
+			//
+			if time.Until(a.expires()) < 89*24*time.Hour {
+				t.Fatalf("unexpected expiry %s", a.expires())
+			}
+			cert, err := ioutil.ReadFile(a.s.opts.TLSCert)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			key, err := ioutil.ReadFile(a.s.opts.TLSKey)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			block, _ := pem.Decode(cert)
+			leaf, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			priv, err := parseECKey(key)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !priv.PublicKey.Equal(leaf.PublicKey) {
+				t.Fatalf("the key doesn't match the certificate")
+			}
+			if leaf.VerifyHostname("example.com") != nil || leaf.VerifyHostname("foo.example.com") != nil {
+				t.Fatalf("unexpected names %v", leaf.DNSNames)
+			}
+		})
+	}
+}
+
+func TestACMERenewal(t *testing.T) {
+
+	dns := &fakeDNS{records: make(map[string][]string)}
+	ca := newFakeCA(t, dns)
+	dir := t.TempDir()
+
+	a := newTestACME(t, ca, dir)
+	if err := a.ensure(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ca.order != "valid" {
+		t.Fatalf("expected a certificate to be issued")
+	}
+
+	//
+	// We reuse our account key, and needn't obtain a certificate
+	// whilst ours remains current.
+	//
+	b := newTestACME(t, ca, dir)
+	if b.thumbprint() != a.thumbprint() {
+		t.Fatalf("expected our account key to be reused")
+	}
+	ca.order = "pending"
+	if err := b.ensure(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ca.order != "pending" {
+		t.Fatalf("expected no certificate to be requested")
+	}
+
+	//
+	// A certificate for another domain is replaced.
+	//
+	b.s.opts.ACMEDomain = "example.org"
+	if !b.expires().IsZero() {
+		t.Fatalf("expected our certificate not to cover example.org")
+	}
+}
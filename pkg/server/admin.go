@@ -0,0 +1,114 @@
+//
+// The server may optionally present an administrative API, upon a
+// separate address to the public one, which reports upon the state of
+// the tunnels.
+//
+// This should not be publicly accessible!
+//
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// adminHandler returns the handler for our administrative API.
+func (s *Server) adminHandler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/usage", s.usageHandler)
+	mux.HandleFunc("/tunnels", s.tunnelsHandler)
+	mux.HandleFunc("/stats", s.statsHandler)
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/reload", s.reloadHandler)
+	mux.HandleFunc("/domains", s.domainsHandler)
+	mux.HandleFunc("/kick", s.kickHandler)
+	mux.HandleFunc("/bans", s.bansHandler)
+	mux.HandleFunc("/maintenance", s.maintenanceHandler)
+	mux.HandleFunc("/cache", s.cacheHandler)
+	mux.HandleFunc("/accounts", s.withAccounts(s.accountsHandler))
+	mux.HandleFunc("/accounts/usage", s.withAccounts(s.accountUsageHandler))
+	mux.HandleFunc("/tokens", s.withAccounts(s.tokensHandler))
+	mux.HandleFunc("/names", s.withAccounts(s.namesHandler))
+	mux.HandleFunc("/limits", s.withAccounts(s.limitsHandler))
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	return mux
+}
+
+// usageHandler reports the bandwidth used by each tunnel, as JSON.
+func (s *Server) usageHandler(w http.ResponseWriter, r *http.Request) {
+
+	out, err := json.MarshalIndent(s.usage.Snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// metricsHandler reports the bandwidth used by each tunnel, in the
+// text-format which Prometheus understands.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	usage := s.usage.Snapshot()
+
+	//
+	// Sort the names, for consistent output.
+	//
+	var names []string
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP tunneller_bytes_in_total Bytes sent to each tunnel.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_bytes_in_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "tunneller_bytes_in_total{tunnel=%q} %d\n", name, usage[name].BytesIn)
+	}
+
+	fmt.Fprintf(w, "# HELP tunneller_bytes_out_total Bytes received from each tunnel.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_bytes_out_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "tunneller_bytes_out_total{tunnel=%q} %d\n", name, usage[name].BytesOut)
+	}
+
+	fmt.Fprintf(w, "# HELP tunneller_failed_requests_total Requests which clients didn't receive, or didn't answer in time.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_failed_requests_total counter\n")
+	for _, kind := range []string{"unreachable", "timeout"} {
+		fmt.Fprintf(w, "tunneller_failed_requests_total{kind=%q} %d\n", kind, s.failures.get(kind))
+	}
+
+	active, rejected := s.concurrency.stats()
+
+	fmt.Fprintf(w, "# HELP tunneller_requests_in_flight Requests awaiting a reply.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_requests_in_flight gauge\n")
+	fmt.Fprintf(w, "tunneller_requests_in_flight %d\n", active)
+
+	fmt.Fprintf(w, "# HELP tunneller_requests_rejected_total Requests refused as too many were in flight.\n")
+	fmt.Fprintf(w, "# TYPE tunneller_requests_rejected_total counter\n")
+	fmt.Fprintf(w, "tunneller_requests_rejected_total %d\n", rejected)
+
+	if s.cache != nil {
+		hits, misses, size := s.cache.stats()
+
+		fmt.Fprintf(w, "# HELP tunneller_cache_hits_total Requests answered from our cache.\n")
+		fmt.Fprintf(w, "# TYPE tunneller_cache_hits_total counter\n")
+		fmt.Fprintf(w, "tunneller_cache_hits_total %d\n", hits)
+
+		fmt.Fprintf(w, "# HELP tunneller_cache_misses_total Cacheable requests not found within our cache.\n")
+		fmt.Fprintf(w, "# TYPE tunneller_cache_misses_total counter\n")
+		fmt.Fprintf(w, "tunneller_cache_misses_total %d\n", misses)
+
+		fmt.Fprintf(w, "# HELP tunneller_cache_bytes The size of the responses within our cache.\n")
+		fmt.Fprintf(w, "# TYPE tunneller_cache_bytes gauge\n")
+		fmt.Fprintf(w, "tunneller_cache_bytes %d\n", size)
+	}
+}
@@ -0,0 +1,159 @@
+//
+// Audit log.
+//
+// The server may record every request it receives in an append-only log,
+// via -audit-log, as a series of JSON objects, one per line.
+//
+// So that the log is safe to leave enabled we rotate it once it reaches
+// a given size, or age, see pkg/logfile.
+//
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/skx/tunneller/pkg/logfile"
+)
+
+// AuditEntry is written to the audit log for each request we receive.
+type AuditEntry struct {
+	// Time is the time at which we received the request.
+	Time time.Time
+
+	// RequestID uniquely identifies the request.
+	RequestID string
+
+	// Tunnel is the name of the tunnel the visitor requested.
+	Tunnel string
+
+	// Client is the ID of the client the request was sent to, which
+	// is empty if it wasn't sent to one.
+	Client string
+
+	// Visitor is the IP address the request was received from.
+	Visitor string
+
+	// Method and Path are those of the request.
+	Method string
+	Path   string
+
+	// Status is the HTTP status-code of our response, which is zero
+	// if the response was written verbatim, see hijackResponse.
+	Status int
+
+	// BytesIn is the size of the request-body, and BytesOut the size
+	// of the response-body.
+	BytesIn  int64
+	BytesOut int64
+
+	// Duration is the time taken to respond, in seconds.
+	Duration float64
+}
+
+// auditLog writes AuditEntry records to a file, rotating it as required.
+type auditLog struct {
+	// file is the log we write to.
+	file *logfile.File
+}
+
+// newAuditLog opens the given log for appending.
+func newAuditLog(path string, maxSize int64, maxAge time.Duration, keep int) (*auditLog, error) {
+
+	file, err := logfile.Open(path, 0640, maxSize, maxAge, keep)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// Write appends the given entry to our log, rotating it first if it
+// has grown too large, or too old.
+func (a *auditLog) Write(entry *AuditEntry) error {
+
+	out, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+
+	_, err = a.file.Write(out)
+	return err
+}
+
+// Close closes our log.
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
+
+// auditWriter wraps the ResponseWriter of a request, recording the
+// status-code and size of the response for the audit log.
+type auditWriter struct {
+	http.ResponseWriter
+
+	// status is the status-code written, and bytes the size of the
+	// body.
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status-code of the response.
+func (a *auditWriter) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size of the response-body.
+func (a *auditWriter) Write(data []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(data)
+	a.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the visitor.
+func (a *auditWriter) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows hijackResponse to take over the connection.
+func (a *auditWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := a.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking is not supported")
+	}
+	return hj.Hijack()
+}
+
+// audit records the given request in our audit log, if we have one.
+func (s *Server) audit(entry *AuditEntry, r *http.Request, w *auditWriter) {
+
+	if s.auditLog == nil {
+		return
+	}
+
+	entry.Visitor, _, _ = net.SplitHostPort(r.RemoteAddr)
+	entry.Method = r.Method
+	entry.Path = r.URL.RequestURI()
+	entry.Status = w.status
+	entry.BytesOut = w.bytes
+	entry.Duration = time.Since(entry.Time).Seconds()
+	if r.ContentLength > 0 {
+		entry.BytesIn = r.ContentLength
+	}
+
+	if err := s.auditLog.Write(entry); err != nil {
+		s.logf("Error writing to the audit log: %s\n", err.Error())
+	}
+}
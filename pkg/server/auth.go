@@ -0,0 +1,145 @@
+//
+// Server-enforced authentication.
+//
+// Independently of any credentials a client asks us to require, the
+// operator may require visitors to present HTTP Basic credentials via
+// -auth, which may be repeated:
+//
+//   -auth "foo=alice:secret"   Alice may reach the tunnel "foo".
+//   -auth "bob:password"       Bob may reach every other tunnel.
+//
+// Credentials given for a particular tunnel take precedence over those
+// given for all of them.
+//
+// Clients may ask us to require credentials too, sending a verifier of
+// them which is deliberately slow to check, see pkg/protocol/auth.go, so
+// we remember those we've checked, whether they matched or not, and only
+// check a few at once.
+//
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// maxVerifiedCredentials is the number of credentials we'll remember,
+// before forgetting them all.
+const maxVerifiedCredentials = 1024
+
+// maxConcurrentChecks is the number of verifiers we'll check at once,
+// so that visitors guessing passwords cannot exhaust our CPUs.
+const maxConcurrentChecks = 4
+
+// verifiedCredentials remembers the credentials we've checked against
+// the verifiers clients sent us.
+type verifiedCredentials struct {
+	// checked holds the hash of each verifier, and the credentials
+	// we checked against it, and whether they matched.
+	checked map[[sha256.Size]byte]bool
+
+	// slots limits the number of verifiers we check at once.
+	slots chan struct{}
+
+	// mutex protects our map.
+	mutex sync.Mutex
+}
+
+// newVerifiedCredentials creates a new, empty, set of credentials.
+func newVerifiedCredentials() *verifiedCredentials {
+	return &verifiedCredentials{
+		checked: make(map[[sha256.Size]byte]bool),
+		slots:   make(chan struct{}, maxConcurrentChecks),
+	}
+}
+
+// check returns true if the given username and password match the
+// given verifier.
+func (v *verifiedCredentials) check(verifier string, user string, pass string) bool {
+
+	key := sha256.Sum256([]byte(verifier + "\n" + user + ":" + pass))
+
+	v.mutex.Lock()
+	ok, seen := v.checked[key]
+	v.mutex.Unlock()
+	if seen {
+		return ok
+	}
+
+	v.slots <- struct{}{}
+	ok = protocol.CheckAuth(verifier, user, pass)
+	<-v.slots
+
+	v.mutex.Lock()
+	if len(v.checked) >= maxVerifiedCredentials {
+		v.checked = make(map[[sha256.Size]byte]bool)
+	}
+	v.checked[key] = ok
+	v.mutex.Unlock()
+	return ok
+}
+
+// credentials returns the credentials, as "user:password", which may be
+// used to reach the named tunnel, or nil if it doesn't require any.
+func (s *Server) credentials(name string) []string {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var named, all []string
+	for _, ent := range s.opts.Auth {
+
+		//
+		// The tunnel, if named, precedes the username.
+		//
+		user := ent
+		if i := strings.Index(ent, ":"); i >= 0 {
+			user = ent[:i]
+		}
+		i := strings.Index(user, "=")
+		if i < 0 {
+			all = append(all, ent)
+			continue
+		}
+		if ent[:i] == name {
+			named = append(named, ent[i+1:])
+		}
+	}
+
+	if len(named) > 0 {
+		return named
+	}
+	return all
+}
+
+// authorized returns true if the visitor has presented credentials which
+// permit them to reach the named tunnel, or if it doesn't require any.
+//
+// Otherwise we've asked them to login.
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request, name string) bool {
+
+	creds := s.credentials(name)
+	if len(creds) == 0 {
+		return true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if ok {
+		for _, c := range creds {
+			if subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(c)) == 1 {
+				return true
+			}
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", name))
+	http.Error(w, "Authentication required", http.StatusUnauthorized)
+	return false
+}
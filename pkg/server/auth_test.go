@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+func TestVerifiedCredentials(t *testing.T) {
+
+	verifier, err := protocol.AuthVerifier("alice", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	v := newVerifiedCredentials()
+
+	tests := []struct {
+		user string
+		pass string
+		ok   bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "guess", false},
+		{"bob", "secret", false},
+	}
+
+	//
+	// We remember each outcome, so checking again gives the same one.
+	//
+	for i := 0; i < 2; i++ {
+		for _, test := range tests {
+			if got := v.check(verifier, test.user, test.pass); got != test.ok {
+				t.Fatalf("%s:%s: expected %t, got %t", test.user, test.pass, test.ok, got)
+			}
+		}
+	}
+	if len(v.checked) != len(tests) {
+		t.Fatalf("expected %d credentials to be remembered, got %d", len(tests), len(v.checked))
+	}
+}
@@ -0,0 +1,180 @@
+//
+// Kicking, and banning, tunnels.
+//
+// On a shared server the operator may need to remove a tunnel which is
+// being abused.  Via the "/kick" end-point of the admin API they may
+// disconnect the client(s) serving a tunnel, and via "/bans" they may
+// also prevent its name from being used again.  Names may be banned
+// permanently via -ban.
+//
+// We kick a client by clearing its presence, which every server sharing
+// the queue will notice, and by asking the client to disconnect upon the
+// topic "clients/$id/kick".  A client serving several tunnels loses all
+// of them.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// banned returns true if the named tunnel may not be used.
+func (s *Server) banned(name string) bool {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.bans[name] {
+		return true
+	}
+	for _, ban := range s.opts.Bans {
+		if ban == name {
+			return true
+		}
+	}
+	return false
+}
+
+// kick disconnects the client(s) serving the named tunnel, returning
+// the number of clients we kicked.
+func (s *Server) kick(name string, reason string) int {
+
+	count := 0
+	for _, reg := range s.registry.all() {
+
+		serving := false
+		for _, n := range reg.Names {
+			if n == name {
+				serving = true
+			}
+		}
+		if !serving {
+			continue
+		}
+
+		s.disconnect(reg.Client, name, "kick", reason)
+		count++
+	}
+	return count
+}
+
+// disconnect clears the presence of the given client, which serves the
+// named tunnel, and then tells it why upon "clients/$id/$kind".
+//
+// We clear its presence first so that any registration it publishes in
+// response isn't cleared too.
+func (s *Server) disconnect(client string, name string, kind string, reason string) {
+
+	token := s.mq.Publish("clients/"+protocol.TopicLevel(client)+"/presence", byte(s.opts.QoS), true, "")
+	token.Wait()
+
+	topic := "clients/" + protocol.TopicLevel(client) + "/" + kind
+	msg := []byte(reason)
+	if secret := s.secret(name); secret != "" {
+		msg = protocol.Sign(secret, kind, topic, msg)
+	}
+	token = s.mq.Publish(topic, byte(s.opts.QoS), false, msg)
+	token.Wait()
+}
+
+// kickHandler disconnects the client(s) serving a tunnel, via the admin
+// API:
+//
+//   POST /kick?tunnel=foo
+//
+func (s *Server) kickHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tunnel := r.FormValue("tunnel")
+	if tunnel == "" {
+		http.Error(w, "The tunnel is required", http.StatusBadRequest)
+		return
+	}
+
+	count := s.kick(tunnel, "kicked by the operator of the server")
+	if count == 0 {
+		http.Error(w, "No client is serving that tunnel", http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "Kicked %d client(s)\n", count)
+}
+
+// bansHandler lists, adds, and removes banned tunnels via the admin API:
+//
+//   GET    /bans             - List the banned tunnels.
+//   POST   /bans?tunnel=foo  - Ban a tunnel, kicking its client(s).
+//   DELETE /bans?tunnel=foo  - Lift a ban we added.
+//
+func (s *Server) bansHandler(w http.ResponseWriter, r *http.Request) {
+
+	tunnel := r.FormValue("tunnel")
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		if tunnel == "" {
+			http.Error(w, "The tunnel is required", http.StatusBadRequest)
+			return
+		}
+		s.mutex.Lock()
+		s.bans[tunnel] = true
+		s.mutex.Unlock()
+
+		s.kick(tunnel, "banned by the operator of the server")
+
+	case http.MethodDelete:
+		s.mutex.Lock()
+		ok := s.bans[tunnel]
+		delete(s.bans, tunnel)
+		s.mutex.Unlock()
+
+		if !ok {
+			http.Error(w, "No such ban was added via the API", http.StatusNotFound)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	//
+	// Always report the current state.
+	//
+	s.mutex.RLock()
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, name := range s.opts.Bans {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	for name := range s.bans {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	s.mutex.RUnlock()
+	sort.Strings(out)
+
+	js, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
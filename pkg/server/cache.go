@@ -0,0 +1,485 @@
+//
+// Caching responses.
+//
+// Every request is usually sent to the client, over the queue, even if
+// it is for a static asset which hasn't changed.  The operator may give
+// us a cache, via -cache-size, in which we keep the responses clients
+// say may be shared, as a proxy would:
+//
+//   * Only GET requests are cached, keyed by the tunnel, host, and URL,
+//     and by the request headers named by the response's Vary header.
+//
+//   * Responses are fresh for the time given by "Cache-Control: s-maxage"
+//     or "max-age", or by the Expires header, and those marked "no-store"
+//     or "private", or which set cookies, are never cached.
+//
+//   * Once stale, a response with an ETag, or Last-Modified, header is
+//     revalidated via a conditional request to the client, so that the
+//     body needn't be sent again if it hasn't changed.
+//
+//   * Requests which modify a resource, such as a POST, remove it from
+//     the cache, as does the "/cache" end-point of the admin API.
+//
+// Responses served from the cache have an "X-Cache: HIT" header, and
+// their Age, whilst others have "X-Cache: MISS".
+//
+
+package server
+
+import (
+	"bufio"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheableStatus holds the status-codes of the responses we may cache.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheEntry is a single cached response.
+type cacheEntry struct {
+	// key identifies the resource, and tunnel the tunnel serving it.
+	key    string
+	tunnel string
+
+	// vary holds the names of the request headers the response varies
+	// upon, and varied their values for the request which fetched it.
+	vary   []string
+	varied string
+
+	// response is the (complete) response, as the client sent it.
+	response string
+
+	// stored is the time at which we stored, or last revalidated, the
+	// response, and expires the time at which it becomes stale.
+	stored  time.Time
+	expires time.Time
+
+	// etag and modified hold the validators of the response, if any.
+	etag     string
+	modified string
+}
+
+// fresh returns true if the entry hasn't yet become stale.
+func (e *cacheEntry) fresh() bool {
+	return time.Now().Before(e.expires)
+}
+
+// size returns the (approximate) memory the entry consumes.
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.varied) + len(e.response))
+}
+
+// responseCache is an in-memory cache of responses, which discards
+// those least recently used once it reaches its maximum size.
+type responseCache struct {
+	// max is the maximum size of the cache, and maxObject that of any
+	// single response within it.
+	max       int64
+	maxObject int64
+
+	// size is the current size of the cache.
+	size int64
+
+	// entries holds our entries, by key, within the list lru, which is
+	// ordered by the time at which they were last used.
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// hits and misses count our lookups.
+	hits   int64
+	misses int64
+
+	mutex sync.Mutex
+}
+
+// newResponseCache returns a cache of the given size, or nil if the
+// size is zero.
+func newResponseCache(max int64, maxObject int64) *responseCache {
+
+	if max <= 0 {
+		return nil
+	}
+	if maxObject <= 0 || maxObject > max {
+		maxObject = max
+	}
+	return &responseCache{
+		max:       max,
+		maxObject: maxObject,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// cacheKey returns the key of the resource the given request is for.
+func cacheKey(tunnel string, r *http.Request) string {
+	return tunnel + " " + strings.ToLower(r.Host) + " " + r.URL.RequestURI()
+}
+
+// varied returns the values of the named request headers.
+func varied(r *http.Request, names []string) string {
+
+	var out []string
+	for _, name := range names {
+		out = append(out, strings.Join(r.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	return strings.Join(out, "\n")
+}
+
+// cacheControl parses the directives of the given Cache-Control header.
+func cacheControl(h http.Header) map[string]string {
+
+	out := make(map[string]string)
+	for _, value := range h["Cache-Control"] {
+		for _, dir := range strings.Split(value, ",") {
+			dir = strings.TrimSpace(dir)
+			if dir == "" {
+				continue
+			}
+			val := ""
+			if i := strings.Index(dir, "="); i >= 0 {
+				dir, val = dir[:i], strings.Trim(dir[i+1:], `"`)
+			}
+			out[strings.ToLower(dir)] = val
+		}
+	}
+	return out
+}
+
+// lookup returns the cached response to the given request, if any,
+// which may be stale.
+func (c *responseCache) lookup(tunnel string, r *http.Request) *cacheEntry {
+
+	if c == nil || r.Method != http.MethodGet {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[cacheKey(tunnel, r)]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if varied(r, e.vary) != e.varied {
+		c.misses++
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+	return e
+}
+
+// store caches the response to the given request, if we may, and
+// returns it with our X-Cache header added.
+func (c *responseCache) store(tunnel string, r *http.Request, response string) string {
+
+	if c == nil || r.Method != http.MethodGet {
+		return response
+	}
+	c.cache(tunnel, r, response)
+	return addHeader(response, "X-Cache", "MISS")
+}
+
+// cache caches the response to the given request, if we may.
+func (c *responseCache) cache(tunnel string, r *http.Request, response string) {
+
+	if int64(len(response)) > c.maxObject {
+		return
+	}
+
+	//
+	// The visitor may ask us not to.
+	//
+	if _, ok := cacheControl(r.Header)["no-store"]; ok {
+		return
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(response)), r)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if !cacheableStatus[res.StatusCode] || len(res.Header["Set-Cookie"]) > 0 {
+		return
+	}
+
+	cc := cacheControl(res.Header)
+	if _, ok := cc["no-store"]; ok {
+		return
+	}
+	if _, ok := cc["private"]; ok {
+		return
+	}
+
+	//
+	// Responses to requests which required credentials are only
+	// shared if the client says they may be.
+	//
+	_, public := cc["public"]
+	_, shared := cc["s-maxage"]
+	if r.Header.Get("Authorization") != "" && !public && !shared {
+		return
+	}
+
+	vary := splitList(res.Header.Get("Vary"))
+	for _, v := range vary {
+		if v == "*" {
+			return
+		}
+	}
+
+	e := &cacheEntry{
+		key:      cacheKey(tunnel, r),
+		tunnel:   tunnel,
+		vary:     vary,
+		varied:   varied(r, vary),
+		response: response,
+		stored:   time.Now(),
+		etag:     res.Header.Get("ETag"),
+		modified: res.Header.Get("Last-Modified"),
+	}
+	e.expires = freshUntil(res.Header, cc, e.stored)
+
+	//
+	// There's no point keeping a stale response we cannot revalidate.
+	//
+	if !e.fresh() && e.etag == "" && e.modified == "" {
+		return
+	}
+
+	c.add(e)
+}
+
+// freshUntil returns the time at which a response with the given headers,
+// received at the given time, becomes stale.
+func freshUntil(h http.Header, cc map[string]string, now time.Time) time.Time {
+
+	if _, ok := cc["no-cache"]; ok {
+		return now
+	}
+	for _, dir := range []string{"s-maxage", "max-age"} {
+		if val, ok := cc[dir]; ok {
+			secs, err := strconv.Atoi(val)
+			if err != nil || secs < 0 {
+				return now
+			}
+			return now.Add(time.Duration(secs) * time.Second)
+		}
+	}
+
+	if exp := h.Get("Expires"); exp != "" {
+		expires, err := http.ParseTime(exp)
+		if err != nil {
+			return now
+		}
+
+		//
+		// The client's clock may differ from ours.
+		//
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			return now.Add(expires.Sub(date))
+		}
+		return expires
+	}
+	return now
+}
+
+// splitList splits a comma-separated header into its (trimmed) values.
+func splitList(value string) []string {
+
+	var out []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// add adds the given entry, replacing any with the same key, and then
+// discards the least recently used entries until we're within our size.
+func (c *responseCache) add(e *cacheEntry) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+
+	for c.size > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the given element, with our mutex held.
+func (c *responseCache) remove(el *list.Element) {
+
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+// refresh updates the given entry after the client has told us that it
+// remains valid, via the given "304 Not Modified" response, returning
+// the response to send to the visitor.
+func (c *responseCache) refresh(e *cacheEntry, r *http.Request, notModified string) string {
+
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(notModified)), r)
+	if err != nil {
+		return e.response
+	}
+	res.Body.Close()
+
+	//
+	// Entries are shared by concurrent requests, so we replace it
+	// rather than updating it.
+	//
+	updated := *e
+	updated.stored = time.Now()
+	updated.expires = freshUntil(res.Header, cacheControl(res.Header), updated.stored)
+	c.add(&updated)
+
+	return addHeader(e.response, "X-Cache", "REVALIDATED")
+}
+
+// notModified returns true if the given response is a "304 Not Modified".
+func notModified(response string) bool {
+
+	fields := strings.Fields(strings.SplitN(response, "\n", 2)[0])
+	return len(fields) > 1 && fields[1] == "304"
+}
+
+// invalidate removes the resource the given request is for, which is
+// about to modify it, from the cache.
+func (c *responseCache) invalidate(tunnel string, r *http.Request) {
+
+	if c == nil {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[cacheKey(tunnel, r)]; ok {
+		c.remove(el)
+	}
+}
+
+// purge removes every response the named tunnel, or every tunnel if
+// the name is empty, has sent us from the cache, returning the number
+// removed.
+func (c *responseCache) purge(tunnel string) int {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	count := 0
+	for _, el := range c.entries {
+		if tunnel == "" || el.Value.(*cacheEntry).tunnel == tunnel {
+			c.remove(el)
+			count++
+		}
+	}
+	return count
+}
+
+// hit returns the cached response to send to the visitor.
+func (e *cacheEntry) hit() string {
+
+	age := int(time.Since(e.stored).Seconds())
+	return addHeader(addHeader(e.response, "X-Cache", "HIT"), "Age", strconv.Itoa(age))
+}
+
+// conditional returns true if the visitor's request is conditional upon
+// the given cached response, and that response satisfies it, in which
+// case a "304 Not Modified" response should be sent.
+func (e *cacheEntry) conditional(r *http.Request) bool {
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if e.etag == "" {
+			return false
+		}
+		for _, tag := range splitList(inm) {
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(e.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && e.modified != "" {
+		since, err1 := http.ParseTime(ims)
+		modified, err2 := http.ParseTime(e.modified)
+		return err1 == nil && err2 == nil && !modified.After(since)
+	}
+	return false
+}
+
+// revalidate makes the given request conditional upon the given cached
+// response, returning false if it cannot be, as it has no validators,
+// or as the visitor's request is already conditional.
+func (e *cacheEntry) revalidate(r *http.Request) bool {
+
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	switch {
+	case e.etag != "":
+		r.Header.Set("If-None-Match", e.etag)
+	case e.modified != "":
+		r.Header.Set("If-Modified-Since", e.modified)
+	default:
+		return false
+	}
+	return true
+}
+
+// stats returns the number of hits, and misses, we've had, and our
+// current size.
+func (c *responseCache) stats() (int64, int64, int64) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.hits, c.misses, c.size
+}
+
+// cacheHandler purges the cache via the admin API:
+//
+//   DELETE /cache              - Purge every response.
+//   DELETE /cache?tunnel=foo   - Purge the responses of the tunnel "foo".
+//
+func (s *Server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.cache == nil {
+		http.Error(w, "The cache is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	count := s.cache.purge(r.FormValue("tunnel"))
+	w.Write([]byte("Purged " + strconv.Itoa(count) + " response(s)\n"))
+}
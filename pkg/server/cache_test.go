@@ -0,0 +1,304 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cachedResponse returns a response with the given status and headers.
+func cachedResponse(status string, headers ...string) string {
+	return "HTTP/1.1 " + status + "\r\n" + strings.Join(append(headers, "Content-Length: 5"), "\r\n") + "\r\n\r\nhello"
+}
+
+func TestCacheControl(t *testing.T) {
+
+	tests := []struct {
+		values   []string
+		expected map[string]string
+	}{
+		{nil, map[string]string{}},
+		{[]string{"no-store"}, map[string]string{"no-store": ""}},
+		{[]string{"Public, Max-Age=60"}, map[string]string{"public": "", "max-age": "60"}},
+		{[]string{`max-age="60",,`, "s-maxage=10"}, map[string]string{"max-age": "60", "s-maxage": "10"}},
+	}
+
+	for _, test := range tests {
+		h := http.Header{"Cache-Control": test.values}
+		if got := cacheControl(h); !reflect.DeepEqual(got, test.expected) {
+			t.Fatalf("cacheControl(%q): expected %v, got %v", test.values, test.expected, got)
+		}
+	}
+}
+
+func TestFreshUntil(t *testing.T) {
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := http.TimeFormat
+
+	tests := []struct {
+		name     string
+		headers  http.Header
+		expected time.Duration
+	}{
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		{"s-maxage first", http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, 10 * time.Second},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0},
+		{"invalid max-age", http.Header{"Cache-Control": {"max-age=soon"}}, 0},
+		{"negative max-age", http.Header{"Cache-Control": {"max-age=-1"}}, 0},
+		{"max-age over Expires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {now.Add(time.Hour).Format(date)}}, time.Minute},
+		{"Expires", http.Header{"Expires": {now.Add(time.Hour).Format(date)}}, time.Hour},
+		{"Expires by their clock", http.Header{"Expires": {now.Add(-time.Hour).Format(date)}, "Date": {now.Add(-2 * time.Hour).Format(date)}}, time.Hour},
+		{"Expires in the past", http.Header{"Expires": {now.Add(-time.Hour).Format(date)}}, -time.Hour},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, 0},
+		{"nothing", http.Header{}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := freshUntil(test.headers, cacheControl(test.headers), now)
+			if got.Sub(now) != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, got.Sub(now))
+			}
+		})
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		method   string
+		request  http.Header
+		response string
+		cached   bool
+	}{
+		{"fresh", "GET", nil, cachedResponse("200 OK", "Cache-Control: max-age=60"), true},
+		{"not found", "GET", nil, cachedResponse("404 Not Found", "Cache-Control: max-age=60"), true},
+		{"stale with an ETag", "GET", nil, cachedResponse("200 OK", `ETag: "a"`), true},
+		{"stale with Last-Modified", "GET", nil, cachedResponse("200 OK", "Last-Modified: Mon, 01 Jan 2024 00:00:00 GMT"), true},
+		{"stale", "GET", nil, cachedResponse("200 OK"), false},
+		{"POST", "POST", nil, cachedResponse("200 OK", "Cache-Control: max-age=60"), false},
+		{"server error", "GET", nil, cachedResponse("500 Internal Server Error", "Cache-Control: max-age=60"), false},
+		{"no-store", "GET", nil, cachedResponse("200 OK", "Cache-Control: no-store, max-age=60"), false},
+		{"private", "GET", nil, cachedResponse("200 OK", "Cache-Control: private, max-age=60"), false},
+		{"cookie", "GET", nil, cachedResponse("200 OK", "Cache-Control: max-age=60", "Set-Cookie: a=b"), false},
+		{"vary *", "GET", nil, cachedResponse("200 OK", "Cache-Control: max-age=60", "Vary: *"), false},
+		{"visitor's no-store", "GET", http.Header{"Cache-Control": {"no-store"}}, cachedResponse("200 OK", "Cache-Control: max-age=60"), false},
+		{"credentials", "GET", http.Header{"Authorization": {"Basic x"}}, cachedResponse("200 OK", "Cache-Control: max-age=60"), false},
+		{"public credentials", "GET", http.Header{"Authorization": {"Basic x"}}, cachedResponse("200 OK", "Cache-Control: public, max-age=60"), true},
+		{"shared credentials", "GET", http.Header{"Authorization": {"Basic x"}}, cachedResponse("200 OK", "Cache-Control: s-maxage=60"), true},
+		{"too large", "GET", nil, cachedResponse("200 OK", "Cache-Control: max-age=60", "X-Padding: "+strings.Repeat("x", 200)), false},
+		{"unparseable", "GET", nil, "hello", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			c := newResponseCache(1000, 200)
+			r := httptest.NewRequest(test.method, "http://foo.example.com/a?b=c", nil)
+			for k, v := range test.request {
+				r.Header[k] = v
+			}
+
+			out := c.store("foo", r, test.response)
+			if test.method == "GET" && strings.HasPrefix(test.response, "HTTP/") && !strings.Contains(out, "X-Cache: MISS") {
+				t.Fatalf("expected X-Cache: MISS, got %q", out)
+			}
+
+			r.Method = "GET"
+			if got := c.lookup("foo", r) != nil; got != test.cached {
+				t.Fatalf("expected cached %t, got %t", test.cached, got)
+			}
+		})
+	}
+}
+
+func TestCacheLookup(t *testing.T) {
+
+	c := newResponseCache(1000, 0)
+	r := httptest.NewRequest("GET", "http://Foo.example.com/a", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	c.store("foo", r, cachedResponse("200 OK", "Cache-Control: max-age=60", "Vary: Accept-Encoding"))
+
+	tests := []struct {
+		name   string
+		tunnel string
+		url    string
+		header string
+		hit    bool
+	}{
+		{"same", "foo", "http://foo.example.com/a", "gzip", true},
+		{"another tunnel", "bar", "http://foo.example.com/a", "gzip", false},
+		{"another host", "foo", "http://bar.example.com/a", "gzip", false},
+		{"another path", "foo", "http://foo.example.com/b", "gzip", false},
+		{"another query", "foo", "http://foo.example.com/a?x=1", "gzip", false},
+		{"another encoding", "foo", "http://foo.example.com/a", "br", false},
+		{"no encoding", "foo", "http://foo.example.com/a", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.url, nil)
+			if test.header != "" {
+				r.Header.Set("Accept-Encoding", test.header)
+			}
+			if got := c.lookup(test.tunnel, r) != nil; got != test.hit {
+				t.Fatalf("expected hit %t, got %t", test.hit, got)
+			}
+		})
+	}
+
+	hits, misses, _ := c.stats()
+	if hits != 1 || misses != 6 {
+		t.Fatalf("expected 1 hit and 6 misses, got %d and %d", hits, misses)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+
+	response := cachedResponse("200 OK", "Cache-Control: max-age=60")
+	request := func(path string) *http.Request {
+		return httptest.NewRequest("GET", "http://foo.example.com"+path, nil)
+	}
+
+	//
+	// The cache holds two responses, so storing a third discards the
+	// least recently used.
+	//
+	entry := &cacheEntry{key: cacheKey("foo", request("/a")), response: response}
+	c := newResponseCache(2*entry.size()+10, 0)
+
+	c.store("foo", request("/a"), response)
+	c.store("foo", request("/b"), response)
+	c.lookup("foo", request("/a"))
+	c.store("foo", request("/c"), response)
+
+	for path, cached := range map[string]bool{"/a": true, "/b": false, "/c": true} {
+		if got := c.lookup("foo", request(path)) != nil; got != cached {
+			t.Fatalf("%s: expected cached %t, got %t", path, cached, got)
+		}
+	}
+
+	//
+	// Requests which modify a resource remove it.
+	//
+	c.invalidate("foo", request("/a"))
+	if c.lookup("foo", request("/a")) == nil {
+		t.Fatalf("expected a GET to leave the response cached")
+	}
+	post := request("/a")
+	post.Method = "POST"
+	c.invalidate("foo", post)
+	if c.lookup("foo", request("/a")) != nil {
+		t.Fatalf("expected a POST to remove the response")
+	}
+
+	c.store("bar", request("/a"), response)
+	if n := c.purge("foo"); n != 1 {
+		t.Fatalf("expected to purge one response, purged %d", n)
+	}
+	if n := c.purge(""); n != 1 {
+		t.Fatalf("expected to purge one response, purged %d", n)
+	}
+	if _, _, size := c.stats(); size != 0 {
+		t.Fatalf("expected an empty cache, got %d bytes", size)
+	}
+}
+
+func TestCacheConditional(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		etag     string
+		modified string
+		header   string
+		value    string
+		ok       bool
+	}{
+		{"matching ETag", `"a"`, "", "If-None-Match", `"a"`, true},
+		{"one of several ETags", `"a"`, "", "If-None-Match", `"b", "a"`, true},
+		{"weak ETag", `W/"a"`, "", "If-None-Match", `"a"`, true},
+		{"any ETag", `"a"`, "", "If-None-Match", "*", true},
+		{"another ETag", `"a"`, "", "If-None-Match", `"b"`, false},
+		{"no ETag", "", "", "If-None-Match", `"a"`, false},
+		{"unmodified", "", "Mon, 01 Jan 2024 00:00:00 GMT", "If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT", true},
+		{"modified since", "", "Tue, 02 Jan 2024 00:00:00 GMT", "If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT", false},
+		{"invalid date", "", "Mon, 01 Jan 2024 00:00:00 GMT", "If-Modified-Since", "yesterday", false},
+		{"unconditional", `"a"`, "Mon, 01 Jan 2024 00:00:00 GMT", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &cacheEntry{etag: test.etag, modified: test.modified}
+			r := httptest.NewRequest("GET", "http://foo.example.com/", nil)
+			if test.header != "" {
+				r.Header.Set(test.header, test.value)
+			}
+			if got := e.conditional(r); got != test.ok {
+				t.Fatalf("expected %t, got %t", test.ok, got)
+			}
+		})
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		etag     string
+		modified string
+		request  string
+		ok       bool
+		header   string
+		value    string
+	}{
+		{"ETag", `"a"`, "Mon, 01 Jan 2024 00:00:00 GMT", "", true, "If-None-Match", `"a"`},
+		{"Last-Modified", "", "Mon, 01 Jan 2024 00:00:00 GMT", "", true, "If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT"},
+		{"no validators", "", "", "", false, "", ""},
+		{"already conditional", `"a"`, "", `"b"`, false, "If-None-Match", `"b"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &cacheEntry{etag: test.etag, modified: test.modified}
+			r := httptest.NewRequest("GET", "http://foo.example.com/", nil)
+			if test.request != "" {
+				r.Header.Set("If-None-Match", test.request)
+			}
+			if got := e.revalidate(r); got != test.ok {
+				t.Fatalf("expected %t, got %t", test.ok, got)
+			}
+			if test.header != "" && r.Header.Get(test.header) != test.value {
+				t.Fatalf("expected %s %q, got %q", test.header, test.value, r.Header.Get(test.header))
+			}
+		})
+	}
+}
+
+func TestCacheRefresh(t *testing.T) {
+
+	c := newResponseCache(1000, 0)
+	r := httptest.NewRequest("GET", "http://foo.example.com/", nil)
+	c.store("foo", r, cachedResponse("200 OK", `ETag: "a"`))
+
+	e := c.lookup("foo", r)
+	if e == nil || e.fresh() {
+		t.Fatalf("expected a stale entry, got %+v", e)
+	}
+
+	out := c.refresh(e, r, "HTTP/1.1 304 Not Modified\r\nCache-Control: max-age=60\r\n\r\n")
+	if !strings.Contains(out, "X-Cache: REVALIDATED") || !strings.HasSuffix(out, "hello") {
+		t.Fatalf("unexpected response %q", out)
+	}
+	if e = c.lookup("foo", r); e == nil || !e.fresh() {
+		t.Fatalf("expected a fresh entry, got %+v", e)
+	}
+
+	if !notModified("HTTP/1.1 304 Not Modified\r\n\r\n") || notModified(cachedResponse("200 OK")) || notModified("") {
+		t.Fatalf("notModified misidentified a response")
+	}
+}
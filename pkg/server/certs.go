@@ -0,0 +1,121 @@
+//
+// Serving HTTPS.
+//
+// The server may terminate TLS itself, using an existing certificate
+// (typically a wildcard one), via -tls-cert and -tls-key.
+//
+// The files are checked for changes periodically, and reloaded if they
+// have been updated, so that renewed certificates are picked up without
+// restarting.  They are also reloaded upon SIGHUP.
+//
+
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificate holds the certificate we present to visitors.
+type certificate struct {
+	// The paths of the certificate and key.
+	certFile string
+	keyFile  string
+
+	// The certificate we loaded, and the modification-times of the
+	// files when we did so.
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+
+	// mutex protects our certificate.
+	mutex sync.RWMutex
+}
+
+// newCertificate loads the given certificate and key.
+func newCertificate(certFile string, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads our certificate and key from disk.
+//
+// If they cannot be loaded we keep using the previous certificate.
+func (c *certificate) reload() error {
+
+	certTime, keyTime, err := c.modified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.cert = &cert
+	c.certTime = certTime
+	c.keyTime = keyTime
+	c.mutex.Unlock()
+	return nil
+}
+
+// modified returns the modification-times of our certificate and key.
+func (c *certificate) modified() (time.Time, time.Time, error) {
+
+	cert, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	key, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return cert.ModTime(), key.ModTime(), nil
+}
+
+// watch reloads our certificate whenever the files change, checking
+// at the given interval, and reporting the outcome via logf.
+func (c *certificate) watch(interval time.Duration, logf func(string, ...interface{})) {
+
+	for range time.Tick(interval) {
+
+		certTime, keyTime, err := c.modified()
+		if err != nil {
+			continue
+		}
+
+		c.mutex.RLock()
+		changed := !certTime.Equal(c.certTime) || !keyTime.Equal(c.keyTime)
+		c.mutex.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		//
+		// The certificate and key might not be updated at the
+		// same moment, so if they don't match we'll try again
+		// next time.
+		//
+		if err := c.reload(); err != nil {
+			logf("Error reloading our certificate: %s\n", err.Error())
+			continue
+		}
+		logf("Reloaded our certificate\n")
+	}
+}
+
+// getCertificate returns our certificate, for use as the
+// GetCertificate function of a tls.Config.
+func (c *certificate) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
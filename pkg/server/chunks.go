@@ -0,0 +1,59 @@
+//
+// Large requests, and replies, may be split into several messages, as
+// brokers commonly limit the size of those they'll relay, see
+// pkg/protocol/chunks.go.
+//
+// Given -chunk-size we split the requests we send which are larger, to
+// those clients which can reassemble them, and we always reassemble the
+// replies which clients split.
+//
+
+package server
+
+import (
+	"fmt"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// chunkMessage is a message we've reassembled from its parts.
+type chunkMessage struct {
+	// Message is the last of its parts.
+	MQTT.Message
+
+	// payload is the reassembled payload.
+	payload []byte
+}
+
+// Payload returns the reassembled payload.
+func (m *chunkMessage) Payload() []byte {
+	return m.payload
+}
+
+// publishRequest publishes the given request upon the given topic,
+// splitting it into parts if it is too large, and the client can
+// reassemble them, which are signed with the given secret if it isn't
+// empty.
+func (s *Server) publishRequest(topic string, secret string, reg *protocol.Registration, payload []byte) error {
+
+	size := 0
+	if reg != nil && reg.Chunks {
+		size = s.opts.ChunkSize
+	}
+	parts, err := protocol.Split(secret, topic, payload, size)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		token := s.mq.Publish(topic, byte(s.opts.QoS), false, part)
+		if token.Wait() && token.Error() != nil {
+			if size == 0 {
+				return fmt.Errorf("%s (the request was %d bytes, see -chunk-size)", token.Error(), len(payload))
+			}
+			return token.Error()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+//
+// Compressing responses.
+//
+// Many of the services our clients expose don't compress their responses,
+// as they're usually only reached over a local network.  Given -compress
+// we gzip responses ourselves, if the visitor accepts that, which can
+// considerably reduce the traffic sent to them.
+//
+// We only compress responses which aren't already encoded, whose type is
+// textual, and which are large enough to benefit.
+//
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressMinSize is the size of the smallest response we compress.
+const compressMinSize = 1024
+
+// compressTypes holds the (non-text/*) media-types we compress.
+var compressTypes = map[string]bool{
+	"application/javascript":    true,
+	"application/json":          true,
+	"application/manifest+json": true,
+	"application/rss+xml":       true,
+	"application/atom+xml":      true,
+	"application/xhtml+xml":     true,
+	"application/xml":           true,
+	"application/wasm":          true,
+	"image/svg+xml":             true,
+}
+
+// compressible returns true if responses of the given Content-Type are
+// worth compressing.
+func compressible(contentType string) bool {
+
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(media, "text/") || compressTypes[media]
+}
+
+// acceptsGzip returns true if the visitor's Accept-Encoding header
+// permits a gzipped response.
+func acceptsGzip(r *http.Request) bool {
+
+	for _, value := range r.Header["Accept-Encoding"] {
+		for _, enc := range splitList(value) {
+			params := strings.Split(enc, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+
+			q := 1.0
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(p)
+				if strings.HasPrefix(p, "q=") {
+					q, _ = strconv.ParseFloat(p[2:], 64)
+				}
+			}
+			if q > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compress gzips the body of the given response, if we're configured to
+// do so and the visitor accepts it.
+func (s *Server) compress(r *http.Request, res *http.Response) {
+
+	if !s.opts.Compress || !compressible(res.Header.Get("Content-Type")) {
+		return
+	}
+
+	//
+	// The response differs depending upon whether we compress it, so
+	// caches between us and the visitor must know that.
+	//
+	res.Header.Add("Vary", "Accept-Encoding")
+
+	if !acceptsGzip(r) || r.Method == http.MethodHead {
+		return
+	}
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Range") != "" {
+		return
+	}
+	if res.StatusCode < 200 || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+		return
+	}
+	if strings.Contains(res.Header.Get("Cache-Control"), "no-transform") {
+		return
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || len(body) < compressMinSize {
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(body)
+	gz.Close()
+
+	res.Body = ioutil.NopCloser(&buf)
+	res.ContentLength = int64(buf.Len())
+	res.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	res.Header.Set("Content-Encoding", "gzip")
+
+	//
+	// The compressed body isn't byte-for-byte identical to the
+	// original, so any strong validator must be weakened.
+	//
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+}
@@ -0,0 +1,147 @@
+//
+// Limiting the number of requests in flight.
+//
+// Each request we're awaiting a reply to holds a goroutine, a buffered
+// body, and a subscription, until the client replies or we give up upon
+// it.  A slow, or busy, tunnel could therefore exhaust our resources, so
+// we limit the number of requests in flight to each tunnel, and overall,
+// via -max-concurrent-per-tunnel and -max-concurrent.
+//
+// Requests beyond those limits wait, for up to -queue-timeout, for an
+// earlier request to finish, and are then answered with a 503 status,
+// so that visitors learn promptly that the tunnel is too busy.
+//
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// concurrencyLimiter counts the requests in flight, by tunnel.
+type concurrencyLimiter struct {
+	// max is the number of requests which may be in flight, and
+	// perTunnel the number to any single tunnel, zero for unlimited.
+	max       int
+	perTunnel int
+
+	// queue is how long a request may wait for the others to finish.
+	queue time.Duration
+
+	// active is the number of requests in flight, and tunnels the
+	// number to each tunnel.
+	active  int
+	tunnels map[string]int
+
+	// released is closed, and replaced, whenever a request finishes,
+	// to wake those which are waiting.
+	released chan struct{}
+
+	// rejected counts the requests we've refused.
+	rejected int64
+
+	// mutex protects our fields.
+	mutex sync.Mutex
+}
+
+// newConcurrencyLimiter returns a limiter with the given limits.
+func newConcurrencyLimiter(max int, perTunnel int, queue time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		max:       max,
+		perTunnel: perTunnel,
+		queue:     queue,
+		tunnels:   make(map[string]int),
+		released:  make(chan struct{}),
+	}
+}
+
+// SetLimit updates the limits, and the queueing time, of the limiter.
+func (c *concurrencyLimiter) SetLimit(max int, perTunnel int, queue time.Duration) {
+
+	c.mutex.Lock()
+	c.max = max
+	c.perTunnel = perTunnel
+	c.queue = queue
+	c.mutex.Unlock()
+
+	//
+	// Raising the limits may permit those waiting to proceed.
+	//
+	c.wake()
+}
+
+// Acquire waits until a request may be sent to the named tunnel, or until
+// the visitor goes away, returning false if it may not be sent.  Each
+// successful call must be matched by a call to Release.
+func (c *concurrencyLimiter) Acquire(ctx context.Context, name string) bool {
+
+	c.mutex.Lock()
+	timer := time.NewTimer(c.queue)
+	defer timer.Stop()
+
+	for {
+		if (c.max <= 0 || c.active < c.max) && (c.perTunnel <= 0 || c.tunnels[name] < c.perTunnel) {
+			c.active++
+			c.tunnels[name]++
+			c.mutex.Unlock()
+			return true
+		}
+
+		released := c.released
+		c.mutex.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			c.reject()
+			return false
+		case <-ctx.Done():
+			c.reject()
+			return false
+		}
+		c.mutex.Lock()
+	}
+}
+
+// Release records that a request to the named tunnel has finished.
+func (c *concurrencyLimiter) Release(name string) {
+
+	c.mutex.Lock()
+	c.active--
+	c.tunnels[name]--
+	if c.tunnels[name] <= 0 {
+		delete(c.tunnels, name)
+	}
+	c.mutex.Unlock()
+
+	c.wake()
+}
+
+// wake wakes the requests which are waiting, so they may try again.
+func (c *concurrencyLimiter) wake() {
+
+	c.mutex.Lock()
+	close(c.released)
+	c.released = make(chan struct{})
+	c.mutex.Unlock()
+}
+
+// reject counts a request we've refused.
+func (c *concurrencyLimiter) reject() {
+
+	c.mutex.Lock()
+	c.rejected++
+	c.mutex.Unlock()
+}
+
+// stats returns the number of requests in flight, and the number we've
+// refused.
+func (c *concurrencyLimiter) stats() (int, int64) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.active, c.rejected
+}
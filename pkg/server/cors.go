@@ -0,0 +1,264 @@
+//
+// Cross-origin requests.
+//
+// Browser-based frontends may only call the APIs exposed by our tunnels
+// if they permit it, via CORS headers, which the local services rarely
+// send.  The operator may therefore give each tunnel a CORS policy via
+// -cors, which is most conveniently given in the configuration file:
+//
+//   cors:
+//     - "api origins=https://app.example.com,https://*.example.org credentials"
+//     - "* origins=* methods=GET,POST headers=Content-Type max-age=3600"
+//
+// Each policy is the name of the tunnel it applies to, or "*" for all of
+// them, followed by any of:
+//
+//   origins=...   The origins which may call the tunnel, "*" for any.
+//   methods=...   The methods they may use, by default GET, HEAD, POST,
+//                 PUT, PATCH, and DELETE.
+//   headers=...   The request headers they may send, by default those
+//                 the browser asks for.
+//   expose=...    The response headers their scripts may read.
+//   credentials   Permit requests which carry cookies or credentials.
+//   max-age=N     How long browsers may cache preflights, in seconds,
+//                 by default 600.
+//
+// Policies given for a particular tunnel take precedence over those given
+// for all of them.  We answer preflight requests ourselves, so they never
+// reach the client, and add the CORS headers to the responses to other
+// requests from permitted origins, replacing any the service sent.
+//
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsMethods are the methods permitted by policies which don't say.
+var corsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// corsPolicy is a single policy given via -cors.
+type corsPolicy struct {
+	// tunnel is the name of the tunnel the policy applies to, or "*".
+	tunnel string
+
+	// origins, methods, headers, and expose, are the origins which may
+	// call the tunnel, the methods and headers they may use, and the
+	// headers they may read.
+	origins []string
+	methods []string
+	headers []string
+	expose  []string
+
+	// credentials is true if requests may carry credentials.
+	credentials bool
+
+	// maxAge is how long, in seconds, preflights may be cached for.
+	maxAge int
+}
+
+// parseCORS parses the policies given via -cors.
+func parseCORS(policies []string) ([]corsPolicy, error) {
+
+	var out []corsPolicy
+	for _, ent := range policies {
+
+		fields := strings.Fields(ent)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid CORS policy %q", ent)
+		}
+
+		p := corsPolicy{
+			tunnel:  fields[0],
+			methods: corsMethods,
+			maxAge:  600,
+		}
+
+		for _, field := range fields[1:] {
+
+			key, value := field, ""
+			if i := strings.Index(field, "="); i >= 0 {
+				key, value = field[:i], field[i+1:]
+			}
+
+			var list []string
+			for _, v := range strings.Split(value, ",") {
+				if v != "" {
+					list = append(list, v)
+				}
+			}
+
+			switch key {
+			case "origins":
+				p.origins = list
+			case "methods":
+				p.methods = nil
+				for _, m := range list {
+					p.methods = append(p.methods, strings.ToUpper(m))
+				}
+			case "headers":
+				p.headers = list
+			case "expose":
+				p.expose = list
+			case "credentials":
+				p.credentials = true
+			case "max-age":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid CORS policy %q: invalid max-age %q", ent, value)
+				}
+				p.maxAge = n
+			default:
+				return nil, fmt.Errorf("invalid CORS policy %q: unknown setting %q", ent, key)
+			}
+		}
+
+		if len(p.origins) == 0 {
+			return nil, fmt.Errorf("invalid CORS policy %q: no origins are permitted", ent)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// cors returns the CORS policy of the named tunnel, or nil if it has
+// none.
+func (s *Server) cors(tunnel string) *corsPolicy {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var all *corsPolicy
+	for i, p := range s.corsPolicies {
+		if p.tunnel == tunnel {
+			return &s.corsPolicies[i]
+		}
+		if p.tunnel == "*" && all == nil {
+			all = &s.corsPolicies[i]
+		}
+	}
+	return all
+}
+
+// allows returns true if the policy permits the given origin.
+//
+// Origins may be given as "https://*.example.com" to permit any
+// subdomain of example.com.
+func (p *corsPolicy) allows(origin string) bool {
+
+	if origin == "" {
+		return false
+	}
+	for _, o := range p.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if i := strings.Index(o, "://*."); i >= 0 {
+			scheme, domain := o[:i+3], o[i+4:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(strings.ToLower(origin), strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addVary adds the given header to the Vary header, unless it is present.
+func addVary(h http.Header, name string) {
+
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// allowOrigin sets the headers which permit the given origin.
+func (p *corsPolicy) allowOrigin(h http.Header, origin string) {
+
+	//
+	// A wildcard isn't permitted alongside credentials, and otherwise
+	// the response depends upon the origin.
+	//
+	wildcard := false
+	for _, o := range p.origins {
+		if o == "*" {
+			wildcard = true
+		}
+	}
+	if wildcard && !p.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		addVary(h, "Origin")
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		h.Del("Access-Control-Allow-Credentials")
+	}
+}
+
+// preflight answers the visitor's request, if it is a CORS preflight
+// for a tunnel with a policy, returning true if it has done so.
+func (s *Server) preflight(w http.ResponseWriter, r *http.Request, tunnel string) bool {
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != http.MethodOptions || method == "" {
+		return false
+	}
+	p := s.cors(tunnel)
+	if p == nil {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	permitted := false
+	for _, m := range p.methods {
+		if m == "*" || m == strings.ToUpper(method) {
+			permitted = true
+		}
+	}
+	if !p.allows(origin) || !permitted {
+		w.Header().Set("Vary", "Origin")
+		http.Error(w, "Cross-origin request not permitted", http.StatusForbidden)
+		return true
+	}
+
+	h := w.Header()
+	p.allowOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+	if len(p.headers) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.headers, ", "))
+	} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+		h.Set("Access-Control-Allow-Headers", req)
+		addVary(h, "Access-Control-Request-Headers")
+	}
+	if p.maxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// applyCORS adds the CORS headers of the named tunnel's policy to the
+// headers of a response to the given origin, if it is permitted.
+func (s *Server) applyCORS(h http.Header, tunnel string, origin string) {
+
+	p := s.cors(tunnel)
+	if p == nil || !p.allows(origin) {
+		return
+	}
+
+	p.allowOrigin(h, origin)
+	if len(p.expose) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(p.expose, ", "))
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestCORS returns a server with the given CORS policies.
+func newTestCORS(t *testing.T, policies ...string) *Server {
+	parsed, err := parseCORS(policies)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return &Server{corsPolicies: parsed}
+}
+
+func TestParseCORS(t *testing.T) {
+
+	tests := []struct {
+		policy   string
+		expected corsPolicy
+		err      string
+	}{
+		{
+			"api origins=https://app.example.com credentials",
+			corsPolicy{tunnel: "api", origins: []string{"https://app.example.com"}, methods: corsMethods, credentials: true, maxAge: 600},
+			"",
+		},
+		{
+			"* origins=*,, methods=get,Post headers=Content-Type expose=X-A,X-B max-age=0",
+			corsPolicy{tunnel: "*", origins: []string{"*"}, methods: []string{"GET", "POST"}, headers: []string{"Content-Type"}, expose: []string{"X-A", "X-B"}},
+			"",
+		},
+		{"api", corsPolicy{}, "invalid CORS policy"},
+		{"api credentials", corsPolicy{}, "no origins"},
+		{"api origins=", corsPolicy{}, "no origins"},
+		{"api origins=* max-age=soon", corsPolicy{}, "invalid max-age"},
+		{"api origins=* max-age=-1", corsPolicy{}, "invalid max-age"},
+		{"api origins=* cookies", corsPolicy{}, "unknown setting"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+
+			policies, err := parseCORS([]string{test.policy})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(policies) != 1 || !reflect.DeepEqual(policies[0], test.expected) {
+				t.Fatalf("expected %+v, got %+v", test.expected, policies)
+			}
+		})
+	}
+}
+
+func TestCORSAllows(t *testing.T) {
+
+	p := corsPolicy{origins: []string{"https://app.example.com", "https://*.example.org"}}
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://foo.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://FOO.Example.Org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://foo.example.org", false},
+		{"", false},
+		{"null", false},
+	}
+
+	for _, test := range tests {
+		if got := p.allows(test.origin); got != test.ok {
+			t.Fatalf("allows(%q): expected %t, got %t", test.origin, test.ok, got)
+		}
+	}
+
+	open := corsPolicy{origins: []string{"*"}}
+	if !open.allows("https://anywhere.com") || open.allows("") {
+		t.Fatalf("expected a wildcard to permit any origin")
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+
+	s := newTestCORS(t, "* origins=*", "api origins=https://app.example.com credentials")
+
+	tests := []struct {
+		tunnel string
+		origin string
+	}{
+		{"api", "https://app.example.com"},
+		{"web", "*"},
+		{"", "*"},
+	}
+
+	for _, test := range tests {
+		p := s.cors(test.tunnel)
+		if p == nil || p.origins[0] != test.origin {
+			t.Fatalf("cors(%q): expected the policy for %s, got %+v", test.tunnel, test.origin, p)
+		}
+	}
+
+	if (&Server{}).cors("api") != nil {
+		t.Fatalf("expected no policy")
+	}
+}
+
+func TestApplyCORS(t *testing.T) {
+
+	s := newTestCORS(t,
+		"public origins=* expose=X-Total",
+		"private origins=https://app.example.com credentials",
+		"both origins=* credentials",
+	)
+
+	tests := []struct {
+		name     string
+		tunnel   string
+		origin   string
+		in       http.Header
+		expected http.Header
+	}{
+		{
+			"wildcard",
+			"public", "https://x.com",
+			http.Header{"Access-Control-Allow-Credentials": {"true"}},
+			http.Header{"Access-Control-Allow-Origin": {"*"}, "Access-Control-Expose-Headers": {"X-Total"}},
+		},
+		{
+			"credentials",
+			"private", "https://app.example.com",
+			http.Header{"Vary": {"Accept-Encoding"}, "Access-Control-Allow-Origin": {"*"}},
+			http.Header{
+				"Vary":                             {"Accept-Encoding", "Origin"},
+				"Access-Control-Allow-Origin":      {"https://app.example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+			},
+		},
+		{
+			"wildcard with credentials",
+			"both", "https://x.com",
+			http.Header{"Vary": {"accept, origin"}},
+			http.Header{
+				"Vary":                             {"accept, origin"},
+				"Access-Control-Allow-Origin":      {"https://x.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+			},
+		},
+		{
+			"forbidden origin",
+			"private", "https://evil.com",
+			http.Header{"Access-Control-Allow-Origin": {"*"}},
+			http.Header{"Access-Control-Allow-Origin": {"*"}},
+		},
+		{
+			"same origin",
+			"public", "",
+			http.Header{},
+			http.Header{},
+		},
+		{
+			"no policy",
+			"other", "https://x.com",
+			http.Header{},
+			http.Header{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.applyCORS(test.in, test.tunnel, test.origin)
+			if !reflect.DeepEqual(test.in, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, test.in)
+			}
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+
+	s := newTestCORS(t,
+		"api origins=https://app.example.com methods=GET,PUT headers=Content-Type max-age=60",
+		"open origins=*",
+	)
+
+	tests := []struct {
+		name     string
+		method   string
+		tunnel   string
+		origin   string
+		request  string
+		headers  string
+		answered bool
+		status   int
+		expected map[string]string
+	}{
+		{
+			"permitted", "OPTIONS", "api", "https://app.example.com", "put", "", true, http.StatusNoContent,
+			map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET, PUT",
+				"Access-Control-Allow-Headers": "Content-Type",
+				"Access-Control-Max-Age":       "60",
+			},
+		},
+		{
+			"forbidden method", "OPTIONS", "api", "https://app.example.com", "DELETE", "", true, http.StatusForbidden,
+			map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			"forbidden origin", "OPTIONS", "api", "https://evil.com", "GET", "", true, http.StatusForbidden,
+			map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"},
+		},
+		{
+			"requested headers", "OPTIONS", "open", "https://x.com", "POST", "X-A, X-B", true, http.StatusNoContent,
+			map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Headers": "X-A, X-B",
+				"Vary":                         "Access-Control-Request-Headers",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{"not a preflight", "OPTIONS", "api", "https://app.example.com", "", "", false, http.StatusOK, nil},
+		{"not OPTIONS", "GET", "api", "https://app.example.com", "GET", "", false, http.StatusOK, nil},
+		{"no policy", "OPTIONS", "other", "https://app.example.com", "GET", "", false, http.StatusOK, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest(test.method, "http://api.example.com/", nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			if test.request != "" {
+				r.Header.Set("Access-Control-Request-Method", test.request)
+			}
+			if test.headers != "" {
+				r.Header.Set("Access-Control-Request-Headers", test.headers)
+			}
+
+			w := httptest.NewRecorder()
+			if got := s.preflight(w, r, test.tunnel); got != test.answered {
+				t.Fatalf("expected %t, got %t", test.answered, got)
+			}
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, w.Code)
+			}
+			for k, v := range test.expected {
+				if got := w.Header().Get(k); got != v {
+					t.Fatalf("expected %s %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+//
+// DNS providers.
+//
+// The server may manage DNS records in two ways:
+//
+//   * To obtain a wildcard certificate, see acme.go, we must publish TXT
+//     records beneath "_acme-challenge" in our domain, via a DNSProvider.
+//
+//   * We may create a record for each tunnel as it connects, and remove
+//     it when it disconnects, see records.go, via DNSRecords.
+//
+// Those embedding the server may supply their own implementations, via
+// Options.DNS and Options.Records, whilst the operator may select one of
+// those below via -acme-dns and -dns-update:
+//
+//   cloudflare
+//      Use the Cloudflare API, with the token in $CLOUDFLARE_API_TOKEN.
+//
+//   rfc2136://[keyname:secret@]ns.example.com[:53]/zone
+//      Send dynamic updates to the given nameserver, signed with the
+//      given TSIG key (hmac-sha256, base64 encoded), if any.
+//
+//   exec:/usr/local/bin/dns-script
+//      Invoke the given program, which should exit with a non-zero
+//      status upon failure, as one of:
+//
+//        dns-script present fqdn value
+//        dns-script cleanup fqdn value
+//        dns-script add     fqdn type value ttl
+//        dns-script delete  fqdn type value
+//
+//      such as:
+//
+//        dns-script present _acme-challenge.tunnel.example.com. "gfj9X...M"
+//        dns-script add foo.tunnel.example.com. A 192.0.2.1 300
+//
+//      which allows any other host, such as Route53 via the AWS CLI, to
+//      be used with a few lines of shell.
+//
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// DNSProvider publishes, and removes, the TXT records which prove that
+// we control a domain.
+//
+// The name is fully-qualified, with a trailing dot, and there may be
+// several records with the same name, but different values.
+type DNSProvider interface {
+	Present(fqdn string, value string) error
+	CleanUp(fqdn string, value string) error
+}
+
+// DNSRecord is a single DNS record, whose name is fully-qualified, with
+// a trailing dot.
+type DNSRecord struct {
+	Name  string
+	Type  string
+	Value string
+	TTL   int
+}
+
+// DNSRecords adds, and deletes, DNS records.
+//
+// Deleting a record removes only that with the same name, type, and
+// value, leaving any others with the same name in place.
+type DNSRecords interface {
+	AddRecord(rec DNSRecord) error
+	DeleteRecord(rec DNSRecord) error
+}
+
+// newDNSRecords returns the provider named by the given specification.
+func newDNSRecords(spec string) (DNSRecords, error) {
+
+	switch {
+	case spec == "cloudflare":
+		return newCloudflare()
+	case strings.HasPrefix(spec, "rfc2136://"):
+		return newRFC2136(spec)
+	case strings.HasPrefix(spec, "exec:"):
+		return execProvider(strings.TrimPrefix(spec, "exec:")), nil
+	}
+	return nil, fmt.Errorf("unknown DNS provider %q", spec)
+}
+
+// newDNSProvider returns the provider named by the given -acme-dns
+// specification.
+func newDNSProvider(spec string) (DNSProvider, error) {
+
+	switch {
+	case spec == "":
+		return nil, errors.New("-acme-domain requires a DNS provider, via -acme-dns")
+	case strings.HasPrefix(spec, "exec:"):
+		return execProvider(strings.TrimPrefix(spec, "exec:")), nil
+	}
+
+	records, err := newDNSRecords(spec)
+	if err != nil {
+		return nil, err
+	}
+	return txtProvider{records}, nil
+}
+
+// txtProvider is a DNSProvider which publishes TXT records via any of
+// our DNSRecords.
+type txtProvider struct {
+	DNSRecords
+}
+
+// Present publishes the given record.
+func (t txtProvider) Present(fqdn string, value string) error {
+	return t.AddRecord(DNSRecord{Name: fqdn, Type: "TXT", Value: value, TTL: 60})
+}
+
+// CleanUp removes the given record.
+func (t txtProvider) CleanUp(fqdn string, value string) error {
+	return t.DeleteRecord(DNSRecord{Name: fqdn, Type: "TXT", Value: value})
+}
+
+// execProvider is a DNSProvider, and DNSRecords, which invokes the
+// named program.
+type execProvider string
+
+// run invokes our program, with the given arguments.
+func (e execProvider) run(args ...string) error {
+	out, err := exec.Command(string(e), args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s %s", e, err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Present publishes the given record.
+func (e execProvider) Present(fqdn string, value string) error {
+	return e.run("present", fqdn, value)
+}
+
+// CleanUp removes the given record.
+func (e execProvider) CleanUp(fqdn string, value string) error {
+	return e.run("cleanup", fqdn, value)
+}
+
+// AddRecord adds the given record.
+func (e execProvider) AddRecord(rec DNSRecord) error {
+	return e.run("add", rec.Name, rec.Type, rec.Value, strconv.Itoa(rec.TTL))
+}
+
+// DeleteRecord deletes the given record.
+func (e execProvider) DeleteRecord(rec DNSRecord) error {
+	return e.run("delete", rec.Name, rec.Type, rec.Value)
+}
@@ -0,0 +1,182 @@
+//
+// Managing DNS records via the Cloudflare API.
+//
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cloudflareAPI is the base URL of the Cloudflare API.
+var cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareExists is the error code returned when adding a record
+// which already exists.
+const cloudflareExists = 81057
+
+// cloudflare manages records via the Cloudflare API.
+type cloudflare struct {
+	// token authenticates us.
+	token string
+
+	// zones caches the IDs of the zones we've found, by name, with
+	// an empty ID for those names which aren't zones.
+	zones map[string]string
+	mutex sync.Mutex
+
+	// client makes our requests.
+	client *http.Client
+}
+
+// newCloudflare returns a provider using the token in our environment.
+func newCloudflare() (*cloudflare, error) {
+
+	token := os.Getenv("CLOUDFLARE_API_TOKEN")
+	if token == "" {
+		return nil, errors.New("the cloudflare DNS provider requires $CLOUDFLARE_API_TOKEN")
+	}
+	return &cloudflare{
+		token:  token,
+		zones:  make(map[string]string),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// call makes a request to the API, decoding the result into out, if it
+// is non-nil.
+func (c *cloudflare) call(method string, path string, body interface{}, out interface{}) error {
+
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, cloudflareAPI+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var reply struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("cloudflare: %s", res.Status)
+	}
+	if !reply.Success {
+		for _, e := range reply.Errors {
+			if e.Code == cloudflareExists {
+				return nil
+			}
+		}
+		if len(reply.Errors) > 0 {
+			return fmt.Errorf("cloudflare: %s", reply.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare: %s", res.Status)
+	}
+	if out != nil {
+		return json.Unmarshal(reply.Result, out)
+	}
+	return nil
+}
+
+// zone returns the ID of the zone containing the given name, which is
+// the longest suffix of it that Cloudflare knows.
+func (c *cloudflare) zone(name string) (string, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		zone := strings.Join(labels[i:], ".")
+		if id, ok := c.zones[zone]; ok {
+			if id == "" {
+				continue
+			}
+			return id, nil
+		}
+
+		var found []struct {
+			ID string `json:"id"`
+		}
+		if err := c.call(http.MethodGet, "/zones?name="+url.QueryEscape(zone), nil, &found); err != nil {
+			return "", err
+		}
+		if len(found) == 0 {
+			c.zones[zone] = ""
+			continue
+		}
+		c.zones[zone] = found[0].ID
+		return found[0].ID, nil
+	}
+	return "", fmt.Errorf("cloudflare: no zone contains %s", name)
+}
+
+// AddRecord adds the given record.
+func (c *cloudflare) AddRecord(rec DNSRecord) error {
+
+	id, err := c.zone(rec.Name)
+	if err != nil {
+		return err
+	}
+	return c.call(http.MethodPost, "/zones/"+id+"/dns_records", map[string]interface{}{
+		"type":    rec.Type,
+		"name":    strings.TrimSuffix(rec.Name, "."),
+		"content": rec.Value,
+		"ttl":     rec.TTL,
+	}, nil)
+}
+
+// DeleteRecord deletes the given record.
+func (c *cloudflare) DeleteRecord(rec DNSRecord) error {
+
+	id, err := c.zone(rec.Name)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("type", rec.Type)
+	q.Set("name", strings.TrimSuffix(rec.Name, "."))
+	q.Set("content", rec.Value)
+
+	var found []struct {
+		ID string `json:"id"`
+	}
+	if err := c.call(http.MethodGet, "/zones/"+id+"/dns_records?"+q.Encode(), nil, &found); err != nil {
+		return err
+	}
+	for _, r := range found {
+		if err := c.call(http.MethodDelete, "/zones/"+id+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+//
+// Managing DNS records via dynamic updates (RFC 2136), signed with TSIG
+// (RFC 8945), as supported by BIND, Knot, PowerDNS, and others.
+//
+// When we have a key we sign our updates, and require the response to be
+// signed too, covering the MAC of our update, so that nobody who can
+// reach us may forge the acknowledgement of an update which was lost.
+//
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The values we need which dnsmessage doesn't define.
+const (
+	dnsOpUpdate  = 5
+	dnsClassNone = 254
+	dnsTypeTSIG  = 250
+	tsigFudge    = 300
+	tsigHMAC     = "hmac-sha256."
+)
+
+// rfc2136 manages the records of a zone via dynamic updates.
+type rfc2136 struct {
+	// server is the address of the primary nameserver.
+	server string
+
+	// zone is the name of the zone we update.
+	zone string
+
+	// keyName and secret form the TSIG key we sign our updates with,
+	// if any.
+	keyName string
+	secret  []byte
+
+	// now returns the current time, with which we sign, and check the
+	// time at which responses were signed.
+	now func() time.Time
+}
+
+// tsigErrors are the names of the errors a TSIG record may carry.
+var tsigErrors = map[uint16]string{
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+	22: "BADTRUNC",
+}
+
+// newRFC2136 returns a provider for the given specification, which has
+// the form "rfc2136://[keyname:secret@]server[:port]/zone".
+func newRFC2136(spec string) (*rfc2136, error) {
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rfc2136{
+		server: u.Host,
+		zone:   strings.Trim(u.Path, "/"),
+		now:    time.Now,
+	}
+	if r.zone == "" {
+		return nil, errors.New("rfc2136: the zone to update is required")
+	}
+	r.zone = strings.ToLower(r.zone) + "."
+	if u.Port() == "" {
+		r.server = net.JoinHostPort(u.Hostname(), "53")
+	}
+
+	if u.User != nil {
+		r.keyName = strings.ToLower(strings.TrimSuffix(u.User.Username(), ".")) + "."
+		secret, _ := u.User.Password()
+		r.secret, err = base64.StdEncoding.DecodeString(secret)
+		if err != nil || len(r.secret) == 0 {
+			return nil, errors.New("rfc2136: the TSIG secret must be base64 encoded")
+		}
+	}
+	return r, nil
+}
+
+// AddRecord adds the given record.
+func (r *rfc2136) AddRecord(rec DNSRecord) error {
+	return r.update(rec, dnsmessage.ClassINET, uint32(rec.TTL))
+}
+
+// DeleteRecord deletes the given record.
+func (r *rfc2136) DeleteRecord(rec DNSRecord) error {
+	return r.update(rec, dnsClassNone, 0)
+}
+
+// update sends a single update, adding the given record if the class is
+// IN, or deleting it if it is NONE.
+func (r *rfc2136) update(rec DNSRecord, class dnsmessage.Class, ttl uint32) error {
+
+	zone, err := dnsmessage.NewName(r.zone)
+	if err != nil {
+		return err
+	}
+	name, err := dnsmessage.NewName(strings.ToLower(rec.Name))
+	if err != nil {
+		return err
+	}
+
+	var rnd [2]byte
+	rand.Read(rnd[:])
+	id := binary.BigEndian.Uint16(rnd[:])
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, OpCode: dnsOpUpdate})
+
+	//
+	// The zone is sent as the (only) question, and the record within
+	// the authority section, which RFC 2136 calls the update section.
+	//
+	if err := b.StartQuestions(); err != nil {
+		return err
+	}
+	if err := b.Question(dnsmessage.Question{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}); err != nil {
+		return err
+	}
+	if err := b.StartAuthorities(); err != nil {
+		return err
+	}
+
+	h := dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+	switch strings.ToUpper(rec.Type) {
+	case "A":
+		ip := net.ParseIP(rec.Value).To4()
+		if ip == nil {
+			return fmt.Errorf("rfc2136: invalid IPv4 address %q", rec.Value)
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		err = b.AResource(h, a)
+	case "AAAA":
+		ip := net.ParseIP(rec.Value).To16()
+		if ip == nil {
+			return fmt.Errorf("rfc2136: invalid IPv6 address %q", rec.Value)
+		}
+		var a dnsmessage.AAAAResource
+		copy(a.AAAA[:], ip)
+		err = b.AAAAResource(h, a)
+	case "CNAME":
+		target, nerr := dnsmessage.NewName(strings.TrimSuffix(rec.Value, ".") + ".")
+		if nerr != nil {
+			return nerr
+		}
+		err = b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: target})
+	case "TXT":
+		err = b.TXTResource(h, dnsmessage.TXTResource{TXT: []string{rec.Value}})
+	default:
+		return fmt.Errorf("rfc2136: unsupported record type %q", rec.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	var mac []byte
+	if r.keyName != "" {
+		msg, mac = r.sign(msg, id)
+	}
+
+	reply, err := r.exchange(msg)
+	if err != nil {
+		return fmt.Errorf("rfc2136: %s", err.Error())
+	}
+	if r.keyName != "" {
+		if err := r.verify(reply, mac); err != nil {
+			return fmt.Errorf("rfc2136: the response to the update of %s: %s", rec.Name, err.Error())
+		}
+	}
+
+	var p dnsmessage.Parser
+	rh, err := p.Start(reply)
+	if err != nil {
+		return fmt.Errorf("rfc2136: %s", err.Error())
+	}
+	if rh.ID != id || !rh.Response {
+		return fmt.Errorf("rfc2136: the response to the update of %s doesn't match it", rec.Name)
+	}
+	if rh.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("rfc2136: the update of %s was refused: %s", rec.Name, rh.RCode)
+	}
+	return nil
+}
+
+// wireName returns the given fully-qualified name in its uncompressed
+// wire format.
+func wireName(name string) []byte {
+
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+// readName reads the name at the given offset of the given message,
+// following any compression pointers, and returns it in lower case with
+// a trailing dot, along with the offset which follows it.
+func readName(msg []byte, off int) (string, int, error) {
+
+	var labels []string
+	next := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errors.New("invalid name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", next, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("invalid name")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = (n&0x3f)<<8 | int(msg[off+1])
+		case n&0xc0 != 0:
+			return "", 0, errors.New("invalid name")
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("invalid name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// digest returns the MAC of the given message, which lacks its TSIG
+// record, and then the variables of that record: the time signed and
+// fudge, followed by the rest, being the error and other data.
+//
+// The MAC of a response also covers that of the request, given as prior.
+func (r *rfc2136) digest(prior []byte, msg []byte, signed []byte, rest []byte) []byte {
+
+	mac := hmac.New(sha256.New, r.secret)
+	if prior != nil {
+		mac.Write([]byte{byte(len(prior) >> 8), byte(len(prior))})
+		mac.Write(prior)
+	}
+	mac.Write(msg)
+	mac.Write(wireName(r.keyName))
+	mac.Write([]byte{0, 255, 0, 0, 0, 0})
+	mac.Write(wireName(tsigHMAC))
+	mac.Write(signed)
+	mac.Write(rest)
+	return mac.Sum(nil)
+}
+
+// sign appends a TSIG record to the given message, returning it, and the
+// MAC, which the response must cover.
+func (r *rfc2136) sign(msg []byte, id uint16) ([]byte, []byte) {
+
+	now := r.now().Unix()
+	signed := []byte{
+		byte(now >> 40), byte(now >> 32), byte(now >> 24), byte(now >> 16), byte(now >> 8), byte(now),
+		tsigFudge >> 8, tsigFudge & 0xff,
+	}
+	sum := r.digest(nil, msg, signed, []byte{0, 0, 0, 0})
+
+	var rdata []byte
+	rdata = append(rdata, wireName(tsigHMAC)...)
+	rdata = append(rdata, signed...)
+	rdata = append(rdata, byte(len(sum)>>8), byte(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, byte(id>>8), byte(id), 0, 0, 0, 0)
+
+	out := append([]byte{}, msg...)
+	out = append(out, wireName(r.keyName)...)
+	out = append(out, dnsTypeTSIG>>8, dnsTypeTSIG&0xff, 0, 255, 0, 0, 0, 0)
+	out = append(out, byte(len(rdata)>>8), byte(len(rdata)))
+	out = append(out, rdata...)
+
+	//
+	// The TSIG record is the last additional record.
+	//
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	return out, sum
+}
+
+// verify checks that the given response is signed with our key, covering
+// the MAC of our request, given as prior, and at about the current time.
+func (r *rfc2136) verify(reply []byte, prior []byte) error {
+
+	errTruncated := errors.New("the response is truncated")
+	if len(reply) < 12 {
+		return errTruncated
+	}
+	var counts [4]int
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(reply[4+2*i:]))
+	}
+	if counts[3] == 0 {
+		return errors.New("the response is unsigned")
+	}
+
+	//
+	// Find the last record, which must be the TSIG record.
+	//
+	off := 12
+	var err error
+	for i := 0; i < counts[0]; i++ {
+		if _, off, err = readName(reply, off); err != nil {
+			return err
+		}
+		off += 4
+	}
+
+	var owner string
+	var start, typ, class int
+	var rdata []byte
+	for i := 0; i < counts[1]+counts[2]+counts[3]; i++ {
+		start = off
+		if owner, off, err = readName(reply, off); err != nil {
+			return err
+		}
+		if off+10 > len(reply) {
+			return errTruncated
+		}
+		typ = int(binary.BigEndian.Uint16(reply[off:]))
+		class = int(binary.BigEndian.Uint16(reply[off+2:]))
+		size := int(binary.BigEndian.Uint16(reply[off+8:]))
+		if off+10+size > len(reply) {
+			return errTruncated
+		}
+		rdata = reply[off+10 : off+10+size]
+		off += 10 + size
+	}
+	if off != len(reply) {
+		return errors.New("the response has trailing data")
+	}
+	if typ != dnsTypeTSIG || class != 255 {
+		return errors.New("the response is unsigned")
+	}
+	if owner != r.keyName {
+		return fmt.Errorf("the response is signed with the key %s", owner)
+	}
+
+	//
+	// The algorithm, time signed and fudge, MAC, original ID, error,
+	// and other data.
+	//
+	alg, n, err := readName(rdata, 0)
+	if err != nil {
+		return err
+	}
+	if alg != tsigHMAC {
+		return fmt.Errorf("the response is signed with %s", alg)
+	}
+	if n+10 > len(rdata) {
+		return errTruncated
+	}
+	signed := rdata[n : n+8]
+	p := n + 10 + int(binary.BigEndian.Uint16(rdata[n+8:]))
+	if p+6 > len(rdata) || p+6+int(binary.BigEndian.Uint16(rdata[p+4:])) != len(rdata) {
+		return errTruncated
+	}
+	mac := rdata[n+10 : p]
+	rest := rdata[p+2:]
+
+	if code := binary.BigEndian.Uint16(rest); code != 0 {
+		name, ok := tsigErrors[code]
+		if !ok {
+			name = fmt.Sprintf("error %d", code)
+		}
+		return fmt.Errorf("the server rejected our signature: %s", name)
+	}
+
+	//
+	// The MAC covers the message as it was before the TSIG record was
+	// added, bearing its original ID.
+	//
+	msg := append([]byte{}, reply[:start]...)
+	copy(msg[0:2], rdata[p:p+2])
+	binary.BigEndian.PutUint16(msg[10:], uint16(counts[3]-1))
+	if !hmac.Equal(mac, r.digest(prior, msg, signed, rest)) {
+		return errors.New("the response has an invalid signature")
+	}
+
+	var at int64
+	for _, b := range signed[:6] {
+		at = at<<8 | int64(b)
+	}
+	fudge := int64(binary.BigEndian.Uint16(signed[6:]))
+	if skew := r.now().Unix() - at; skew > fudge || skew < -fudge {
+		return fmt.Errorf("the response was signed at %s, beyond the fudge of %ds", time.Unix(at, 0).UTC().Format(time.RFC3339), fudge)
+	}
+	return nil
+}
+
+// exchange sends the given message to our nameserver, over TCP, and
+// returns the response.
+func (r *rfc2136) exchange(msg []byte) ([]byte, error) {
+
+	conn, err := net.DialTimeout("tcp", r.server, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	if _, err := conn.Write(append(frame, msg...)); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, frame[:2]); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(frame))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The known answers below were computed independently of our code, with
+// a TSIG key named key.example., whose secret is testSecret, at the time
+// testSigned.
+const (
+	testSecret = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testSigned = 1700000000
+
+	// testRequest is an update of the zone example.com, with the ID
+	// 0x1234, and testSignedRequest the same, signed.
+	testRequest       = "123428000001000000000000076578616d706c6503636f6d0000060001"
+	testSignedRequest = "123428000001000000000001076578616d706c6503636f6d0000060001036b6579076578616d706c650000fa00ff00000000003d0b686d61632d7368613235360000006553f100012c0020d103a6a5b7c1491103eb14697361ff0bf1eff9e9a749a450ea42bc17282339b7123400000000"
+	testRequestMAC    = "d103a6a5b7c1491103eb14697361ff0bf1eff9e9a749a450ea42bc17282339b7"
+
+	// testResponse is the signed response to testSignedRequest.
+	testResponse = "1234a8000001000000000001076578616d706c6503636f6d0000060001036b6579076578616d706c650000fa00ff00000000003d0b686d61632d7368613235360000006553f100012c00201ee8bf79aafc30f7543aa30bd09f1fe03a6c589052d05a0e92545e1585e31702123400000000"
+
+	// testBadSig is an unsigned response, reporting a BADSIG error.
+	testBadSig = "1234a8000001000000000001076578616d706c6503636f6d0000060001036b6579076578616d706c650000fa00ff00000000001d0b686d61632d7368613235360000006553f100012c0000123400100000"
+
+	// testShortMAC is testResponse, with its MAC truncated.
+	testShortMAC = "1234a8000001000000000001076578616d706c6503636f6d0000060001036b6579076578616d706c650000fa00ff00000000002d0b686d61632d7368613235360000006553f100012c00101ee8bf79aafc30f7543aa30bd09f1fe0123400000000"
+
+	// testRewritten is testResponse, whose ID was rewritten en route.
+	testRewritten = "5678a8000001000000000001076578616d706c6503636f6d0000060001036b6579076578616d706c650000fa00ff00000000003d0b686d61632d7368613235360000006553f100012c00201ee8bf79aafc30f7543aa30bd09f1fe03a6c589052d05a0e92545e1585e31702123400000000"
+)
+
+// unhex decodes the given hex, or fails the test.
+func unhex(t *testing.T, s string) []byte {
+	out, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return out
+}
+
+// newTestRFC2136 returns a provider using our test key, at the given
+// time, updating example.com upon the given server.
+func newTestRFC2136(t *testing.T, server string, now int64) *rfc2136 {
+
+	r, err := newRFC2136("rfc2136://Key.Example:" + testSecret + "@" + server + "/example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r.now = func() time.Time { return time.Unix(now, 0) }
+	return r
+}
+
+func TestReadName(t *testing.T) {
+
+	// example.com at 0, www.<pointer to 0> at 13, and a loop at 19.
+	msg := []byte("\x07example\x03com\x00\x03www\xc0\x00\xc0\x13")
+
+	tests := []struct {
+		off  int
+		name string
+		next int
+		ok   bool
+	}{
+		{0, "example.com.", 13, true},
+		{8, "com.", 13, true},
+		{12, ".", 13, true},
+		{13, "www.example.com.", 19, true},
+		{19, "", 0, false},
+		{len(msg), "", 0, false},
+	}
+
+	for _, test := range tests {
+		name, next, err := readName(msg, test.off)
+		if (err == nil) != test.ok || name != test.name || next != test.next {
+			t.Fatalf("readName at %d: expected (%q, %d, %t), got (%q, %d, %v)", test.off, test.name, test.next, test.ok, name, next, err)
+		}
+	}
+
+	if _, _, err := readName([]byte("\x07exam"), 0); err == nil {
+		t.Fatalf("expected a truncated label to be rejected")
+	}
+}
+
+func TestTSIGSign(t *testing.T) {
+
+	r := newTestRFC2136(t, "ns.example.com", testSigned)
+
+	msg, mac := r.sign(unhex(t, testRequest), 0x1234)
+	if hex.EncodeToString(msg) != testSignedRequest {
+		t.Fatalf("expected %s, got %x", testSignedRequest, msg)
+	}
+	if hex.EncodeToString(mac) != testRequestMAC {
+		t.Fatalf("expected the MAC %s, got %x", testRequestMAC, mac)
+	}
+}
+
+func TestTSIGVerify(t *testing.T) {
+
+	response := unhex(t, testResponse)
+	tampered := append([]byte{}, response...)
+	tampered[14] ^= 1
+
+	tests := []struct {
+		name     string
+		response []byte
+		prior    string
+		secret   string
+		key      string
+		now      int64
+		err      string
+	}{
+		{"valid", response, testRequestMAC, "", "", testSigned, ""},
+		{"rewritten ID", unhex(t, testRewritten), testRequestMAC, "", "", testSigned, ""},
+		{"within the fudge", response, testRequestMAC, "", "", testSigned + 300, ""},
+		{"within the fudge, behind", response, testRequestMAC, "", "", testSigned - 300, ""},
+		{"too late", response, testRequestMAC, "", "", testSigned + 301, "beyond the fudge"},
+		{"too early", response, testRequestMAC, "", "", testSigned - 301, "beyond the fudge"},
+		{"tampered", tampered, testRequestMAC, "", "", testSigned, "invalid signature"},
+		{"another request", response, strings.Repeat("00", 32), "", "", testSigned, "invalid signature"},
+		{"another secret", response, testRequestMAC, "c2VjcmV0", "", testSigned, "invalid signature"},
+		{"another key", response, testRequestMAC, "", "other.example.", testSigned, "signed with the key key.example."},
+		{"truncated MAC", unhex(t, testShortMAC), testRequestMAC, "", "", testSigned, "invalid signature"},
+		{"rejected", unhex(t, testBadSig), testRequestMAC, "", "", testSigned, "rejected our signature: BADSIG"},
+		{"unsigned", unhex(t, testRequest), testRequestMAC, "", "", testSigned, "unsigned"},
+		{"truncated", response[:len(response)-1], testRequestMAC, "", "", testSigned, "truncated"},
+		{"trailing data", append(append([]byte{}, response...), 0), testRequestMAC, "", "", testSigned, "trailing data"},
+		{"header only", response[:11], testRequestMAC, "", "", testSigned, "truncated"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := newTestRFC2136(t, "ns.example.com", test.now)
+			if test.secret != "" {
+				r.secret = []byte(test.secret)
+			}
+			if test.key != "" {
+				r.keyName = test.key
+			}
+
+			err := r.verify(test.response, unhex(t, test.prior))
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// fakeNameserver accepts a single update, and sends the response which
+// the given function returns for it.
+func fakeNameserver(t *testing.T, respond func(req []byte) []byte) string {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var frame [2]byte
+		if _, err := io.ReadFull(conn, frame[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(frame[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		reply := respond(req)
+		binary.BigEndian.PutUint16(frame[:], uint16(len(reply)))
+		conn.Write(append(frame[:], reply...))
+	}()
+	return l.Addr().String()
+}
+
+func TestRFC2136Update(t *testing.T) {
+
+	//
+	// reply answers a signed request, copying its ID and question, with
+	// the given response code, signed with the given key, which is
+	// ours unless it's nil.
+	//
+	reply := func(rcode byte, key *rfc2136, id uint16) func(req []byte) []byte {
+		return func(req []byte) []byte {
+
+			prior := req[len(req)-38 : len(req)-6]
+			body := req[12:bytes.Index(req, wireName("key.example."))]
+
+			msg := []byte{0, 0, 0xa8, rcode, 0, 0, 0, 0, 0, 0, 0, 0}
+			binary.BigEndian.PutUint16(msg, id)
+			if id == 0 {
+				copy(msg, req[:2])
+			}
+			copy(msg[4:10], req[4:10])
+			msg = append(msg, body...)
+			if key == nil {
+				return msg
+			}
+
+			signed := make([]byte, 8)
+			binary.BigEndian.PutUint64(signed, uint64(key.now().Unix())<<16|tsigFudge)
+			mac := key.digest(prior, msg, signed, []byte{0, 0, 0, 0})
+
+			rdata := append(wireName(tsigHMAC), signed...)
+			rdata = append(rdata, 0, byte(len(mac)))
+			rdata = append(rdata, mac...)
+			rdata = append(rdata, msg[0], msg[1], 0, 0, 0, 0)
+
+			out := append(msg, wireName(key.keyName)...)
+			out = append(out, 0, dnsTypeTSIG, 0, 255, 0, 0, 0, 0, 0, byte(len(rdata)))
+			out = append(out, rdata...)
+			out[11] = 1
+			return out
+		}
+	}
+
+	now := time.Now().Unix()
+	ours := newTestRFC2136(t, "", now)
+	theirs := newTestRFC2136(t, "", now)
+	theirs.secret = []byte("another secret")
+
+	tests := []struct {
+		name    string
+		respond func(req []byte) []byte
+		err     string
+	}{
+		{"accepted", reply(0, ours, 0), ""},
+		{"refused", reply(5, ours, 0), "was refused: RCodeRefused"},
+		{"unsigned", reply(0, nil, 0), "unsigned"},
+		{"forged", reply(0, theirs, 0), "invalid signature"},
+		{"another ID", reply(0, ours, 1), "doesn't match"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := newTestRFC2136(t, fakeNameserver(t, test.respond), now)
+			err := r.AddRecord(DNSRecord{Name: "_acme-challenge.example.com.", Type: "TXT", Value: "token", TTL: 60})
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
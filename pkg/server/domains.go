@@ -0,0 +1,141 @@
+//
+// Custom domains.
+//
+// Usually the name of a tunnel is taken from the first label of the
+// hostname a visitor requests, so "foo.tunnel.steve.fi" reaches the
+// tunnel named "foo".
+//
+// Users may also point a domain of their own, such as "demo.example.com",
+// at the server via a CNAME record.  The operator then maps that domain
+// to the name of a tunnel, either via "-domain demo.example.com=foo", or
+// at runtime via the "/domains" end-point of the admin API.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// tunnelName returns the name of the tunnel which serves the given
+// hostname, as sent by the visitor.
+func (s *Server) tunnelName(host string) string {
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if name, ok := s.domainMap()[host]; ok {
+		return name
+	}
+
+	//
+	// We assume that the variable part will be the start of the
+	// hostname, which will be split by ".".
+	//
+	if i := strings.Index(host, "."); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// domainMap returns the custom domains we know of, mapped to the names
+// of the tunnels serving them.
+//
+// Those added via the admin API take precedence over those configured
+// via -domain.
+func (s *Server) domainMap() map[string]string {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	out := make(map[string]string)
+	for _, ent := range s.opts.Domains {
+		if i := strings.Index(ent, "="); i > 0 {
+			out[strings.ToLower(ent[:i])] = ent[i+1:]
+		}
+	}
+	for domain, name := range s.customDomains {
+		out[domain] = name
+	}
+	return out
+}
+
+// domainsHandler lists, adds, and removes custom domains via the admin
+// API:
+//
+//   GET    /domains                              - List the domains.
+//   POST   /domains?domain=a.example&tunnel=foo  - Map a domain to a tunnel.
+//   DELETE /domains?domain=a.example             - Remove a domain we added.
+//
+func (s *Server) domainsHandler(w http.ResponseWriter, r *http.Request) {
+
+	domain := strings.ToLower(r.FormValue("domain"))
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		tunnel := r.FormValue("tunnel")
+		if domain == "" || tunnel == "" {
+			http.Error(w, "Both the domain and tunnel are required", http.StatusBadRequest)
+			return
+		}
+		if err := protocol.CheckName(tunnel); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mutex.Lock()
+		s.customDomains[domain] = tunnel
+		s.mutex.Unlock()
+
+	case http.MethodDelete:
+		s.mutex.Lock()
+		_, ok := s.customDomains[domain]
+		delete(s.customDomains, domain)
+		s.mutex.Unlock()
+
+		if !ok {
+			http.Error(w, "No such domain was added via the API", http.StatusNotFound)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.records != nil && r.Method != http.MethodGet {
+		s.records.update()
+	}
+
+	//
+	// Always report the current state.
+	//
+	type mapping struct {
+		Domain string
+		Tunnel string
+	}
+	var out []mapping
+	for d, t := range s.domainMap() {
+		out = append(out, mapping{Domain: d, Tunnel: t})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Domain < out[j].Domain
+	})
+
+	js, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
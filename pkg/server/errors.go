@@ -0,0 +1,178 @@
+//
+// Error pages.
+//
+// When we cannot relay a request we show the visitor an error page,
+// which operators may customize by pointing -error-pages at a directory
+// containing one, or more, Go templates named after the kind of error:
+//
+//   offline.html      - No client is serving the tunnel.
+//   unreachable.html  - The client didn't receive the request.
+//   timeout.html      - The client received the request, but didn't reply
+//                       in time.
+//   denied.html       - The visitor's address isn't permitted.
+//   banned.html       - The operator has banned the tunnel.
+//   maintenance.html  - The tunnel is in maintenance mode.
+//   busy.html         - The tunnel has too many requests in flight.
+//   quota.html        - The tunnel's token has exceeded its daily limits.
+//
+// Each template is executed with an ErrorPage structure, and those which
+// are not present are replaced by our default page.
+//
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrorPage holds the details available to our error templates.
+type ErrorPage struct {
+	// Tunnel is the name of the tunnel the visitor requested.
+	Tunnel string
+
+	// RequestID uniquely identifies the request.
+	RequestID string
+
+	// Kind is the kind of error, such as "timeout".
+	Kind string
+
+	// Status is the HTTP status-code of the response.
+	Status int
+
+	// Message is a short description of the error.
+	Message string
+}
+
+// errorKinds maps each kind of error to its default message.
+var errorKinds = map[string]string{
+	"offline":     "There is no client serving this tunnel.",
+	"unreachable": "The client serving this tunnel didn't receive your request.",
+	"timeout":     "We didn't receive a reply from the remote host in time.",
+	"denied":      "You are not permitted to access this tunnel.",
+	"banned":      "This tunnel has been disabled by the operator of this server.",
+	"maintenance": "This service is down for maintenance, please try again shortly.",
+	"busy":        "This tunnel is too busy to handle your request, please try again shortly.",
+	"quota":       "This tunnel has exceeded its quota for today, please try again tomorrow.",
+}
+
+// defaultErrorPage is used for any kind of error the operator hasn't
+// supplied a template for.
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+// loadErrorPages parses the templates within the given directory,
+// returning a map of the kinds of error to the template to use.
+//
+// If the directory is empty our default page is used for every kind.
+func loadErrorPages(dir string) (map[string]*template.Template, error) {
+
+	pages := make(map[string]*template.Template)
+
+	for kind := range errorKinds {
+		pages[kind] = defaultErrorPage
+
+		if dir == "" {
+			continue
+		}
+
+		path := filepath.Join(dir, kind+".html")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		t, err := template.ParseFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		pages[kind] = t
+	}
+	return pages, nil
+}
+
+// renderError returns the body of the error page of the given kind.
+func (s *Server) renderError(kind string, status int, tunnel string, id string) []byte {
+	return s.renderMessage(kind, status, tunnel, id, "")
+}
+
+// renderMessage returns the body of the error page of the given kind,
+// showing the given message rather than our default, if it is set.
+func (s *Server) renderMessage(kind string, status int, tunnel string, id string, message string) []byte {
+
+	if message == "" {
+		message = errorKinds[kind]
+	}
+
+	s.mutex.RLock()
+	t := s.errorPages[kind]
+	s.mutex.RUnlock()
+
+	if t == nil {
+		t = defaultErrorPage
+	}
+
+	var buf bytes.Buffer
+	err := t.Execute(&buf, ErrorPage{
+		Tunnel:    tunnel,
+		RequestID: id,
+		Kind:      kind,
+		Status:    status,
+		Message:   message,
+	})
+	if err != nil {
+		s.logf("Error rendering the %s page: %s\n", kind, err.Error())
+		return []byte(message + "\n")
+	}
+	return buf.Bytes()
+}
+
+// errorPage writes the error page of the given kind to the visitor.
+func (s *Server) errorPage(w http.ResponseWriter, kind string, status int, tunnel string, id string) {
+
+	body := s.renderError(kind, status, tunnel, id)
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// errorResponse returns the error page of the given kind as a complete
+// plain-text response, as our clients would send.
+func (s *Server) errorResponse(kind string, status int, tunnel string, id string) string {
+
+	body := s.renderError(kind, status, tunnel, id)
+
+	return fmt.Sprintf("HTTP/1.0 %d %s\r\nContent-Type: text/html; charset=UTF-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+}
+
+// failureCounts counts the requests we couldn't relay, by the kind of
+// error page we showed, for our metrics.
+type failureCounts struct {
+	counts map[string]int64
+	mutex  sync.Mutex
+}
+
+// add counts a failure of the given kind.
+func (f *failureCounts) add(kind string) {
+	f.mutex.Lock()
+	f.counts[kind]++
+	f.mutex.Unlock()
+}
+
+// get returns the number of failures of the given kind.
+func (f *failureCounts) get(kind string) int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.counts[kind]
+}
@@ -0,0 +1,189 @@
+//
+// Header rules.
+//
+// The operator may add, replace, or remove the headers of the requests
+// we send to each tunnel, and of the responses we send to visitors, via
+// -header-rule, which is most conveniently given in the configuration
+// file:
+//
+//   header-rule:
+//     - "* response del Server"
+//     - "* response set Strict-Transport-Security max-age=31536000"
+//     - "api request set X-Correlation-ID {id}"
+//
+// Each rule is the name of the tunnel it applies to, or "*" for all of
+// them, whether it applies to the "request" or the "response", the
+// action, one of "add", "set", or "del", the name of the header, and its
+// value.  Values may refer to the ID of the request as "{id}", and the
+// name of the tunnel as "{tunnel}".
+//
+// Responses which we cannot parse, and write to the visitor verbatim,
+// are not affected, see hijackResponse.
+//
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// headerRule is a single rule given via -header-rule.
+type headerRule struct {
+	// tunnel is the name of the tunnel the rule applies to, or "*".
+	tunnel string
+
+	// response is true if the rule applies to responses, rather than
+	// requests.
+	response bool
+
+	// action is one of "add", "set", or "del".
+	action string
+
+	// name and value are those of the header.
+	name  string
+	value string
+}
+
+// parseHeaderRules parses the rules given via -header-rule.
+func parseHeaderRules(rules []string) ([]headerRule, error) {
+
+	var out []headerRule
+	for _, ent := range rules {
+
+		fields := strings.Fields(ent)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid header rule %q", ent)
+		}
+
+		rule := headerRule{
+			tunnel: fields[0],
+			action: fields[2],
+			name:   http.CanonicalHeaderKey(fields[3]),
+		}
+
+		switch fields[1] {
+		case "request":
+		case "response":
+			rule.response = true
+		default:
+			return nil, fmt.Errorf("invalid header rule %q: %q is neither request nor response", ent, fields[1])
+		}
+
+		switch rule.action {
+		case "del":
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("invalid header rule %q: del takes no value", ent)
+			}
+		case "add", "set":
+			if len(fields) < 5 {
+				return nil, fmt.Errorf("invalid header rule %q: %s requires a value", ent, rule.action)
+			}
+			rule.value = strings.Join(fields[4:], " ")
+		default:
+			return nil, fmt.Errorf("invalid header rule %q: unknown action %q", ent, rule.action)
+		}
+
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+// applyHeaderRules applies the rules for the named tunnel, and either
+// requests or responses, to the given headers.
+func (s *Server) applyHeaderRules(h http.Header, response bool, tunnel string, id string) {
+
+	s.mutex.RLock()
+	rules := s.headerRules
+	s.mutex.RUnlock()
+
+	for _, rule := range rules {
+		if rule.response != response || (rule.tunnel != "*" && rule.tunnel != tunnel) {
+			continue
+		}
+
+		value := strings.Replace(rule.value, "{id}", id, -1)
+		value = strings.Replace(value, "{tunnel}", tunnel, -1)
+
+		switch rule.action {
+		case "add":
+			h.Add(rule.name, value)
+		case "set":
+			h.Set(rule.name, value)
+		case "del":
+			h.Del(rule.name)
+		}
+	}
+}
+
+// headerWriter wraps the ResponseWriter of a request, applying our
+// rules to the headers of the response before they're written.
+type headerWriter struct {
+	http.ResponseWriter
+
+	// s is our server.
+	s *Server
+
+	// tunnel and id are the name of the tunnel, and the ID of the
+	// request.
+	tunnel string
+	id     string
+
+	// origin is the origin of the request, if it is cross-origin.
+	origin string
+
+	// prefix is the part of the path which addressed the tunnel, if
+	// any, which we restore to the locations in the response, and host
+	// is the hostname the visitor requested.
+	prefix string
+	host   string
+
+	// written is true once the headers have been written.
+	written bool
+}
+
+// apply restores the tunnel's prefix to the locations in the response,
+// and scopes its cookies beneath it, and applies its CORS policy, and
+// our rules, once.
+func (h *headerWriter) apply() {
+	if !h.written {
+		h.written = true
+		if h.prefix != "" {
+			rewriteLocations(h.Header(), h.prefix, h.host)
+			rewriteCookies(h.Header(), h.prefix)
+		}
+		h.s.applyCORS(h.Header(), h.tunnel, h.origin)
+		h.s.applyHeaderRules(h.Header(), true, h.tunnel, h.id)
+	}
+}
+
+// WriteHeader applies our rules before writing the headers.
+func (h *headerWriter) WriteHeader(status int) {
+	h.apply()
+	h.ResponseWriter.WriteHeader(status)
+}
+
+// Write applies our rules, if the headers haven't been written.
+func (h *headerWriter) Write(data []byte) (int, error) {
+	h.apply()
+	return h.ResponseWriter.Write(data)
+}
+
+// Flush sends any buffered data to the visitor.
+func (h *headerWriter) Flush() {
+	if f, ok := h.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows hijackResponse to take over the connection.
+func (h *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking is not supported")
+	}
+	return hj.Hijack()
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaderRules(t *testing.T) {
+
+	tests := []struct {
+		rule     string
+		expected headerRule
+		err      string
+	}{
+		{"* response del server", headerRule{tunnel: "*", response: true, action: "del", name: "Server"}, ""},
+		{"api request set X-Id {id}", headerRule{tunnel: "api", action: "set", name: "X-Id", value: "{id}"}, ""},
+		{"api request add x-note  two   words", headerRule{tunnel: "api", action: "add", name: "X-Note", value: "two words"}, ""},
+		{"* response del", headerRule{}, "invalid header rule"},
+		{"* both set X-A b", headerRule{}, "neither request nor response"},
+		{"* request del X-A b", headerRule{}, "del takes no value"},
+		{"* request set X-A", headerRule{}, "set requires a value"},
+		{"* request add X-A", headerRule{}, "add requires a value"},
+		{"* request move X-A b", headerRule{}, "unknown action"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.rule, func(t *testing.T) {
+
+			rules, err := parseHeaderRules([]string{test.rule})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(rules) != 1 || rules[0] != test.expected {
+				t.Fatalf("expected %+v, got %+v", test.expected, rules)
+			}
+		})
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+
+	rules, err := parseHeaderRules([]string{
+		"* response del Server",
+		"* response set X-Tunnel {tunnel}",
+		"api response add Vary Origin",
+		"api request set X-Correlation-ID {id}-{id}",
+		"web request del Cookie",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &Server{headerRules: rules}
+
+	tests := []struct {
+		name     string
+		response bool
+		tunnel   string
+		in       http.Header
+		expected http.Header
+	}{
+		{
+			"response of any tunnel",
+			true, "web",
+			http.Header{"Server": {"nginx"}, "Vary": {"Accept"}},
+			http.Header{"X-Tunnel": {"web"}, "Vary": {"Accept"}},
+		},
+		{
+			"response of api",
+			true, "api",
+			http.Header{"Server": {"nginx"}, "Vary": {"Accept"}, "X-Tunnel": {"old"}},
+			http.Header{"X-Tunnel": {"api"}, "Vary": {"Accept", "Origin"}},
+		},
+		{
+			"request of api",
+			false, "api",
+			http.Header{"Server": {"x"}, "Cookie": {"a=b"}},
+			http.Header{"Server": {"x"}, "Cookie": {"a=b"}, "X-Correlation-Id": {"42-42"}},
+		},
+		{
+			"request of web",
+			false, "web",
+			http.Header{"Cookie": {"a=b"}},
+			http.Header{},
+		},
+		{
+			"request of another tunnel",
+			false, "other",
+			http.Header{"Cookie": {"a=b"}},
+			http.Header{"Cookie": {"a=b"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.applyHeaderRules(test.in, test.response, test.tunnel, "42")
+			if !reflect.DeepEqual(test.in, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, test.in)
+			}
+		})
+	}
+}
+
+func TestHeaderWriter(t *testing.T) {
+
+	rules, err := parseHeaderRules([]string{"* response set X-Request-ID {id}"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &Server{headerRules: rules}
+
+	//
+	// The rules are applied once, whether the status is written
+	// explicitly or not, and no later changes are made.
+	//
+	for _, explicit := range []bool{true, false} {
+
+		rec := httptest.NewRecorder()
+		w := &headerWriter{ResponseWriter: rec, s: s, tunnel: "api", id: "42"}
+		if explicit {
+			w.WriteHeader(http.StatusTeapot)
+		}
+		w.Write([]byte("hello"))
+		w.Header().Set("X-Request-ID", "later")
+		w.Write([]byte(" world"))
+
+		if rec.Result().Header.Get("X-Request-ID") != "42" {
+			t.Fatalf("expected the rule to be applied, got %v", rec.Result().Header)
+		}
+		if rec.Body.String() != "hello world" {
+			t.Fatalf("unexpected body %q", rec.Body.String())
+		}
+	}
+}
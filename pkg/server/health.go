@@ -0,0 +1,153 @@
+//
+// The admin API presents health-checks, suitable for use by a
+// load-balancer or Kubernetes:
+//
+//   /healthz reports whether we're connected to the queue.
+//
+//   /readyz publishes a message to the queue, and waits to receive it
+//   back, reporting the round-trip time.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Health is the result of a health-check.
+type Health struct {
+	// Connected is true if we're connected to the queue.
+	Connected bool
+
+	// Latency is the round-trip time to the queue, in milliseconds,
+	// if it was measured.
+	Latency float64 `json:",omitempty"`
+
+	// Error describes the failure, if the check failed.
+	Error string `json:",omitempty"`
+}
+
+// pinger measures the round-trip time to the queue, by publishing
+// messages upon a topic to which we're subscribed.
+type pinger struct {
+	// topic is the topic we use, which is unique to this process.
+	topic string
+
+	// waiters maps the payload of each message we've sent to the
+	// channel awaiting its receipt.
+	waiters map[string]chan struct{}
+
+	// mutex protects our map.
+	mutex sync.Mutex
+}
+
+// newPinger creates a new pinger.
+//
+// The tunnel names are taken from hostnames, so cannot contain a
+// period, which ensures our topic is distinct from theirs.
+func newPinger() *pinger {
+	return &pinger{
+		topic:   "clients/.health/" + uuid.NewV4().String(),
+		waiters: make(map[string]chan struct{}),
+	}
+}
+
+// onMessage is invoked when one of our messages is received.
+func (p *pinger) onMessage(client MQTT.Client, msg MQTT.Message) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if ch, ok := p.waiters[string(msg.Payload())]; ok {
+		close(ch)
+		delete(p.waiters, string(msg.Payload()))
+	}
+}
+
+// Ping publishes a message, and waits up to the given time for it to be
+// received, returning the round-trip time.
+func (p *pinger) Ping(mq MQTT.Client, timeout time.Duration) (time.Duration, error) {
+
+	id := uuid.NewV4().String()
+	ch := make(chan struct{})
+
+	p.mutex.Lock()
+	p.waiters[id] = ch
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		delete(p.waiters, id)
+		p.mutex.Unlock()
+	}()
+
+	start := time.Now()
+
+	token := mq.Publish(p.topic, 0, false, id)
+	token.Wait()
+	if token.Error() != nil {
+		return 0, token.Error()
+	}
+
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-time.After(timeout):
+		return 0, errTimeout
+	}
+}
+
+// healthzHandler reports whether we're connected to the queue.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+
+	h := Health{Connected: s.mq.IsConnectionOpen()}
+	if !h.Connected {
+		h.Error = "not connected to the queue"
+	}
+	writeHealth(w, h)
+}
+
+// readyzHandler reports whether we're connected to the queue, and the
+// round-trip time to it.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+
+	h := Health{Connected: s.mq.IsConnectionOpen()}
+	if !h.Connected {
+		h.Error = "not connected to the queue"
+		writeHealth(w, h)
+		return
+	}
+
+	latency, err := s.pinger.Ping(s.mq, 5*time.Second)
+	if err != nil {
+		h.Error = err.Error()
+	} else {
+		h.Latency = float64(latency) / float64(time.Millisecond)
+	}
+	writeHealth(w, h)
+}
+
+// writeHealth sends the result of a health-check, with a status-code
+// reflecting whether it succeeded.
+func writeHealth(w http.ResponseWriter, h Health) {
+
+	status := http.StatusOK
+	if h.Error != "" {
+		status = http.StatusServiceUnavailable
+	}
+
+	out, _ := json.Marshal(h)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// errTimeout is returned when our message isn't received in time.
+var errTimeout = errors.New("timed out waiting for the queue")
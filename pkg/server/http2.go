@@ -0,0 +1,60 @@
+//
+// HTTP/2 support.
+//
+// Our clients speak HTTP/1.x to the services they expose, so for
+// visitors using HTTP/2 we downgrade their request before sending it.
+// The response is written via the usual http.ResponseWriter, as with
+// every other, see response.go.
+//
+// HTTP/2 is negotiated automatically if we're serving via TLS, and may
+// be enabled for plain-text connections ("h2c") via the -h2c flag.
+//
+
+package server
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// isHTTP2 returns true if the given request was received via HTTP/2,
+// and so must be downgraded, and cannot be answered by hijacking the
+// connection.
+func isHTTP2(r *http.Request) bool {
+	return r.ProtoMajor >= 2
+}
+
+// downgradeRequest updates a request received via HTTP/2 such that it
+// may be sent to the client as a HTTP/1.1 request.
+//
+// HTTP/2 requests needn't declare the length of their body, but we'll
+// have read it already, see bufferBody.
+func downgradeRequest(r *http.Request) {
+	r.Proto = "HTTP/1.1"
+	r.ProtoMajor = 1
+	r.ProtoMinor = 1
+}
+
+// publicHandler returns the handler for our public HTTP-server, which
+// will accept h2c connections if we've been configured to do so.
+//
+// We only support h2c "with prior knowledge", which is what gRPC
+// clients use.  Requests to upgrade a HTTP/1.1 connection are ignored,
+// as the RFC permits, and served via HTTP/1.1.
+func (s *Server) publicHandler() http.Handler {
+	handler := http.HandlerFunc(s.HTTPHandler)
+	if !s.opts.H2C {
+		return handler
+	}
+
+	h := h2c.NewHandler(handler, &http2.Server{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PRI" && r.Proto == "HTTP/2.0" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+//
+// Expiring idle tunnels.
+//
+// On a shared server clients may be left running long after anybody
+// uses their tunnels, holding on to their names.  Given -idle-ttl we
+// expire the tunnels which haven't received a request for that long,
+// or since they connected, releasing their names.
+//
+// The client(s) serving an expired tunnel are told so upon the topic
+// "clients/$id/expire", and their presence is cleared, as when they're
+// kicked.  Clients may then exit, or re-register their tunnels.
+//
+// TCP and UDP tunnels are never expired, as we don't record their
+// activity.
+//
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// expireIdle expires the tunnels which have been idle for longer than
+// the given duration.
+func (s *Server) expireIdle(ttl time.Duration) {
+
+	//
+	// A tunnel is active if it has received a request, or a client
+	// has connected to serve it, recently.
+	//
+	usage := s.usage.Snapshot()
+	active := make(map[string]time.Time)
+	clients := make(map[string][]string)
+
+	for _, reg := range s.registry.all() {
+		for _, name := range reg.Names {
+			if reg.IsTCP(name) || reg.IsUDP(name) {
+				continue
+			}
+			if reg.Connected.After(active[name]) {
+				active[name] = reg.Connected
+			}
+			if usage[name].LastActive.After(active[name]) {
+				active[name] = usage[name].LastActive
+			}
+			clients[name] = append(clients[name], reg.Client)
+		}
+	}
+
+	reason := fmt.Sprintf("idle for %s", ttl)
+	for name, last := range active {
+		if time.Since(last) < ttl {
+			continue
+		}
+		s.logf("Expiring the tunnel %s, which has been idle since %s\n", name, last.Format(time.RFC3339))
+		for _, client := range clients[name] {
+			s.disconnect(client, name, "expire", reason)
+		}
+	}
+}
+
+// watchIdle expires idle tunnels, checking at the given interval.
+func (s *Server) watchIdle(ttl time.Duration, interval time.Duration) {
+	for range time.Tick(interval) {
+		s.expireIdle(ttl)
+	}
+}
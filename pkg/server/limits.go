@@ -0,0 +1,398 @@
+//
+// Limiting the use of each token.
+//
+// The operator may limit each of the tokens issued by the account system,
+// see accounts.go, via the admin API:
+//
+//   * To a number of tunnels, which the clients registered with it may
+//     serve at once.  Registrations which would exceed this are refused.
+//
+//   * To a number of requests, and of bytes, per day.  Visitors to the
+//     tunnels of a token which has made its requests for the day receive
+//     a 429 status, and those to a token which has transferred its bytes
+//     a 403 status, along with the "quota" error page.
+//
+// Days are those of UTC, and the traffic of each token is written to the
+// database along with that of the accounts, so that it survives restarts.
+//
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// TokenLimits are the limits placed upon a token, zero meaning unlimited.
+type TokenLimits struct {
+	// Tunnels is the number of tunnels which may be served at once.
+	Tunnels int
+
+	// Requests and Bytes are the number of requests, and of bytes,
+	// which may be sent to those tunnels each day.
+	Requests int64
+	Bytes    int64
+}
+
+// TokenQuota reports the limits of a token, and its use of them, as
+// reported by the admin API.
+type TokenQuota struct {
+	// ID identifies the token, and Account is its account.
+	ID      string
+	Account string
+
+	// Limits holds the limits placed upon the token.
+	Limits TokenLimits
+
+	// Tunnels is the number of tunnels being served with the token.
+	Tunnels int
+
+	// Requests and Bytes are the traffic of the token today, and
+	// Rejected the number of requests we've refused today as the
+	// token had exceeded its limits.
+	Requests int64
+	Bytes    int64
+	Rejected int64
+}
+
+// tokenCount is the traffic of a single token.
+type tokenCount struct {
+	requests int64
+	bytes    int64
+	rejected int64
+}
+
+// loadLimits reads the limits of every token.
+func (a *accounts) loadLimits() error {
+
+	rows, err := a.db.Query("SELECT token, tunnels, requests, bytes FROM token_limits")
+	if err != nil {
+		return err
+	}
+	limits := make(map[string]TokenLimits)
+	for rows.Next() {
+		var id string
+		var l TokenLimits
+		if err := rows.Scan(&id, &l.Tunnels, &l.Requests, &l.Bytes); err != nil {
+			rows.Close()
+			return err
+		}
+		limits[id] = l
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.limits = limits
+	a.mutex.Unlock()
+	return nil
+}
+
+// loadCounts reads the traffic of every token today.
+func (a *accounts) loadCounts() error {
+
+	day := time.Now().UTC().Format("2006-01-02")
+	rows, err := a.db.Query(a.query("SELECT token, requests, bytes FROM token_usage WHERE day = ?"), day)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]*tokenCount)
+	for rows.Next() {
+		var id string
+		c := &tokenCount{}
+		if err := rows.Scan(&id, &c.requests, &c.bytes); err != nil {
+			return err
+		}
+		counts[id] = c
+	}
+
+	a.mutex.Lock()
+	a.today = day
+	a.counts = counts
+	a.mutex.Unlock()
+
+	return rows.Err()
+}
+
+// setLimits sets the limits of the token with the given ID.
+func (a *accounts) setLimits(id string, l TokenLimits) error {
+
+	if l.Tunnels < 0 || l.Requests < 0 || l.Bytes < 0 {
+		return fmt.Errorf("limits may not be negative")
+	}
+
+	var count int
+	err := a.db.QueryRow(a.query("SELECT COUNT(*) FROM tokens WHERE id = ?"), id).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNoToken
+	}
+
+	_, err = a.exec(`INSERT INTO token_limits (token, tunnels, requests, bytes)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (token) DO UPDATE SET
+			tunnels  = excluded.tunnels,
+			requests = excluded.requests,
+			bytes    = excluded.bytes`,
+		id, l.Tunnels, l.Requests, l.Bytes)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.limits[id] = l
+	a.mutex.Unlock()
+	return nil
+}
+
+// clearLimits removes the limits of the token with the given ID.
+func (a *accounts) clearLimits(id string) error {
+
+	if _, err := a.exec("DELETE FROM token_limits WHERE token = ?", id); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	delete(a.limits, id)
+	a.mutex.Unlock()
+	return nil
+}
+
+// bind records the token the given client registered with.
+func (a *accounts) bind(client string, token string) {
+
+	a.mutex.Lock()
+	a.clients[client] = token
+	a.mutex.Unlock()
+}
+
+// forget forgets the token of a client which has gone away.
+func (a *accounts) forget(client string) {
+
+	a.mutex.Lock()
+	delete(a.clients, client)
+	a.mutex.Unlock()
+}
+
+// tokenOf returns the ID of the token the given client registered with,
+// if any.
+func (a *accounts) tokenOf(client string) string {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.clients[client]
+}
+
+// limitsOf returns the limits of the token with the given ID.
+func (a *accounts) limitsOf(token string) TokenLimits {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.limits[token]
+}
+
+// counter returns the traffic of the given token upon the given day,
+// starting afresh each day.  The caller must hold our mutex.
+func (a *accounts) counter(token string, day string) *tokenCount {
+
+	if day != a.today {
+		a.today = day
+		a.counts = make(map[string]*tokenCount)
+	}
+
+	c, ok := a.counts[token]
+	if !ok {
+		c = &tokenCount{}
+		a.counts[token] = c
+	}
+	return c
+}
+
+// count adds a single request, of the given size, to the traffic of the
+// given token.  The caller must hold our mutex.
+func (a *accounts) count(token string, day string, size int64) {
+
+	c := a.counter(token, day)
+	u, ok := a.unwritten[[2]string{token, day}]
+	if !ok {
+		u = &tokenCount{}
+		a.unwritten[[2]string{token, day}] = u
+	}
+	c.requests++
+	c.bytes += size
+	u.requests++
+	u.bytes += size
+}
+
+// exceeded returns the HTTP status, and a message, with which to refuse
+// a request sent to the given client, if the token it registered with
+// has exceeded its daily limits, otherwise zero.
+func (a *accounts) exceeded(client string) (int, string) {
+
+	if a == nil {
+		return 0, ""
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	token, ok := a.clients[client]
+	if !ok {
+		return 0, ""
+	}
+	l := a.limits[token]
+	if l.Requests == 0 && l.Bytes == 0 {
+		return 0, ""
+	}
+
+	c := a.counter(token, time.Now().UTC().Format("2006-01-02"))
+	switch {
+	case l.Requests > 0 && c.requests >= l.Requests:
+		c.rejected++
+		return http.StatusTooManyRequests, fmt.Sprintf("This tunnel has received its %d requests for today, please try again tomorrow.", l.Requests)
+	case l.Bytes > 0 && c.bytes >= l.Bytes:
+		c.rejected++
+		return http.StatusForbidden, fmt.Sprintf("This tunnel has transferred its %d bytes for today, please try again tomorrow.", l.Bytes)
+	}
+	return 0, ""
+}
+
+// flushTokens writes the traffic of each token we've yet to write.
+func (a *accounts) flushTokens() error {
+
+	a.mutex.Lock()
+	unwritten := a.unwritten
+	a.unwritten = make(map[[2]string]*tokenCount)
+	a.mutex.Unlock()
+
+	for key, u := range unwritten {
+		_, err := a.exec(`INSERT INTO token_usage (token, day, requests, bytes)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (token, day) DO UPDATE SET
+				requests = token_usage.requests + excluded.requests,
+				bytes    = token_usage.bytes + excluded.bytes`,
+			key[0], key[1], u.requests, u.bytes)
+		if err != nil {
+
+			//
+			// Keep what we couldn't write, to try again later.
+			//
+			a.mutex.Lock()
+			for k, v := range unwritten {
+				if cur, ok := a.unwritten[k]; ok {
+					cur.requests += v.requests
+					cur.bytes += v.bytes
+				} else {
+					a.unwritten[k] = v
+				}
+			}
+			a.mutex.Unlock()
+			return err
+		}
+		delete(unwritten, key)
+	}
+	return nil
+}
+
+// quotas reports the limits, and traffic, of the tokens of the named
+// account, or of every account if the name is empty, given the number of
+// tunnels being served with each.
+func (a *accounts) quotas(account string, tunnels map[string]int) ([]TokenQuota, error) {
+
+	tokens, err := a.tokens(account)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	out := []TokenQuota{}
+	for _, t := range tokens {
+		q := TokenQuota{
+			ID:      t.ID,
+			Account: t.Account,
+			Limits:  a.limits[t.ID],
+			Tunnels: tunnels[t.ID],
+		}
+		if a.today == time.Now().UTC().Format("2006-01-02") {
+			if c, ok := a.counts[t.ID]; ok {
+				q.Requests = c.requests
+				q.Bytes = c.bytes
+				q.Rejected = c.rejected
+			}
+		}
+		out = append(out, q)
+	}
+	return out, nil
+}
+
+// tokenTunnels returns the names of the tunnels being served with each
+// token, other than by the given client.
+func (s *Server) tokenTunnels(except string) map[string]map[string]bool {
+
+	out := make(map[string]map[string]bool)
+	for _, reg := range s.registry.all() {
+		if reg.Client == except {
+			continue
+		}
+		token := s.accounts.tokenOf(reg.Client)
+		if token == "" {
+			continue
+		}
+		if out[token] == nil {
+			out[token] = make(map[string]bool)
+		}
+		for _, name := range reg.Names {
+			out[token][name] = true
+		}
+	}
+	return out
+}
+
+// checkTunnels returns an error if the given registration, made with the
+// given token, would serve more tunnels than the token may.
+func (s *Server) checkTunnels(reg *protocol.Registration, token string) error {
+
+	l := s.accounts.limitsOf(token)
+	if l.Tunnels == 0 {
+		return nil
+	}
+
+	names := s.tokenTunnels(reg.Client)[token]
+	if names == nil {
+		names = make(map[string]bool)
+	}
+	for _, name := range reg.Names {
+		names[name] = true
+	}
+	if len(names) > l.Tunnels {
+		return fmt.Errorf("the token %s may only serve %d tunnels", token, l.Tunnels)
+	}
+	return nil
+}
+
+// quotaPage writes our quota page to the visitor, with the given status
+// and message, asking them to retry once the day is over.
+func (s *Server) quotaPage(w http.ResponseWriter, status int, tunnel string, id string, message string) {
+
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(s.renderMessage("quota", status, tunnel, id, message))
+}
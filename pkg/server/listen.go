@@ -0,0 +1,260 @@
+//
+// The addresses we serve visitors upon.
+//
+// By default we bind upon a single host, given via -host, and -port, but
+// -host may be repeated to bind upon several addresses at once, each of
+// which may be:
+//
+//   127.0.0.1        An IPv4 address, upon -port.
+//   ::1, or [::1]    An IPv6 address, upon -port.
+//   ::               Every address, both IPv4 and IPv6, upon -port.
+//   [::]:8080        An address with a port of its own.
+//
+// TCP and UDP tunnels are served upon the first of them.
+//
+// When serving HTTPS we may also listen for plain-HTTP visitors, upon
+// -http-port of the same hosts, and redirect them to HTTPS, unless told
+// to serve them via -http-serve.  Redirects are sent to -https-port, or
+// -port if that isn't given, which allows for port-forwarding.
+//
+// Given -reuse-port we listen via SO_REUSEPORT, and so does our admin
+// API, so that a new server may be launched upon the same addresses
+// while we're running.  Sending us SIGTERM then stops us accepting
+// connections, which the new server receives instead, and we exit once
+// our in-flight requests are complete, so that we may be upgraded, or
+// restarted, without visitors noticing.
+//
+// The ports of TCP and UDP tunnels are shared too.  We learn the ports
+// the server we're replacing allocated from its retained announcements,
+// and give each tunnel the same port, while avoiding the ports it gave
+// to others.
+//
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// bindAddrs returns the addresses, as "host:port", we should bind upon.
+func bindAddrs(opts Options) ([]string, error) {
+
+	hosts := opts.BindHosts
+	if len(hosts) == 0 {
+		hosts = []string{opts.BindHost}
+	}
+
+	var out []string
+	for _, host := range hosts {
+
+		//
+		// The address may have a port of its own, otherwise we use
+		// the default, and IPv6 addresses may be bracketed either way.
+		//
+		addr := net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(opts.BindPort))
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			if _, err := strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("invalid address %q: invalid port %q", host, p)
+			}
+			addr = net.JoinHostPort(h, p)
+		}
+
+		out = append(out, addr)
+	}
+	return out, nil
+}
+
+// bindHost returns the host we serve TCP and UDP tunnels upon.
+func (s *Server) bindHost() string {
+
+	host, _, _ := net.SplitHostPort(s.addrs[0])
+	return host
+}
+
+// plainAddrs returns the addresses, as "host:port", we should serve
+// plain-HTTP visitors upon, when we're serving HTTPS.
+func (s *Server) plainAddrs() []string {
+
+	var out []string
+	seen := make(map[string]bool)
+	for _, addr := range s.addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		addr = net.JoinHostPort(host, strconv.Itoa(s.opts.HTTPPort))
+		if !seen[addr] {
+			seen[addr] = true
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// redirectHTTPS redirects a plain-HTTP visitor to HTTPS.
+func (s *Server) redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+
+	port := s.opts.HTTPSPort
+	if port == 0 {
+		port = s.opts.BindPort
+	}
+	if port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	//
+	// Only GET and HEAD requests may be redirected permanently, as
+	// browsers change the method of others.
+	//
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
+
+// listenTCP opens a listener upon the given address, which others may
+// share if we should reuse our ports.
+func (s *Server) listenTCP(addr string) (net.Listener, error) {
+
+	if !s.opts.ReusePort {
+		return net.Listen("tcp", addr)
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenUDP opens a socket upon the given address, which others may
+// share if we should reuse our ports.
+func (s *Server) listenUDP(addr string) (net.PacketConn, error) {
+
+	if !s.opts.ReusePort {
+		return net.ListenPacket("udp", addr)
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	return lc.ListenPacket(context.Background(), "udp", addr)
+}
+
+// announcedPorts records the port announced for each TCP, or UDP, tunnel,
+// by us, or by the server we're replacing.
+type announcedPorts struct {
+	// suffix is that of the topics the ports are announced upon.
+	suffix string
+
+	// ports maps the name of each tunnel to its port.
+	ports map[string]int
+
+	// mutex protects our map.
+	mutex sync.Mutex
+}
+
+// newAnnouncedPorts creates a record of the ports announced upon the
+// topics "clients/$name/$kind".
+func newAnnouncedPorts(kind string) *announcedPorts {
+	return &announcedPorts{suffix: "/" + kind, ports: make(map[string]int)}
+}
+
+// onMessage is invoked when a port is announced, or withdrawn.
+func (a *announcedPorts) onMessage(client MQTT.Client, msg MQTT.Message) {
+
+	name := strings.TrimSuffix(strings.TrimPrefix(msg.Topic(), "clients/"), a.suffix)
+	if !protocol.ValidName(name) {
+		return
+	}
+	port, err := strconv.Atoi(string(msg.Payload()))
+	if err != nil {
+		port = 0
+	}
+	a.set(name, port)
+}
+
+// set records the port of the named tunnel, with zero forgetting it.
+func (a *announcedPorts) set(name string, port int) {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if port == 0 {
+		delete(a.ports, name)
+	} else {
+		a.ports[name] = port
+	}
+}
+
+// candidates returns the ports within the given range which the named
+// tunnel may be given, starting with the one announced for it, if any,
+// and omitting those announced for others.
+func (a *announcedPorts) candidates(name string, first int, last int) []int {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	taken := make(map[int]bool)
+	for other, port := range a.ports {
+		if other != name {
+			taken[port] = true
+		}
+	}
+
+	var out []int
+	ours, ok := a.ports[name]
+	if ok && ours >= first && ours <= last && !taken[ours] {
+		out = append(out, ours)
+		taken[ours] = true
+	}
+	for port := first; port <= last; port++ {
+		if !taken[port] {
+			out = append(out, port)
+		}
+	}
+	return out
+}
+
+// announcedPorts returns the records of the ports of our TCP, and UDP,
+// tunnels, if we serve them.
+func (s *Server) announcedPorts() []*announcedPorts {
+
+	var out []*announcedPorts
+	if s.tcp != nil {
+		out = append(out, s.tcp.announced)
+	}
+	if s.udp != nil {
+		out = append(out, s.udp.announced)
+	}
+	return out
+}
+
+// listen opens a listener upon each of the given addresses, closing them
+// all if any cannot be opened.
+func (s *Server) listen(addrs []string) ([]net.Listener, error) {
+
+	var out []net.Listener
+	for _, addr := range addrs {
+		l, err := s.listenTCP(addr)
+		if err != nil {
+			for _, l := range out {
+				l.Close()
+			}
+			return nil, err
+		}
+		if len(s.proxyNets) > 0 {
+			l = &proxyListener{Listener: l, trusted: s.proxyNets}
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
@@ -0,0 +1,13 @@
+// +build !darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!linux linux,mips linux,mipsle linux,mips64 linux,mips64le
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort reports that SO_REUSEPORT isn't available upon this platform.
+func reusePort(network string, address string, c syscall.RawConn) error {
+	return errors.New("-reuse-port is not supported upon this platform")
+}
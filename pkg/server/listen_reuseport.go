@@ -0,0 +1,19 @@
+// +build darwin dragonfly freebsd netbsd openbsd linux,!mips,!mipsle,!mips64,!mips64le
+
+package server
+
+import "syscall"
+
+// reusePort sets SO_REUSEPORT upon the sockets we listen upon, so that
+// another process may listen upon the same address alongside us.
+func reusePort(network string, address string, c syscall.RawConn) error {
+
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package server
+
+import "syscall"
+
+// soReusePort is the value of SO_REUSEPORT.
+const soReusePort = syscall.SO_REUSEPORT
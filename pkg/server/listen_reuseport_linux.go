@@ -0,0 +1,7 @@
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package server
+
+// soReusePort is the value of SO_REUSEPORT, which the syscall package
+// doesn't define upon Linux.
+const soReusePort = 0xf
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestAnnouncedPorts(t *testing.T) {
+
+	a := newAnnouncedPorts("tcp")
+	a.onMessage(nil, &testMessage{topic: "clients/ssh/tcp", payload: []byte("9002")})
+	a.onMessage(nil, &testMessage{topic: "clients/db/tcp", payload: []byte("9000")})
+	a.onMessage(nil, &testMessage{topic: "clients/gone/tcp", payload: []byte("9003")})
+	a.onMessage(nil, &testMessage{topic: "clients/gone/tcp", payload: []byte("")})
+	a.onMessage(nil, &testMessage{topic: "clients/far/tcp", payload: []byte("10000")})
+	a.onMessage(nil, &testMessage{topic: "clients/a/b/tcp", payload: []byte("9001")})
+
+	tests := []struct {
+		name     string
+		expected []int
+	}{
+		{"ssh", []int{9002, 9001, 9003, 9004}},
+		{"db", []int{9000, 9001, 9003, 9004}},
+		{"far", []int{9001, 9003, 9004}},
+		{"new", []int{9001, 9003, 9004}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := a.candidates(test.name, 9000, 9004); !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestReusePortTunnels(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only tested upon Linux")
+	}
+
+	s := &Server{opts: Options{ReusePort: true}}
+
+	l, err := s.listenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer l.Close()
+	again, err := s.listenTCP(l.Addr().String())
+	if err != nil {
+		t.Fatalf("expected the TCP port to be shared, got %s", err)
+	}
+	again.Close()
+
+	conn, err := s.listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	other, err := s.listenUDP(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("expected the UDP port to be shared, got %s", err)
+	}
+	other.Close()
+
+	//
+	// Without -reuse-port the ports are ours alone.
+	//
+	s.opts.ReusePort = false
+	if _, err := s.listenTCP(l.Addr().String()); err == nil {
+		t.Fatalf("expected the TCP port to be in use")
+	}
+	if _, err := s.listenUDP(conn.LocalAddr().String()); err == nil {
+		t.Fatalf("expected the UDP port to be in use")
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Maintenance mode.
+//
+// A tunnel may be put into maintenance mode, in which case we answer
+// visitors ourselves with a "503 Service Unavailable" page, rather than
+// sending their requests to its client.  The page may be customized via
+// the "maintenance.html" template, see errors.go.
+//
+// Clients put their own tunnels into maintenance mode via their
+// registration, whilst restarting, or deploying, the local service, and
+// the operator may do so via the "/maintenance" end-point of the admin
+// API, which applies even if no client is connected.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// maintenanceRetry is the number of seconds we ask visitors to wait
+// before retrying, via the Retry-After header.
+const maintenanceRetry = "30"
+
+// inMaintenance returns true, and the message to show visitors, if the
+// operator has put the named tunnel into maintenance mode.
+func (s *Server) inMaintenance(name string) (string, bool) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	msg, ok := s.maintenance[name]
+	return msg, ok
+}
+
+// maintenancePage writes our maintenance page to the visitor, showing
+// the given message, or our default.
+func (s *Server) maintenancePage(w http.ResponseWriter, tunnel string, id string, message string) {
+
+	w.Header().Set("Retry-After", maintenanceRetry)
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(s.renderMessage("maintenance", http.StatusServiceUnavailable, tunnel, id, message))
+}
+
+// maintenanceHandler lists the tunnels in maintenance mode, and puts
+// them into, or takes them out of, it via the admin API:
+//
+//   GET    /maintenance                      - List the tunnels.
+//   POST   /maintenance?tunnel=foo&message=  - Start maintenance.
+//   DELETE /maintenance?tunnel=foo           - End maintenance.
+//
+// Only those tunnels put into maintenance mode via the API are listed.
+func (s *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+
+	tunnel := r.FormValue("tunnel")
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		if tunnel == "" {
+			http.Error(w, "The tunnel is required", http.StatusBadRequest)
+			return
+		}
+		s.mutex.Lock()
+		s.maintenance[tunnel] = r.FormValue("message")
+		s.mutex.Unlock()
+
+	case http.MethodDelete:
+		s.mutex.Lock()
+		_, ok := s.maintenance[tunnel]
+		delete(s.maintenance, tunnel)
+		s.mutex.Unlock()
+
+		if !ok {
+			http.Error(w, "That tunnel is not in maintenance mode", http.StatusNotFound)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	//
+	// Always report the current state.
+	//
+	type entry struct {
+		Tunnel  string
+		Message string
+	}
+	out := []entry{}
+	s.mutex.RLock()
+	for name, msg := range s.maintenance {
+		out = append(out, entry{Tunnel: name, Message: msg})
+	}
+	s.mutex.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Tunnel < out[j].Tunnel
+	})
+
+	js, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
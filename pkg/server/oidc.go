@@ -0,0 +1,471 @@
+//
+// OpenID Connect.
+//
+// The operator may require visitors to login via an OpenID Connect
+// provider, such as Google or Keycloak, before their requests are sent
+// to particular tunnels, via -oidc-allow:
+//
+//   -oidc-allow "foo=alice@example.com"   Alice may reach "foo".
+//   -oidc-allow "foo=@example.com"        As may anybody at example.com.
+//   -oidc-allow "*=@example.com"          Every tunnel requires a login.
+//
+// Visitors who haven't logged in are redirected to the provider, which
+// returns them to the URL given via -oidc-redirect, such as
+// "https://auth.tunnel.example.com/.tunneller/oidc".  That URL must be
+// registered with the provider, and served by us, and the session cookie
+// we set there is scoped to the domain given via -oidc-cookie-domain, so
+// that it is sent to every tunnel.
+//
+// We receive the visitor's ID token directly from the provider, over
+// TLS, so we don't need to verify its signature.
+//
+// Before redirecting a visitor to the provider we set a short-lived
+// cookie holding a random nonce, which the state we send must match when
+// they return, so that nobody can complete a login they started within
+// somebody else's browser.
+//
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcCookie is the name of the cookie which holds a visitor's
+	// session.
+	oidcCookie = "tunneller_session"
+
+	// oidcLoginCookie prefixes the name of the cookie which holds the
+	// nonce of each login in progress.
+	oidcLoginCookie = "tunneller_login_"
+
+	// oidcLoginTimeout is how long a visitor has to login.
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// oidcEndpoints are those of our provider, which we discover from it.
+type oidcEndpoints struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// oidc holds the state of our OpenID Connect support.
+type oidc struct {
+	// s is our server.
+	s *Server
+
+	// key signs our sessions, and the state we send to the provider.
+	key []byte
+
+	// endpoints are those of our provider, once discovered.
+	endpoints *oidcEndpoints
+
+	// mutex protects our endpoints.
+	mutex sync.Mutex
+}
+
+// newOIDC validates our settings, and returns our OpenID Connect support,
+// or nil if it isn't enabled.
+func newOIDC(s *Server) (*oidc, error) {
+
+	opts := s.opts
+	if opts.OIDCIssuer == "" {
+		if len(opts.OIDCAllow) > 0 {
+			return nil, errors.New("-oidc-allow requires an OpenID Connect provider")
+		}
+		return nil, nil
+	}
+	if opts.OIDCClientID == "" || opts.OIDCClientSecret == "" || opts.OIDCRedirect == "" {
+		return nil, errors.New("OpenID Connect requires a client ID, a client secret, and a redirect URL")
+	}
+	if _, err := url.Parse(opts.OIDCRedirect); err != nil {
+		return nil, fmt.Errorf("invalid redirect URL: %s", err.Error())
+	}
+
+	//
+	// Our key is derived from the client secret, so that servers
+	// sharing it accept each other's sessions.
+	//
+	key := sha256.Sum256([]byte("tunneller-oidc:" + opts.OIDCClientSecret))
+	return &oidc{s: s, key: key[:]}, nil
+}
+
+// discover returns the endpoints of our provider, fetching them the
+// first time we need them.
+func (o *oidc) discover() (*oidcEndpoints, error) {
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.endpoints != nil {
+		return o.endpoints, nil
+	}
+
+	c := &http.Client{Timeout: 10 * time.Second}
+	res, err := c.Get(strings.TrimSuffix(o.s.opts.OIDCIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery failed: %s", res.Status)
+	}
+
+	var ep oidcEndpoints
+	if err := json.NewDecoder(res.Body).Decode(&ep); err != nil {
+		return nil, err
+	}
+	if ep.AuthorizationEndpoint == "" || ep.TokenEndpoint == "" {
+		return nil, errors.New("discovery failed: the provider's endpoints are missing")
+	}
+	o.endpoints = &ep
+	return o.endpoints, nil
+}
+
+// sign returns the given value, with an expiry time, signed with our
+// key, for use within a cookie or the state we send to our provider.
+func (o *oidc) sign(value string, expires time.Time) string {
+
+	msg := strconv.FormatInt(expires.Unix(), 10) + "|" + value
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(msg))
+
+	return base64.RawURLEncoding.EncodeToString([]byte(msg)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the value signed by sign, if the signature is valid
+// and it hasn't expired.
+func (o *oidc) verify(signed string) (string, bool) {
+
+	parts := strings.SplitN(signed, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	msg, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write(msg)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return "", false
+	}
+
+	fields := strings.SplitN(string(msg), "|", 2)
+	if len(fields) != 2 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// allowed returns the addresses, and domains, which may reach the named
+// tunnel, or nil if it doesn't require visitors to login.
+func (o *oidc) allowed(tunnel string) []string {
+
+	o.s.mutex.RLock()
+	defer o.s.mutex.RUnlock()
+
+	var out []string
+	for _, ent := range o.s.opts.OIDCAllow {
+		i := strings.Index(ent, "=")
+		if i < 0 {
+			continue
+		}
+		if ent[:i] == tunnel || ent[:i] == "*" {
+			out = append(out, strings.ToLower(ent[i+1:]))
+		}
+	}
+	return out
+}
+
+// permitted returns true if the visitor with the given address may
+// reach a tunnel which allows the given addresses, and domains.
+func permitted(email string, allowed []string) bool {
+
+	email = strings.ToLower(email)
+	for _, a := range allowed {
+		if a == email || (strings.HasPrefix(a, "@") && strings.HasSuffix(email, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCallback returns true if the given request is the provider
+// returning a visitor to us.
+func (o *oidc) isCallback(r *http.Request) bool {
+
+	u, _ := url.Parse(o.s.opts.OIDCRedirect)
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.EqualFold(host, u.Hostname()) && r.URL.Path == u.Path
+}
+
+// stripCookies removes our session, and login, cookies from the given
+// request, which is about to be forwarded.
+func stripCookies(r *http.Request) {
+	for _, c := range r.Cookies() {
+		if c.Name == oidcCookie || strings.HasPrefix(c.Name, oidcLoginCookie) {
+			removeCookie(r, c.Name)
+		}
+	}
+}
+
+// authenticate ensures that the visitor may reach the named tunnel,
+// returning true if so.
+//
+// Otherwise we've redirected them to login, or told them that they're
+// not permitted.
+func (o *oidc) authenticate(w http.ResponseWriter, r *http.Request, tunnel string, id string) bool {
+
+	//
+	// Only we may tell the service who is visiting.
+	//
+	r.Header.Del("X-Forwarded-Email")
+
+	//
+	// Our cookies are set upon the parent domain, so the browser sends
+	// them to every tunnel, whether it requires a login or not, and we
+	// never pass them on, lest the owner of one replay them to another.
+	//
+	session, _ := r.Cookie(oidcCookie)
+	stripCookies(r)
+
+	allowed := o.allowed(tunnel)
+	if allowed == nil {
+		return true
+	}
+
+	//
+	// If the visitor has a session then they're either permitted, or
+	// they're not.
+	//
+	if session != nil {
+		if email, ok := o.verify(session.Value); ok {
+			if !permitted(email, allowed) {
+				o.s.errorPage(w, "denied", http.StatusForbidden, tunnel, id)
+				return false
+			}
+
+			//
+			// Tell the service who is visiting.
+			//
+			r.Header.Set("X-Forwarded-Email", email)
+			return true
+		}
+	}
+
+	//
+	// Otherwise send them to login, recording where they were going.
+	//
+	ep, err := o.discover()
+	if err != nil {
+		o.s.logf("Error contacting our OpenID Connect provider: %s\n", err.Error())
+		http.Error(w, "Error contacting the login provider", http.StatusBadGateway)
+		return false
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	target := scheme + "://" + r.Host + r.URL.RequestURI()
+
+	//
+	// Bind the login to this browser.  Each login has a cookie of its
+	// own, so that several may be in progress at once.
+	//
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "Error starting the login", http.StatusInternalServerError)
+		return false
+	}
+	nonce := hex.EncodeToString(raw)
+	expires := time.Now().Add(oidcLoginTimeout)
+
+	u, _ := url.Parse(o.s.opts.OIDCRedirect)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie + nonce[:8],
+		Value:    nonce,
+		Path:     u.Path,
+		Domain:   o.s.opts.OIDCCookieDomain,
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.s.opts.OIDCClientID)
+	q.Set("redirect_uri", o.s.opts.OIDCRedirect)
+	q.Set("scope", "openid email")
+	q.Set("state", o.sign(nonce+"|"+target, expires))
+
+	sep := "?"
+	if strings.Contains(ep.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, ep.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+	return false
+}
+
+// callback handles the provider returning a visitor to us, after they've
+// logged in, exchanging the code it gives us for their ID token.
+func (o *oidc) callback(w http.ResponseWriter, r *http.Request) {
+
+	state, ok := o.verify(r.URL.Query().Get("state"))
+	fields := strings.SplitN(state, "|", 2)
+	if !ok || len(fields) != 2 || len(fields[0]) < 8 {
+		http.Error(w, "Invalid, or expired, login attempt", http.StatusBadRequest)
+		return
+	}
+	nonce, target := fields[0], fields[1]
+
+	//
+	// The login must have been started within this browser.
+	//
+	name := oidcLoginCookie + nonce[:8]
+	c, err := r.Cookie(name)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(nonce)) != 1 {
+		http.Error(w, "Invalid, or expired, login attempt", http.StatusBadRequest)
+		return
+	}
+	u, _ := url.Parse(o.s.opts.OIDCRedirect)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     u.Path,
+		Domain:   o.s.opts.OIDCCookieDomain,
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+	})
+
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		http.Error(w, "Login failed: "+msg, http.StatusForbidden)
+		return
+	}
+
+	email, err := o.exchange(r.URL.Query().Get("code"))
+	if err != nil {
+		o.s.logf("Error completing an OpenID Connect login: %s\n", err.Error())
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	expires := time.Now().Add(o.s.opts.OIDCSession)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    o.sign(email, expires),
+		Path:     "/",
+		Domain:   o.s.opts.OIDCCookieDomain,
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// exchange exchanges the given code for the visitor's ID token, and
+// returns the (verified) email address it contains.
+func (o *oidc) exchange(code string) (string, error) {
+
+	ep, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.s.opts.OIDCRedirect)
+	form.Set("client_id", o.s.opts.OIDCClientID)
+	form.Set("client_secret", o.s.opts.OIDCClientSecret)
+
+	c := &http.Client{Timeout: 10 * time.Second}
+	res, err := c.PostForm(ep.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", res.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+
+	//
+	// The token is a JWT, of which we need only the claims.
+	//
+	parts := strings.Split(tokens.IDToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Issuer        string          `json:"iss"`
+		Audience      json.RawMessage `json:"aud"`
+		Expires       int64           `json:"exp"`
+		Email         string          `json:"email"`
+		EmailVerified *bool           `json:"email_verified"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", err
+	}
+
+	if claims.Issuer != ep.Issuer {
+		return "", fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	if !strings.Contains(string(claims.Audience), strconv.Quote(o.s.opts.OIDCClientID)) {
+		return "", errors.New("ID token issued for another client")
+	}
+	if time.Now().Unix() > claims.Expires {
+		return "", errors.New("ID token has expired")
+	}
+	if claims.Email == "" {
+		return "", errors.New("ID token has no email address")
+	}
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return "", errors.New("email address is not verified")
+	}
+	return claims.Email, nil
+}
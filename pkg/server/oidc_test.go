@@ -0,0 +1,276 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProvider is an OpenID Connect provider, which issues ID tokens
+// for alice@example.com.
+func fakeProvider(t *testing.T) *httptest.Server {
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(oidcEndpoints{
+				Issuer:                srv.URL,
+				AuthorizationEndpoint: srv.URL + "/authorize",
+				TokenEndpoint:         srv.URL + "/token",
+			})
+		case "/token":
+			if r.FormValue("code") != "good" {
+				http.Error(w, "invalid code", http.StatusBadRequest)
+				return
+			}
+			claims, _ := json.Marshal(map[string]interface{}{
+				"iss":   srv.URL,
+				"aud":   "client",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"email": "alice@example.com",
+			})
+			json.NewEncoder(w).Encode(map[string]string{
+				"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig",
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestOIDC returns our OpenID Connect support, using the given
+// provider.
+func newTestOIDC(t *testing.T, issuer string) *oidc {
+
+	s := &Server{opts: Options{
+		OIDCIssuer:       issuer,
+		OIDCClientID:     "client",
+		OIDCClientSecret: "secret",
+		OIDCRedirect:     "https://auth.example.com/.tunneller/oidc",
+		OIDCCookieDomain: "example.com",
+		OIDCAllow:        []string{"*=@example.com"},
+		OIDCSession:      time.Hour,
+		Log:              ioutil.Discard,
+	}}
+	o, err := newOIDC(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return o
+}
+
+func TestOIDCSign(t *testing.T) {
+
+	o := newTestOIDC(t, "https://provider.example.com")
+	other := &oidc{key: []byte("another key")}
+	valid := o.sign("alice@example.com", time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name   string
+		signed string
+		value  string
+		ok     bool
+	}{
+		{"valid", valid, "alice@example.com", true},
+		{"expired", o.sign("alice@example.com", time.Now().Add(-time.Second)), "", false},
+		{"other key", other.sign("alice@example.com", time.Now().Add(time.Minute)), "", false},
+		{"tampered", "x" + valid, "", false},
+		{"unsigned", strings.SplitN(valid, ".", 2)[0], "", false},
+		{"empty", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, ok := o.verify(test.signed)
+			if value != test.value || ok != test.ok {
+				t.Fatalf("expected (%q, %t), got (%q, %t)", test.value, test.ok, value, ok)
+			}
+		})
+	}
+}
+
+func TestOIDCPermitted(t *testing.T) {
+
+	tests := []struct {
+		email   string
+		allowed []string
+		ok      bool
+	}{
+		{"alice@example.com", []string{"alice@example.com"}, true},
+		{"Alice@Example.com", []string{"alice@example.com"}, true},
+		{"bob@example.com", []string{"alice@example.com"}, false},
+		{"bob@example.com", []string{"@example.com"}, true},
+		{"bob@badexample.com", []string{"@example.com"}, false},
+		{"bob@example.com", nil, false},
+	}
+
+	for _, test := range tests {
+		if got := permitted(test.email, test.allowed); got != test.ok {
+			t.Fatalf("permitted(%q, %q): expected %t, got %t", test.email, test.allowed, test.ok, got)
+		}
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+
+	provider := fakeProvider(t)
+	o := newTestOIDC(t, provider.URL)
+
+	//
+	// Begin a login, recording the state we send to the provider, and
+	// the cookie which binds it to the visitor's browser.
+	//
+	login := func() (string, *http.Cookie) {
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://foo.example.com/page?x=1", nil)
+		if o.authenticate(w, r, "foo", "id") {
+			t.Fatalf("expected to be sent to login")
+		}
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected a redirect, got %d", w.Code)
+		}
+		u, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(u.String(), provider.URL+"/authorize?") {
+			t.Fatalf("unexpected redirect to %s", w.Header().Get("Location"))
+		}
+
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || !strings.HasPrefix(cookies[0].Name, oidcLoginCookie) {
+			t.Fatalf("expected a login cookie, got %v", cookies)
+		}
+		c := cookies[0]
+		if c.Domain != "example.com" || c.Path != "/.tunneller/oidc" || !c.HttpOnly {
+			t.Fatalf("unexpected login cookie %s", c)
+		}
+		return u.Query().Get("state"), c
+	}
+
+	state, cookie := login()
+	otherState, otherCookie := login()
+	if cookie.Name == otherCookie.Name {
+		t.Fatalf("expected each login to have a cookie of its own")
+	}
+
+	tests := []struct {
+		name    string
+		state   string
+		cookies []*http.Cookie
+		code    string
+		status  int
+	}{
+		{"no cookie", state, nil, "good", http.StatusBadRequest},
+		{"another login's cookie", state, []*http.Cookie{otherCookie}, "good", http.StatusBadRequest},
+		{"forged cookie", state, []*http.Cookie{{Name: cookie.Name, Value: strings.Repeat("0", 32)}}, "good", http.StatusBadRequest},
+		{"forged state", "x" + state, []*http.Cookie{cookie}, "good", http.StatusBadRequest},
+		{"state without nonce", o.sign("http://foo.example.com/", time.Now().Add(time.Minute)), []*http.Cookie{cookie}, "good", http.StatusBadRequest},
+		{"bad code", state, []*http.Cookie{cookie}, "bad", http.StatusForbidden},
+		{"valid", state, []*http.Cookie{cookie}, "good", http.StatusFound},
+		{"concurrent login", otherState, []*http.Cookie{cookie, otherCookie}, "good", http.StatusFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			q := url.Values{}
+			q.Set("state", test.state)
+			q.Set("code", test.code)
+			r := httptest.NewRequest("GET", o.s.opts.OIDCRedirect+"?"+q.Encode(), nil)
+			for _, c := range test.cookies {
+				r.AddCookie(c)
+			}
+			if !o.isCallback(r) {
+				t.Fatalf("expected a callback")
+			}
+
+			w := httptest.NewRecorder()
+			o.callback(w, r)
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusFound {
+				return
+			}
+
+			if w.Header().Get("Location") != "http://foo.example.com/page?x=1" {
+				t.Fatalf("unexpected redirect to %s", w.Header().Get("Location"))
+			}
+
+			//
+			// The login cookie is removed, and the session we
+			// set admits the visitor.
+			//
+			var session *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				switch {
+				case c.Name == oidcCookie:
+					session = c
+				case strings.HasPrefix(c.Name, oidcLoginCookie) && c.MaxAge >= 0:
+					t.Fatalf("expected the login cookie to be removed, got %s", c)
+				}
+			}
+			if session == nil {
+				t.Fatalf("expected a session cookie")
+			}
+
+			r = httptest.NewRequest("GET", "http://foo.example.com/page", nil)
+			r.AddCookie(session)
+			if !o.authenticate(httptest.NewRecorder(), r, "foo", "id") {
+				t.Fatalf("expected the session to be accepted")
+			}
+			if r.Header.Get("X-Forwarded-Email") != "alice@example.com" {
+				t.Fatalf("unexpected X-Forwarded-Email %q", r.Header.Get("X-Forwarded-Email"))
+			}
+		})
+	}
+}
+
+func TestOIDCStripCookies(t *testing.T) {
+
+	o := newTestOIDC(t, fakeProvider(t).URL)
+	o.s.opts.OIDCAllow = []string{"private=@example.com"}
+	session := o.sign("alice@example.com", time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name     string
+		tunnel   string
+		cookies  string
+		ok       bool
+		expected string
+	}{
+		{"public, session", "public", oidcCookie + "=" + session + "; app=1", true, "app=1"},
+		{"public, login", "public", oidcLoginCookie + "abcd=x; app=1", true, "app=1"},
+		{"public, only ours", "public", oidcCookie + "=" + session, true, ""},
+		{"public, none", "public", "app=1; other=2", true, "app=1; other=2"},
+		{"private, session", "private", "app=1; " + oidcCookie + "=" + session + "; " + oidcLoginCookie + "abcd=x", true, "app=1"},
+		{"private, no session", "private", oidcLoginCookie + "abcd=x; app=1", false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest("GET", "http://"+test.tunnel+".example.com/", nil)
+			r.Header.Set("Cookie", test.cookies)
+
+			w := httptest.NewRecorder()
+			if o.authenticate(w, r, test.tunnel, "id") != test.ok {
+				t.Fatalf("expected %t", test.ok)
+			}
+			if !test.ok {
+				return
+			}
+			if got := r.Header.Get("Cookie"); got != test.expected {
+				t.Fatalf("expected the cookies %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
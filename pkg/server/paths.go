@@ -0,0 +1,147 @@
+//
+// Path-based routing.
+//
+// Not everyone may point a wildcard DNS record at the server, so the
+// operator may also address tunnels by path, via -path-prefix /t/, such
+// that "https://tunnel.example.com/t/foo/login" reaches the "/login" page
+// of the tunnel named "foo".
+//
+// The prefix, and the name of the tunnel, are removed from the path of
+// each request before it is sent to the client, and given to the service
+// via the X-Forwarded-Prefix header.  The Location, and Content-Location,
+// headers of responses which refer to the service's own pages have them
+// restored, so that redirects work as expected.
+//
+// Every tunnel addressed this way shares the same origin, so the paths of
+// the cookies a service sets are scoped beneath its prefix too, as is our
+// sticky cookie, such that tunnels don't receive each other's cookies.
+// (Cookies set via script, or for a domain, cannot be kept apart.)
+//
+// Requests whose path doesn't begin with the prefix are routed by their
+// hostname as usual.
+//
+
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// routePath returns the name of the tunnel the request's path addresses,
+// if it begins with our prefix, along with the part of its path which
+// does so, having removed that from its path.  bare is true if the path
+// consisted of nothing more, lacking even a trailing slash.
+func (s *Server) routePath(r *http.Request) (name string, strip string, bare bool) {
+
+	prefix := s.opts.PathPrefix
+	if prefix == "" || !strings.HasPrefix(r.URL.Path, prefix) {
+		return "", "", false
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	name, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, path = rest[:i], rest[i:]
+	}
+	if name == "" {
+		return "", "", false
+	}
+	strip = prefix + name
+
+	if path != "" {
+		r.URL.Path = path
+		if strings.HasPrefix(r.URL.RawPath, strip+"/") {
+			r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, strip)
+		} else {
+			r.URL.RawPath = ""
+		}
+		r.RequestURI = r.URL.RequestURI()
+		r.Header.Set("X-Forwarded-Prefix", strip)
+	}
+
+	return strings.ToLower(name), strip, path == ""
+}
+
+// redirectPrefix redirects visitors who requested the prefix of a tunnel
+// without a trailing slash, such as "/t/foo", to "/t/foo/", so that the
+// relative links of its pages work.
+func redirectPrefix(w http.ResponseWriter, r *http.Request, prefix string) {
+
+	target := prefix + "/"
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, target, status)
+}
+
+// rewriteCookies scopes the cookies set by a response beneath the given
+// prefix, by prepending it to their Path attribute, if they have one.
+//
+// Those without are scoped to the path of the request the visitor made,
+// which already begins with the prefix.
+func rewriteCookies(h http.Header, prefix string) {
+
+	cookies := h["Set-Cookie"]
+	for i, cookie := range cookies {
+
+		attrs := strings.Split(cookie, ";")
+		for j, attr := range attrs {
+
+			name, value := strings.TrimSpace(attr), ""
+			if k := strings.Index(name, "="); k >= 0 {
+				name, value = strings.TrimSpace(name[:k]), strings.TrimSpace(name[k+1:])
+			}
+			if j == 0 || !strings.EqualFold(name, "Path") {
+				continue
+			}
+			if value == prefix || strings.HasPrefix(value, prefix+"/") {
+				continue
+			}
+
+			path := prefix
+			if value != "/" && strings.HasPrefix(value, "/") {
+				path += value
+			}
+			attrs[j] = " Path=" + path
+		}
+		cookies[i] = strings.Join(attrs, ";")
+	}
+}
+
+// rewriteLocations restores the given prefix to the Location, and
+// Content-Location, headers of a response, which refer to pages upon the
+// given host.
+func rewriteLocations(h http.Header, prefix string, host string) {
+
+	for _, name := range []string{"Location", "Content-Location"} {
+
+		value := h.Get(name)
+		if value == "" {
+			continue
+		}
+
+		u, err := url.Parse(value)
+		if err != nil || !strings.HasPrefix(u.Path, "/") {
+			continue
+		}
+		if u.Host != "" && !strings.EqualFold(u.Host, host) {
+			continue
+		}
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			continue
+		}
+
+		u.Path = prefix + u.Path
+		if u.RawPath != "" {
+			u.RawPath = prefix + u.RawPath
+		}
+		h.Set(name, u.String())
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRoutePath(t *testing.T) {
+
+	tests := []struct {
+		prefix string
+		url    string
+		name   string
+		strip  string
+		bare   bool
+		path   string
+	}{
+		{"/t/", "/t/foo/login?x=1", "foo", "/t/foo", false, "/login"},
+		{"/t/", "/t/Foo/", "foo", "/t/Foo", false, "/"},
+		{"/t/", "/t/foo", "foo", "/t/foo", true, "/t/foo"},
+		{"/t/", "/t/", "", "", false, "/t/"},
+		{"/t/", "/other/foo/", "", "", false, "/other/foo/"},
+		{"", "/t/foo/", "", "", false, "/t/foo/"},
+		{"/t/", "/t/foo/a%2Fb", "foo", "/t/foo", false, "/a/b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+
+			s := &Server{opts: Options{PathPrefix: test.prefix}}
+			r := httptest.NewRequest("GET", test.url, nil)
+
+			name, strip, bare := s.routePath(r)
+			if name != test.name || strip != test.strip || bare != test.bare {
+				t.Fatalf("expected (%q, %q, %t), got (%q, %q, %t)", test.name, test.strip, test.bare, name, strip, bare)
+			}
+			if r.URL.Path != test.path {
+				t.Fatalf("expected the path %q, got %q", test.path, r.URL.Path)
+			}
+			if name != "" && !bare && r.Header.Get("X-Forwarded-Prefix") != strip {
+				t.Fatalf("expected X-Forwarded-Prefix %q, got %q", strip, r.Header.Get("X-Forwarded-Prefix"))
+			}
+		})
+	}
+}
+
+func TestRewriteLocations(t *testing.T) {
+
+	tests := []struct {
+		location string
+		expected string
+	}{
+		{"/home", "/t/foo/home"},
+		{"/home?a=b#c", "/t/foo/home?a=b#c"},
+		{"http://example.com/home", "http://example.com/t/foo/home"},
+		{"http://EXAMPLE.com/home", "http://EXAMPLE.com/t/foo/home"},
+		{"http://other.com/home", "http://other.com/home"},
+		{"/t/foo/home", "/t/foo/home"},
+		{"/t/foo", "/t/foo"},
+		{"/t/foobar", "/t/foo/t/foobar"},
+		{"relative", "relative"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.location, func(t *testing.T) {
+
+			h := http.Header{}
+			if test.location != "" {
+				h.Set("Location", test.location)
+				h.Set("Content-Location", test.location)
+			}
+			rewriteLocations(h, "/t/foo", "example.com")
+
+			if got := h.Get("Location"); got != test.expected {
+				t.Fatalf("expected Location %q, got %q", test.expected, got)
+			}
+			if got := h.Get("Content-Location"); got != test.expected {
+				t.Fatalf("expected Content-Location %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRewriteCookies(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		cookies  []string
+		expected []string
+	}{
+		{
+			"root",
+			[]string{"session=abc; Path=/; HttpOnly"},
+			[]string{"session=abc; Path=/t/foo; HttpOnly"},
+		},
+		{
+			"beneath the root",
+			[]string{"session=abc; Path=/admin"},
+			[]string{"session=abc; Path=/t/foo/admin"},
+		},
+		{
+			"case and spacing",
+			[]string{"session=abc;path = /admin;Secure"},
+			[]string{"session=abc; Path=/t/foo/admin;Secure"},
+		},
+		{
+			"already scoped",
+			[]string{"a=1; Path=/t/foo", "b=2; Path=/t/foo/admin"},
+			[]string{"a=1; Path=/t/foo", "b=2; Path=/t/foo/admin"},
+		},
+		{
+			"another tunnel's prefix",
+			[]string{"a=1; Path=/t/foobar"},
+			[]string{"a=1; Path=/t/foo/t/foobar"},
+		},
+		{
+			"no path",
+			[]string{"a=1; HttpOnly", "b=2"},
+			[]string{"a=1; HttpOnly", "b=2"},
+		},
+		{
+			"empty path",
+			[]string{"a=1; Path="},
+			[]string{"a=1; Path=/t/foo"},
+		},
+		{
+			"value resembling a path",
+			[]string{"Path=/; Secure"},
+			[]string{"Path=/; Secure"},
+		},
+		{
+			"several",
+			[]string{"a=1; Path=/", "b=2; Path=/x", "c=3"},
+			[]string{"a=1; Path=/t/foo", "b=2; Path=/t/foo/x", "c=3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			h := http.Header{"Set-Cookie": append([]string{}, test.cookies...)}
+			rewriteCookies(h, "/t/foo")
+
+			if !reflect.DeepEqual(h["Set-Cookie"], test.expected) {
+				t.Fatalf("expected %q, got %q", test.expected, h["Set-Cookie"])
+			}
+		})
+	}
+}
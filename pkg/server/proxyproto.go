@@ -0,0 +1,278 @@
+//
+// The PROXY protocol.
+//
+// Behind HAProxy, or a cloud load-balancer operating at layer four, every
+// connection we accept comes from the load-balancer, so we'd log, and tell
+// the services behind our tunnels, its address rather than the visitor's.
+// Such load-balancers may send the visitor's address at the start of each
+// connection, via version one (text) or two (binary) of the PROXY protocol:
+//
+//   https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+//
+// Given -proxy-protocol 10.0.0.0/8, which may be repeated, we require the
+// connections made from those networks to begin with a PROXY header, and
+// use the address it gives in place of the load-balancer's.  Connections
+// from elsewhere are served as usual, so that nobody else may claim to be
+// whoever they wish.
+//
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// proxySignature begins each header of version two of the protocol.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyTimeout is how long we wait for the header of a connection.
+const proxyTimeout = 10 * time.Second
+
+// proxyMaxV2 is the size of the largest header of version two we accept,
+// which leaves room for the TLVs load-balancers add after the addresses.
+const proxyMaxV2 = 4096
+
+// proxyListener wraps a listener, reading the PROXY header of each
+// connection accepted from the networks of our load-balancers.
+type proxyListener struct {
+	net.Listener
+
+	// trusted holds the networks of our load-balancers.
+	trusted []*net.IPNet
+}
+
+// parseProxyNetworks parses the networks given via -proxy-protocol.
+func parseProxyNetworks(networks []string) ([]*net.IPNet, error) {
+
+	var out []*net.IPNet
+	for _, network := range networks {
+		n, err := protocol.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -proxy-protocol network %s: %s", network, err.Error())
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// Accept returns the next connection, which reads its PROXY header if it
+// was made by one of our load-balancers.
+func (l *proxyListener) Accept() (net.Conn, error) {
+
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		for _, n := range l.trusted {
+			if n.Contains(addr.IP) {
+				return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+			}
+		}
+	}
+	return c, nil
+}
+
+// proxyConn is a connection which begins with a PROXY header.
+//
+// We read the header when we're first asked for the connection's address,
+// or to read from it, rather than when accepting it, so that a slow
+// load-balancer cannot prevent us accepting others.
+type proxyConn struct {
+	net.Conn
+
+	// r reads the connection, following its header.
+	r *bufio.Reader
+
+	// once reads the header, which gives remote, the visitor's address,
+	// unless err is set.
+	once   sync.Once
+	remote net.Addr
+	err    error
+
+	// deadline is the read deadline we were given, such as that of the
+	// TLS handshake, which we restore once we've read the header.
+	deadline time.Time
+
+	// mutex protects our deadline.
+	mutex sync.Mutex
+}
+
+// init reads the connection's header, once.
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.mutex.Lock()
+		deadline := time.Now().Add(proxyTimeout)
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+		c.mutex.Unlock()
+
+		c.remote, c.err = readProxyHeader(c.r)
+
+		c.mutex.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mutex.Unlock()
+	})
+}
+
+// SetDeadline sets the read and write deadlines of the connection,
+// recording the former so that reading the header doesn't discard it.
+func (c *proxyConn) SetDeadline(t time.Time) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection, recording it
+// so that reading the header doesn't discard it.
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Read reads the connection, following its header.
+func (c *proxyConn) Read(p []byte) (int, error) {
+
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the visitor's address, given by the header, or that
+// of the load-balancer if it gave none.
+func (c *proxyConn) RemoteAddr() net.Addr {
+
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY header, of either version, returning
+// the address of the visitor it gives, which is nil for connections the
+// load-balancer made itself, such as health-checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+
+	sig, err := r.Peek(len(proxySignature))
+	if err == nil && bytes.Equal(sig, proxySignature) {
+		return readProxyV2(r)
+	}
+
+	start, err := r.Peek(6)
+	if err == nil && string(start) == "PROXY " {
+		return readProxyV1(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyV1 reads a header of the first version, such as:
+//
+//   PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+
+	//
+	// Headers are at most 107 bytes.
+	//
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads a header of the second version.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	version, command := head[12]>>4, head[12]&0x0f
+	family := head[13]
+	size := binary.BigEndian.Uint16(head[14:16])
+	if size > proxyMaxV2 {
+		return nil, fmt.Errorf("oversized PROXY protocol header of %d bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+
+	//
+	// The LOCAL command is sent for the load-balancer's own
+	// connections, and we ignore protocols other than TCP.
+	//
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", command)
+	}
+
+	switch family {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errors.New("truncated PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errors.New("truncated PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a header of the second version of the PROXY protocol.
+func proxyV2(command byte, family byte, body []byte) []byte {
+
+	out := append([]byte{}, proxySignature...)
+	out = append(out, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(out[14:16], uint16(len(body)))
+	return append(out, body...)
+}
+
+// proxyV2TCP4 returns the addresses of a TCP4 header, from 192.0.2.1:56324
+// to 198.51.100.1:443.
+func proxyV2TCP4() []byte {
+	body := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(body[8:10], 56324)
+	binary.BigEndian.PutUint16(body[10:12], 443)
+	return body
+}
+
+// proxyV2TCP6 returns the addresses of a TCP6 header, from
+// [2001:db8::1]:56324 to [2001:db8::2]:443.
+func proxyV2TCP6() []byte {
+	body := make([]byte, 36)
+	copy(body[0:16], net.ParseIP("2001:db8::1"))
+	copy(body[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(body[32:34], 56324)
+	binary.BigEndian.PutUint16(body[34:36], 443)
+	return body
+}
+
+func TestReadProxyHeader(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		input  []byte
+		remote string
+		err    string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /"), "192.0.2.1:56324", ""},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /"), "[2001:db8::1]:56324", ""},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nGET /"), "", ""},
+		{"v1 missing", []byte("GET / HTTP/1.1\r\n"), "", "missing PROXY protocol header"},
+		{"v1 bad address", []byte("PROXY TCP4 example 198.51.100.1 56324 443\r\n"), "", "invalid PROXY protocol header"},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n"), "", "invalid PROXY protocol header"},
+		{"v1 bad protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "", "invalid PROXY protocol header"},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1\r\n"), "", "invalid PROXY protocol header"},
+		{"v1 bare newline", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), "", "invalid PROXY protocol header"},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 198.51"), "", "EOF"},
+		{"v1 oversized", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", "invalid PROXY protocol header"},
+		{"v2 tcp4", append(proxyV2(1, 0x11, proxyV2TCP4()), "GET /"...), "192.0.2.1:56324", ""},
+		{"v2 tcp6", proxyV2(1, 0x21, proxyV2TCP6()), "[2001:db8::1]:56324", ""},
+		{"v2 tlvs", proxyV2(1, 0x11, append(proxyV2TCP4(), 0x04, 0, 1, 'x')), "192.0.2.1:56324", ""},
+		{"v2 local", proxyV2(0, 0x00, nil), "", ""},
+		{"v2 udp", proxyV2(1, 0x12, proxyV2TCP4()), "", ""},
+		{"v2 unknown command", proxyV2(2, 0x11, proxyV2TCP4()), "", "unsupported PROXY protocol command"},
+		{"v2 short tcp4", proxyV2(1, 0x11, proxyV2TCP4()[:8]), "", "truncated PROXY protocol header"},
+		{"v2 short tcp6", proxyV2(1, 0x21, proxyV2TCP6()[:20]), "", "truncated PROXY protocol header"},
+		{"v2 truncated head", proxyV2(1, 0x11, nil)[:14], "", "EOF"},
+		{"v2 truncated body", proxyV2(1, 0x11, proxyV2TCP4())[:20], "", "EOF"},
+		{"v2 oversized", proxyV2(1, 0x11, make([]byte, proxyMaxV2+1)), "", "oversized PROXY protocol header"},
+		{"v2 bad version", func() []byte {
+			h := proxyV2(1, 0x11, proxyV2TCP4())
+			h[12] = 0x31
+			return h
+		}(), "", "unsupported PROXY protocol version"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			remote, err := readProxyHeader(bufio.NewReader(bytes.NewReader(test.input)))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got := ""
+			if remote != nil {
+				got = remote.String()
+			}
+			if got != test.remote {
+				t.Fatalf("expected remote %q, got %q", test.remote, got)
+			}
+		})
+	}
+}
+
+func TestProxyConnRead(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello"))
+
+	c := &proxyConn{Conn: server, r: bufio.NewReader(server)}
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected the data following the header, got %q", buf)
+	}
+	if c.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Fatalf("unexpected remote address %s", c.RemoteAddr())
+	}
+}
+
+// deadlineConn records the read deadlines set upon it.
+type deadlineConn struct {
+	net.Conn
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestProxyConnDeadline(t *testing.T) {
+
+	input := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+
+	//
+	// A deadline set before the header is read, such as that of the
+	// TLS handshake, is kept once it has been read, and bounds the
+	// time we wait for the header too.
+	//
+	handshake := time.Now().Add(time.Second)
+	conn := &deadlineConn{}
+	c := &proxyConn{Conn: conn, r: bufio.NewReader(strings.NewReader(input))}
+	c.SetReadDeadline(handshake)
+	c.RemoteAddr()
+
+	last := conn.deadlines[len(conn.deadlines)-1]
+	if !last.Equal(handshake) {
+		t.Fatalf("expected the deadline %s to be restored, got %s", handshake, last)
+	}
+	if reading := conn.deadlines[1]; reading.After(handshake) {
+		t.Fatalf("expected the header to be read by %s, got %s", handshake, reading)
+	}
+
+	//
+	// Without one the header must arrive within proxyTimeout, and no
+	// deadline remains once it has.
+	//
+	conn = &deadlineConn{}
+	c = &proxyConn{Conn: conn, r: bufio.NewReader(strings.NewReader(input))}
+	c.RemoteAddr()
+
+	if len(conn.deadlines) != 2 {
+		t.Fatalf("expected two deadlines, got %v", conn.deadlines)
+	}
+	if d := time.Until(conn.deadlines[0]); d <= 0 || d > proxyTimeout {
+		t.Fatalf("unexpected deadline for the header, %s", d)
+	}
+	if !conn.deadlines[1].IsZero() {
+		t.Fatalf("expected no deadline once the header was read, got %s", conn.deadlines[1])
+	}
+}
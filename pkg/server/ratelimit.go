@@ -0,0 +1,98 @@
+//
+// A simple token-bucket rate-limiter, which the server uses to ensure
+// that a single busy tunnel cannot overwhelm the queue.
+//
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a single token-bucket.
+type bucket struct {
+	// tokens is the number of requests which may currently be made.
+	tokens float64
+
+	// last is the time at which the bucket was last refilled.
+	last time.Time
+}
+
+// rateLimiter holds a token-bucket for each tunnel name.
+type rateLimiter struct {
+	// rate is the number of requests per second which are permitted.
+	rate float64
+
+	// burst is the maximum number of requests which may be made at once.
+	burst float64
+
+	// buckets holds the bucket for each name.
+	buckets map[string]*bucket
+
+	// mutex protects our buckets.
+	mutex sync.Mutex
+}
+
+// newRateLimiter creates a rate-limiter which permits the given number
+// of requests per second, with bursts of up to the given size.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// SetLimit updates the rate, and burst-size, of the limiter.
+func (r *rateLimiter) SetLimit(rate float64, burst int) {
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rate = rate
+	r.burst = float64(burst)
+}
+
+// Allow returns true if a request may be made to the named tunnel.
+//
+// A rate of zero means that there is no limit.
+func (r *rateLimiter) Allow(name string) bool {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	b, ok := r.buckets[name]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[name] = b
+	}
+
+	//
+	// Refill the bucket, based on the time since we last did so.
+	//
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
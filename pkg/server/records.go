@@ -0,0 +1,235 @@
+//
+// Managing the DNS records of our tunnels.
+//
+// Usually the operator creates a wildcard record, pointing every name
+// beneath their domain at the server.  Instead we may create a record
+// for each tunnel as it connects, and remove it when the last client
+// serving it disconnects, via:
+//
+//   -dns-update cloudflare -dns-zone tunnel.example.com -dns-target 192.0.2.1
+//
+// which creates "foo.tunnel.example.com" whilst the tunnel "foo" is
+// connected, along with any custom domains mapped to it, see domains.go.
+//
+// The target is an IPv4 or IPv6 address, for an A or AAAA record, or
+// a hostname, for a CNAME record.  Several servers may share a zone if
+// each has its own target, as we only remove the records we created.
+//
+// Our provider may be slow, or unavailable, so we update it in the
+// background, retrying failed updates every minute.
+//
+
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// records manages the DNS records of our tunnels.
+type records struct {
+	// s is our server.
+	s *Server
+
+	// provider updates our records.
+	provider DNSRecords
+
+	// owners holds the clients serving each tunnel, by name.
+	owners map[string]map[string]bool
+
+	// mutex protects our owners.
+	mutex sync.Mutex
+
+	// created holds the records we've created, by name, and is only
+	// touched by run, and close once run has stopped.
+	created map[string]DNSRecord
+
+	// changed wakes run when the records we need may have changed.
+	changed chan struct{}
+
+	// done stops run, which closes stopped once it has.
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newRecords returns our DNS record management, or nil if it isn't
+// enabled.
+func newRecords(s *Server) (*records, error) {
+
+	opts := s.opts
+	provider := opts.Records
+	if provider == nil {
+		if opts.DNSUpdate == "" {
+			return nil, nil
+		}
+		var err error
+		provider, err = newDNSRecords(opts.DNSUpdate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.DNSZone == "" || opts.DNSTarget == "" {
+		return nil, errors.New("-dns-update requires both -dns-zone and -dns-target")
+	}
+
+	r := &records{
+		s:        s,
+		provider: provider,
+		owners:   make(map[string]map[string]bool),
+		created:  make(map[string]DNSRecord),
+		changed:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// onAdd records the tunnels served by a newly connected client.
+func (r *records) onAdd(reg *protocol.Registration) {
+
+	r.mutex.Lock()
+	for _, name := range reg.Names {
+		if r.owners[name] == nil {
+			r.owners[name] = make(map[string]bool)
+		}
+		r.owners[name][reg.Client] = true
+	}
+	r.mutex.Unlock()
+
+	r.update()
+}
+
+// onRemove forgets the tunnels served by a client which has gone away.
+func (r *records) onRemove(reg *protocol.Registration) {
+
+	r.mutex.Lock()
+	for _, name := range reg.Names {
+		delete(r.owners[name], reg.Client)
+		if len(r.owners[name]) == 0 {
+			delete(r.owners, name)
+		}
+	}
+	r.mutex.Unlock()
+
+	r.update()
+}
+
+// update asks run to bring our records up to date.
+func (r *records) update() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// record returns the record we create for the given name.
+func (r *records) record(name string) DNSRecord {
+
+	rec := DNSRecord{
+		Name:  strings.ToLower(strings.TrimSuffix(name, ".")) + ".",
+		Type:  "CNAME",
+		Value: r.s.opts.DNSTarget,
+		TTL:   r.s.opts.DNSTTL,
+	}
+	if ip := net.ParseIP(rec.Value); ip != nil {
+		rec.Type = "AAAA"
+		if ip.To4() != nil {
+			rec.Type = "A"
+		}
+	}
+	return rec
+}
+
+// wanted returns the records we should have, by name.
+func (r *records) wanted() map[string]DNSRecord {
+
+	out := make(map[string]DNSRecord)
+	zone := strings.Trim(r.s.opts.DNSZone, ".")
+
+	r.mutex.Lock()
+	for name := range r.owners {
+		rec := r.record(name + "." + zone)
+		out[rec.Name] = rec
+	}
+	r.mutex.Unlock()
+
+	for domain, name := range r.s.domainMap() {
+		r.mutex.Lock()
+		live := len(r.owners[name]) > 0
+		r.mutex.Unlock()
+
+		if live {
+			rec := r.record(domain)
+			out[rec.Name] = rec
+		}
+	}
+	return out
+}
+
+// sync creates the records we need, and deletes those we don't.
+func (r *records) sync() {
+
+	want := r.wanted()
+
+	for name, rec := range r.created {
+		if _, ok := want[name]; ok {
+			continue
+		}
+		if err := r.provider.DeleteRecord(rec); err != nil {
+			r.s.logf("Error deleting the DNS record %s: %s\n", name, err.Error())
+			continue
+		}
+		delete(r.created, name)
+	}
+
+	for name, rec := range want {
+		if _, ok := r.created[name]; ok {
+			continue
+		}
+		if err := r.provider.AddRecord(rec); err != nil {
+			r.s.logf("Error creating the DNS record %s: %s\n", name, err.Error())
+			continue
+		}
+		r.created[name] = rec
+	}
+}
+
+// run updates our records when they change, or every minute to retry
+// those which failed, until we're closed.
+func (r *records) run() {
+
+	defer close(r.stopped)
+
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-r.changed:
+		case <-tick.C:
+		case <-r.done:
+			return
+		}
+		r.sync()
+	}
+}
+
+// close deletes the records we've created, as we're no longer serving
+// them.
+func (r *records) close() {
+
+	close(r.done)
+	<-r.stopped
+
+	for name, rec := range r.created {
+		if err := r.provider.DeleteRecord(rec); err != nil {
+			r.s.logf("Error deleting the DNS record %s: %s\n", name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,400 @@
+//
+// The server keeps track of the clients which are connected, and the
+// tunnels they serve, by watching the presence messages they publish.
+//
+// Clients may also republish their registration periodically, as a
+// heartbeat, in which case we forget those which miss several of them,
+// rather than waiting for the queue to notice they've gone.
+//
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// missedHeartbeats is the number of heartbeats a client may miss before
+// we forget it.
+const missedHeartbeats = 3
+
+// registry holds the most recent registration of each connected client.
+type registry struct {
+	// clients maps the ID of a client to its registration.
+	clients map[string]*protocol.Registration
+
+	// seen maps the ID of a client to the time we last heard from it.
+	seen map[string]time.Time
+
+	// next holds the index of the client which should receive the
+	// next request for each tunnel, see pick.
+	next map[string]int
+
+	// mutex protects our maps.
+	mutex sync.RWMutex
+
+	// onAdd holds functions to invoke when a client registers, or
+	// updates its registration.
+	onAdd []func(reg *protocol.Registration)
+
+	// onRemove holds functions to invoke when a client disappears.
+	onRemove []func(reg *protocol.Registration)
+
+	// allow, if set, decides whether we accept each registration.
+	allow func(reg *protocol.Registration) bool
+
+	// secret, if set, returns the secret with which the client serving
+	// the named tunnel must sign its registrations, if any.
+	secret func(name string) string
+}
+
+// newRegistry creates a new, empty, registry.
+func newRegistry() *registry {
+	return &registry{
+		clients: make(map[string]*protocol.Registration),
+		seen:    make(map[string]time.Time),
+		next:    make(map[string]int),
+	}
+}
+
+// onPresence is invoked when a message is received upon the topic
+// "clients/$id/presence".
+//
+// A non-empty message registers a client, and an empty message, which
+// is what the queue publishes when a client disappears, removes it.
+func (r *registry) onPresence(client MQTT.Client, msg MQTT.Message) {
+
+	id := strings.TrimSuffix(strings.TrimPrefix(msg.Topic(), "clients/"), "/presence")
+
+	if len(msg.Payload()) == 0 {
+		r.mutex.Lock()
+		old, ok := r.clients[id]
+		delete(r.clients, id)
+		delete(r.seen, id)
+		r.mutex.Unlock()
+
+		if ok {
+			for _, fn := range r.onRemove {
+				fn(old)
+			}
+		}
+		return
+	}
+
+	reg, ok := r.open("presence", msg)
+	if !ok {
+		return
+	}
+
+	//
+	// Clients may only register themselves.
+	//
+	if protocol.TopicLevel(reg.Client) != id {
+		return
+	}
+
+	if !validNames(reg) {
+		return
+	}
+	if r.allow != nil && !r.allow(reg) {
+		return
+	}
+
+	r.mutex.Lock()
+	r.clients[id] = reg
+	r.seen[id] = time.Now()
+	r.mutex.Unlock()
+
+	for _, fn := range r.onAdd {
+		fn(reg)
+	}
+}
+
+// open returns the registration the given message holds, verifying its
+// signature if the tunnels it claims require one.
+//
+// The kind should be either "presence" or "heartbeat".
+func (r *registry) open(kind string, msg MQTT.Message) (*protocol.Registration, bool) {
+
+	var reg protocol.Registration
+	if err := json.Unmarshal(msg.Payload(), &reg); err == nil {
+		if r.signed(&reg) == "" {
+			return &reg, true
+		}
+		return nil, false
+	}
+
+	//
+	// Signatures are appended to the message, so the registration
+	// precedes it, and must be signed with the secret we share with
+	// the client serving each of its tunnels.
+	//
+	payload := msg.Payload()
+	if len(payload) < sha256.Size {
+		return nil, false
+	}
+	if err := json.Unmarshal(payload[:len(payload)-sha256.Size], &reg); err != nil {
+		return nil, false
+	}
+	secret := r.signed(&reg)
+	if secret == "" {
+		return &reg, true
+	}
+	for _, name := range reg.Names {
+		if other := r.secret(name); other != "" && other != secret {
+			return nil, false
+		}
+	}
+	if _, err := protocol.Verify(secret, kind, msg.Topic(), payload); err != nil {
+		return nil, false
+	}
+	return &reg, true
+}
+
+// signed returns the secret with which the given registration must be
+// signed, or the empty string if it needn't be.
+func (r *registry) signed(reg *protocol.Registration) string {
+
+	if r.secret == nil {
+		return ""
+	}
+	if len(reg.Names) == 0 {
+		return r.secret("")
+	}
+	for _, name := range reg.Names {
+		if secret := r.secret(name); secret != "" {
+			return secret
+		}
+	}
+	return ""
+}
+
+// validNames returns true if the given registration only claims names
+// which are valid, as clients may not claim those which visitors cannot
+// reach, or which would address other topics.
+func validNames(reg *protocol.Registration) bool {
+
+	for _, name := range reg.Names {
+		if !protocol.ValidName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// onHeartbeat is invoked when a message is received upon the topic
+// "clients/$id/heartbeat".
+//
+// The message holds the client's registration, so if we've forgotten
+// the client, perhaps because its heartbeats were delayed, we add it
+// again.
+func (r *registry) onHeartbeat(client MQTT.Client, msg MQTT.Message) {
+
+	id := strings.TrimSuffix(strings.TrimPrefix(msg.Topic(), "clients/"), "/heartbeat")
+
+	reg, ok := r.open("heartbeat", msg)
+	if !ok {
+		return
+	}
+
+	//
+	// Clients may only register themselves.
+	//
+	if protocol.TopicLevel(reg.Client) != id {
+		return
+	}
+	if !validNames(reg) {
+		return
+	}
+
+	r.mutex.RLock()
+	_, known := r.clients[id]
+	r.mutex.RUnlock()
+
+	if !known && r.allow != nil && !r.allow(reg) {
+		return
+	}
+
+	r.mutex.Lock()
+	_, known = r.clients[id]
+	if !known {
+		r.clients[id] = reg
+	}
+	r.seen[id] = time.Now()
+	r.mutex.Unlock()
+
+	if !known {
+		for _, fn := range r.onAdd {
+			fn(reg)
+		}
+	}
+}
+
+// lastSeen returns the time at which we last heard from the given
+// client.
+func (r *registry) lastSeen(id string) time.Time {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.seen[id]
+}
+
+// expire forgets the clients which have missed several heartbeats.
+func (r *registry) expire() {
+
+	var gone []*protocol.Registration
+
+	r.mutex.Lock()
+	for id, reg := range r.clients {
+		if reg.Heartbeat <= 0 {
+			continue
+		}
+		if time.Since(r.seen[id]) > missedHeartbeats*reg.Heartbeat {
+			gone = append(gone, reg)
+			delete(r.clients, id)
+			delete(r.seen, id)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, reg := range gone {
+		for _, fn := range r.onRemove {
+			fn(reg)
+		}
+	}
+}
+
+// watch expires clients, checking at the given interval.
+func (r *registry) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.expire()
+	}
+}
+
+// lookup returns the registration of the client serving the named
+// tunnel, or nil if there is no such client.
+func (r *registry) lookup(name string) *protocol.Registration {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, reg := range r.clients {
+		for _, n := range reg.Names {
+			if n == name {
+				return reg
+			}
+		}
+	}
+	return nil
+}
+
+// all returns a copy of the registration of every connected client.
+func (r *registry) all() []protocol.Registration {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var out []protocol.Registration
+	for _, reg := range r.clients {
+		out = append(out, *reg)
+	}
+	return out
+}
+
+// get returns the registration of the client with the given ID, if it
+// serves the named tunnel, or nil otherwise.
+func (r *registry) get(id string, name string) *protocol.Registration {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if reg, ok := r.clients[id]; ok {
+		for _, n := range reg.Names {
+			if n == name {
+				return reg
+			}
+		}
+	}
+	return nil
+}
+
+// pick returns the registration of a client serving the named tunnel,
+// or nil if there is no such client.
+//
+// If several clients serve the tunnel we choose among them in turn,
+// skipping those which are in maintenance mode, unless every one is.
+func (r *registry) pick(name string) *protocol.Registration {
+	return r.pickFrom(name, func(reg *protocol.Registration) []string {
+		return reg.Names
+	})
+}
+
+// serves returns true if any client lists the named tunnel among the
+// names returned by the given function, such as its TCP tunnels.
+func (r *registry) serves(name string, names func(reg *protocol.Registration) []string) bool {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, reg := range r.clients {
+		for _, n := range names(reg) {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pickFrom works as pick, choosing among the clients which list the
+// named tunnel among the names returned by the given function.
+func (r *registry) pickFrom(name string, names func(reg *protocol.Registration) []string) *protocol.Registration {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var found []*protocol.Registration
+	for _, reg := range r.clients {
+		for _, n := range names(reg) {
+			if n == name {
+				found = append(found, reg)
+			}
+		}
+	}
+	if len(found) == 0 {
+		delete(r.next, name)
+		return nil
+	}
+
+	//
+	// Prefer those clients which aren't in maintenance mode.
+	//
+	var live []*protocol.Registration
+	for _, reg := range found {
+		if _, ok := reg.InMaintenance(name); !ok {
+			live = append(live, reg)
+		}
+	}
+	if len(live) > 0 {
+		found = live
+	}
+
+	//
+	// Sort the clients, so that our rotation is stable.
+	//
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Client < found[j].Client
+	})
+
+	n := r.next[name] % len(found)
+	r.next[name] = n + 1
+	return found[n]
+}
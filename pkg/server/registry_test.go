@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// testMessage is a message received from the queue.
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 0 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+func TestRegistrySigned(t *testing.T) {
+
+	s := &Server{opts: Options{Secrets: []string{"private=secret"}}}
+	r := newRegistry()
+	r.secret = s.secret
+
+	topic := "clients/one/presence"
+	private, _ := json.Marshal(protocol.Registration{Client: "one", Names: []string{"private"}})
+	public, _ := json.Marshal(protocol.Registration{Client: "one", Names: []string{"public"}})
+
+	tests := []struct {
+		name    string
+		kind    string
+		payload []byte
+		ok      bool
+	}{
+		{"signed", "presence", protocol.Sign("secret", "presence", topic, private), true},
+		{"unsigned", "presence", private, false},
+		{"another secret", "presence", protocol.Sign("other", "presence", topic, private), false},
+		{"another kind", "heartbeat", protocol.Sign("secret", "presence", topic, private), false},
+		{"another topic", "presence", protocol.Sign("secret", "presence", "clients/two/presence", private), false},
+		{"not JSON", "presence", []byte("nonsense"), false},
+		{"no secret", "presence", public, true},
+		{"no secret, signed", "presence", protocol.Sign("secret", "presence", topic, public), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg, ok := r.open(test.kind, &testMessage{topic: topic, payload: test.payload})
+			if ok != test.ok {
+				t.Fatalf("expected %t, got %t", test.ok, ok)
+			}
+			if ok && reg.Client != "one" {
+				t.Fatalf("unexpected registration %+v", reg)
+			}
+		})
+	}
+}
+
+func TestRegistryClient(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		topic  string
+		client string
+		ok     bool
+	}{
+		{"itself", "clients/one/presence", "one", true},
+		{"another", "clients/one/presence", "two", false},
+		{"escaped", "clients/a%2Fb/presence", "a/b", true},
+		{"unescaped", "clients/a/b/presence", "a/b", false},
+		{"heartbeat", "clients/one/heartbeat", "one", true},
+		{"another heartbeat", "clients/one/heartbeat", "two", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := newRegistry()
+			payload, _ := json.Marshal(protocol.Registration{Client: test.client, Names: []string{"foo"}})
+			msg := &testMessage{topic: test.topic, payload: payload}
+			if strings.HasSuffix(test.topic, "/heartbeat") {
+				r.onHeartbeat(nil, msg)
+			} else {
+				r.onPresence(nil, msg)
+			}
+
+			if got := r.lookup("foo") != nil; got != test.ok {
+				t.Fatalf("expected %t, got %t", test.ok, got)
+			}
+		})
+	}
+}
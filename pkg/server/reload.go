@@ -0,0 +1,130 @@
+//
+// The server may reload its settings, without restarting, when asked
+// to do so via the admin API, or by the program embedding it.
+//
+// The settings which may safely be changed while we're running are:
+//
+//   * The rate-limits.
+//   * The limits upon the requests in flight.
+//   * The bandwidth quotas.
+//   * The maximum request-body size.
+//   * How long we wait for replies.
+//   * How long we wait for acknowledgements, and how often we resend.
+//   * The secrets used to sign messages.
+//   * The templates of our error pages.
+//   * The custom domains.
+//   * The banned tunnels.
+//   * The URLs of our webhooks.
+//   * The rules which modify headers.
+//   * The CORS policies.
+//   * The visitors who may login to each tunnel.
+//   * The credentials visitors must present.
+//   * Our TLS certificate, from the same files.
+//
+// Changes to any other setting are ignored.
+//
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Reload applies the given settings, as far as they may be changed
+// while we're running.
+func (s *Server) Reload(opts Options) error {
+
+	//
+	// Load everything we need first, so we don't leave things
+	// half-updated if there is an error.
+	//
+	pages, err := loadErrorPages(opts.ErrorDir)
+	if err != nil {
+		return err
+	}
+
+	rules, err := parseHeaderRules(opts.HeaderRules)
+	if err != nil {
+		return err
+	}
+
+	policies, err := parseCORS(opts.CORS)
+	if err != nil {
+		return err
+	}
+
+	if s.cert != nil {
+		if err := s.cert.reload(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.AckTimeout == 0 {
+		opts.AckTimeout = time.Second
+	}
+
+	//
+	// Now apply them.
+	//
+	s.limiter.SetLimit(opts.Rate, opts.Burst)
+	s.concurrency.SetLimit(opts.MaxConcurrent, opts.MaxConcurrentPerTunnel, opts.QueueTimeout)
+	s.usage.SetQuotas(opts.QuotaDaily, opts.QuotaMonthly)
+
+	s.mutex.Lock()
+	s.opts.MaxBody = opts.MaxBody
+	s.opts.Timeout = opts.Timeout
+	s.opts.MaxTimeout = opts.MaxTimeout
+	s.opts.AckTimeout = opts.AckTimeout
+	s.opts.Retransmit = opts.Retransmit
+	s.opts.Secrets = opts.Secrets
+	s.opts.ErrorDir = opts.ErrorDir
+	s.errorPages = pages
+	s.opts.Domains = opts.Domains
+	s.opts.Bans = opts.Bans
+	s.opts.Webhooks = opts.Webhooks
+	s.opts.HeaderRules = opts.HeaderRules
+	s.opts.OIDCAllow = opts.OIDCAllow
+	s.opts.Auth = opts.Auth
+	s.headerRules = rules
+	s.opts.CORS = opts.CORS
+	s.corsPolicies = policies
+	s.mutex.Unlock()
+
+	//
+	// Our custom domains may need records.
+	//
+	if s.records != nil {
+		s.records.update()
+	}
+
+	return nil
+}
+
+// reloadHandler reloads our settings, via the admin API.
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.opts.Reload == nil {
+		http.Error(w, "Reloading is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	opts, err := s.opts.Reload()
+	if err == nil {
+		err = s.Reload(opts)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
@@ -0,0 +1,163 @@
+//
+// Dispatching of replies.
+//
+// The server subscribes once to "clients/.replies/$id/+", and each
+// request asks the client to reply upon the topic beneath that which
+// is named by its ID.  The replies are then handed to the handler
+// awaiting them, which avoids subscribing for each request.
+//
+// Replies which the client split into parts are reassembled first, see
+// chunks.go.
+//
+
+package server
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// replies holds the channels of the requests awaiting replies.
+type replies struct {
+	// waiters maps the ID of a request to the channel its reply
+	// will be sent to.
+	waiters map[string]chan MQTT.Message
+
+	// secrets maps the ID of a request to the secret the parts of
+	// its reply must be signed with, if any.
+	secrets map[string]string
+
+	// chunks holds the replies whose parts we're receiving.
+	chunks *protocol.Chunks
+
+	// mutex protects our maps.
+	mutex sync.Mutex
+}
+
+// newReplies creates a new, empty, set of waiters.
+func newReplies() *replies {
+	return &replies{
+		waiters: make(map[string]chan MQTT.Message),
+		secrets: make(map[string]string),
+		chunks:  protocol.NewChunks(),
+	}
+}
+
+// wait registers the given request ID, and returns the channel its
+// replies will be sent to.
+//
+// The secret is that which the reply is signed with, if any.
+func (r *replies) wait(id string, secret string) chan MQTT.Message {
+
+	//
+	// A few replies are buffered, as we might receive those which
+	// fail verification, or acknowledgements of the request, before
+	// the genuine one.
+	//
+	ch := make(chan MQTT.Message, 8)
+
+	r.mutex.Lock()
+	r.waiters[id] = ch
+	r.secrets[id] = secret
+	r.mutex.Unlock()
+
+	return ch
+}
+
+// cancel removes the given request ID, once we've stopped waiting.
+func (r *replies) cancel(id string) {
+	r.mutex.Lock()
+	delete(r.waiters, id)
+	delete(r.secrets, id)
+	r.mutex.Unlock()
+}
+
+// onMessage is invoked when a reply is received, and passes it to the
+// handler awaiting it.  Replies nobody is awaiting are discarded.
+func (r *replies) onMessage(client MQTT.Client, msg MQTT.Message) {
+
+	topic := msg.Topic()
+	id := topic[strings.LastIndex(topic, "/")+1:]
+
+	r.mutex.Lock()
+	ch, ok := r.waiters[id]
+	secret := r.secrets[id]
+	r.mutex.Unlock()
+
+	if ok && protocol.IsChunk(msg.Payload()) {
+		payload, err := r.chunks.Add(secret, topic, msg.Payload())
+		if err != nil || payload == nil {
+			return
+		}
+		msg = &chunkMessage{Message: msg, payload: payload}
+	}
+
+	if ok {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// openAck returns true if the given message is the client's acknowledgement
+// of the request with the given ID, which is prefixed with "A-" rather than
+// the "X-" of its reply, and signed if we share a secret.
+func (s *Server) openAck(host string, secret string, id string, msg MQTT.Message) bool {
+
+	tmp := msg.Payload()
+	if !bytes.HasPrefix(tmp, []byte("A-")) {
+		return false
+	}
+	tmp = tmp[2:]
+
+	if secret != "" {
+		var err error
+		tmp, err = protocol.Verify(secret, "ack", msg.Topic(), tmp)
+		if err != nil {
+			s.logf("Ignoring acknowledgement from %s - %s\n", host, err)
+			return false
+		}
+	}
+	return string(tmp) == id
+}
+
+// openReply returns the response contained within the given reply,
+// or the empty string if it isn't valid.
+//
+// To avoid loops the client publishes its replies with a "X-" prefix,
+// and the remainder may be signed, encrypted and compressed.
+func (s *Server) openReply(host string, secret string, key []byte, msg MQTT.Message) string {
+
+	tmp := msg.Payload()
+	if !bytes.HasPrefix(tmp, []byte("X-")) {
+		return ""
+	}
+	tmp = tmp[2:]
+
+	var err error
+	if secret != "" {
+		tmp, err = protocol.Verify(secret, "reply", msg.Topic(), tmp)
+		if err != nil {
+			s.logf("Ignoring reply from %s - %s\n", host, err)
+			return ""
+		}
+	}
+	if key != nil {
+		tmp, err = protocol.Unseal(key, tmp)
+		if err != nil {
+			s.logf("Error decrypting reply from %s - %s\n", host, err)
+			return ""
+		}
+	}
+	out, err := protocol.Decompress(tmp)
+	if err != nil {
+		s.logf("Error decompressing reply from %s - %s\n", host, err)
+		return ""
+	}
+	return string(out)
+}
@@ -0,0 +1,120 @@
+//
+// Writing responses to visitors.
+//
+// Our clients reply with a complete plain-text response, such as:
+//
+//   HTTP/1.0 200 OK
+//   Header: blah
+//   Date: blah
+//   [newline]
+//   <html>
+//   ..
+//
+// We parse that, and write it via the usual http.ResponseWriter, rather
+// than writing it verbatim to the visitor's connection.  That allows the
+// connection to be kept alive, and used for HTTP/2, and it allows us to
+// relay the trailers which gRPC services depend upon.
+//
+// If the response cannot be parsed we fall back to writing it verbatim,
+// after hijacking the visitor's connection, as we always used to.
+//
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are the headers which only apply to the connection between
+// the client and the local service, rather than to our visitor's.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// writeResponse parses the plain-text response we received from the
+// client, and writes it to the visitor via the given ResponseWriter,
+// after passing it to our hooks, and compressing it if we may.
+//
+// An error is returned if the response cannot be parsed, in which case
+// nothing has been written.
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, tunnel string, response string) error {
+
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(response)), r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	s.mutex.RLock()
+	hooks := s.opts.Hooks
+	s.mutex.RUnlock()
+
+	for _, h := range hooks {
+		if err := h.Response(tunnel, r, res); err != nil {
+			s.logf("Error running our hooks for %s: %s\n", tunnel, err.Error())
+			http.Error(w, "Error processing the response", http.StatusBadGateway)
+			return nil
+		}
+	}
+
+	s.compress(r, res)
+	copyResponse(w, res)
+	return nil
+}
+
+// copyResponse writes the given response to the visitor.
+func copyResponse(w http.ResponseWriter, res *http.Response) {
+
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+
+	//
+	// gRPC responses carry their status in trailers, which are only
+	// available once the body has been read.
+	//
+	for k, v := range res.Trailer {
+		for _, val := range v {
+			w.Header().Add(http.TrailerPrefix+k, val)
+		}
+	}
+}
+
+// hijackResponse writes the plain-text response to the visitor verbatim,
+// after hijacking their connection, and then closes it.
+func (s *Server) hijackResponse(w http.ResponseWriter, response string) {
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Error parsing the response from the client", http.StatusBadGateway)
+		s.logf("Webserver doesn't support hijacking\n")
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.logf("Error running hijack:%s\n", err.Error())
+		return
+	}
+
+	//
+	// Send the reply, and close the connection:
+	//
+	fmt.Fprintf(bufrw, "%s", response)
+	bufrw.Flush()
+	conn.Close()
+}
@@ -0,0 +1,1670 @@
+// Package server implements the public end-point of our tunnels, which
+// receives requests from visitors and relays them to the clients via the
+// queue.
+//
+// It is used by the "serve" sub-command, but may be embedded within any
+// Go program:
+//
+//   s, err := server.New(server.Options{BindHost: "0.0.0.0", BindPort: 8080})
+//   if err != nil {
+//       ...
+//   }
+//   err = s.ListenAndServe()
+//
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/satori/go.uuid"
+	"github.com/skx/tunneller/pkg/hook"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// Options holds the settings of a Server.
+//
+// The zero value of each field is safe, and disables the corresponding
+// feature, unless otherwise noted.
+type Options struct {
+	// Broker is the address of the MQ-server, which defaults to
+	// "tcp://localhost:1883".  Brokers may list several MQ-servers
+	// instead, such as the members of a cluster, which we try in
+	// order, failing over to the next if we lose our connection.
+	Broker  string
+	Brokers []string
+
+	// The CA which signed the MQ-server's certificate, and the
+	// certificate and key we present to it, when connecting via TLS.
+	BrokerCA   string
+	BrokerCert string
+	BrokerKey  string
+
+	// The host and port we bind upon.  BindHosts may list several
+	// hosts, or "host:port" pairs, to bind upon instead, see listen.go.
+	BindHost  string
+	BindHosts []string
+	BindPort  int
+
+	// Should we listen via SO_REUSEPORT, so that a new server may be
+	// launched alongside us before we're stopped?  See listen.go.
+	ReusePort bool
+
+	// The number of requests per second each tunnel may receive,
+	// and the size of the bursts we'll allow.
+	Rate  float64
+	Burst int
+
+	// The number of requests which may be in flight, overall and to
+	// each tunnel, and how long those beyond the limits may wait, see
+	// concurrency.go.
+	MaxConcurrent          int
+	MaxConcurrentPerTunnel int
+	QueueTimeout           time.Duration
+
+	// The number of bytes each tunnel may transfer per day, and
+	// per month.
+	QuotaDaily   int64
+	QuotaMonthly int64
+
+	// The address upon which we present our administrative API.
+	Admin string
+
+	// The maximum size of the request-bodies we'll forward.
+	MaxBody int64
+
+	// The secrets used to sign the messages we exchange with clients,
+	// as "name=secret", or just "secret" for all tunnels.
+	Secrets []string
+
+	// How long we wait for replies by default, which defaults to ten
+	// seconds, and the most a visitor may ask us to wait via the
+	// X-Tunnel-Timeout header.
+	Timeout    time.Duration
+	MaxTimeout time.Duration
+
+	// The range of ports we allocate to TCP tunnels, as "first-last".
+	TCPPorts string
+
+	// The range of ports we allocate to UDP tunnels, as "first-last".
+	UDPPorts string
+
+	// Should we accept HTTP/2 connections without TLS?
+	H2C bool
+
+	// Should we gzip responses for visitors who accept that?  See
+	// compress.go.
+	Compress bool
+
+	// The ID of this server, which must be unique amongst those
+	// sharing the queue (default random).
+	ID string
+
+	// The QoS level we use for requests, replies, and presence.
+	QoS int
+
+	// ChunkSize is the size of the largest message we'll publish, as
+	// we split larger requests into parts, see chunks.go.
+	ChunkSize int
+
+	// The database of accounts, as "sqlite:/path" or "postgres://...",
+	// and whether every client must register with one of their tokens,
+	// see accounts.go.
+	AccountsDB       string
+	AccountsRequired bool
+
+	// How long a tunnel may go without receiving a request before we
+	// expire it, zero for never, see idle.go.
+	IdleTTL time.Duration
+
+	// The number of times we resend requests which clients don't
+	// acknowledge within AckTimeout (default one second).
+	Retransmit int
+	AckTimeout time.Duration
+
+	// Should the queue persist our session whilst we're disconnected?
+	Persistent bool
+
+	// The directory containing our error templates, if any.
+	ErrorDir string
+
+	// Custom domains, specified as "domain=name".
+	Domains []string
+
+	// The prefix of the paths which address tunnels by name, such as
+	// "/t/", see paths.go.
+	PathPrefix string
+
+	// The names of the tunnels which may not be used.
+	Bans []string
+
+	// The certificate and key to serve HTTPS with, if any.
+	TLSCert string
+	TLSKey  string
+
+	// The port to accept plain-HTTP visitors upon too, when serving
+	// HTTPS, who are redirected to HTTPS upon HTTPSPort, or BindPort,
+	// unless HTTPServe is set, see listen.go.
+	HTTPPort  int
+	HTTPSPort int
+	HTTPServe bool
+
+	// The networks of the load-balancers whose connections begin with
+	// a PROXY protocol header, see proxyproto.go.
+	ProxyProtocol []string
+
+	// The networks of the reverse-proxies whose X-Forwarded-For headers
+	// we believe, when determining the visitor's address.
+	TrustedProxies []string
+
+	// The domain to obtain a wildcard certificate for, via ACME, which
+	// is written to TLSCert and TLSKey, see acme.go.
+	ACMEDomain string
+
+	// The ACME CA's directory URL, the contact address for our account,
+	// and the file holding our account key.
+	ACMEDirectory  string
+	ACMEEmail      string
+	ACMEAccountKey string
+
+	// The DNS provider which publishes our challenge records, see dns.go,
+	// and how long to wait for them to propagate.
+	ACMEDNS         string
+	ACMEPropagation time.Duration
+
+	// DNS, if set, is used in preference to ACMEDNS, which allows those
+	// embedding the server to supply their own provider.
+	DNS DNSProvider
+
+	// The DNS provider through which we create a record for each tunnel
+	// as it connects, see records.go, the zone beneath which they are
+	// created, the address or hostname they point to, and their TTL.
+	DNSUpdate string
+	DNSZone   string
+	DNSTarget string
+	DNSTTL    int
+
+	// Records, if set, is used in preference to DNSUpdate, which allows
+	// those embedding the server to supply their own provider.
+	Records DNSRecords
+
+	// The file to record each request within, if any, which is rotated
+	// once it exceeds the given size, or age, keeping the given number
+	// of older logs.
+	AuditLog     string
+	AuditMaxSize int64
+	AuditMaxAge  time.Duration
+	AuditKeep    int
+
+	// The maximum size of our cache of responses, zero to disable it,
+	// and of any single response within it, see cache.go.
+	CacheSize      int64
+	CacheMaxObject int64
+
+	// Rules which modify the headers of requests and responses, see
+	// headers.go.
+	HeaderRules []string
+
+	// The CORS policies of our tunnels, see cors.go.
+	CORS []string
+
+	// The URLs to which we POST events, such as tunnels connecting
+	// and disconnecting, see webhooks.go.
+	Webhooks []string
+
+	// The credentials visitors must present, as "name=user:password",
+	// or just "user:password" for all tunnels, see auth.go.
+	Auth []string
+
+	// The OpenID Connect provider visitors may be required to login
+	// via, our client ID and secret, and the URL the provider returns
+	// visitors to, see oidc.go.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirect     string
+
+	// The domain our session cookies are scoped to, and how long the
+	// sessions last, which defaults to twelve hours.
+	OIDCCookieDomain string
+	OIDCSession      time.Duration
+
+	// The visitors who may reach each tunnel, as "name=email", or
+	// "name=@domain", with a name of "*" matching every tunnel.
+	OIDCAllow []string
+
+	// Hooks which may inspect, modify, or answer our requests, and
+	// inspect or modify our responses.
+	Hooks []hook.Hook
+
+	// Log is where we write our messages, which defaults to stdout.
+	Log io.Writer
+
+	// Reload, if set, is invoked when a reload is requested via the
+	// admin API, and returns the settings to apply, see Server.Reload.
+	Reload func() (Options, error)
+}
+
+//
+// Server is the structure which holds our state.
+//
+type Server struct {
+	// Our settings.
+	//
+	// Those which may be reloaded are protected by our mutex.
+	opts Options
+
+	// MQ conneciton
+	mq MQTT.Client
+
+	// The HTTP-server which visitors connect to, and the addresses it
+	// listens upon.
+	srv   *http.Server
+	addrs []string
+
+	// The HTTP-server which plain-HTTP visitors connect to, if we're
+	// serving HTTPS to others.
+	plain *http.Server
+
+	// The networks of our load-balancers, which use the PROXY protocol.
+	proxyNets []*net.IPNet
+
+	// The networks of the reverse-proxies we trust, see RemoteIP.
+	trustedNets []*net.IPNet
+
+	// The clients which are connected, and their tunnels.
+	registry *registry
+
+	// The rate-limiter which enforces our limits.
+	limiter *rateLimiter
+
+	// The limits upon the requests in flight.
+	concurrency *concurrencyLimiter
+
+	// The bandwidth used by each tunnel.
+	usage *usageTracker
+
+	// The requests we couldn't relay, by the kind of failure.
+	failures *failureCounts
+
+	// The recent traffic of each tunnel.
+	stats *statsTracker
+
+	// The requests which are currently in-flight.
+	inflight sync.WaitGroup
+
+	// mutex protects the settings which may be reloaded.
+	mutex sync.RWMutex
+
+	// The pinger we use to measure our latency to the queue.
+	pinger *pinger
+
+	// The relay for TCP tunnels, if enabled.
+	tcp *tcpServer
+
+	// The relay for UDP tunnels, if enabled.
+	udp *udpServer
+
+	// The requests awaiting replies.
+	replies *replies
+
+	// The credentials which matched those clients require.
+	verified *verifiedCredentials
+
+	// The templates of our error pages, by kind.
+	errorPages map[string]*template.Template
+
+	// Custom domains added via the admin API, mapped to the names of
+	// the tunnels serving them.
+	customDomains map[string]string
+
+	// The tunnels banned via the admin API.
+	bans map[string]bool
+
+	// The certificate we present, if we're serving HTTPS.
+	cert *certificate
+
+	// The log we record requests within, if any.
+	auditLog *auditLog
+
+	// The webhooks we notify of events.
+	hooks *webhooks
+
+	// The rules which modify our headers.
+	headerRules []headerRule
+
+	// The CORS policies of our tunnels.
+	corsPolicies []corsPolicy
+
+	// Our OpenID Connect support, if enabled.
+	oidc *oidc
+
+	// The TLS configuration we use to connect to the MQ-server, if any.
+	brokerTLS *tls.Config
+
+	// The DNS records of our tunnels, if we manage them.
+	records *records
+
+	// Our database of accounts, if we have one.
+	accounts *accounts
+
+	// The tunnels the operator has put into maintenance mode, mapped
+	// to the message to show visitors.
+	maintenance map[string]string
+
+	// Our cache of responses, if enabled.
+	cache *responseCache
+}
+
+//
+// New creates a new server with the given settings.
+//
+// The server does nothing until ListenAndServe is invoked.
+//
+func New(opts Options) (*Server, error) {
+
+	if opts.Broker == "" && len(opts.Brokers) == 0 {
+		opts.Broker = "tcp://localhost:1883"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.AckTimeout == 0 {
+		opts.AckTimeout = time.Second
+	}
+	if opts.OIDCSession == 0 {
+		opts.OIDCSession = 12 * time.Hour
+	}
+	if opts.ACMEDirectory == "" {
+		opts.ACMEDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	}
+	if opts.PathPrefix != "" {
+		opts.PathPrefix = "/" + strings.Trim(opts.PathPrefix, "/") + "/"
+	}
+	if opts.ACMEAccountKey == "" && opts.TLSCert != "" {
+		opts.ACMEAccountKey = filepath.Join(filepath.Dir(opts.TLSCert), "acme-account.pem")
+	}
+	if opts.ACMEPropagation == 0 {
+		opts.ACMEPropagation = 60 * time.Second
+	}
+	if opts.DNSTTL == 0 {
+		opts.DNSTTL = 300
+	}
+	if opts.Log == nil {
+		opts.Log = os.Stdout
+	}
+	if opts.ID == "" {
+		uid := uuid.NewV4()
+		opts.ID = uid.String()[:8]
+	}
+	if opts.QoS < 0 || opts.QoS > 2 {
+		return nil, errors.New("the QoS level must be 0, 1, or 2")
+	}
+	if opts.ChunkSize != 0 && opts.ChunkSize < protocol.MinChunkSize {
+		return nil, fmt.Errorf("the chunk size must be at least %d bytes", protocol.MinChunkSize)
+	}
+
+	s := &Server{
+		opts:          opts,
+		registry:      newRegistry(),
+		limiter:       newRateLimiter(opts.Rate, opts.Burst),
+		concurrency:   newConcurrencyLimiter(opts.MaxConcurrent, opts.MaxConcurrentPerTunnel, opts.QueueTimeout),
+		usage:         newUsageTracker(opts.QuotaDaily, opts.QuotaMonthly),
+		failures:      &failureCounts{counts: make(map[string]int64)},
+		stats:         newStatsTracker(),
+		pinger:        newPinger(),
+		replies:       newReplies(),
+		verified:      newVerifiedCredentials(),
+		customDomains: make(map[string]string),
+		bans:          make(map[string]bool),
+		maintenance:   make(map[string]string),
+		cache:         newResponseCache(opts.CacheSize, opts.CacheMaxObject),
+	}
+
+	//
+	// Notify our webhooks as clients come and go.
+	//
+	s.hooks = newWebhooks(s)
+	s.registry.onAdd = append(s.registry.onAdd, s.hooks.onAdd)
+	s.registry.onRemove = append(s.registry.onRemove, s.hooks.onRemove)
+
+	//
+	// Clients we share a secret with must sign their registrations.
+	//
+	s.registry.secret = s.secret
+
+	//
+	// Forget clients which stop sending heartbeats.
+	//
+	go s.registry.watch(time.Second)
+
+	//
+	// Expire tunnels which nobody is using, checking every minute, or
+	// more often if they expire quickly.
+	//
+	if opts.IdleTTL > 0 {
+		interval := opts.IdleTTL / 4
+		if interval > time.Minute {
+			interval = time.Minute
+		}
+		go s.watchIdle(opts.IdleTTL, interval)
+	}
+
+	var err error
+	s.errorPages, err = loadErrorPages(opts.ErrorDir)
+	if err != nil {
+		return nil, fmt.Errorf("error loading our error pages: %s", err.Error())
+	}
+
+	s.headerRules, err = parseHeaderRules(opts.HeaderRules)
+	if err != nil {
+		return nil, err
+	}
+
+	s.corsPolicies, err = parseCORS(opts.CORS)
+	if err != nil {
+		return nil, err
+	}
+
+	s.oidc, err = newOIDC(s)
+	if err != nil {
+		return nil, err
+	}
+
+	s.brokerTLS, err = protocol.BrokerTLS(opts.BrokerCA, opts.BrokerCert, opts.BrokerKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading our TLS settings for the MQ-server: %s", err.Error())
+	}
+
+	//
+	// Open our database of accounts, if we have one, which decides
+	// which clients may register.
+	//
+	if opts.AccountsDB != "" {
+		s.accounts, err = openAccounts(opts.AccountsDB, s.logf)
+		if err != nil {
+			return nil, fmt.Errorf("error opening our accounts: %s", err.Error())
+		}
+		s.registry.allow = s.allowRegistration
+		s.registry.onRemove = append(s.registry.onRemove, func(reg *protocol.Registration) {
+			s.accounts.forget(reg.Client)
+		})
+	} else if opts.AccountsRequired {
+		return nil, errors.New("-accounts-required requires -accounts-db")
+	}
+
+	//
+	// Create DNS records for our tunnels, if we should.
+	//
+	s.records, err = newRecords(s)
+	if err != nil {
+		return nil, err
+	}
+	if s.records != nil {
+		s.registry.onAdd = append(s.registry.onAdd, s.records.onAdd)
+		s.registry.onRemove = append(s.registry.onRemove, s.records.onRemove)
+	}
+
+	//
+	// Obtain our certificate, if we're to do so via ACME, and keep it
+	// renewed.
+	//
+	if opts.ACMEDomain != "" {
+		a, err := newACME(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.ensure(); err != nil {
+			return nil, fmt.Errorf("error obtaining our certificate: %s", err.Error())
+		}
+		go a.watch(12 * time.Hour)
+	}
+
+	//
+	// Load our certificate, if we're to serve HTTPS, and watch for
+	// it to be renewed.
+	//
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		if opts.TLSCert == "" || opts.TLSKey == "" {
+			return nil, errors.New("both a certificate and key are required to serve HTTPS")
+		}
+		s.cert, err = newCertificate(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading our certificate: %s", err.Error())
+		}
+		go s.cert.watch(30*time.Second, s.logf)
+	}
+
+	//
+	// Open our audit log, if we should record requests.
+	//
+	if opts.AuditLog != "" {
+		s.auditLog, err = newAuditLog(opts.AuditLog, opts.AuditMaxSize, opts.AuditMaxAge, opts.AuditKeep)
+		if err != nil {
+			return nil, fmt.Errorf("error opening our audit log: %s", err.Error())
+		}
+	}
+
+	//
+	// If we're relaying TCP tunnels then we need to allocate ports
+	// to them as their clients come and go.
+	//
+	if opts.TCPPorts != "" {
+		s.tcp, err = newTCPServer(s, opts.TCPPorts)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up TCP tunnels: %s", err.Error())
+		}
+		s.registry.onAdd = append(s.registry.onAdd, s.tcp.onAdd)
+		s.registry.onRemove = append(s.registry.onRemove, s.tcp.onRemove)
+	}
+
+	//
+	// Similarly for UDP tunnels.
+	//
+	if opts.UDPPorts != "" {
+		s.udp, err = newUDPServer(s, opts.UDPPorts)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up UDP tunnels: %s", err.Error())
+		}
+		s.registry.onAdd = append(s.registry.onAdd, s.udp.onAdd)
+		s.registry.onRemove = append(s.registry.onRemove, s.udp.onRemove)
+	}
+
+	//
+	// Work out the addresses we'll listen upon.
+	//
+	s.addrs, err = bindAddrs(opts)
+	if err != nil {
+		return nil, err
+	}
+	s.proxyNets, err = parseProxyNetworks(opts.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	s.trustedNets, err = parseTrustedNetworks(opts.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// We want to make sure we handle timeouts effectively by using
+	// a non-default http-server
+	//
+	// NOTE: The timeouts are a little generous, considering our
+	// proxy to the client will timeout after 10 seconds..
+	//
+	s.srv = &http.Server{
+		Addr:         s.addrs[0],
+		Handler:      s.publicHandler(),
+		ReadTimeout:  300 * time.Second,
+		WriteTimeout: 300 * time.Second,
+		ErrorLog:     log.New(opts.Log, "", 0),
+	}
+
+	//
+	// If we're serving HTTPS we present our certificate, which may
+	// be reloaded while we're running.
+	//
+	if s.cert != nil {
+		s.srv.TLSConfig = &tls.Config{GetCertificate: s.cert.getCertificate}
+	}
+
+	//
+	// We may accept plain-HTTP visitors too, redirecting them to
+	// HTTPS unless we're to serve them.
+	//
+	if opts.HTTPPort != 0 {
+		if s.cert == nil {
+			return nil, errors.New("-http-port requires HTTPS, via -tls-cert and -tls-key")
+		}
+		var handler http.Handler = http.HandlerFunc(s.redirectHTTPS)
+		if opts.HTTPServe {
+			handler = s.publicHandler()
+		}
+		s.plain = &http.Server{
+			Handler:      handler,
+			ReadTimeout:  s.srv.ReadTimeout,
+			WriteTimeout: s.srv.WriteTimeout,
+			ErrorLog:     s.srv.ErrorLog,
+		}
+	}
+
+	return s, nil
+}
+
+//
+// RemoteIP retrieves the remote IP address of the requesting HTTP-client.
+//
+// This is sent to the client, for logging purposes.
+//
+// The address of the connection already reflects any PROXY protocol
+// header, and the X-Forwarded-For header is only believed if it was set
+// by one of the given trusted proxies, as visitors may set it to whatever
+// they like.  Each proxy appends the address it received the request
+// from, so we take the last entry which wasn't added by a proxy we trust.
+//
+func RemoteIP(request *http.Request, trusted []*net.IPNet) string {
+
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+
+	entries := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(entries) - 1; i >= 0 && trustedIP(ip, trusted); i-- {
+
+		address := strings.TrimSpace(entries[i])
+
+		// Remove the port, if present.
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		if net.ParseIP(address) == nil {
+			break
+		}
+		ip = address
+	}
+
+	return ip
+}
+
+//
+// trustedIP returns true if the given address is within one of the
+// given networks.
+//
+func trustedIP(ip string, trusted []*net.IPNet) bool {
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// parseTrustedNetworks parses the networks of our trusted proxies.
+//
+func parseTrustedNetworks(networks []string) ([]*net.IPNet, error) {
+
+	var out []*net.IPNet
+	for _, network := range networks {
+		n, err := protocol.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -trusted-proxy network %s: %s", network, err.Error())
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+//
+// addForwardedHeaders adds the standard X-Forwarded-* headers to the
+// request, so that the service behind the tunnel can learn who the
+// visitor was, and how they connected to us.
+//
+func addForwardedHeaders(request *http.Request) {
+
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+
+	//
+	// If we're behind another proxy we append to its list.
+	//
+	if prior := request.Header.Get("X-Forwarded-For"); prior != "" {
+		ip = prior + ", " + ip
+	}
+	request.Header.Set("X-Forwarded-For", ip)
+
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+	request.Header.Set("X-Forwarded-Proto", proto)
+	request.Header.Set("X-Forwarded-Host", request.Host)
+}
+
+//
+// bufferBody reads the body of the given request into memory, if its
+// length is unknown, such that the request we send to the client has a
+// Content-Length header.
+//
+// This is the case for requests which send their body in chunks, and
+// for HTTP/2 requests which don't declare a length.
+//
+func bufferBody(r *http.Request) error {
+
+	if r.ContentLength >= 0 && len(r.TransferEncoding) == 0 {
+		return nil
+	}
+
+	body := []byte{}
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.Header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	return nil
+}
+
+//
+// requestTimeout returns how long we should wait for the reply to the
+// given request.
+//
+// Visitors may ask us to wait for a number of seconds, via the header
+// X-Tunnel-Timeout, up to our maximum.
+//
+func (s *Server) requestTimeout(r *http.Request) time.Duration {
+
+	s.mutex.RLock()
+	timeout, max := s.opts.Timeout, s.opts.MaxTimeout
+	s.mutex.RUnlock()
+
+	if v := r.Header.Get("X-Tunnel-Timeout"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			timeout = time.Duration(secs * float64(time.Second))
+		}
+	}
+	if max > 0 && timeout > max {
+		timeout = max
+	}
+	return timeout
+}
+
+//
+// secret returns the secret used to sign the messages we exchange with
+// the client serving the named tunnel, if any.
+//
+func (s *Server) secret(name string) string {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	secret := ""
+	for _, ent := range s.opts.Secrets {
+		if !strings.Contains(ent, "=") {
+			secret = ent
+			continue
+		}
+		if strings.HasPrefix(ent, name+"=") {
+			return strings.TrimPrefix(ent, name+"=")
+		}
+	}
+	return secret
+}
+
+//
+// logf writes a message to our log.
+//
+func (s *Server) logf(format string, args ...interface{}) {
+	fmt.Fprintf(s.opts.Log, format, args...)
+}
+
+//
+// HTTPHandler is the core of our server.
+//
+// This function is invoked for all accesses.
+//
+func (s *Server) HTTPHandler(w http.ResponseWriter, r *http.Request) {
+
+	//
+	// Record that this request is in-flight, so that we can wait for
+	// it to complete if we're asked to shutdown.
+	//
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+
+	//
+	// Each request has a unique ID, which is shown upon our error
+	// pages, and used to route the reply to us.
+	//
+	uid := uuid.NewV4()
+	id := uid.String()
+
+	//
+	// Record the request in our audit log, once we've responded.
+	//
+	aw := &auditWriter{ResponseWriter: w}
+	w = aw
+	entry := &AuditEntry{Time: time.Now(), RequestID: id}
+	defer s.audit(entry, r, aw)
+
+	//
+	// Visitors returning from our OpenID Connect provider aren't
+	// visiting a tunnel.
+	//
+	if s.oidc != nil && s.oidc.isCallback(r) {
+		s.oidc.callback(w, r)
+		return
+	}
+
+	//
+	// See which vhost the connection was sent to, we assume that
+	// the variable part will be the start of the hostname, unless
+	// it is one of our custom domains.
+	//
+	// i.e. "foo.tunnel.steve.fi" has a name of "foo".
+	//
+	// If we route by path too then "tunnel.steve.fi/t/foo/" has the
+	// same name, see paths.go.
+	//
+	host, prefix, bare := s.routePath(r)
+	if host == "" {
+		host = s.tunnelName(r.Host)
+	}
+	entry.Tunnel = host
+
+	//
+	// The name is used within the topic we publish the request upon,
+	// so we refuse those which aren't valid, rather than allowing the
+	// visitor to address other topics.
+	//
+	if !protocol.ValidName(host) {
+		http.Error(w, "Invalid tunnel name", http.StatusBadRequest)
+		return
+	}
+
+	//
+	// Apply the operator's rules to the headers of our response.
+	//
+	w = &headerWriter{ResponseWriter: w, s: s, tunnel: host, id: id, origin: r.Header.Get("Origin"), prefix: prefix, host: r.Host}
+
+	//
+	// Visitors who request the root of a tunnel's path need a trailing
+	// slash, for relative links to work.
+	//
+	if bare {
+		redirectPrefix(w, r, prefix)
+		return
+	}
+
+	//
+	// The operator may have banned this tunnel.
+	//
+	if s.banned(host) {
+		s.errorPage(w, "banned", http.StatusForbidden, host, id)
+		return
+	}
+
+	//
+	// We answer CORS preflights ourselves, which browsers send without
+	// credentials, if the tunnel has a CORS policy.
+	//
+	if s.preflight(w, r, host) {
+		return
+	}
+
+	//
+	// The operator may require visitors to login.
+	//
+	if s.oidc != nil && !s.oidc.authenticate(w, r, host, id) {
+		return
+	}
+
+	//
+	// The operator may require visitors to present credentials too.
+	//
+	if !s.authorized(w, r, host) {
+		return
+	}
+
+	//
+	// The operator may have put the tunnel into maintenance mode.
+	//
+	if msg, ok := s.inMaintenance(host); ok {
+		s.maintenancePage(w, host, id, msg)
+		return
+	}
+
+	//
+	// Ensure the tunnel isn't receiving more requests than we allow.
+	//
+	if !s.limiter.Allow(host) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	//
+	// Ensure the tunnel hasn't used all of its bandwidth.
+	//
+	if s.usage.Exceeded(host) {
+		s.hooks.exceeded(host)
+		http.Error(w, "Bandwidth quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	//
+	// Several clients may serve the same tunnel, in which case we
+	// spread our requests among them, unless the visitor is pinned
+	// to one of them.
+	//
+	reg, pin := s.registry.pickSticky(host, r)
+
+	//
+	// If no client is serving this tunnel there's nobody to send
+	// the request to.
+	//
+	if reg == nil {
+		s.errorPage(w, "offline", http.StatusServiceUnavailable, host, id)
+		return
+	}
+	entry.Client = reg.Client
+
+	//
+	// The client may have put the tunnel into maintenance mode, which
+	// means every client serving it has done so.
+	//
+	if msg, ok := reg.InMaintenance(host); ok {
+		s.maintenancePage(w, host, id, msg)
+		return
+	}
+
+	//
+	// If the client serving this tunnel has restricted the networks
+	// it may be accessed from then ensure the visitor is permitted.
+	//
+	// NOTE: We deliberately ignore any X-Forwarded-For header here,
+	// as visitors may set it to whatever they like.
+	//
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !reg.Permitted(net.ParseIP(ip)) {
+		s.errorPage(w, "denied", http.StatusForbidden, host, id)
+		return
+	}
+
+	//
+	// The token the client registered with may have exceeded its
+	// limits for the day.
+	//
+	if status, msg := s.accounts.exceeded(reg.Client); status != 0 {
+		s.quotaPage(w, status, host, id, msg)
+		return
+	}
+
+	//
+	// TCP and UDP tunnels are reached via their own port, not via HTTP.
+	//
+	if reg.IsTCP(host) || reg.IsUDP(host) {
+		http.Error(w, "This is not a HTTP tunnel", http.StatusNotFound)
+		return
+	}
+
+	//
+	// If the client serving this tunnel requires visitors to login
+	// then ensure they have done so.
+	//
+	// If the operator requires credentials too then they must be the
+	// same.
+	//
+	if reg.Auth != "" {
+
+		user, pass, ok := r.BasicAuth()
+		if !ok || !s.verified.check(reg.Auth, user, pass) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", host))
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		//
+		// The credentials are for the tunnel, not the service
+		// behind it, so don't pass them on.
+		//
+		r.Header.Del("Authorization")
+	}
+	if len(s.credentials(host)) > 0 {
+		r.Header.Del("Authorization")
+	}
+
+	//
+	// Ensure we're not awaiting too many replies, from this tunnel or
+	// overall, waiting briefly for earlier requests to finish if so.
+	//
+	if !s.concurrency.Acquire(r.Context(), host) {
+		s.errorPage(w, "busy", http.StatusServiceUnavailable, host, id)
+		return
+	}
+	defer s.concurrency.Release(host)
+
+	//
+	// Ensure the body of the request isn't too large to send.
+	//
+	// We never read more than one byte beyond our limit, regardless
+	// of what the visitor claims the size is.
+	//
+	s.mutex.RLock()
+	maxBody := s.opts.MaxBody
+	s.mutex.RUnlock()
+
+	if maxBody > 0 {
+
+		if r.ContentLength > maxBody {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody+1))
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > maxBody {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	//
+	// Our clients expect requests to state the length of their body,
+	// so if the visitor sent it in chunks we read it all now.
+	//
+	if err := bufferBody(r); err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	//
+	// The visitor may have asked us to confirm we'll accept the body
+	// before sending it, which Go has done for us as we read it.  As
+	// we send the body along with the request there's no need for the
+	// local service to do the same.
+	//
+	r.Header.Del("Expect")
+
+	//
+	// Slow end-points may ask us to wait longer than usual for the
+	// reply, which is a matter for us rather than the local service.
+	//
+	wait := s.requestTimeout(r)
+	r.Header.Del("X-Tunnel-Timeout")
+
+	//
+	// Let the service know who is visiting.
+	//
+	addForwardedHeaders(r)
+
+	//
+	// Apply the operator's rules to the headers of the request.
+	//
+	s.applyHeaderRules(r.Header, false, host, id)
+
+	//
+	// Our hooks may modify the request, or answer it themselves.
+	//
+	s.mutex.RLock()
+	hooks := s.opts.Hooks
+	s.mutex.RUnlock()
+
+	for _, h := range hooks {
+		res, err := h.Request(host, r)
+		if err != nil {
+			s.logf("Error running our hooks for %s: %s\n", host, err.Error())
+			http.Error(w, "Error processing the request", http.StatusInternalServerError)
+			return
+		}
+		if res != nil {
+			copyResponse(w, res)
+			res.Body.Close()
+			return
+		}
+	}
+
+	//
+	// We may be able to answer the request from our cache, or to ask
+	// the client only to confirm that our cached response is current.
+	//
+	// Requests which modify a resource make our copy of it stale.
+	//
+	s.cache.invalidate(host, r)
+	cached := s.cache.lookup(host, r)
+	if cached != nil {
+		_, noCache := cacheControl(r.Header)["no-cache"]
+		if cached.fresh() && !noCache {
+			if cached.conditional(r) {
+				w.Header().Set("X-Cache", "HIT")
+				if cached.etag != "" {
+					w.Header().Set("ETag", cached.etag)
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if err := s.writeResponse(w, r, host, cached.hit()); err != nil {
+				s.logf("Error parsing a cached response from %s: %s\n", host, err.Error())
+			}
+			return
+		}
+		if !cached.revalidate(r) {
+			cached = nil
+		}
+	}
+
+	//
+	// Our clients only speak HTTP/1.x.
+	//
+	h2 := isHTTP2(r)
+	if h2 {
+		downgradeRequest(r)
+	}
+
+	//
+	// Dump the request to plain-text.
+	//
+	requestDump, err := httputil.DumpRequest(r, true)
+	s.logf("Sending request to remote name %s\n", host)
+	if err != nil {
+		fmt.Fprintf(w, "Error converting the incoming request to plain-text: %s\n", err.Error())
+		s.logf("Error converting the incoming request to plain-text: %s\n", err.Error())
+		return
+	}
+
+	//
+	// This is the structure we'll send to the client.
+	//
+	var req protocol.Request
+
+	//
+	// Add the actual request.
+	//
+	req.Request = string(requestDump)
+
+	//
+	// Add the source-IP from which it was received.
+	//
+	req.Source = RemoteIP(r, s.trustedNets)
+
+	//
+	// Ask the client to reply upon a topic which only we, and only
+	// for this request, are subscribed to.  This ensures that several
+	// servers may share the queue.
+	//
+	req.ID = id
+	req.Reply = "clients/.replies/" + s.opts.ID + "/" + req.ID
+
+	//
+	// Ask the client to acknowledge the request, if it is able to, so
+	// that we may resend it if it is lost, and know whether it was.
+	//
+	req.Ack = reg.Acks
+
+	//
+	// Convert the structure to a JSON message, so we can send it down
+	// the queue.
+	//
+	toSend, err := json.Marshal(req)
+
+	if err != nil {
+		fmt.Fprintf(w, "Error encoding the request as JSON: %s\n", err.Error())
+		s.logf("Error encoding the request as JSON: %s\n", err.Error())
+		return
+	}
+
+	//
+	// Compress the request, if the client asked us to.
+	//
+	if reg.Compress == "gzip" {
+		toSend, err = protocol.Compress(toSend)
+		if err != nil {
+			fmt.Fprintf(w, "Error compressing the request: %s\n", err.Error())
+			s.logf("Error compressing the request: %s\n", err.Error())
+			return
+		}
+	}
+
+	//
+	// Encrypt the request, if the client asked us to.
+	//
+	// The same key will be used to decrypt the reply.
+	//
+	var key []byte
+	if len(reg.PublicKey) > 0 {
+		toSend, key, err = protocol.SealRequest(reg.PublicKey, toSend)
+		if err != nil {
+			fmt.Fprintf(w, "Error encrypting the request: %s\n", err.Error())
+			s.logf("Error encrypting the request: %s\n", err.Error())
+			return
+		}
+	}
+
+	//
+	// Each client receives requests upon a topic of its own, beneath
+	// that of the tunnel.
+	//
+	topic := "clients/" + protocol.TopicLevel(host) + "/" + protocol.TopicLevel(reg.Client)
+
+	//
+	// Sign the request, if we share a secret with the client, and
+	// we'll require its reply to be signed too.
+	//
+	secret := s.secret(host)
+	if secret != "" {
+		toSend = protocol.Sign(secret, "request", topic, toSend)
+	}
+
+	//
+	// The (complete) response from the client will be placed here.
+	//
+	response := ""
+
+	//
+	// Register our interest in the reply before we send the request,
+	// so that we can't miss it.
+	//
+	replies := s.replies.wait(req.ID, secret)
+	defer s.replies.cancel(req.ID)
+
+	//
+	// Publish the JSON object to the topic that we believe the client
+	// will be listening upon.
+	//
+	published := s.publishRequest(topic, secret, reg, toSend)
+	if published != nil {
+		s.logf("Error publishing request %s to %s: %s\n", id, host, published.Error())
+	}
+
+	//
+	// We now wait until we have a reply.
+	//
+	// We wait for up to ten seconds, by default, before deciding the
+	// client is either a) offline, or b) failing.
+	//
+	// If the client acknowledges our requests we resend those it
+	// doesn't acknowledge promptly, as they've probably been lost,
+	// and give up once we've resent them as often as we may.
+	//
+	timeout := time.After(wait)
+
+	s.mutex.RLock()
+	ackTimeout := s.opts.AckTimeout
+	retransmit := s.opts.Retransmit
+	s.mutex.RUnlock()
+
+	var resend <-chan time.Time
+	if req.Ack {
+		resend = time.After(ackTimeout)
+	}
+	retries := 0
+	acknowledged := false
+
+	for waiting := published == nil; waiting && len(response) == 0; {
+		select {
+		case msg := <-replies:
+			if s.openAck(host, secret, req.ID, msg) {
+				acknowledged = true
+				resend = nil
+				continue
+			}
+			response = s.openReply(host, secret, key, msg)
+		case <-resend:
+			if retries >= retransmit {
+				waiting = false
+				break
+			}
+			retries++
+			s.logf("Resending request %s to %s, as it wasn't acknowledged\n", req.ID, host)
+			s.publishRequest(topic, secret, reg, toSend)
+			resend = time.After(ackTimeout)
+		case <-timeout:
+			waiting = false
+		}
+	}
+	unacknowledged := (req.Ack && !acknowledged) || published != nil
+
+	//
+	// If the length is empty then that means either:
+	//
+	//   1. We didn't get a reply because the remote host was slow.
+	//
+	//   2. Nothing is listening on the topic, so the client is dead.
+	//
+	// Clients which acknowledge our requests let us tell the two
+	// apart, otherwise we assume the former, unless we couldn't even
+	// publish the request.
+	//
+	// If we did receive a response, and the visitor should be pinned
+	// to the client which sent it, then we add our cookie.
+	//
+	s.hooks.reply(host, reg.Client, len(response) > 0)
+
+	//
+	// Cache the response, if we may, or if the client confirmed that
+	// our cached response is current then send that.
+	//
+	if len(response) > 0 {
+		if cached != nil && notModified(response) {
+			response = s.cache.refresh(cached, r, response)
+		} else {
+			response = s.cache.store(host, r, response)
+		}
+	}
+	if len(response) > 0 && pin {
+		path := "/"
+		if prefix != "" {
+			path = prefix
+		}
+		response = addCookie(response, &http.Cookie{
+			Name:     stickyCookie,
+			Value:    reg.Client,
+			Path:     path,
+			HttpOnly: true,
+		})
+	}
+	if len(response) == 0 {
+
+		//
+		// Failure-response.
+		//
+		// NOTE: This is a "complete" response.
+		//
+		if unacknowledged {
+			s.logf("Request %s to %s wasn't received by client %s\n", id, host, reg.Client)
+			s.failures.add("unreachable")
+			response = s.errorResponse("unreachable", http.StatusBadGateway, host, id)
+		} else {
+			s.logf("Request %s to %s wasn't answered in time by client %s\n", id, host, reg.Client)
+			s.failures.add("timeout")
+			response = s.errorResponse("timeout", http.StatusGatewayTimeout, host, id)
+		}
+	}
+
+	//
+	// Record the traffic.
+	//
+	s.usage.Add(host, int64(len(requestDump)), int64(len(response)))
+	s.stats.record(host, responseStatus(response), time.Since(entry.Time), int64(len(requestDump)), int64(len(response)))
+	s.accounts.record(reg, host, int64(len(requestDump)), int64(len(response)))
+
+	//
+	// Send the response to the visitor, see response.go.
+	//
+	// HTTP/2 connections can't be hijacked, so if we cannot parse
+	// the response we can only report that.
+	//
+	if err := s.writeResponse(w, r, host, response); err != nil {
+		s.logf("Error parsing the response from %s: %s\n", host, err.Error())
+		if h2 {
+			http.Error(w, "Error parsing the response from the client", http.StatusBadGateway)
+			return
+		}
+		s.hijackResponse(w, response)
+	}
+}
+
+//
+// ListenAndServe connects to the MQ-server, and then serves visitors
+// until Shutdown is invoked.
+//
+// Like http.Server it returns nil, rather than http.ErrServerClosed,
+// once we've been shutdown.
+//
+func (s *Server) ListenAndServe() error {
+
+	//
+	// We connect to the first of our MQ-servers which accepts us, and
+	// fail over to the others, in the same order, should we lose our
+	// connection.
+	//
+	opts := MQTT.NewClientOptions()
+	brokers := s.opts.Brokers
+	if len(brokers) == 0 {
+		brokers = []string{s.opts.Broker}
+	}
+	for _, broker := range brokers {
+		opts.AddBroker(broker)
+	}
+
+	//
+	// Our session can only be persisted if we use the same ID each
+	// time we connect.
+	//
+	opts.SetClientID("server." + s.opts.ID)
+	opts.SetCleanSession(!s.opts.Persistent)
+
+	//
+	// Present our certificate, and verify the MQ-server's, if we
+	// should.
+	//
+	if s.brokerTLS != nil {
+		opts.SetTLSConfig(s.brokerTLS)
+	}
+
+	//
+	// Every time we connect we'll subscribe to the presence messages
+	// of our clients, so that we know which tunnels are available.
+	//
+	// The messages are retained, so we'll receive the registration
+	// of every connected client immediately.
+	//
+	// We also subscribe to the replies to our requests, see replies.go.
+	//
+	opts.SetOnConnectHandler(s.onConnect)
+	s.mq = MQTT.NewClient(opts)
+	if token := s.mq.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to connect to MQ-server: %s", token.Error())
+	}
+
+	//
+	// Launch our administrative API, if we should.
+	//
+	if s.opts.Admin != "" {
+		s.logf("Launching the admin API on http://%s\n", s.opts.Admin)
+		go func() {
+			l, err := s.listenTCP(s.opts.Admin)
+			if err == nil {
+				err = http.Serve(l, s.adminHandler())
+			}
+			if err != nil {
+				s.logf("Error launching our admin API: %s\n", err.Error())
+			}
+		}()
+	}
+
+	//
+	// Bind upon each of our addresses, and show where we've done so.
+	//
+	listeners, err := s.listen(s.addrs)
+	if err != nil {
+		return err
+	}
+	var plain []net.Listener
+	if s.plain != nil {
+		plain, err = s.listen(s.plainAddrs())
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+	}
+
+	scheme := "http"
+	if s.cert != nil {
+		scheme = "https"
+	}
+	for _, l := range listeners {
+		s.logf("Launching the server on %s://%s\n", scheme, l.Addr())
+	}
+	for _, l := range plain {
+		if s.opts.HTTPServe {
+			s.logf("Launching the server on http://%s\n", l.Addr())
+		} else {
+			s.logf("Redirecting visitors from http://%s to HTTPS\n", l.Addr())
+		}
+	}
+
+	//
+	// Launch the server upon each of them, until it is shutdown, or
+	// any fails.
+	//
+	errs := make(chan error, len(listeners)+len(plain))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if s.cert != nil {
+				errs <- s.srv.ServeTLS(l, "", "")
+			} else {
+				errs <- s.srv.Serve(l)
+			}
+		}(l)
+	}
+	for _, l := range plain {
+		go func(l net.Listener) {
+			errs <- s.plain.Serve(l)
+		}(l)
+	}
+
+	err = <-errs
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	s.srv.Close()
+	if s.plain != nil {
+		s.plain.Close()
+	}
+	return err
+}
+
+// onConnect subscribes to the topics we're interested in, every time
+// we connect to the MQ-server.
+func (s *Server) onConnect(c MQTT.Client) {
+
+	//
+	// If we're replacing another server we learn the ports it gave
+	// to the TCP and UDP tunnels, which the queue retains, before we
+	// learn of the clients.
+	//
+	if s.opts.ReusePort {
+		for _, ports := range s.announcedPorts() {
+			token := c.Subscribe("clients/+"+ports.suffix, byte(s.opts.QoS), ports.onMessage)
+			token.Wait()
+			if token.Error() != nil {
+				s.logf("Failed to subscribe to clients/+%s - %s\n", ports.suffix, token.Error())
+			}
+		}
+	}
+
+	token := c.Subscribe("clients/+/presence", byte(s.opts.QoS), s.registry.onPresence)
+	token.Wait()
+	if token.Error() != nil {
+		s.logf("Failed to subscribe to clients/+/presence - %s\n", token.Error())
+	}
+
+	token = c.Subscribe("clients/.replies/"+s.opts.ID+"/+", byte(s.opts.QoS), s.replies.onMessage)
+	token.Wait()
+	if token.Error() != nil {
+		s.logf("Failed to subscribe to clients/.replies/%s/+ - %s\n", s.opts.ID, token.Error())
+	}
+
+	token = c.Subscribe("clients/+/heartbeat", 0, s.registry.onHeartbeat)
+	token.Wait()
+	if token.Error() != nil {
+		s.logf("Failed to subscribe to clients/+/heartbeat - %s\n", token.Error())
+	}
+
+	token = c.Subscribe(s.pinger.topic, 0, s.pinger.onMessage)
+	token.Wait()
+	if token.Error() != nil {
+		s.logf("Failed to subscribe to %s - %s\n", s.pinger.topic, token.Error())
+	}
+
+	if s.tcp != nil {
+		token = c.Subscribe("clients/+/+/stream/up", byte(s.opts.QoS), s.tcp.onMessage)
+		token.Wait()
+		if token.Error() != nil {
+			s.logf("Failed to subscribe to clients/+/+/stream/up - %s\n", token.Error())
+		}
+	}
+
+	if s.udp != nil {
+		token = c.Subscribe("clients/+/+/datagram/up", byte(s.opts.QoS), s.udp.onMessage)
+		token.Wait()
+		if token.Error() != nil {
+			s.logf("Failed to subscribe to clients/+/+/datagram/up - %s\n", token.Error())
+		}
+	}
+}
+
+//
+// Shutdown stops the server gracefully, waiting for in-flight requests
+// to complete, until the given context expires, before disconnecting
+// from the MQ-server.
+//
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	//
+	// Stop accepting new connections, and wait for idle ones to close.
+	//
+	err := s.srv.Shutdown(ctx)
+	if s.plain != nil {
+		if perr := s.plain.Shutdown(ctx); err == nil {
+			err = perr
+		}
+	}
+
+	//
+	// The server doesn't track the connections we've hijacked, so
+	// we wait for our handlers to complete too.
+	//
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	//
+	// Finally disconnect from the queue.
+	//
+	if s.mq != nil {
+		token := s.mq.Unsubscribe("clients/+/presence")
+		token.Wait()
+		s.mq.Disconnect(250)
+	}
+
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
+	if s.accounts != nil {
+		if err := s.accounts.close(); err != nil {
+			s.logf("Error recording the traffic of our accounts: %s\n", err.Error())
+		}
+	}
+	if s.records != nil {
+		s.records.close()
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+
+	trusted, err := parseTrustedNetworks([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		{"direct", "1.2.3.4:5678", nil, "1.2.3.4"},
+		{"spoofed", "1.2.3.4:5678", []string{"6.6.6.6"}, "1.2.3.4"},
+		{"via a proxy", "10.0.0.1:5678", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"spoofed via a proxy", "10.0.0.1:5678", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{"via two proxies", "10.0.0.1:5678", []string{"6.6.6.6, 1.2.3.4, 192.168.1.1"}, "1.2.3.4"},
+		{"several headers", "10.0.0.1:5678", []string{"6.6.6.6", "1.2.3.4:80"}, "1.2.3.4"},
+		{"only proxies", "10.0.0.1:5678", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"proxy without header", "10.0.0.1:5678", nil, "10.0.0.1"},
+		{"garbage via a proxy", "10.0.0.1:5678", []string{"1.2.3.4, nonsense"}, "10.0.0.1"},
+		{"untrusted proxy", "192.168.1.2:5678", []string{"6.6.6.6"}, "192.168.1.2"},
+		{"IPv6", "[2001:db8::1]:5678", []string{"6.6.6.6"}, "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest("GET", "http://foo.example.com/", nil)
+			r.RemoteAddr = test.remote
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := RemoteIP(r, trusted); got != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+
+	if _, err := parseTrustedNetworks([]string{"nonsense"}); err == nil {
+		t.Fatalf("expected an invalid network to be rejected")
+	}
+}
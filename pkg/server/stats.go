@@ -0,0 +1,228 @@
+//
+// The traffic of each tunnel, over the last few minutes.
+//
+// The usage of each tunnel is counted since we launched, which doesn't
+// show which tunnels are busy, or failing, right now.  So we also count
+// the requests each tunnel receives, those we answered with an error,
+// the time taken to answer them, and the bytes transferred, within
+// ten-second buckets covering the last fifteen minutes.
+//
+// These are summed over the last one, five, and fifteen minutes, along
+// with the 50th and 95th percentiles of the latency, and reported by the
+// "/stats" end-point of the admin API, and "tunneller status -stats".
+//
+// Latencies are counted within buckets which grow by a fourth root of
+// two, so the percentiles are accurate to within a fifth or so.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statsBucket is the period each of our buckets covers.
+	statsBucket = 10 * time.Second
+
+	// statsBuckets is the number of buckets we keep, covering our
+	// longest window.
+	statsBuckets = 90
+
+	// latencyBuckets is the number of buckets we count latencies in,
+	// the last of which counts those of twenty minutes or more.
+	latencyBuckets = 82
+)
+
+// statsWindows are the windows we report upon.
+var statsWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// Stats holds the traffic of a single tunnel, over a single window.
+type Stats struct {
+	// Requests is the number of requests sent to the tunnel, and
+	// Errors the number we answered with a 5xx status.
+	Requests int64
+	Errors   int64
+
+	// P50 and P95 are the 50th and 95th percentiles of the time taken
+	// to answer the requests, in milliseconds.
+	P50 float64
+	P95 float64
+
+	// BytesIn and BytesOut are the total size of the requests sent
+	// to the tunnel, and the responses received from it.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// statsSlot holds the traffic of a tunnel during a single bucket.
+type statsSlot struct {
+	// start is the start of the bucket, which tells us whether the
+	// slot is current.
+	start int64
+
+	requests int64
+	errors   int64
+	bytesIn  int64
+	bytesOut int64
+
+	// latency counts the requests by the bucket of their latency.
+	latency [latencyBuckets]int32
+}
+
+// statsTracker holds the recent traffic of each tunnel.
+type statsTracker struct {
+	// tunnels holds the slots of each tunnel.
+	tunnels map[string]*[statsBuckets]statsSlot
+
+	// mutex protects our map.
+	mutex sync.Mutex
+}
+
+// newStatsTracker creates a new tracker.
+func newStatsTracker() *statsTracker {
+	return &statsTracker{tunnels: make(map[string]*[statsBuckets]statsSlot)}
+}
+
+// latencyBucket returns the bucket which counts the given latency.
+func latencyBucket(d time.Duration) int {
+
+	ms := float64(d) / float64(time.Millisecond)
+	if ms <= 1 {
+		return 0
+	}
+	i := int(math.Ceil(4 * math.Log2(ms)))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	return i
+}
+
+// record adds a request to the named tunnel's traffic.
+func (t *statsTracker) record(name string, status int, latency time.Duration, in int64, out int64) {
+
+	now := time.Now().UnixNano() / int64(statsBucket)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	slots, ok := t.tunnels[name]
+	if !ok {
+		slots = new([statsBuckets]statsSlot)
+		t.tunnels[name] = slots
+	}
+
+	slot := &slots[now%statsBuckets]
+	if slot.start != now {
+		*slot = statsSlot{start: now}
+	}
+	slot.requests++
+	if status >= 500 {
+		slot.errors++
+	}
+	slot.bytesIn += in
+	slot.bytesOut += out
+	slot.latency[latencyBucket(latency)]++
+}
+
+// percentile returns the given percentile of the latencies counted by
+// the given histogram, in milliseconds.
+func percentile(hist *[latencyBuckets]int64, total int64, p float64) float64 {
+
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(total)))
+	var seen int64
+	for i, n := range hist {
+		seen += n
+		if seen >= rank {
+			return math.Round(math.Pow(2, float64(i)/4)*10) / 10
+		}
+	}
+	return 0
+}
+
+// Snapshot returns the traffic of each tunnel which received requests
+// within our longest window, by the name of the tunnel and the window,
+// such as "5m".
+func (t *statsTracker) Snapshot() map[string]map[string]Stats {
+
+	now := time.Now().UnixNano() / int64(statsBucket)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	out := make(map[string]map[string]Stats)
+	for name, slots := range t.tunnels {
+
+		windows := make(map[string]Stats)
+		for _, window := range statsWindows {
+
+			var s Stats
+			var hist [latencyBuckets]int64
+			count := int64(window / statsBucket)
+			for i := range slots {
+				slot := &slots[i]
+				if slot.start == 0 || slot.start <= now-count {
+					continue
+				}
+				s.Requests += slot.requests
+				s.Errors += slot.errors
+				s.BytesIn += slot.bytesIn
+				s.BytesOut += slot.bytesOut
+				for j, n := range slot.latency {
+					hist[j] += int64(n)
+				}
+			}
+			s.P50 = percentile(&hist, s.Requests, 0.50)
+			s.P95 = percentile(&hist, s.Requests, 0.95)
+			windows[strings.TrimSuffix(window.String(), "0s")] = s
+		}
+
+		//
+		// Forget those tunnels which have been idle for longer than
+		// our longest window.
+		//
+		if windows["15m"].Requests == 0 {
+			delete(t.tunnels, name)
+			continue
+		}
+		out[name] = windows
+	}
+	return out
+}
+
+// responseStatus returns the HTTP-status of the given response, which
+// begins "HTTP/1.1 200 OK".
+func responseStatus(response string) int {
+
+	line := response
+	if i := strings.Index(line, "\n"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return 0
+	}
+	status, _ := strconv.Atoi(fields[1])
+	return status
+}
+
+// statsHandler reports the recent traffic of each tunnel, as JSON.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+
+	out, err := json.MarshalIndent(s.stats.Snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,78 @@
+//
+// Sticky sessions.
+//
+// When several clients serve the same tunnel we usually send requests
+// to each in turn.  Stateful applications may prefer that each visitor
+// is always sent to the same client, which they request via -sticky.
+//
+// We achieve that by setting a cookie holding the ID of the client that
+// served the visitor's first request, and honouring it thereafter for
+// as long as that client remains connected.
+//
+
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// stickyCookie is the name of the cookie we use to pin visitors.
+const stickyCookie = "tunneller_client"
+
+// pickSticky returns the registration of the client which should serve
+// the given request for the named tunnel, or nil if there is none.
+//
+// The second return value is true if we should set our cookie upon the
+// response, to pin the visitor to that client.
+func (r *registry) pickSticky(name string, req *http.Request) (*protocol.Registration, bool) {
+
+	if c, err := req.Cookie(stickyCookie); err == nil {
+		removeCookie(req, stickyCookie)
+		if reg := r.get(c.Value, name); reg != nil && reg.Sticky {
+			if _, ok := reg.InMaintenance(name); !ok {
+				return reg, false
+			}
+		}
+	}
+
+	reg := r.pick(name)
+	return reg, reg != nil && reg.Sticky
+}
+
+// removeCookie removes the named cookie from the given request, so that
+// it isn't passed on to the local service.
+func removeCookie(req *http.Request, name string) {
+
+	var keep []string
+	for _, c := range req.Cookies() {
+		if c.Name != name {
+			keep = append(keep, c.String())
+		}
+	}
+
+	req.Header.Del("Cookie")
+	if len(keep) > 0 {
+		req.Header.Set("Cookie", strings.Join(keep, "; "))
+	}
+}
+
+// addCookie inserts a Set-Cookie header into the given plain-text
+// response.
+func addCookie(response string, cookie *http.Cookie) string {
+	return addHeader(response, "Set-Cookie", cookie.String())
+}
+
+// addHeader inserts the given header into the given plain-text response,
+// immediately after its status-line.
+func addHeader(response string, name string, value string) string {
+
+	line, err := bufio.NewReader(strings.NewReader(response)).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "HTTP/") {
+		return response
+	}
+
+	return line + name + ": " + value + "\r\n" + response[len(line):]
+}
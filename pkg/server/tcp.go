@@ -0,0 +1,324 @@
+//
+// Raw TCP tunnels.
+//
+// A client may expose a TCP service, such as SSH, rather than a
+// HTTP-server, via "-expose tcp://localhost:22".
+//
+// When such a client registers the server allocates a public port for
+// the tunnel, from the range given by -tcp-ports, and announces it to
+// the client via a retained message upon "clients/$name/tcp".
+//
+// Each connection made to that port is then relayed over the queue, to
+// one of the clients serving the tunnel, as a series of Stream messages
+// upon "clients/$name/$id/stream/down", and "clients/$name/$id/stream/up":
+//
+//   1. The server sends "open", and the client connects to its service.
+//
+//   2. Both sides send "data" as they read from their connection.
+//
+//   3. Either side sends "close" when their connection is closed.
+//
+// If the client asked for encryption the "open" message carries a public
+// key, from which both sides derive the key used to encrypt the data of
+// the connection.
+//
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/satori/go.uuid"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// tcpServer allocates ports to the TCP tunnels, and relays the
+// connections made to them.
+type tcpServer struct {
+	// s is the server we belong to.
+	s *Server
+
+	// first and last are the range of ports we may allocate.
+	first int
+	last  int
+
+	// listeners maps the name of each tunnel to its listener.
+	listeners map[string]net.Listener
+
+	// owners maps the ID of each stream to the ID of the client it
+	// was relayed to.
+	owners map[string]string
+
+	// announced records the ports allocated to each tunnel.
+	announced *announcedPorts
+
+	// mutex protects our listeners, and owners.
+	mutex sync.Mutex
+
+	// streams holds the connections we're relaying.
+	streams *protocol.Streams
+}
+
+// newTCPServer creates a new relay, allocating ports from the given
+// range, which is expressed as "first-last".
+func newTCPServer(s *Server, ports string) (*tcpServer, error) {
+
+	t := &tcpServer{
+		s:         s,
+		listeners: make(map[string]net.Listener),
+		owners:    make(map[string]string),
+		announced: newAnnouncedPorts("tcp"),
+		streams:   protocol.NewStreams(),
+	}
+
+	var err error
+	t.first, t.last, err = parsePortRange(ports)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parsePortRange parses a range of ports expressed as "first-last".
+func parsePortRange(ports string) (int, int, error) {
+
+	rng := strings.SplitN(ports, "-", 2)
+	if len(rng) != 2 {
+		return 0, 0, fmt.Errorf("the port-range must be given as first-last")
+	}
+
+	first, err := strconv.Atoi(rng[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := strconv.Atoi(rng[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if first < 1 || last < first {
+		return 0, 0, fmt.Errorf("invalid port-range %s", ports)
+	}
+	return first, last, nil
+}
+
+// onAdd is invoked when a client registers, and allocates ports to its
+// TCP tunnels.
+func (t *tcpServer) onAdd(reg *protocol.Registration) {
+
+	for _, name := range reg.TCP {
+
+		if t.s.banned(name) {
+			continue
+		}
+
+		t.mutex.Lock()
+		l, ok := t.listeners[name]
+		if !ok {
+			l = t.listen(name)
+			if l != nil {
+				t.listeners[name] = l
+				go t.accept(name, l)
+			}
+		}
+		t.mutex.Unlock()
+
+		if l == nil {
+			t.s.logf("No free ports for the TCP tunnel %s\n", name)
+			continue
+		}
+
+		//
+		// Tell the client which port it was given.
+		//
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		number, _ := strconv.Atoi(port)
+		t.announced.set(name, number)
+		token := t.s.mq.Publish("clients/"+protocol.TopicLevel(name)+"/tcp", 0, true, port)
+		token.Wait()
+	}
+}
+
+// onRemove is invoked when a client disappears, and closes the
+// connections relayed to it.
+//
+// The ports of its TCP tunnels are freed once no other client serves
+// them.
+func (t *tcpServer) onRemove(reg *protocol.Registration) {
+
+	var gone []string
+	t.mutex.Lock()
+	for id, client := range t.owners {
+		if client == reg.Client {
+			gone = append(gone, id)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, id := range gone {
+		t.streams.Remove(id)
+	}
+
+	for _, name := range reg.TCP {
+
+		if t.s.registry.serves(name, tcpNames) {
+			continue
+		}
+
+		t.mutex.Lock()
+		l, ok := t.listeners[name]
+		delete(t.listeners, name)
+		t.mutex.Unlock()
+
+		if ok {
+			l.Close()
+			t.announced.set(name, 0)
+			token := t.s.mq.Publish("clients/"+protocol.TopicLevel(name)+"/tcp", 0, true, "")
+			token.Wait()
+		}
+	}
+}
+
+// listen opens a listener for the named tunnel upon the first free port
+// in our range, preferring the one it was given previously.
+//
+// The caller must hold the mutex.
+func (t *tcpServer) listen(name string) net.Listener {
+
+	for _, port := range t.announced.candidates(name, t.first, t.last) {
+		l, err := t.s.listenTCP(net.JoinHostPort(t.s.bindHost(), strconv.Itoa(port)))
+		if err == nil {
+			return l
+		}
+	}
+	return nil
+}
+
+// accept handles the connections made to the named tunnel's port.
+func (t *tcpServer) accept(name string, l net.Listener) {
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		//
+		// Choose the client to relay the connection to, and apply
+		// its allow/deny lists.
+		//
+		reg := t.s.registry.pickFrom(name, tcpNames)
+		if reg == nil {
+			conn.Close()
+			continue
+		}
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !reg.Permitted(net.ParseIP(ip)) {
+			conn.Close()
+			continue
+		}
+
+		id := uuid.NewV4().String()
+		client := reg.Client
+
+		var key, pub []byte
+		if len(reg.PublicKey) > 0 {
+			key, pub, err = protocol.NewSessionKey(reg.PublicKey)
+			if err != nil {
+				t.s.logf("Failed to encrypt a connection to %s - %s\n", name, err)
+				conn.Close()
+				continue
+			}
+		}
+
+		t.mutex.Lock()
+		t.owners[id] = client
+		t.mutex.Unlock()
+
+		t.streams.Add(id, conn, key)
+		t.send(name, client, key, protocol.Stream{ID: id, Kind: "open", Key: pub})
+
+		go func() {
+			t.streams.Pump(id, conn, func(s protocol.Stream) {
+				t.send(name, client, key, s)
+			})
+
+			t.mutex.Lock()
+			delete(t.owners, id)
+			t.mutex.Unlock()
+		}()
+	}
+}
+
+// tcpNames returns the names of the TCP tunnels a client serves.
+func tcpNames(reg *protocol.Registration) []string {
+	return reg.TCP
+}
+
+// send publishes a protocol.Stream message to the given client, which
+// serves the named tunnel, encrypting its data if we have a key.
+func (t *tcpServer) send(name string, client string, key []byte, s protocol.Stream) {
+
+	topic := "clients/" + protocol.TopicLevel(name) + "/" + protocol.TopicLevel(client) + "/stream/down"
+
+	if key != nil && s.Data != nil {
+		var err error
+		s.Data, err = protocol.Seal(key, s.Data)
+		if err != nil {
+			return
+		}
+	}
+
+	out, err := protocol.EncodeStream(t.s.secret(name), "stream-down", topic, s)
+	if err != nil {
+		return
+	}
+	token := t.s.mq.Publish(topic, byte(t.s.opts.QoS), false, out)
+	token.Wait()
+}
+
+// onMessage is invoked when a client sends a protocol.Stream message, upon the
+// topic "clients/$name/$id/stream/up".
+func (t *tcpServer) onMessage(client MQTT.Client, msg MQTT.Message) {
+
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) != 5 {
+		return
+	}
+	name, id := parts[1], parts[2]
+
+	s, err := protocol.DecodeStream(t.s.secret(name), "stream-up", msg)
+	if err != nil {
+		t.s.logf("Ignoring stream message from %s - %s\n", name, err)
+		return
+	}
+
+	//
+	// Only the client we relayed the connection to may write to it.
+	//
+	t.mutex.Lock()
+	owner := t.owners[s.ID]
+	t.mutex.Unlock()
+	if protocol.TopicLevel(owner) != id {
+		return
+	}
+
+	switch s.Kind {
+	case "data":
+		data := s.Data
+		if key := t.streams.Key(s.ID); key != nil {
+			data, err = protocol.Unseal(key, data)
+			if err != nil {
+				t.s.logf("Ignoring stream message from %s - %s\n", name, err)
+				return
+			}
+		}
+		t.streams.Write(s.ID, data)
+	case "close":
+		t.streams.Remove(s.ID)
+	}
+}
@@ -0,0 +1,123 @@
+//
+// The administrative API reports upon the tunnels which are currently
+// connected, the clients serving them, and their activity, via the
+// "/tunnels" end-point.
+//
+// This is what the "status" sub-command displays.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// TunnelStatus describes a single connected tunnel.
+type TunnelStatus struct {
+	// Name is the name of the tunnel.
+	Name string
+
+	// Kind is one of "http", "tcp", or "udp".
+	Kind string
+
+	// Clients holds the IDs of the clients serving the tunnel.
+	Clients []string
+
+	// Connected is the time at which the longest-connected of those
+	// clients (re)connected.
+	Connected time.Time
+
+	// LastActive is the time at which the tunnel last received a
+	// request, which is zero if it never has.
+	LastActive time.Time
+
+	// LastSeen is the time at which we last heard from any of the
+	// clients serving the tunnel.
+	LastSeen time.Time
+
+	// Maintenance is true if the tunnel is in maintenance mode, either
+	// because the operator, or every client serving it, said so.
+	Maintenance bool
+
+	// Requests is the number of requests sent to the tunnel.
+	Requests int64
+
+	// BytesIn and BytesOut are the total size of the requests sent
+	// to the tunnel, and the responses received from it.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// Tunnels returns the status of each connected tunnel, sorted by name.
+func (s *Server) Tunnels() []TunnelStatus {
+
+	usage := s.usage.Snapshot()
+	tunnels := make(map[string]*TunnelStatus)
+	maintenance := make(map[string]int)
+
+	for _, reg := range s.registry.all() {
+		for _, name := range reg.Names {
+
+			t, ok := tunnels[name]
+			if !ok {
+				u := usage[name]
+				t = &TunnelStatus{
+					Name:       name,
+					Kind:       "http",
+					Connected:  reg.Connected,
+					LastActive: u.LastActive,
+					Requests:   u.Requests,
+					BytesIn:    u.BytesIn,
+					BytesOut:   u.BytesOut,
+				}
+				tunnels[name] = t
+			}
+
+			if reg.IsTCP(name) {
+				t.Kind = "tcp"
+			}
+			if reg.IsUDP(name) {
+				t.Kind = "udp"
+			}
+			if reg.Connected.Before(t.Connected) {
+				t.Connected = reg.Connected
+			}
+			if seen := s.registry.lastSeen(reg.Client); seen.After(t.LastSeen) {
+				t.LastSeen = seen
+			}
+			if _, ok := reg.InMaintenance(name); ok {
+				maintenance[name]++
+			}
+			t.Clients = append(t.Clients, reg.Client)
+		}
+	}
+
+	var out []TunnelStatus
+	for _, t := range tunnels {
+		_, t.Maintenance = s.inMaintenance(t.Name)
+		if maintenance[t.Name] == len(t.Clients) {
+			t.Maintenance = true
+		}
+		sort.Strings(t.Clients)
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// tunnelsHandler reports the status of each connected tunnel, as JSON.
+func (s *Server) tunnelsHandler(w http.ResponseWriter, r *http.Request) {
+
+	out, err := json.MarshalIndent(s.Tunnels(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
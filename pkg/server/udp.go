@@ -0,0 +1,336 @@
+//
+// UDP tunnels.
+//
+// A client may expose a UDP service, such as a DNS server, via
+// "-expose udp://localhost:53".
+//
+// This works much like our TCP tunnels: the server allocates a public
+// port, from the range given by -udp-ports, and announces it to the
+// client via a retained message upon "clients/$name/udp".
+//
+// Each datagram received upon that port is relayed as a Stream message,
+// of kind "data", upon "clients/$name/$id/datagram/down", to one of the
+// clients serving the tunnel.  The ID of the message is the address of
+// the visitor who sent it, and each visitor's datagrams are relayed to
+// the same client until they've been idle for a while.
+//
+// The client sends the datagram to its service, from a socket dedicated
+// to that visitor, and relays any replies upon
+// "clients/$name/$id/datagram/up" until the socket has been idle too.
+//
+// If the client asked for encryption we generate a key for each visitor,
+// and send the public key the client derives it from with each datagram.
+//
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// udpIdle is the length of time after which we forget about a visitor
+// who has sent nothing, matching the client.
+const udpIdle = 2 * time.Minute
+
+// udpVisitor records the client we relay a visitor's datagrams to.
+type udpVisitor struct {
+	// client is the ID of the client.
+	client string
+
+	// seen is the time we last received a datagram from the visitor.
+	seen time.Time
+
+	// key, if set, is used to encrypt the visitor's datagrams, and pub
+	// is the public key the client derives it from.
+	key []byte
+	pub []byte
+}
+
+// udpServer allocates ports to the UDP tunnels, and relays the
+// datagrams sent to them.
+type udpServer struct {
+	// s is the server we belong to.
+	s *Server
+
+	// first and last are the range of ports we may allocate.
+	first int
+	last  int
+
+	// conns maps the name of each tunnel to its socket.
+	conns map[string]net.PacketConn
+
+	// visitors maps the name of a tunnel, and the address of each of
+	// its visitors, "$name/$address", to the client serving them.
+	visitors map[string]*udpVisitor
+
+	// pruned is the time we last forgot the idle visitors.
+	pruned time.Time
+
+	// announced records the ports allocated to each tunnel.
+	announced *announcedPorts
+
+	// mutex protects our sockets, and visitors.
+	mutex sync.Mutex
+}
+
+// newUDPServer creates a new relay, allocating ports from the given
+// range, which is expressed as "first-last".
+func newUDPServer(s *Server, ports string) (*udpServer, error) {
+
+	u := &udpServer{
+		s:         s,
+		conns:     make(map[string]net.PacketConn),
+		visitors:  make(map[string]*udpVisitor),
+		announced: newAnnouncedPorts("udp"),
+	}
+
+	var err error
+	u.first, u.last, err = parsePortRange(ports)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// onAdd is invoked when a client registers, and allocates ports to its
+// UDP tunnels.
+func (u *udpServer) onAdd(reg *protocol.Registration) {
+
+	for _, name := range reg.UDP {
+
+		if u.s.banned(name) {
+			continue
+		}
+
+		u.mutex.Lock()
+		conn, ok := u.conns[name]
+		if !ok {
+			conn = u.listen(name)
+			if conn != nil {
+				u.conns[name] = conn
+				go u.read(name, conn)
+			}
+		}
+		u.mutex.Unlock()
+
+		if conn == nil {
+			u.s.logf("No free ports for the UDP tunnel %s\n", name)
+			continue
+		}
+
+		//
+		// Tell the client which port it was given.
+		//
+		_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+		number, _ := strconv.Atoi(port)
+		u.announced.set(name, number)
+		token := u.s.mq.Publish("clients/"+protocol.TopicLevel(name)+"/udp", 0, true, port)
+		token.Wait()
+	}
+}
+
+// onRemove is invoked when a client disappears, and forgets the
+// visitors it was serving.
+//
+// The ports of its UDP tunnels are freed once no other client serves
+// them.
+func (u *udpServer) onRemove(reg *protocol.Registration) {
+
+	u.mutex.Lock()
+	for key, v := range u.visitors {
+		if v.client == reg.Client {
+			delete(u.visitors, key)
+		}
+	}
+	u.mutex.Unlock()
+
+	for _, name := range reg.UDP {
+
+		if u.s.registry.serves(name, udpNames) {
+			continue
+		}
+
+		u.mutex.Lock()
+		conn, ok := u.conns[name]
+		delete(u.conns, name)
+		u.mutex.Unlock()
+
+		if ok {
+			conn.Close()
+			u.announced.set(name, 0)
+			token := u.s.mq.Publish("clients/"+protocol.TopicLevel(name)+"/udp", 0, true, "")
+			token.Wait()
+		}
+	}
+}
+
+// listen opens a socket for the named tunnel upon the first free port in
+// our range, preferring the one it was given previously.
+//
+// The caller must hold the mutex.
+func (u *udpServer) listen(name string) net.PacketConn {
+
+	for _, port := range u.announced.candidates(name, u.first, u.last) {
+		conn, err := u.s.listenUDP(net.JoinHostPort(u.s.bindHost(), strconv.Itoa(port)))
+		if err == nil {
+			return conn
+		}
+	}
+	return nil
+}
+
+// read relays the datagrams sent to the named tunnel's port.
+func (u *udpServer) read(name string, conn net.PacketConn) {
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		//
+		// Find the client serving the visitor, and apply its
+		// allow/deny lists.
+		//
+		reg, v := u.visitor(name, addr.String())
+		if reg == nil {
+			continue
+		}
+		ip, _, _ := net.SplitHostPort(addr.String())
+		if !reg.Permitted(net.ParseIP(ip)) {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		if v.key != nil {
+			data, err = protocol.Seal(v.key, data)
+			if err != nil {
+				continue
+			}
+		}
+
+		topic := "clients/" + protocol.TopicLevel(name) + "/" + protocol.TopicLevel(reg.Client) + "/datagram/down"
+
+		out, err := protocol.EncodeStream(u.s.secret(name), "datagram-down", topic, protocol.Stream{ID: addr.String(), Kind: "data", Data: data, Key: v.pub})
+		if err != nil {
+			continue
+		}
+		token := u.s.mq.Publish(topic, byte(u.s.opts.QoS), false, out)
+		token.Wait()
+	}
+}
+
+// udpNames returns the names of the UDP tunnels a client serves.
+func udpNames(reg *protocol.Registration) []string {
+	return reg.UDP
+}
+
+// visitor returns the registration of the client serving the visitor
+// with the given address, choosing one if the visitor is new, or nil if
+// no client serves the named tunnel, along with our record of them.
+func (u *udpServer) visitor(name string, addr string) (*protocol.Registration, *udpVisitor) {
+
+	key := name + "/" + addr
+	now := time.Now()
+
+	u.mutex.Lock()
+	v, ok := u.visitors[key]
+	if now.Sub(u.pruned) > udpIdle {
+		for k, old := range u.visitors {
+			if now.Sub(old.seen) > udpIdle {
+				delete(u.visitors, k)
+			}
+		}
+		u.pruned = now
+	}
+	u.mutex.Unlock()
+
+	//
+	// Keep relaying to the same client while it's still around, and
+	// the visitor hasn't been idle.
+	//
+	if ok && now.Sub(v.seen) <= udpIdle {
+		if reg := u.s.registry.get(v.client, name); reg != nil {
+			u.mutex.Lock()
+			v.seen = now
+			u.mutex.Unlock()
+			return reg, v
+		}
+	}
+
+	reg := u.s.registry.pickFrom(name, udpNames)
+	if reg == nil {
+		return nil, nil
+	}
+
+	v = &udpVisitor{client: reg.Client, seen: now}
+	if len(reg.PublicKey) > 0 {
+		var err error
+		v.key, v.pub, err = protocol.NewSessionKey(reg.PublicKey)
+		if err != nil {
+			u.s.logf("Failed to encrypt the datagrams of %s - %s\n", name, err)
+			return nil, nil
+		}
+	}
+
+	u.mutex.Lock()
+	u.visitors[key] = v
+	u.mutex.Unlock()
+	return reg, v
+}
+
+// onMessage is invoked when a client sends a reply, upon the topic
+// "clients/$name/$id/datagram/up".
+func (u *udpServer) onMessage(client MQTT.Client, msg MQTT.Message) {
+
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) != 5 {
+		return
+	}
+	name, id := parts[1], parts[2]
+
+	s, err := protocol.DecodeStream(u.s.secret(name), "datagram-up", msg)
+	if err != nil {
+		u.s.logf("Ignoring datagram from %s - %s\n", name, err)
+		return
+	}
+
+	//
+	// Only the client serving the visitor may reply to them.
+	//
+	u.mutex.Lock()
+	conn, ok := u.conns[name]
+	v := u.visitors[name+"/"+s.ID]
+	if v != nil && protocol.TopicLevel(v.client) != id {
+		v = nil
+	}
+	u.mutex.Unlock()
+	if !ok || v == nil {
+		return
+	}
+
+	data := s.Data
+	if v.key != nil {
+		data, err = protocol.Unseal(v.key, data)
+		if err != nil {
+			u.s.logf("Ignoring datagram from %s - %s\n", name, err)
+			return
+		}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", s.ID)
+	if err != nil {
+		return
+	}
+	conn.WriteTo(data, addr)
+}
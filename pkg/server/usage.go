@@ -0,0 +1,146 @@
+//
+// The server records the bandwidth used by each tunnel, and may enforce
+// daily and monthly quotas upon it.
+//
+// We also count the requests each tunnel receives, and when it last
+// received one.
+//
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Usage holds the bandwidth consumed by a single tunnel.
+type Usage struct {
+	// BytesIn is the total size of the requests sent to the tunnel.
+	BytesIn int64
+
+	// BytesOut is the total size of the responses received from it.
+	BytesOut int64
+
+	// Day is the date, as YYYY-MM-DD, to which DayBytes applies.
+	Day string
+
+	// DayBytes holds the traffic, in both directions, for that day.
+	DayBytes int64
+
+	// Month is the month, as YYYY-MM, to which MonthBytes applies.
+	Month string
+
+	// MonthBytes holds the traffic, in both directions, for that month.
+	MonthBytes int64
+
+	// Requests is the number of requests sent to the tunnel.
+	Requests int64
+
+	// LastActive is the time at which the tunnel last received a
+	// request.
+	LastActive time.Time
+}
+
+// usageTracker holds the usage of each tunnel.
+type usageTracker struct {
+	// daily and monthly are the quotas, in bytes, with zero meaning
+	// that there is no limit.
+	daily   int64
+	monthly int64
+
+	// tunnels maps the name of each tunnel to its usage.
+	tunnels map[string]*Usage
+
+	// mutex protects our map.
+	mutex sync.Mutex
+}
+
+// newUsageTracker creates a new tracker, with the given quotas.
+func newUsageTracker(daily int64, monthly int64) *usageTracker {
+	return &usageTracker{
+		daily:   daily,
+		monthly: monthly,
+		tunnels: make(map[string]*Usage),
+	}
+}
+
+// SetQuotas updates the daily and monthly quotas.
+func (u *usageTracker) SetQuotas(daily int64, monthly int64) {
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.daily = daily
+	u.monthly = monthly
+}
+
+// get returns the usage of the named tunnel, resetting the daily and
+// monthly counters if their period has passed.
+//
+// The caller must hold the mutex.
+func (u *usageTracker) get(name string) *Usage {
+
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	month := now.Format("2006-01")
+
+	ent, ok := u.tunnels[name]
+	if !ok {
+		ent = &Usage{}
+		u.tunnels[name] = ent
+	}
+	if ent.Day != day {
+		ent.Day = day
+		ent.DayBytes = 0
+	}
+	if ent.Month != month {
+		ent.Month = month
+		ent.MonthBytes = 0
+	}
+	return ent
+}
+
+// Add records a request, and the given traffic, against the named
+// tunnel.
+func (u *usageTracker) Add(name string, in int64, out int64) {
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	ent := u.get(name)
+	ent.Requests++
+	ent.LastActive = time.Now()
+	ent.BytesIn += in
+	ent.BytesOut += out
+	ent.DayBytes += in + out
+	ent.MonthBytes += in + out
+}
+
+// Exceeded returns true if the named tunnel has used all of its quota.
+func (u *usageTracker) Exceeded(name string) bool {
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	ent := u.get(name)
+	if u.daily > 0 && ent.DayBytes >= u.daily {
+		return true
+	}
+	if u.monthly > 0 && ent.MonthBytes >= u.monthly {
+		return true
+	}
+	return false
+}
+
+// Snapshot returns a copy of the usage of every tunnel.
+func (u *usageTracker) Snapshot() map[string]Usage {
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	out := make(map[string]Usage)
+	for name := range u.tunnels {
+		out[name] = *u.get(name)
+	}
+	return out
+}
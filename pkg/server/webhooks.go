@@ -0,0 +1,212 @@
+//
+// Webhooks.
+//
+// The server may notify operators of events in the life of each tunnel,
+// via -webhook, by POSTing a JSON object describing the event to one or
+// more URLs.  The events are:
+//
+//   connect     - A client connected, and is serving the tunnel.
+//   disconnect  - A client serving the tunnel disconnected.
+//   timeout     - The tunnel failed to reply to several requests in a row.
+//   quota       - The tunnel exhausted its bandwidth quota.
+//
+// Events are delivered in the order they occur, by a single goroutine,
+// so that a slow receiver cannot hold up our visitors.
+//
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skx/tunneller/pkg/protocol"
+)
+
+// webhookTimeouts is the number of consecutive requests a tunnel must
+// fail to reply to before we send a "timeout" event.
+const webhookTimeouts = 3
+
+// WebhookEvent is the body of each notification we send.
+type WebhookEvent struct {
+	// Event is the kind of event, such as "connect".
+	Event string
+
+	// Server is the ID of the server which sent the event.
+	Server string
+
+	// Tunnel is the name of the tunnel the event concerns.
+	Tunnel string
+
+	// Client is the ID of the client, if the event concerns one.
+	Client string
+
+	// Time is the time at which the event occurred.
+	Time time.Time
+}
+
+// webhooks delivers events to the URLs given via -webhook.
+type webhooks struct {
+	// s is the server whose events we deliver.
+	s *Server
+
+	// events holds the events awaiting delivery.
+	events chan WebhookEvent
+
+	// client is used to make our requests.
+	client *http.Client
+
+	// seen holds the IDs of the clients we've sent "connect" events
+	// for, such that updated registrations don't trigger them again.
+	seen map[string]bool
+
+	// timeouts holds the number of consecutive requests each tunnel
+	// has failed to reply to.
+	timeouts map[string]int
+
+	// quota holds the day upon which we last sent each tunnel a
+	// "quota" event, so that we send at most one per day.
+	quota map[string]string
+
+	// mutex protects our maps.
+	mutex sync.Mutex
+}
+
+// newWebhooks creates the webhooks of the given server, and launches
+// the goroutine which delivers them.
+func newWebhooks(s *Server) *webhooks {
+
+	w := &webhooks{
+		s:        s,
+		events:   make(chan WebhookEvent, 100),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		seen:     make(map[string]bool),
+		timeouts: make(map[string]int),
+		quota:    make(map[string]string),
+	}
+	go w.run()
+	return w
+}
+
+// send queues the given event for delivery, if we have anywhere to
+// deliver it to.
+func (w *webhooks) send(event string, tunnel string, client string) {
+
+	w.s.mutex.RLock()
+	enabled := len(w.s.opts.Webhooks) > 0
+	w.s.mutex.RUnlock()
+
+	if !enabled {
+		return
+	}
+
+	ev := WebhookEvent{
+		Event:  event,
+		Server: w.s.opts.ID,
+		Tunnel: tunnel,
+		Client: client,
+		Time:   time.Now(),
+	}
+
+	select {
+	case w.events <- ev:
+	default:
+		w.s.logf("Dropping %s event for %s, as our webhooks are backlogged\n", event, tunnel)
+	}
+}
+
+// run delivers our events, in order, to each of our URLs.
+func (w *webhooks) run() {
+
+	for ev := range w.events {
+
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+
+		w.s.mutex.RLock()
+		urls := w.s.opts.Webhooks
+		w.s.mutex.RUnlock()
+
+		for _, url := range urls {
+			res, err := w.client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				w.s.logf("Error sending %s event to %s: %s\n", ev.Event, url, err.Error())
+				continue
+			}
+			res.Body.Close()
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				w.s.logf("Error sending %s event to %s: %s\n", ev.Event, url, res.Status)
+			}
+		}
+	}
+}
+
+// onAdd sends a "connect" event for each tunnel of a newly connected
+// client.
+func (w *webhooks) onAdd(reg *protocol.Registration) {
+
+	w.mutex.Lock()
+	seen := w.seen[reg.Client]
+	w.seen[reg.Client] = true
+	w.mutex.Unlock()
+
+	if seen {
+		return
+	}
+	for _, name := range reg.Names {
+		w.send("connect", name, reg.Client)
+	}
+}
+
+// onRemove sends a "disconnect" event for each tunnel of a client which
+// has gone away.
+func (w *webhooks) onRemove(reg *protocol.Registration) {
+
+	w.mutex.Lock()
+	delete(w.seen, reg.Client)
+	w.mutex.Unlock()
+
+	for _, name := range reg.Names {
+		w.send("disconnect", name, reg.Client)
+	}
+}
+
+// reply records whether the named tunnel replied to a request, sending
+// a "timeout" event once it has failed to do so several times in a row.
+func (w *webhooks) reply(name string, client string, ok bool) {
+
+	w.mutex.Lock()
+	if ok {
+		delete(w.timeouts, name)
+		w.mutex.Unlock()
+		return
+	}
+	w.timeouts[name]++
+	count := w.timeouts[name]
+	w.mutex.Unlock()
+
+	if count == webhookTimeouts {
+		w.send("timeout", name, client)
+	}
+}
+
+// exceeded sends a "quota" event for the named tunnel, unless we've
+// already done so today.
+func (w *webhooks) exceeded(name string) {
+
+	day := time.Now().Format("2006-01-02")
+
+	w.mutex.Lock()
+	sent := w.quota[name] == day
+	w.quota[name] = day
+	w.mutex.Unlock()
+
+	if !sent {
+		w.send("quota", name, "")
+	}
+}
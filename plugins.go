@@ -0,0 +1,55 @@
+//
+// Both the client and the server may load hooks, see pkg/hook, from Go
+// plugins given via -plugin.
+//
+// Each plugin must export a variable named "Hook", which implements
+// the hook.Hook interface, and must be built with the same version of
+// Go, and of this module, as we were.
+//
+// Loading plugins requires cgo, so the binaries we release, which are
+// built without it, refuse -plugin rather than failing obscurely.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+
+	"github.com/skx/tunneller/pkg/hook"
+)
+
+// loadPlugins loads the hook exported by each of the named plugins.
+func loadPlugins(paths []string) ([]hook.Hook, error) {
+
+	if len(paths) > 0 && !pluginsSupported {
+		return nil, errors.New("-plugin isn't supported by this build, as plugins require tunneller to be built with CGO_ENABLED=1, upon Linux, FreeBSD, or macOS")
+	}
+
+	var out []hook.Hook
+	for _, path := range paths {
+
+		p, err := plugin.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		sym, err := p.Lookup("Hook")
+		if err != nil {
+			return nil, err
+		}
+
+		//
+		// Looking up a variable returns a pointer to it.
+		//
+		switch h := sym.(type) {
+		case *hook.Hook:
+			out = append(out, *h)
+		case hook.Hook:
+			out = append(out, h)
+		default:
+			return nil, fmt.Errorf("%s: Hook does not implement hook.Hook", path)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,6 @@
+// +build cgo,linux cgo,freebsd cgo,darwin
+
+package main
+
+// pluginsSupported is true as Go plugins may be loaded by this build.
+const pluginsSupported = true
@@ -0,0 +1,7 @@
+// +build !cgo !linux,!freebsd,!darwin
+
+package main
+
+// pluginsSupported is false as Go plugins require cgo, upon Linux,
+// FreeBSD, or macOS, and the binaries we release are built without it.
+const pluginsSupported = false
@@ -0,0 +1,60 @@
+//
+// The server may reload its settings, without restarting, when it
+// receives SIGHUP, or when asked to do so via the admin API.
+//
+// We re-read the same command-line arguments, environment, and
+// configuration file which we were launched with, and the server then
+// applies those settings which may safely be changed while it is
+// running, see pkg/server/reload.go.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/skx/tunneller/pkg/server"
+)
+
+// reload re-reads our settings.
+func (p *serveCmd) reload() (server.Options, error) {
+
+	//
+	// Parse our settings into a fresh object, so we don't leave
+	// things half-updated if there is an error.
+	//
+	fresh := &serveCmd{}
+	f := flag.NewFlagSet(p.Name(), flag.ContinueOnError)
+	fresh.SetFlags(f)
+	if err := f.Parse(p.args); err != nil {
+		return fresh.opts, err
+	}
+	if err := loadConfig(f); err != nil {
+		return fresh.opts, err
+	}
+	return fresh.opts, nil
+}
+
+// reloadOnSignal reloads the settings of the given server every time
+// we receive SIGHUP.
+func (p *serveCmd) reloadOnSignal(s *server.Server) {
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for range sigs {
+		opts, err := p.reload()
+		if err == nil {
+			err = s.Reload(opts)
+		}
+		if err != nil {
+			fmt.Fprintf(p.opts.Log, "Error reloading our configuration: %s\n", err.Error())
+			continue
+		}
+		fmt.Fprintf(p.opts.Log, "Reloaded our configuration\n")
+	}
+}